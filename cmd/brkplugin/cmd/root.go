@@ -0,0 +1,78 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd serves the reference provisioner plugin, which offers in-memory
+// databases to service classes annotated with its endpoint.
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+
+	"istio.io/broker/cmd/shared"
+	"istio.io/broker/pkg/provisioner/plugin/reference"
+)
+
+// GetRootCmd generates the root command for the reference plugin.
+func GetRootCmd(args []string) *cobra.Command {
+	port := uint16(0)
+	delay := time.Duration(0)
+	rootCmd := &cobra.Command{
+		Use:   "brkplugin",
+		Short: "The reference provisioner plugin of the Istio broker",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return fmt.Errorf("'%s' is an invalid argument", args[0])
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			serve(port, delay, shared.Printf, shared.Fatalf)
+		},
+	}
+	rootCmd.SetArgs(args)
+	rootCmd.PersistentFlags().AddGoFlagSet(flag.CommandLine)
+
+	// hack to make flag.Parsed return true such that glog is happy
+	// about the flags having been parsed
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	/* #nosec */
+	_ = fs.Parse([]string{})
+	flag.CommandLine = fs
+
+	rootCmd.Flags().Uint16Var(&port, "port", 9095, "TCP port to use for the plugin's gRPC API")
+	rootCmd.Flags().DurationVar(&delay, "delay", 10*time.Second,
+		"Time taken to provision and deprovision databases")
+	rootCmd.AddCommand(shared.VersionCmd())
+
+	return rootCmd
+}
+
+func serve(port uint16, delay time.Duration, printf, fatalf shared.FormatFn) {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		fatalf("Failed to listen on port %d: %v", port, err)
+	}
+	s := grpc.NewServer()
+	reference.NewServer(delay).Register(s)
+	printf("Plugin started, listening on port %d", port)
+	if err = s.Serve(lis); err != nil {
+		fatalf("Failed to serve: %v", err)
+	}
+}
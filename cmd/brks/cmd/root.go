@@ -46,6 +46,7 @@ func GetRootCmd(args []string) *cobra.Command {
 	flag.CommandLine = fs
 
 	rootCmd.AddCommand(serverCmd(shared.Printf, shared.Fatalf))
+	rootCmd.AddCommand(usageCmd(shared.Fatalf))
 	rootCmd.AddCommand(shared.VersionCmd())
 
 	return rootCmd
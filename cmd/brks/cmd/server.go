@@ -15,16 +15,25 @@
 package cmd
 
 import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/spf13/cobra"
 
 	"istio.io/broker/cmd/shared"
+	"istio.io/broker/pkg/accesslog"
+	"istio.io/broker/pkg/election"
+	"istio.io/broker/pkg/platform/kube/crd"
+	"istio.io/broker/pkg/provisioner/plugin"
 	"istio.io/broker/pkg/server"
 )
 
 type serverArgs struct {
-	port       uint16
-	apiPort    uint16
-	kubeconfig string
+	port    uint16
+	apiPort uint16
+	server  server.Args
 }
 
 func serverCmd(printf, fatalf shared.FormatFn) *cobra.Command {
@@ -42,13 +51,97 @@ func serverCmd(printf, fatalf shared.FormatFn) *cobra.Command {
 	serverCmd.PersistentFlags().Uint16Var(&sa.port, "port", 9091,
 		"TCP port to use for Broker's Open Service Broker (OSB) API")
 	serverCmd.PersistentFlags().Uint16Var(&sa.apiPort, "apiPort", 9093, "TCP port to use for Broker's gRPC API")
-	serverCmd.PersistentFlags().StringVar(&sa.kubeconfig, "kubeconfig", "",
+	serverCmd.PersistentFlags().StringVar(&sa.server.KubeConfig, "kubeconfig", "",
 		"Use a Kubernetes configuration file instead of in-cluster configuration")
+	serverCmd.PersistentFlags().StringSliceVar(&sa.server.CRDVersions, "crdVersions", nil,
+		"API versions served for the broker CRDs, the first one being used by the broker")
+	serverCmd.PersistentFlags().StringVar(&sa.server.CRDStorageVersion, "crdStorageVersion", "",
+		"API version persisted for the broker CRDs, the first served version by default")
+	serverCmd.PersistentFlags().StringVar(&sa.server.ConversionWebhook, "conversionWebhook", "",
+		"HTTPS URL at which the API server reaches the CRD conversion webhook served by the broker at "+
+			crd.ConversionPath)
+	serverCmd.PersistentFlags().StringVar(&sa.server.ConversionWebhookCA, "conversionWebhookCA", "",
+		"PEM file of the CA bundle verifying the certificate of the conversion webhook")
+	serverCmd.PersistentFlags().Uint16Var(&sa.server.ConversionWebhookPort, "conversionWebhookPort", 9443,
+		"TCP port of the HTTPS listener of the CRD conversion webhook")
+	serverCmd.PersistentFlags().StringVar(&sa.server.ConversionWebhookCertFile, "conversionWebhookCertFile", "",
+		"PEM file of the serving certificate of the conversion webhook, required with the webhook")
+	serverCmd.PersistentFlags().StringVar(&sa.server.ConversionWebhookKeyFile, "conversionWebhookKeyFile", "",
+		"PEM file of the private key of the serving certificate of the conversion webhook")
+	serverCmd.PersistentFlags().StringVar(&sa.server.CatalogSelector.Namespace, "catalogNamespace", "",
+		"Only publish service classes and plans from this namespace")
+	serverCmd.PersistentFlags().StringVar(&sa.server.CatalogSelector.LabelSelector, "catalogSelector", "",
+		"Only publish service classes and plans matching this label selector, e.g. tenant=acme")
+	serverCmd.PersistentFlags().StringVar(&sa.server.CACertFile, "caCertFile", "",
+		"PEM file of the CA certificate signing the client certificates of bindings")
+	serverCmd.PersistentFlags().StringVar(&sa.server.CAKeyFile, "caKeyFile", "",
+		"PEM file of the private key of the CA signing the client certificates of bindings")
+	serverCmd.PersistentFlags().DurationVar(&sa.server.CredentialTTL, "credentialTTL", 24*time.Hour,
+		"Lifetime of the client certificates of bindings")
+	serverCmd.PersistentFlags().BoolVar(&sa.server.CredentialSecrets, "credentialSecrets", false,
+		"Store the credentials of bindings in secrets and only return a reference to the secrets")
+	serverCmd.PersistentFlags().DurationVar(&sa.server.PluginTimeout, "pluginTimeout", plugin.DefaultTimeout,
+		"Timeout of the calls to provisioner plugins")
+	serverCmd.PersistentFlags().StringVar(&sa.server.Discovery, "discovery", "",
+		"Publish the Kubernetes services annotated for the catalog, keeping the generated service classes "+
+			"and plans in memory (memory) or as CRDs (crd)")
+	serverCmd.PersistentFlags().StringVar(&sa.server.MeteringLog, "meteringLog", "",
+		"File recording the instance and binding events for usage reports, stored in the state namespace if unset")
+	serverCmd.PersistentFlags().StringVar(&sa.server.StateNamespace, "stateNamespace", "istio-system",
+		"Namespace of the binding certificates and metering events shared by the replicas")
+	serverCmd.PersistentFlags().StringVar(&sa.server.AuditLog, "auditLog", "",
+		"Audit log of the mutating requests and their originating identity, a file or stdout")
+	serverCmd.PersistentFlags().StringVar(&sa.server.Tracing, "tracing", "",
+		"Export the request traces to stdout or to an OpenTelemetry collector (otlp)")
+	serverCmd.PersistentFlags().StringVar(&sa.server.TracingEndpoint, "tracingEndpoint", "http://localhost:4318",
+		"OTLP/HTTP endpoint of the OpenTelemetry collector receiving the traces")
+	serverCmd.PersistentFlags().StringVar(&sa.server.AccessLog, "accessLog", "",
+		"Access log of the requests as JSON lines, a file or stdout")
+	serverCmd.PersistentFlags().Float64Var(&sa.server.AccessLogOptions.Sampling, "accessLogSampling", 1,
+		"Fraction of the successful requests written to the access log, failed requests are always logged")
+	serverCmd.PersistentFlags().BoolVar(&sa.server.AccessLogOptions.Bodies, "accessLogBodies", false,
+		"Include the request and response bodies in the access log")
+	serverCmd.PersistentFlags().StringSliceVar(&sa.server.AccessLogOptions.Redact, "accessLogRedact",
+		accesslog.DefaultRedactedFields, "Fields of the logged bodies whose values are redacted")
+	sa.server.Election = election.DefaultConfig
+	serverCmd.PersistentFlags().BoolVar(&sa.server.LeaderElection, "leaderElect", false,
+		"Elect a leader among the replicas of the broker, which alone executes the operations and reconciliations")
+	serverCmd.PersistentFlags().StringVar(&sa.server.Election.Namespace, "leaderElectNamespace", "istio-system",
+		"Namespace of the Lease of the leader election")
+	serverCmd.PersistentFlags().StringVar(&sa.server.Election.Identity, "leaderElectIdentity", "",
+		"host:port address at which the other replicas reach this replica, "+
+			"the pod IP ($POD_IP) or the host name and the port by default")
+	serverCmd.PersistentFlags().DurationVar(&sa.server.Election.LeaseDuration, "leaderElectLeaseDuration",
+		election.DefaultConfig.LeaseDuration, "Time the followers wait before taking over a lease that is not renewed")
+	serverCmd.PersistentFlags().DurationVar(&sa.server.Election.RenewDeadline, "leaderElectRenewDeadline",
+		election.DefaultConfig.RenewDeadline, "Time the leader retries renewing the lease before giving up the leadership")
+	serverCmd.PersistentFlags().DurationVar(&sa.server.Election.RetryPeriod, "leaderElectRetryPeriod",
+		election.DefaultConfig.RetryPeriod, "Interval between the attempts to acquire or renew the lease")
+	serverCmd.PersistentFlags().BoolVar(&sa.server.Election.MeshMTLS, "leaderElectMeshMTLS", false,
+		"The replicas run inside a service mesh enforcing mutual TLS between them, so the followers may forward "+
+			"the requests to the leader over plain HTTP")
+	serverCmd.PersistentFlags().StringVar(&sa.server.TLSCertFile, "tlsCertFile", "",
+		"PEM file of the serving certificate of the broker API, valid for the identity of each replica "+
+			"with leader election. The API is served over plain HTTP if unset.")
+	serverCmd.PersistentFlags().StringVar(&sa.server.TLSKeyFile, "tlsKeyFile", "",
+		"PEM file of the private key of the serving certificate of the broker API")
+	serverCmd.PersistentFlags().StringVar(&sa.server.ForwardCAFile, "forwardCAFile", "",
+		"PEM file of the CA bundle verifying the serving certificate of the leader, the system roots if unset")
 	return &serverCmd
 }
 
 func runServer(sa *serverArgs, printf, fatalf shared.FormatFn) {
-	if osb, err := server.CreateServer(sa.kubeconfig); err != nil {
+	if sa.server.LeaderElection && sa.server.Election.Identity == "" {
+		host := os.Getenv("POD_IP")
+		if host == "" {
+			var err error
+			if host, err = os.Hostname(); err != nil {
+				fatalf("Failed to resolve the identity of the replica: %s", err.Error())
+			}
+		}
+		sa.server.Election.Identity = net.JoinHostPort(host, strconv.Itoa(int(sa.port)))
+	}
+	if osb, err := server.CreateServer(sa.server); err != nil {
 		fatalf("Failed to create server: %s", err.Error())
 	} else {
 		printf("Server started, listening on port %d", sa.port)
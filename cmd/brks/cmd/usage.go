@@ -0,0 +1,86 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"istio.io/broker/cmd/shared"
+	"istio.io/broker/pkg/metering"
+)
+
+type usageArgs struct {
+	url    string
+	from   string
+	to     string
+	format string
+}
+
+func usageCmd(fatalf shared.FormatFn) *cobra.Command {
+	ua := &usageArgs{}
+	usageCmd := cobra.Command{
+		Use:   "usage",
+		Short: "Exports the usage of the plans by the service instances of a broker as CSV or JSON",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runUsage(ua); err != nil {
+				fatalf("Failed to export usage: %s", err.Error())
+			}
+		},
+	}
+	usageCmd.PersistentFlags().StringVar(&ua.url, "url", "http://localhost:9091", "URL of the broker")
+	usageCmd.PersistentFlags().StringVar(&ua.from, "from", "",
+		"Start of the period in RFC 3339 format, the start of the current month by default")
+	usageCmd.PersistentFlags().StringVar(&ua.to, "to", "", "End of the period in RFC 3339 format, now by default")
+	usageCmd.PersistentFlags().StringVar(&ua.format, "format", "csv", "Output format, csv or json")
+	return &usageCmd
+}
+
+func runUsage(ua *usageArgs) error {
+	if ua.format != "csv" && ua.format != "json" {
+		return fmt.Errorf("unknown format %q", ua.format)
+	}
+	query := url.Values{}
+	if ua.from != "" {
+		query.Set("from", ua.from)
+	}
+	if ua.to != "" {
+		query.Set("to", ua.to)
+	}
+	resp, err := http.Get(ua.url + "/metering/usage?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+
+	var report metering.UsageReport
+	if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("malformed usage report: %v", err)
+	}
+	if ua.format == "json" {
+		return metering.WriteJSON(os.Stdout, report)
+	}
+	return metering.WriteCSV(os.Stdout, report)
+}
@@ -0,0 +1,228 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package accesslog writes a structured record of each request served by the
+// broker: the route, status and latency of the request and the OSB request
+// identity and API version, optionally with the request and response bodies.
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+
+	"istio.io/broker/pkg/tracing"
+)
+
+const (
+	// Stdout selects the standard output as access log
+	Stdout = "stdout"
+
+	// redacted replaces the values of credential fields
+	redacted = "[REDACTED]"
+)
+
+// DefaultRedactedFields are the credential fields of the OSB bodies
+var DefaultRedactedFields = []string{
+	"credentials", "password", "private_key", "token", "secret", "certificate",
+}
+
+// Options of the access log
+type Options struct {
+	// Sampling is the fraction of the successful requests that are logged.
+	// Failed requests are always logged.
+	Sampling float64
+
+	// Bodies includes the JSON bodies of the requests and responses, with the
+	// values of the redacted fields replaced
+	Bodies bool
+
+	// Redact lists the fields of the bodies holding credentials, matched case insensitively
+	Redact []string
+}
+
+// Record is the access log entry of a request
+type Record struct {
+	Time            time.Time       `json:"time"`
+	Method          string          `json:"method"`
+	Route           string          `json:"route"`
+	Path            string          `json:"path"`
+	Status          int             `json:"status"`
+	LatencyMillis   float64         `json:"latency_ms"`
+	RequestIdentity string          `json:"request_identity,omitempty"`
+	APIVersion      string          `json:"api_version,omitempty"`
+	Request         json.RawMessage `json:"request,omitempty"`
+	Response        json.RawMessage `json:"response,omitempty"`
+}
+
+// Logger writes the access log records as JSON lines
+type Logger struct {
+	opts   Options
+	redact map[string]bool
+	sample func() float64
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// New creates a logger writing to out
+func New(out io.Writer, opts Options) *Logger {
+	redact := make(map[string]bool)
+	for _, field := range opts.Redact {
+		redact[strings.ToLower(field)] = true
+	}
+	return &Logger{opts: opts, redact: redact, sample: rand.Float64, out: out}
+}
+
+// Open creates a logger writing to the standard output ("stdout") or appending to a file
+func Open(destination string, opts Options) (*Logger, error) {
+	if destination == Stdout {
+		return New(os.Stdout, opts), nil
+	}
+	f, err := os.OpenFile(destination, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return New(f, opts), nil
+}
+
+// recorder captures the status and, if needed, the body of a response
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   *bytes.Buffer
+}
+
+func (w *recorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body != nil {
+		w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Handler logs the requests served by next. The router resolves the route
+// templates of the requests, so that records of the same route are grouped.
+func (l *Logger) Handler(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		record := Record{
+			Time:            start.UTC(),
+			Method:          r.Method,
+			Route:           r.URL.Path,
+			Path:            r.URL.Path,
+			RequestIdentity: r.Header.Get(tracing.RequestIdentityHeader),
+			APIVersion:      r.Header.Get(tracing.APIVersionHeader),
+		}
+		var match mux.RouteMatch
+		if router.Match(r, &match) {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				record.Route = template
+			}
+		}
+		rec := &recorder{ResponseWriter: w}
+		if l.opts.Bodies {
+			rec.body = &bytes.Buffer{}
+			if r.Body != nil {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					glog.Warningf("Reading the body of %s %s failed: %v", r.Method, r.URL.Path, err)
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				record.Request = l.redactJSON(body)
+			}
+		}
+
+		next.ServeHTTP(rec, r)
+		record.Status = rec.status
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		record.LatencyMillis = float64(time.Since(start)) / float64(time.Millisecond)
+		if record.Status < http.StatusBadRequest && l.sample() >= l.opts.Sampling {
+			return
+		}
+		if rec.body != nil {
+			record.Response = l.redactJSON(rec.body.Bytes())
+		}
+		l.write(record)
+	})
+}
+
+func (l *Logger) write(record Record) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		glog.Errorf("Encoding access log record failed: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err = l.out.Write(append(line, '\n')); err != nil {
+		glog.Errorf("Writing access log record failed: %v", err)
+	}
+}
+
+// redactJSON replaces the values of the redacted fields of a JSON body. Bodies
+// that are not JSON are omitted, since they cannot be redacted.
+func (l *Logger) redactJSON(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil
+	}
+	out, err := json.Marshal(l.redactValue(value))
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func (l *Logger) redactValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if l.redact[strings.ToLower(key)] {
+				value[key] = redacted
+			} else {
+				value[key] = l.redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = l.redactValue(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"istio.io/broker/pkg/tracing"
+)
+
+func serve(t *testing.T, l *Logger, req *http.Request) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}",
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Method == "PUT" && !bytes.Contains(body, []byte("hunter2")) {
+				t.Errorf("body of the request not restored: %s", body)
+			}
+			if r.Method == "DELETE" {
+				w.WriteHeader(http.StatusGone)
+			} else {
+				w.WriteHeader(http.StatusCreated)
+			}
+			_, _ = w.Write([]byte(`{"credentials":{"uri":"mysql://user:hunter2@db"},"syslog_drain_url":""}`))
+		})
+	w := httptest.NewRecorder()
+	l.Handler(router, router).ServeHTTP(w, req)
+	return w
+}
+
+func records(t *testing.T, out *bytes.Buffer) []Record {
+	var result []Record
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("malformed record %q: %v", line, err)
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+func TestHandler(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := New(out, Options{Sampling: 1})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/instance-1/service_bindings/binding-1",
+		strings.NewReader(`{"parameters":{"password":"hunter2"}}`))
+	req.Header.Set(tracing.RequestIdentityHeader, "e26cea36-9b57-4f6e-b3ab-2b1f1b9e2e53")
+	req.Header.Set(tracing.APIVersionHeader, "2.13")
+	if w := serve(t, l, req); w.Code != http.StatusCreated {
+		t.Errorf("got %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	got := records(t, out)
+	if len(got) != 1 {
+		t.Fatalf("got %d records, want 1", len(got))
+	}
+	record := got[0]
+	if record.Method != "PUT" ||
+		record.Route != "/v2/service_instances/{instance_id}/service_bindings/{binding_id}" ||
+		record.Path != "/v2/service_instances/instance-1/service_bindings/binding-1" ||
+		record.Status != http.StatusCreated ||
+		record.RequestIdentity != "e26cea36-9b57-4f6e-b3ab-2b1f1b9e2e53" ||
+		record.APIVersion != "2.13" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if record.LatencyMillis < 0 || record.Time.IsZero() {
+		t.Errorf("missing time or latency in %+v", record)
+	}
+	if record.Request != nil || record.Response != nil {
+		t.Errorf("bodies logged without the bodies option: %+v", record)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := New(out, Options{Sampling: 1, Bodies: true, Redact: []string{"Credentials", "password"}})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/instance-1/service_bindings/binding-1",
+		strings.NewReader(`{"parameters":{"users":[{"name":"admin","password":"hunter2"}]}}`))
+	w := serve(t, l, req)
+	if !strings.Contains(w.Body.String(), "hunter2") {
+		t.Errorf("response redacted for the client: %s", w.Body.String())
+	}
+
+	got := records(t, out)
+	if len(got) != 1 {
+		t.Fatalf("got %d records, want 1", len(got))
+	}
+	if line := out.String(); strings.Contains(line, "hunter2") {
+		t.Errorf("credentials in the access log: %s", line)
+	}
+	if want := `{"parameters":{"users":[{"name":"admin","password":"[REDACTED]"}]}}`; string(got[0].Request) != want {
+		t.Errorf("got request %s, want %s", got[0].Request, want)
+	}
+	if want := `{"credentials":"[REDACTED]","syslog_drain_url":""}`; string(got[0].Response) != want {
+		t.Errorf("got response %s, want %s", got[0].Response, want)
+	}
+
+	// bodies that are not JSON are omitted
+	out.Reset()
+	req = httptest.NewRequest("PUT", "/v2/service_instances/instance-1/service_bindings/binding-1",
+		strings.NewReader("password=hunter2"))
+	serve(t, l, req)
+	if got = records(t, out); len(got) != 1 || got[0].Request != nil {
+		t.Errorf("got %+v, want a record without request body", got)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := New(out, Options{Sampling: 0.25})
+	samples := []float64{0.1, 0.5, 0.9}
+	l.sample = func() float64 {
+		s := samples[0]
+		samples = samples[1:]
+		return s
+	}
+	for i := 0; i < 3; i++ {
+		serve(t, l, httptest.NewRequest("GET", "/v2/service_instances/instance-1/service_bindings/binding-1", nil))
+	}
+	if got := records(t, out); len(got) != 1 {
+		t.Errorf("got %d records, want 1 of 3 sampled", len(got))
+	}
+
+	// failed requests are always logged
+	out.Reset()
+	l = New(out, Options{Sampling: 0})
+	serve(t, l, httptest.NewRequest("DELETE", "/v2/service_instances/instance-1/service_bindings/binding-1", nil))
+	serve(t, l, httptest.NewRequest("GET", "/v2/unknown", nil))
+	got := records(t, out)
+	if len(got) != 2 || got[0].Status != http.StatusGone || got[1].Status != http.StatusNotFound ||
+		got[1].Route != "/v2/unknown" {
+		t.Errorf("got %+v, want the failed requests", got)
+	}
+}
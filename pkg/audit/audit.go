@@ -0,0 +1,196 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Operations of the audited requests
+const (
+	Provision   = "provision"
+	Update      = "update"
+	Deprovision = "deprovision"
+	Bind        = "bind"
+	Unbind      = "unbind"
+)
+
+// Outcomes of the audited requests
+const (
+	Succeeded = "succeeded"
+	Accepted  = "accepted"
+	Failed    = "failed"
+)
+
+// StdoutSink selects the standard output as audit log
+const StdoutSink = "stdout"
+
+// Record is the audit log entry of a mutating request
+type Record struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Identity  *Identity `json:"identity,omitempty"`
+
+	InstanceID string `json:"instance_id"`
+	BindingID  string `json:"binding_id,omitempty"`
+	ServiceID  string `json:"service_id,omitempty"`
+	PlanID     string `json:"plan_id,omitempty"`
+
+	// Status code of the response and the resulting outcome
+	Status  int    `json:"status"`
+	Outcome string `json:"outcome"`
+}
+
+// Sink writes the audit log
+type Sink interface {
+	Write(record Record) error
+}
+
+// jsonSink writes the records as JSON lines
+type jsonSink struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewJSONSink creates a sink writing each record as a JSON object on its own line
+func NewJSONSink(out io.Writer) Sink {
+	return &jsonSink{out: out}
+}
+
+func (s *jsonSink) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.out.Write(append(line, '\n'))
+	return err
+}
+
+// Open creates the sink of an audit log destination: "stdout" for the
+// standard output, or else a file the records are appended to
+func Open(destination string) (Sink, error) {
+	if destination == StdoutSink {
+		return NewJSONSink(os.Stdout), nil
+	}
+	f, err := os.OpenFile(destination, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONSink(f), nil
+}
+
+// statusWriter captures the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Handler wraps the handler of an operation to attach the originating
+// identity of the requests to their context and record them in a sink.
+// Requests with a malformed identity are rejected. The sink is optional.
+func Handler(sink Sink, operation string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id *Identity
+		if header := r.Header.Get(OriginatingIdentityHeader); header != "" {
+			var err error
+			if id, err = ParseIdentity(header); err != nil {
+				writeError(w, err)
+				return
+			}
+			r = r.WithContext(WithIdentity(r.Context(), id))
+		}
+		if sink == nil {
+			next(w, r)
+			return
+		}
+
+		record := Record{
+			Time:       time.Now().UTC(),
+			Operation:  operation,
+			Identity:   id,
+			InstanceID: mux.Vars(r)["instance_id"],
+			BindingID:  mux.Vars(r)["binding_id"],
+			ServiceID:  r.URL.Query().Get("service_id"),
+			PlanID:     r.URL.Query().Get("plan_id"),
+		}
+		if r.Body != nil && r.Method != http.MethodDelete {
+			// the plan of provision, update and bind requests is in the body
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			var ids struct {
+				ServiceID string `json:"service_id"`
+				PlanID    string `json:"plan_id"`
+			}
+			if json.Unmarshal(body, &ids) == nil {
+				record.ServiceID, record.PlanID = ids.ServiceID, ids.PlanID
+			}
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r)
+		record.Status = sw.status
+		switch {
+		case sw.status == http.StatusAccepted:
+			record.Outcome = Accepted
+		case sw.status >= 200 && sw.status < 300:
+			record.Outcome = Succeeded
+		default:
+			record.Outcome = Failed
+		}
+		if err := sink.Write(record); err != nil {
+			glog.Errorf("Writing audit record of %s of instance %q failed: %v", operation, record.InstanceID, err)
+		}
+	}
+}
+
+// writeError rejects a malformed request
+func writeError(w http.ResponseWriter, err error) {
+	data, _ := json.Marshal(map[string]string{"description": err.Error()})
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if _, err = w.Write(data); err != nil {
+		glog.Errorf("Write response data error %s", err.Error())
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// memorySink keeps the records in memory
+type memorySink struct {
+	records []Record
+}
+
+func (s *memorySink) Write(record Record) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+// user of an identity, or empty without identity
+func user(id *Identity) string {
+	if id == nil {
+		return ""
+	}
+	return id.User
+}
+
+func TestHandler(t *testing.T) {
+	sink := &memorySink{}
+	var identity *Identity
+	handler := func(code int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			identity = IdentityFrom(r.Context())
+			// the body is still readable
+			if body, _ := ioutil.ReadAll(r.Body); r.Method == "PUT" && len(body) == 0 {
+				t.Error("got an empty body")
+			}
+			w.WriteHeader(code)
+		}
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", Handler(sink, Provision, handler(http.StatusCreated))).
+		Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", Handler(sink, Deprovision, handler(http.StatusGone))).
+		Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}",
+		Handler(sink, Bind, handler(http.StatusAccepted))).Methods("PUT")
+
+	alice := encode("kubernetes", `{"username": "alice"}`)
+	cases := []struct {
+		method   string
+		path     string
+		header   string
+		code     int
+		want     Record
+		identity string
+	}{
+		{"PUT", "/v2/service_instances/instance-1", alice, http.StatusCreated, Record{
+			Operation: Provision, InstanceID: "instance-1", ServiceID: "service", PlanID: "plan",
+			Status: http.StatusCreated, Outcome: Succeeded,
+		}, "alice"},
+		{"DELETE", "/v2/service_instances/instance-1?service_id=service&plan_id=plan", "", http.StatusGone, Record{
+			Operation: Deprovision, InstanceID: "instance-1", ServiceID: "service", PlanID: "plan",
+			Status: http.StatusGone, Outcome: Failed,
+		}, ""},
+		{"PUT", "/v2/service_instances/instance-1/service_bindings/binding-1", alice, http.StatusAccepted, Record{
+			Operation: Bind, InstanceID: "instance-1", BindingID: "binding-1", ServiceID: "service", PlanID: "plan",
+			Status: http.StatusAccepted, Outcome: Accepted,
+		}, "alice"},
+	}
+	for i, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader(`{"service_id": "service", "plan_id": "plan"}`))
+		if c.header != "" {
+			req.Header.Set(OriginatingIdentityHeader, c.header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("%s %s => got %d, want %d", c.method, c.path, w.Code, c.code)
+		}
+		if len(sink.records) != i+1 {
+			t.Fatalf("%s %s => got %d record(s), want %d", c.method, c.path, len(sink.records), i+1)
+		}
+		got := sink.records[i]
+		if user(got.Identity) != c.identity {
+			t.Errorf("%s %s => got recorded identity %+v, want %q", c.method, c.path, got.Identity, c.identity)
+		}
+		if user(identity) != c.identity {
+			t.Errorf("%s %s => got identity %+v in the request context, want %q", c.method, c.path, identity, c.identity)
+		}
+		got.Time, got.Identity = c.want.Time, nil
+		if got != c.want {
+			t.Errorf("%s %s => got record %+v, want %+v", c.method, c.path, got, c.want)
+		}
+	}
+
+	// malformed identities are rejected
+	req := httptest.NewRequest("PUT", "/v2/service_instances/instance-1", strings.NewReader(`{}`))
+	req.Header.Set(OriginatingIdentityHeader, "kubernetes !!!")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || len(sink.records) != len(cases) {
+		t.Errorf("malformed identity => got %d with %d record(s)", w.Code, len(sink.records))
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "audit.log")
+
+	for i := 0; i < 2; i++ {
+		sink, errOpen := Open(path)
+		if errOpen != nil {
+			t.Fatal(errOpen)
+		}
+		if err = sink.Write(Record{Operation: Provision, InstanceID: "instance-1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d line(s), want 2", len(lines))
+	}
+	var record Record
+	if err = json.Unmarshal(lines[1], &record); err != nil || record.InstanceID != "instance-1" {
+		t.Errorf("got record %+v, %v", record, err)
+	}
+
+	if _, err = Open(filepath.Join(dir, "missing", "audit.log")); err == nil {
+		t.Error("Open() in a missing directory => got no error")
+	}
+}
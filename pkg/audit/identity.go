@@ -0,0 +1,112 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit decodes the originating identity of open service broker
+// requests and records the mutating requests with their outcome.
+package audit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// OriginatingIdentityHeader carries the platform user of a request as the
+// platform name and the base64 encoded JSON identity separated by a space
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+// Platforms of originating identities
+const (
+	PlatformKubernetes   = "kubernetes"
+	PlatformCloudFoundry = "cloudfoundry"
+)
+
+// Identity is the platform user triggering a request
+type Identity struct {
+	Platform string `json:"platform"`
+
+	// User is the kubernetes username or the cloudfoundry user id
+	User string `json:"user,omitempty"`
+
+	// UID and Groups of kubernetes users
+	UID    string   `json:"uid,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	// Value is the decoded identity object, which may hold platform specific fields
+	Value map[string]interface{} `json:"value,omitempty"`
+}
+
+// kubernetesIdentity is the identity object of the kubernetes platform
+type kubernetesIdentity struct {
+	Username string   `json:"username"`
+	UID      string   `json:"uid"`
+	Groups   []string `json:"groups"`
+}
+
+// cloudFoundryIdentity is the identity object of the cloudfoundry platform
+type cloudFoundryIdentity struct {
+	UserID string `json:"user_id"`
+}
+
+// ParseIdentity decodes the value of the originating identity header. The
+// user of the kubernetes and cloudfoundry platforms is required, while the
+// identities of other platforms are kept as they are.
+func ParseIdentity(header string) (*Identity, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%s: want a platform and an encoded identity", OriginatingIdentityHeader)
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", OriginatingIdentityHeader, err)
+	}
+	out := &Identity{Platform: parts[0]}
+	if err = json.Unmarshal(data, &out.Value); err != nil {
+		return nil, fmt.Errorf("%s: %v", OriginatingIdentityHeader, err)
+	}
+
+	switch out.Platform {
+	case PlatformKubernetes:
+		var id kubernetesIdentity
+		if err = json.Unmarshal(data, &id); err != nil || id.Username == "" {
+			return nil, fmt.Errorf("%s: kubernetes identity without username", OriginatingIdentityHeader)
+		}
+		out.User, out.UID, out.Groups = id.Username, id.UID, id.Groups
+	case PlatformCloudFoundry:
+		var id cloudFoundryIdentity
+		if err = json.Unmarshal(data, &id); err != nil || id.UserID == "" {
+			return nil, fmt.Errorf("%s: cloudfoundry identity without user_id", OriginatingIdentityHeader)
+		}
+		out.User = id.UserID
+	}
+	return out, nil
+}
+
+// identityKey is the context key of the originating identity
+type identityKey struct{}
+
+// WithIdentity attaches an originating identity to a context
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the originating identity of a context, or nil if the
+// request carried none
+func IdentityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
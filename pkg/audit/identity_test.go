@@ -0,0 +1,66 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func encode(platform, identity string) string {
+	return platform + " " + base64.StdEncoding.EncodeToString([]byte(identity))
+}
+
+func TestParseIdentity(t *testing.T) {
+	cases := []struct {
+		header string
+		want   *Identity
+	}{
+		{encode("kubernetes", `{"username": "alice", "uid": "1234", "groups": ["admin", "dev"]}`),
+			&Identity{Platform: PlatformKubernetes, User: "alice", UID: "1234", Groups: []string{"admin", "dev"},
+				Value: map[string]interface{}{
+					"username": "alice", "uid": "1234", "groups": []interface{}{"admin", "dev"},
+				}}},
+		{encode("cloudfoundry", `{"user_id": "683ea748"}`),
+			&Identity{Platform: PlatformCloudFoundry, User: "683ea748",
+				Value: map[string]interface{}{"user_id": "683ea748"}}},
+		{encode("other", `{"name": "bob"}`),
+			&Identity{Platform: "other", Value: map[string]interface{}{"name": "bob"}}},
+		{encode("kubernetes", `{"uid": "1234"}`), nil},
+		{encode("cloudfoundry", `{}`), nil},
+		{encode("kubernetes", `not json`), nil},
+		{"kubernetes not-base64!", nil},
+		{"kubernetes", nil},
+	}
+	for _, c := range cases {
+		got, err := ParseIdentity(c.header)
+		if (err != nil) != (c.want == nil) || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseIdentity(%q) => got %+v, %v, want %+v", c.header, got, err, c.want)
+		}
+	}
+}
+
+func TestIdentityContext(t *testing.T) {
+	if id := IdentityFrom(context.Background()); id != nil {
+		t.Errorf("IdentityFrom() of an empty context => got %+v", id)
+	}
+	want := &Identity{Platform: PlatformKubernetes, User: "alice"}
+	if got := IdentityFrom(WithIdentity(context.Background(), want)); got != want {
+		t.Errorf("IdentityFrom() => got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"text/template"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+)
+
+const (
+	// DashboardURLAnnotation sets the dashboard URL template of the instances of a service
+	// class, e.g. "https://grafana.example.com/d/{{.Namespace}}/{{.InstanceID}}?plan={{.Plan}}".
+	DashboardURLAnnotation = "catalog.broker.istio.io/dashboard-url"
+
+	// DashboardClientIDAnnotation sets the id of the OAuth client of the dashboard, enabling
+	// the platform to create it for single sign-on
+	DashboardClientIDAnnotation = "catalog.broker.istio.io/dashboard-client-id"
+
+	// DashboardClientSecretNameAnnotation names the Kubernetes secret, in the namespace of
+	// the service class, holding the secret of the OAuth client of the dashboard
+	DashboardClientSecretNameAnnotation = "catalog.broker.istio.io/dashboard-client-secret-name"
+
+	// DashboardClientSecretKeyAnnotation sets the key of the client secret in the Kubernetes
+	// secret, DefaultDashboardClientSecretKey if unset
+	DashboardClientSecretKeyAnnotation = "catalog.broker.istio.io/dashboard-client-secret-key"
+
+	// DefaultDashboardClientSecretKey is the default key of the client secret in the Kubernetes secret
+	DefaultDashboardClientSecretKey = "client-secret"
+
+	// DashboardRedirectURIAnnotation sets the redirect URI of the OAuth client of the dashboard
+	DashboardRedirectURIAnnotation = "catalog.broker.istio.io/dashboard-redirect-uri"
+)
+
+// Dashboard holds the fields of the dashboard URL template. The fields are path escaped.
+type Dashboard struct {
+	// InstanceID is the id of the service instance
+	InstanceID string
+
+	// Namespace is the platform namespace of the instance, or the namespace of the service class
+	Namespace string
+
+	// Plan and PlanID are the catalog name and id of the plan of the instance
+	Plan   string
+	PlanID string
+}
+
+// DashboardURL renders the dashboard URL of an instance of a service class,
+// empty if the class has no dashboard
+func DashboardURL(class, plan *config.Entry, instanceID, namespace string) (string, error) {
+	p, _ := plan.Spec.(*brokerconfig.ServicePlan)
+	return renderDashboard(class, Dashboard{
+		InstanceID: url.PathEscape(instanceID),
+		Namespace:  url.PathEscape(namespace),
+		Plan:       url.PathEscape(p.GetPlan().GetName()),
+		PlanID:     url.PathEscape(p.GetPlan().GetId()),
+	})
+}
+
+func renderDashboard(class *config.Entry, fields Dashboard) (string, error) {
+	text := class.Annotations[DashboardURLAnnotation]
+	if text == "" {
+		return "", nil
+	}
+	tmpl, err := template.New("dashboard").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid dashboard URL template: %v", err)
+	}
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, fields); err != nil {
+		return "", fmt.Errorf("invalid dashboard URL template: %v", err)
+	}
+	if err = absoluteURL(out.String()); err != nil {
+		return "", fmt.Errorf("invalid dashboard URL: %v", err)
+	}
+	return out.String(), nil
+}
+
+// SecretReader reads the value of a key of a Kubernetes secret
+type SecretReader func(namespace, name, key string) (string, error)
+
+// KubeSecretReader reads the Kubernetes secrets through a client
+func KubeSecretReader(client kubernetes.Interface) SecretReader {
+	return func(namespace, name, key string) (string, error) {
+		secret, err := client.CoreV1().Secrets(namespace).Get(name, meta_v1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		value, ok := secret.Data[key]
+		if !ok {
+			return "", fmt.Errorf("secret %s/%s has no key %q", namespace, name, key)
+		}
+		return string(value), nil
+	}
+}
+
+// DashboardClient returns the OAuth client of the dashboard of a service class, or nil if it has none.
+// The client secret is read from the Kubernetes secret referenced by the class.
+func DashboardClient(class *config.Entry, secrets SecretReader) (*osb.DashboardClient, error) {
+	client, name, key, err := dashboardClient(class)
+	if client == nil || err != nil {
+		return nil, err
+	}
+	if secrets == nil {
+		return nil, fmt.Errorf("no secret reader to read the dashboard client secret %s/%s", class.Namespace, name)
+	}
+	if client.Secret, err = secrets(class.Namespace, name, key); err != nil {
+		return nil, fmt.Errorf("reading the dashboard client secret: %v", err)
+	}
+	return client, nil
+}
+
+// dashboardClient returns the OAuth client of the dashboard of a service class without
+// its secret, and the name and key of the Kubernetes secret holding it
+func dashboardClient(class *config.Entry) (*osb.DashboardClient, string, string, error) {
+	client := &osb.DashboardClient{
+		ID:          class.Annotations[DashboardClientIDAnnotation],
+		RedirectURI: class.Annotations[DashboardRedirectURIAnnotation],
+	}
+	name := class.Annotations[DashboardClientSecretNameAnnotation]
+	key := class.Annotations[DashboardClientSecretKeyAnnotation]
+	if key == "" {
+		key = DefaultDashboardClientSecretKey
+	}
+	switch {
+	case client.ID == "" && name == "" && client.RedirectURI == "":
+		return nil, "", "", nil
+	case client.ID == "" || name == "":
+		return nil, "", "", fmt.Errorf("dashboard client requires both %s and %s",
+			DashboardClientIDAnnotation, DashboardClientSecretNameAnnotation)
+	case client.RedirectURI != "":
+		if err := absoluteURL(client.RedirectURI); err != nil {
+			return nil, "", "", fmt.Errorf("invalid dashboard redirect URI: %v", err)
+		}
+	}
+	return client, name, key, nil
+}
+
+// ValidateDashboard checks the dashboard URL template and client of a service class.
+// The Kubernetes secret holding the client secret is not read.
+func ValidateDashboard(class *config.Entry) error {
+	if _, err := renderDashboard(class, Dashboard{
+		InstanceID: "instance",
+		Namespace:  class.Namespace,
+		Plan:       "plan",
+		PlanID:     "plan",
+	}); err != nil {
+		return err
+	}
+	_, _, _, err := dashboardClient(class)
+	return err
+}
+
+func absoluteURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", raw)
+	}
+	return nil
+}
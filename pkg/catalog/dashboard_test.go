@@ -0,0 +1,113 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"istio.io/broker/pkg/model/osb"
+)
+
+func TestDashboardURL(t *testing.T) {
+	plan := makePlan("monthly", "58646b26-867a-4954-a1b9-233dac07815b", "service-class/default/productpage")
+	cases := []struct {
+		template string
+		want     string
+		invalid  bool
+	}{
+		{"", "", false},
+		{"https://grafana.example.com/d/{{.Namespace}}/{{.InstanceID}}?plan={{.Plan}}",
+			"https://grafana.example.com/d/bookinfo/instance%2F1?plan=monthly", false},
+		{"https://dashboard.example.com/plans/{{.PlanID}}",
+			"https://dashboard.example.com/plans/58646b26-867a-4954-a1b9-233dac07815b", false},
+		{"https://dashboard.example.com/{{.Instance}}", "", true},
+		{"https://dashboard.example.com/{{.InstanceID", "", true},
+		{"/d/{{.InstanceID}}", "", true},
+	}
+	for _, c := range cases {
+		class := makeClass("productpage", "4395a443-f49a-41b0-8d14-d17294cf612f")
+		if c.template != "" {
+			class.Annotations = map[string]string{DashboardURLAnnotation: c.template}
+		}
+		got, err := DashboardURL(&class, &plan, "instance/1", "bookinfo")
+		if (err != nil) != c.invalid || got != c.want {
+			t.Errorf("DashboardURL(%q) => got %q, %v, want %q (invalid %t)", c.template, got, err, c.want, c.invalid)
+		}
+		if err = ValidateDashboard(&class); (err != nil) != c.invalid {
+			t.Errorf("ValidateDashboard(%q) => got %v, want invalid %t", c.template, err, c.invalid)
+		}
+	}
+}
+
+func TestDashboardClient(t *testing.T) {
+	secrets := KubeSecretReader(fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "grafana-oauth", Namespace: "default"},
+			Data:       map[string][]byte{DefaultDashboardClientSecretKey: []byte("s3cr3t"), "other": []byte("0th3r")},
+		},
+		&v1.Secret{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "grafana-oauth", Namespace: "team-a"},
+			Data:       map[string][]byte{DefaultDashboardClientSecretKey: []byte("f0r31gn")},
+		}))
+	cases := []struct {
+		annotations map[string]string
+		want        *osb.DashboardClient
+		invalid     bool
+	}{
+		{nil, nil, false},
+		{map[string]string{DashboardClientIDAnnotation: "grafana", DashboardClientSecretNameAnnotation: "grafana-oauth"},
+			&osb.DashboardClient{ID: "grafana", Secret: "s3cr3t"}, false},
+		{map[string]string{DashboardClientIDAnnotation: "grafana", DashboardClientSecretNameAnnotation: "grafana-oauth",
+			DashboardClientSecretKeyAnnotation: "other"},
+			&osb.DashboardClient{ID: "grafana", Secret: "0th3r"}, false},
+		{map[string]string{DashboardClientIDAnnotation: "grafana", DashboardClientSecretNameAnnotation: "grafana-oauth",
+			DashboardRedirectURIAnnotation: "https://grafana.example.com/login"},
+			&osb.DashboardClient{ID: "grafana", Secret: "s3cr3t", RedirectURI: "https://grafana.example.com/login"}, false},
+		{map[string]string{DashboardClientIDAnnotation: "grafana"}, nil, true},
+		{map[string]string{DashboardClientIDAnnotation: "grafana", DashboardClientSecretNameAnnotation: "grafana-oauth",
+			DashboardRedirectURIAnnotation: "login"}, nil, true},
+		{map[string]string{DashboardClientIDAnnotation: "grafana", DashboardClientSecretNameAnnotation: "missing"},
+			nil, true},
+		{map[string]string{DashboardClientIDAnnotation: "grafana", DashboardClientSecretNameAnnotation: "grafana-oauth",
+			DashboardClientSecretKeyAnnotation: "missing"}, nil, true},
+	}
+	for _, c := range cases {
+		class := makeClass("productpage", "4395a443-f49a-41b0-8d14-d17294cf612f")
+		class.Annotations = c.annotations
+		got, err := DashboardClient(&class, secrets)
+		if (err != nil) != c.invalid || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("DashboardClient(%v) => got %+v, %v, want %+v (invalid %t)", c.annotations, got, err, c.want, c.invalid)
+		}
+	}
+}
+
+func TestDashboardClientWithoutReader(t *testing.T) {
+	class := makeClass("productpage", "4395a443-f49a-41b0-8d14-d17294cf612f")
+	class.Annotations = map[string]string{
+		DashboardClientIDAnnotation:         "grafana",
+		DashboardClientSecretNameAnnotation: "grafana-oauth",
+	}
+	if err := ValidateDashboard(&class); err != nil {
+		t.Errorf("ValidateDashboard(%v) => got %v, want valid", class.Annotations, err)
+	}
+	if got, err := DashboardClient(&class, nil); err == nil {
+		t.Errorf("DashboardClient(%v) => got %+v, want an error without a secret reader", class.Annotations, got)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	multierror "github.com/hashicorp/go-multierror"
+
+	"istio.io/broker/pkg/model/config"
+	brokerproto "istio.io/broker/pkg/model/proto"
+)
+
+// Finalizer holds the removal of deleted service classes and plans until
+// their instances are deprovisioned
+const Finalizer = "broker.istio.io/instances"
+
+// dependents maps the keys of the service classes and plans to the sorted ids of their instances
+func dependents(instances []config.Entry) map[string][]string {
+	out := make(map[string][]string)
+	for _, entry := range instances {
+		spec, ok := entry.Spec.(*brokerproto.ServiceInstance)
+		if !ok {
+			continue
+		}
+		if spec.ServiceClass != "" {
+			out[spec.ServiceClass] = append(out[spec.ServiceClass], entry.Name)
+		}
+		if spec.ServicePlan != "" {
+			out[spec.ServicePlan] = append(out[spec.ServicePlan], entry.Name)
+		}
+	}
+	for _, ids := range out {
+		sort.Strings(ids)
+	}
+	return out
+}
+
+// finalize adds the finalizer to the service classes and plans, and removes
+// it from the deleted ones without instances left. It reports whether any
+// object was updated.
+func (r *Reconciler) finalize(entries []config.Entry, instances map[string][]string) (bool, error) {
+	var errs error
+	updated := false
+	for _, entry := range entries {
+		switch {
+		case entry.Deleting() && entry.HasFinalizer(Finalizer) && len(instances[entry.Key()]) == 0:
+			glog.Infof("releasing deleted %q without instances", entry.Key())
+			entry.RemoveFinalizer(Finalizer)
+		case !entry.Deleting() && !entry.HasFinalizer(Finalizer):
+			glog.V(2).Infof("adding finalizer to %q", entry.Key())
+			entry.Finalizers = append(append([]string(nil), entry.Finalizers...), Finalizer)
+		default:
+			continue
+		}
+		if _, err := r.store.Update(entry); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", entry.Key(), err))
+			continue
+		}
+		updated = true
+	}
+	return updated, errs
+}
+
+// terminating reports a deleted object whose removal waits for its instances
+func terminating(v verdict, instances []string) verdict {
+	if len(instances) == 0 {
+		return v
+	}
+	return verdict{
+		terminating: ReasonInstancesExist,
+		message: fmt.Sprintf("deletion waits for the deprovisioning of %d instance(s): %s",
+			len(instances), strings.Join(instances, ", ")),
+	}
+}
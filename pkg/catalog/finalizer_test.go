@@ -0,0 +1,87 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"strings"
+	"testing"
+
+	"istio.io/broker/pkg/model/config"
+	brokerproto "istio.io/broker/pkg/model/proto"
+	"istio.io/broker/pkg/platform/memory"
+)
+
+func TestFinalizer(t *testing.T) {
+	store := memory.Make(config.BrokerConfigTypes)
+	class := makeClass("productpage", "4395a443-f49a-41b0-8d14-d17294cf612f")
+	plan := makePlan("monthly", "58646b26-867a-4954-a1b9-233dac07815b", class.Key())
+	instance := config.Entry{
+		Meta: config.Meta{Type: config.ServiceInstance.Type, Name: "instance-1", Namespace: "default"},
+		Spec: &brokerproto.ServiceInstance{ServiceClass: class.Key(), ServicePlan: "service-plan/default/yearly"},
+	}
+	for _, entry := range []config.Entry{class, plan, instance} {
+		if _, err := store.Create(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := NewReconciler(store, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []config.Entry{class, plan} {
+		if got, ok := store.Get(entry.Type, entry.Name, entry.Namespace); !ok || !got.HasFinalizer(Finalizer) {
+			t.Errorf("Reconcile() => got %s without finalizer", entry.Key())
+		}
+	}
+
+	// the class waits for its instance, while the plan without instances is removed
+	for _, entry := range []config.Entry{class, plan} {
+		if err = store.Delete(entry.Type, entry.Name, entry.Namespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get(plan.Type, plan.Name, plan.Namespace); ok {
+		t.Errorf("Reconcile() => got deleted %s without instances", plan.Key())
+	}
+	got, ok := store.Get(class.Type, class.Name, class.Namespace)
+	if !ok {
+		t.Fatalf("Reconcile() => got deleted %s removed before its instances", class.Key())
+	}
+	cond, _ := got.Status.GetCondition(config.ConditionTerminating)
+	if cond.Status != config.ConditionTrue || cond.Reason != ReasonInstancesExist ||
+		!strings.Contains(cond.Message, "instance-1") {
+		t.Errorf("Reconcile() => got terminating condition %+v, want the instances waited for", cond)
+	}
+	if ready, _ := got.Status.GetCondition(config.ConditionReady); ready.Status != config.ConditionFalse {
+		t.Errorf("Reconcile() => got ready condition %+v of a deleted class", ready)
+	}
+
+	// the class is removed once its instance is deprovisioned
+	if err = store.Delete(instance.Type, instance.Name, instance.Namespace); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = store.Get(class.Type, class.Name, class.Namespace); ok {
+		t.Errorf("Reconcile() => got deleted %s without instances", class.Key())
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"fmt"
+
+	"istio.io/broker/pkg/model/config"
+)
+
+// LifecycleAnnotation sets the lifecycle state of a service plan. Plans are active unless annotated.
+const LifecycleAnnotation = "catalog.broker.istio.io/lifecycle"
+
+// Lifecycle states of service plans
+const (
+	// Active plans are published and accept new instances
+	Active = "active"
+
+	// Deprecated plans are published with a deprecation flag, and reject new instances
+	Deprecated = "deprecated"
+
+	// Retired plans are no longer published and reject new instances.
+	// Their existing instances keep working and can change to another plan.
+	Retired = "retired"
+)
+
+// Lifecycle returns the lifecycle state of a service plan
+func Lifecycle(plan *config.Entry) (string, error) {
+	switch state := plan.Annotations[LifecycleAnnotation]; state {
+	case "":
+		return Active, nil
+	case Active, Deprecated, Retired:
+		return state, nil
+	default:
+		return "", fmt.Errorf("unknown lifecycle state %q, want %s, %s or %s", state, Active, Deprecated, Retired)
+	}
+}
+
+// Available checks that a service plan accepts new instances
+func Available(plan *config.Entry) error {
+	state, err := Lifecycle(plan)
+	if err != nil {
+		return err
+	}
+	if state != Active {
+		return fmt.Errorf("plan %q is %s and does not accept new instances", plan.Key(), state)
+	}
+	return nil
+}
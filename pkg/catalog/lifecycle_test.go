@@ -0,0 +1,57 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"istio.io/broker/pkg/model/config"
+)
+
+func TestLifecycle(t *testing.T) {
+	cases := []struct {
+		state     string
+		want      string
+		available bool
+		reason    string
+	}{
+		{"", Active, true, ReasonAccepted},
+		{Active, Active, true, ReasonAccepted},
+		{Deprecated, Deprecated, false, ReasonAccepted},
+		{Retired, Retired, false, ReasonAccepted},
+		{"sunset", "", false, ReasonInvalidLifecycle},
+	}
+	class := makeClass("productpage", "4395a443-f49a-41b0-8d14-d17294cf612f")
+	for _, c := range cases {
+		plan := makePlan("monthly", "58646b26-867a-4954-a1b9-233dac07815b", class.Key())
+		if c.state != "" {
+			plan.Annotations = map[string]string{LifecycleAnnotation: c.state}
+		}
+		if got, _ := Lifecycle(&plan); got != c.want {
+			t.Errorf("Lifecycle(%q) => got %q, want %q", c.state, got, c.want)
+		}
+		if err := Available(&plan); (err == nil) != c.available {
+			t.Errorf("Available(%q) => got %v, want available %t", c.state, err, c.available)
+		}
+		updated := evaluate([]config.Entry{class}, []config.Entry{plan}, nil, time.Now())
+		if len(updated) != 2 {
+			t.Fatalf("evaluate(%q) => got %d updates, want 2", c.state, len(updated))
+		}
+		if ready, _ := updated[1].Status.GetCondition(config.ConditionReady); ready.Reason != c.reason {
+			t.Errorf("evaluate(%q) => got ready condition %+v, want reason %s", c.state, ready, c.reason)
+		}
+	}
+}
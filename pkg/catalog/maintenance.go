@@ -0,0 +1,61 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"fmt"
+	"regexp"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+)
+
+const (
+	// MaintenanceVersionAnnotation sets the maintenance version of a service plan, a semantic
+	// version. Bumping it offers the instances of the plan an upgrade to its current configuration.
+	MaintenanceVersionAnnotation = "catalog.broker.istio.io/maintenance-version"
+
+	// MaintenanceDescriptionAnnotation describes the changes of the maintenance version of a service plan
+	MaintenanceDescriptionAnnotation = "catalog.broker.istio.io/maintenance-description"
+)
+
+// semver matches the semantic versions required by the maintenance info
+var semver = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+	`(-[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// MaintenanceInfo returns the maintenance info of a service plan, or nil if it has none
+func MaintenanceInfo(plan *config.Entry) (*osb.MaintenanceInfo, error) {
+	version := plan.Annotations[MaintenanceVersionAnnotation]
+	if version == "" {
+		return nil, nil
+	}
+	if !semver.MatchString(version) {
+		return nil, fmt.Errorf("maintenance version %q is not a semantic version", version)
+	}
+	return &osb.MaintenanceInfo{
+		Version:     version,
+		Description: plan.Annotations[MaintenanceDescriptionAnnotation],
+	}, nil
+}
+
+// MaintenanceVersion returns the maintenance version of a service plan,
+// empty if it has none or an invalid one
+func MaintenanceVersion(plan *config.Entry) string {
+	info, err := MaintenanceInfo(plan)
+	if err != nil || info == nil {
+		return ""
+	}
+	return info.Version
+}
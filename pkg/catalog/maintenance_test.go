@@ -0,0 +1,51 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/broker/pkg/model/osb"
+)
+
+func TestMaintenanceInfo(t *testing.T) {
+	cases := []struct {
+		version string
+		want    *osb.MaintenanceInfo
+		invalid bool
+	}{
+		{"", nil, false},
+		{"1.2.3", &osb.MaintenanceInfo{Version: "1.2.3", Description: "mTLS"}, false},
+		{"2.0.0-rc.1+build.5", &osb.MaintenanceInfo{Version: "2.0.0-rc.1+build.5", Description: "mTLS"}, false},
+		{"1.2", nil, true},
+		{"v1.2.3", nil, true},
+		{"01.2.3", nil, true},
+	}
+	for _, c := range cases {
+		plan := makePlan("monthly", "58646b26-867a-4954-a1b9-233dac07815b", "service-class/default/productpage")
+		plan.Annotations = map[string]string{MaintenanceDescriptionAnnotation: "mTLS"}
+		if c.version != "" {
+			plan.Annotations[MaintenanceVersionAnnotation] = c.version
+		}
+		got, err := MaintenanceInfo(&plan)
+		if (err != nil) != c.invalid || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("MaintenanceInfo(%q) => got %+v, %v, want %+v (invalid %t)", c.version, got, err, c.want, c.invalid)
+		}
+		if c.invalid && MaintenanceVersion(&plan) != "" {
+			t.Errorf("MaintenanceVersion(%q) => got %q, want none", c.version, MaintenanceVersion(&plan))
+		}
+	}
+}
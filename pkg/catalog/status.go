@@ -0,0 +1,304 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package catalog reconciles the broker catalog configuration and reports
+// whether each service class and plan was accepted into the catalog.
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	multierror "github.com/hashicorp/go-multierror"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/routing"
+)
+
+// Reasons reported in the catalog conditions
+const (
+	ReasonAccepted         = "Accepted"
+	ReasonMissingEntry     = "MissingEntry"
+	ReasonMissingID        = "MissingID"
+	ReasonDuplicateID      = "DuplicateID"
+	ReasonNoServices       = "NoServices"
+	ReasonServiceNotFound  = "ServiceClassNotFound"
+	ReasonInstancesExist   = "InstancesExist"
+	ReasonInvalidLifecycle = "InvalidLifecycle"
+	ReasonInvalidVersion   = "InvalidMaintenanceVersion"
+	ReasonInvalidDashboard = "InvalidDashboard"
+	ReasonInvalidQuota     = "InvalidQuota"
+)
+
+// Reconciler writes the catalog status of service classes and plans back to the store
+type Reconciler struct {
+	store     config.Store
+	instances config.Store
+	status    config.StatusUpdater
+	now       func() time.Time
+}
+
+// NewReconciler creates a catalog reconciler for a store supporting status
+// updates. The instances store holds the service instances of the catalog.
+func NewReconciler(store, instances config.Store) (*Reconciler, error) {
+	status, ok := store.(config.StatusUpdater)
+	if !ok {
+		return nil, errors.New("config store does not support status updates")
+	}
+	return &Reconciler{
+		store:     store,
+		instances: instances,
+		status:    status,
+		now:       time.Now,
+	}, nil
+}
+
+// Run reconciles the catalog status periodically until stop is closed
+func (r *Reconciler) Run(period time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		if err := r.Reconcile(); err != nil {
+			glog.Warningf("catalog status reconciliation: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile evaluates the catalog configuration and writes the changed
+// status. The finalizer holds the removal of the deleted service classes and
+// plans until their instances are deprovisioned.
+func (r *Reconciler) Reconcile() error {
+	classes, plans, err := r.list()
+	if err != nil {
+		return err
+	}
+	stored, err := r.instances.List(config.ServiceInstance.Type, "")
+	if err != nil {
+		return err
+	}
+	instances := dependents(stored)
+
+	updated, errs := r.finalize(append(append([]config.Entry(nil), classes...), plans...), instances)
+	if updated {
+		// the revisions changed and the released objects are gone
+		if classes, plans, err = r.list(); err != nil {
+			return multierror.Append(errs, err)
+		}
+	}
+	for _, entry := range evaluate(classes, plans, instances, r.now()) {
+		glog.V(2).Infof("updating status of %q", entry.Key())
+		if _, err := r.status.UpdateStatus(entry); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", entry.Key(), err))
+		}
+	}
+	return errs
+}
+
+// list returns the service classes and plans
+func (r *Reconciler) list() ([]config.Entry, []config.Entry, error) {
+	classes, err := r.store.List(config.ServiceClass.Type, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	plans, err := r.store.List(config.ServicePlan.Type, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return classes, plans, nil
+}
+
+// verdict is the outcome of evaluating a single catalog object
+type verdict struct {
+	// invalid is the reason the object was rejected, if any
+	invalid string
+
+	// orphaned is the reason the object is skipped for missing references, if any
+	orphaned string
+
+	// terminating is the reason the removal of a deleted object waits, if any
+	terminating string
+
+	message string
+}
+
+// evaluate computes the status of catalog objects and returns the objects
+// whose status changed. The instances are keyed by service class and plan.
+func evaluate(classes, plans []config.Entry, instances map[string][]string, now time.Time) []config.Entry {
+	classIDs := make(map[string]int)
+	classKeys := make(map[string]bool)
+	for _, entry := range classes {
+		if c, ok := entry.Spec.(*brokerconfig.ServiceClass); ok && c.GetEntry().GetId() != "" {
+			classIDs[c.GetEntry().GetId()]++
+		}
+		classKeys[entry.Key()] = true
+	}
+	planIDs := make(map[string]int)
+	for _, entry := range plans {
+		if p, ok := entry.Spec.(*brokerconfig.ServicePlan); ok && p.GetPlan().GetId() != "" {
+			planIDs[p.GetPlan().GetId()]++
+		}
+	}
+
+	var out []config.Entry
+	for _, entry := range classes {
+		c, _ := entry.Spec.(*brokerconfig.ServiceClass)
+		v := classVerdict(c, classIDs)
+		if err := ValidateDashboard(&entry); err != nil && v.invalid == "" {
+			v = verdict{invalid: ReasonInvalidDashboard, message: err.Error()}
+		}
+		if entry.Deleting() {
+			v = terminating(v, instances[entry.Key()])
+		}
+		if updated, changed := apply(entry, v, false, now); changed {
+			out = append(out, updated)
+		}
+	}
+	for _, entry := range plans {
+		p, _ := entry.Spec.(*brokerconfig.ServicePlan)
+		v := planVerdict(p, planIDs, classKeys)
+		v = lifecycleVerdict(v, &entry)
+		if _, err := routing.PlanQuota(entry); err != nil && v.invalid == "" && v.orphaned == "" {
+			v = verdict{invalid: ReasonInvalidQuota, message: err.Error()}
+		}
+		if entry.Deleting() {
+			v = terminating(v, instances[entry.Key()])
+		}
+		if updated, changed := apply(entry, v, true, now); changed {
+			out = append(out, updated)
+		}
+	}
+	return out
+}
+
+func classVerdict(c *brokerconfig.ServiceClass, ids map[string]int) verdict {
+	switch {
+	case c.GetEntry() == nil:
+		return verdict{invalid: ReasonMissingEntry, message: "catalog entry is required"}
+	case c.GetEntry().GetId() == "" || c.GetEntry().GetName() == "":
+		return verdict{invalid: ReasonMissingID, message: "catalog entry id and name are required"}
+	case ids[c.GetEntry().GetId()] > 1:
+		return verdict{invalid: ReasonDuplicateID,
+			message: fmt.Sprintf("service id %q is used by another service class", c.GetEntry().GetId())}
+	}
+	return verdict{message: "service class is in the catalog"}
+}
+
+func planVerdict(p *brokerconfig.ServicePlan, ids map[string]int, classes map[string]bool) verdict {
+	switch {
+	case p.GetPlan() == nil:
+		return verdict{invalid: ReasonMissingEntry, message: "catalog plan is required"}
+	case p.GetPlan().GetId() == "" || p.GetPlan().GetName() == "":
+		return verdict{invalid: ReasonMissingID, message: "catalog plan id and name are required"}
+	case ids[p.GetPlan().GetId()] > 1:
+		return verdict{invalid: ReasonDuplicateID,
+			message: fmt.Sprintf("plan id %q is used by another service plan", p.GetPlan().GetId())}
+	case len(p.GetServices()) == 0:
+		return verdict{invalid: ReasonNoServices, message: "plan does not list any service class"}
+	}
+
+	var missing []string
+	for _, s := range p.GetServices() {
+		if !classes[s] {
+			missing = append(missing, s)
+		}
+	}
+	sort.Strings(missing)
+	switch {
+	case len(missing) == len(p.GetServices()):
+		return verdict{orphaned: ReasonServiceNotFound,
+			message: "no listed service class exists: " + strings.Join(missing, ", ")}
+	case len(missing) > 0:
+		return verdict{message: "plan is in the catalog, skipped for missing service classes: " + strings.Join(missing, ", ")}
+	}
+	return verdict{message: "plan is in the catalog"}
+}
+
+// lifecycleVerdict rejects unknown lifecycle states and invalid maintenance
+// versions of an accepted plan, and reports deprecated and retired plans
+func lifecycleVerdict(v verdict, plan *config.Entry) verdict {
+	if v.invalid != "" || v.orphaned != "" {
+		return v
+	}
+	if _, err := MaintenanceInfo(plan); err != nil {
+		return verdict{invalid: ReasonInvalidVersion, message: err.Error()}
+	}
+	state, err := Lifecycle(plan)
+	switch {
+	case err != nil:
+		return verdict{invalid: ReasonInvalidLifecycle, message: err.Error()}
+	case state == Deprecated:
+		v.message += ", deprecated and rejecting new instances"
+	case state == Retired:
+		v.message = "plan is retired from the catalog, its instances keep working"
+	}
+	return v
+}
+
+// apply sets the conditions of a verdict on a copy of the entry and reports whether they changed
+func apply(entry config.Entry, v verdict, orphanable bool, now time.Time) (config.Entry, bool) {
+	status := &config.Status{}
+	if entry.Status != nil {
+		status.Conditions = append(status.Conditions, entry.Status.Conditions...)
+	}
+
+	set := func(typ config.ConditionType, holds bool, reason string) {
+		c := config.Condition{
+			Type:               typ,
+			Status:             config.ConditionFalse,
+			Reason:             reason,
+			LastTransitionTime: now,
+		}
+		if holds {
+			c.Status = config.ConditionTrue
+		}
+		if reason != "" {
+			c.Message = v.message
+		}
+		status.SetCondition(c)
+	}
+
+	switch {
+	case v.terminating != "":
+		set(config.ConditionReady, false, v.terminating)
+	case v.invalid != "":
+		set(config.ConditionReady, false, v.invalid)
+	case v.orphaned != "":
+		set(config.ConditionReady, false, v.orphaned)
+	default:
+		set(config.ConditionReady, true, ReasonAccepted)
+	}
+	set(config.ConditionInvalid, v.invalid != "", v.invalid)
+	if orphanable {
+		set(config.ConditionOrphaned, v.orphaned != "", v.orphaned)
+	}
+	if v.terminating != "" {
+		set(config.ConditionTerminating, true, v.terminating)
+	}
+
+	if status.Equal(entry.Status) {
+		return entry, false
+	}
+	entry.Status = status
+	return entry, true
+}
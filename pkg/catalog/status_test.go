@@ -0,0 +1,101 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/routing"
+)
+
+func makeClass(name, id string) config.Entry {
+	return config.Entry{
+		Meta: config.Meta{Type: config.ServiceClass.Type, Name: name, Namespace: "default"},
+		Spec: &brokerconfig.ServiceClass{
+			Deployment: &brokerconfig.Deployment{Instance: "productpage"},
+			Entry:      &brokerconfig.CatalogEntry{Name: name, Id: id},
+		},
+	}
+}
+
+func makePlan(name, id string, services ...string) config.Entry {
+	return config.Entry{
+		Meta: config.Meta{Type: config.ServicePlan.Type, Name: name, Namespace: "default"},
+		Spec: &brokerconfig.ServicePlan{
+			Plan:     &brokerconfig.CatalogPlan{Name: name, Id: id},
+			Services: services,
+		},
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Now()
+	classes := []config.Entry{
+		makeClass("productpage", "4395a443-f49a-41b0-8d14-d17294cf612f"),
+		makeClass("reviews", "dup"),
+		makeClass("ratings", "dup"),
+	}
+	plans := []config.Entry{
+		makePlan("monthly", "58646b26-867a-4954-a1b9-233dac07815b", "service-class/default/productpage"),
+		makePlan("yearly", "cdd76b03-a28b-4638-b4e2-19ee44b36db7", "service-class/default/missing"),
+		makePlan("empty", "0c3e4a5a-1e41-4a3e-9b0a-c1b2d3e4f5a6"),
+		makePlan("partial", "6d1ef1f4-64a8-4e1e-8b2a-8a7c9f0b1c2d",
+			"service-class/default/productpage", "service-class/default/missing"),
+		makePlan("metered", "2f6a8c1e-3b5d-4e7f-9a0b-1c2d3e4f5a6b", "service-class/default/productpage"),
+	}
+	plans[4].Annotations = map[string]string{routing.RequestsPerSecondAnnotation: "lots"}
+
+	type want struct {
+		ready, invalid, orphaned config.ConditionStatus
+		reason                   string
+	}
+	cases := map[string]want{
+		"service-class/default/productpage": {config.ConditionTrue, config.ConditionFalse, "", ReasonAccepted},
+		"service-class/default/reviews":     {config.ConditionFalse, config.ConditionTrue, "", ReasonDuplicateID},
+		"service-class/default/ratings":     {config.ConditionFalse, config.ConditionTrue, "", ReasonDuplicateID},
+		"service-plan/default/monthly":      {config.ConditionTrue, config.ConditionFalse, config.ConditionFalse, ReasonAccepted},
+		"service-plan/default/yearly":       {config.ConditionFalse, config.ConditionFalse, config.ConditionTrue, ReasonServiceNotFound},
+		"service-plan/default/empty":        {config.ConditionFalse, config.ConditionTrue, config.ConditionFalse, ReasonNoServices},
+		"service-plan/default/partial":      {config.ConditionTrue, config.ConditionFalse, config.ConditionFalse, ReasonAccepted},
+		"service-plan/default/metered":      {config.ConditionFalse, config.ConditionTrue, config.ConditionFalse, ReasonInvalidQuota},
+	}
+
+	updated := evaluate(classes, plans, nil, now)
+	if len(updated) != len(cases) {
+		t.Fatalf("evaluate() => got %d updates, want %d", len(updated), len(cases))
+	}
+	for _, entry := range updated {
+		w, ok := cases[entry.Key()]
+		if !ok {
+			t.Errorf("unexpected update of %q", entry.Key())
+			continue
+		}
+		ready, _ := entry.Status.GetCondition(config.ConditionReady)
+		invalid, _ := entry.Status.GetCondition(config.ConditionInvalid)
+		orphaned, _ := entry.Status.GetCondition(config.ConditionOrphaned)
+		if ready.Status != w.ready || ready.Reason != w.reason || invalid.Status != w.invalid || orphaned.Status != w.orphaned {
+			t.Errorf("%s => got ready %s (%s), invalid %s, orphaned %s, want %+v",
+				entry.Key(), ready.Status, ready.Reason, invalid.Status, orphaned.Status, w)
+		}
+	}
+
+	// status is only written when it changes
+	if again := evaluate(updated[:3], updated[3:], nil, now.Add(time.Minute)); len(again) != 0 {
+		t.Errorf("evaluate() with unchanged config => got %d updates, want 0", len(again))
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"istio.io/broker/pkg/model/config"
+	brokerproto "istio.io/broker/pkg/model/proto"
+)
+
+// attemptWait bounds the time a deprovision or unbind request waits for the
+// creation of its instance or binding to complete
+const attemptWait = 10 * time.Second
+
+// attemptLease bounds the time a creation is considered running by the
+// replicas other than the one attempting it. It exceeds the timeout of the
+// calls to the provisioners, so that only interrupted creations expire.
+const attemptLease = 2 * time.Minute
+
+// errAttemptRunning is returned when the creation of an object is attempted
+// by another replica
+var errAttemptRunning = errors.New("the creation is attempted by another replica")
+
+// attempts tracks the creations of instances and bindings in progress in the
+// replica. The creations attempted by a previous leader are told by the
+// expiry recorded with the objects being created, see attemptRunning.
+type attempts struct {
+	mu      sync.Mutex
+	running map[string]chan struct{}
+}
+
+func newAttempts() *attempts {
+	return &attempts{running: make(map[string]chan struct{})}
+}
+
+// begin registers the creation of an object, unless one is already running.
+// The returned function ends the creation.
+func (a *attempts) begin(key string) (func(), bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.running[key]; ok {
+		return nil, false
+	}
+	done := make(chan struct{})
+	a.running[key] = done
+	return func() {
+		a.mu.Lock()
+		delete(a.running, key)
+		a.mu.Unlock()
+		close(done)
+	}, true
+}
+
+// wait waits for the creation of an object to end and reports false if it
+// is still running after the timeout
+func (a *attempts) wait(key string, timeout time.Duration) bool {
+	a.mu.Lock()
+	done, ok := a.running[key]
+	a.mu.Unlock()
+	if !ok {
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// attemptExpiry returns the expiry of a creation attempted from now on
+func attemptExpiry() string {
+	return time.Now().Add(attemptLease).UTC().Format(time.RFC3339)
+}
+
+// attemptRunning reports whether the creation of a stored object is still
+// attempted, possibly by another replica. A creation whose attempt expired
+// was interrupted, e.g. by a change of leader, and is attempted again.
+func attemptRunning(state brokerproto.CreationState, expires string) bool {
+	if state != brokerproto.CreationState_CREATING || expires == "" {
+		return false
+	}
+	at, err := time.Parse(time.RFC3339, expires)
+	return err == nil && time.Now().Before(at)
+}
+
+// requestHash digests the fields of a creation request, so that a repeated
+// request can be told from a conflicting one. Maps are marshaled with sorted
+// keys, so equal requests have equal hashes.
+func requestHash(fields ...interface{}) (string, error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// recordState stores the creation state of an instance or binding
+func (c *Controller) recordState(entry config.Entry, state brokerproto.CreationState) error {
+	switch spec := proto.Clone(entry.Spec).(type) {
+	case *brokerproto.ServiceInstance:
+		spec.State, spec.AttemptExpires = state, ""
+		entry.Spec = spec
+	case *brokerproto.ServiceBinding:
+		spec.State, spec.AttemptExpires = state, ""
+		entry.Spec = spec
+	}
+	_, err := c.instances.Update(entry)
+	return err
+}
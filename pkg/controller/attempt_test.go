@@ -0,0 +1,68 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttempts(t *testing.T) {
+	a := newAttempts()
+	if !a.wait("instance", time.Millisecond) {
+		t.Error("wait => waited without a creation in progress")
+	}
+	done, ok := a.begin("instance")
+	if !ok {
+		t.Fatal("begin => got a creation in progress")
+	}
+	if _, ok = a.begin("instance"); ok {
+		t.Error("begin again => got no creation in progress")
+	}
+	if a.wait("instance", time.Millisecond) {
+		t.Error("wait => got the creation ended")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		done()
+	}()
+	if !a.wait("instance", time.Second) {
+		t.Error("wait => got the creation still running")
+	}
+	if _, ok = a.begin("instance"); !ok {
+		t.Error("begin after the creation => got a creation in progress")
+	}
+}
+
+func TestRequestHash(t *testing.T) {
+	hash := func(fields ...interface{}) string {
+		out, err := requestHash(fields...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	params := map[string]interface{}{"a": 1, "b": map[string]interface{}{"c": true, "d": "e"}}
+	reordered := map[string]interface{}{"b": map[string]interface{}{"d": "e", "c": true}, "a": 1}
+	if hash("service", "plan", params) != hash("service", "plan", reordered) {
+		t.Error("got different hashes of equal requests")
+	}
+	if hash("service", "plan", params) == hash("service", "plan", nil) {
+		t.Error("got equal hashes of different parameters")
+	}
+	if hash("service", "plan") == hash("service", "other") {
+		t.Error("got equal hashes of different plans")
+	}
+}
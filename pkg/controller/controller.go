@@ -21,23 +21,89 @@ import (
 	"net/http"
 
 	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/catalog"
+	"istio.io/broker/pkg/credentials"
+	"istio.io/broker/pkg/election"
+	"istio.io/broker/pkg/metering"
 	"istio.io/broker/pkg/model/config"
 	"istio.io/broker/pkg/model/osb"
+	brokerproto "istio.io/broker/pkg/model/proto"
+	"istio.io/broker/pkg/provisioner"
+	"istio.io/broker/pkg/tracing"
 )
 
 // Controller data
 type Controller struct {
 	config.BrokerConfigStore
+
+	// instances stores the provisioned service instances
+	instances config.Store
+
+	// provisioners create the backend resources of instances and bindings
+	provisioners *provisioner.Registry
+
+	// credentials issues the client certificates of bindings, if configured
+	credentials *credentials.Provider
+
+	// secrets stores the credentials of bindings, if configured
+	secrets *credentials.SecretStore
+
+	// metering records the lifecycle events of instances and bindings, if configured
+	metering metering.Recorder
+
+	// elector tells whether the replica leads and completes the operations, if several replicas run
+	elector *election.Elector
+
+	// dashboardSecrets reads the OAuth client secrets of the dashboards of service classes
+	dashboardSecrets catalog.SecretReader
+
+	// attempts tracks the creations of instances and bindings in progress
+	attempts *attempts
 }
 
-// CreateController creates a new controller instance.
-func CreateController(config config.BrokerConfigStore) (*Controller, error) {
-	return &Controller{config}, nil
+// CreateController creates a new controller instance. The credentials provider, the
+// secret store, the metering recorder, the elector and the dashboard secret reader are optional.
+func CreateController(catalog config.BrokerConfigStore, instances config.Store, provisioners *provisioner.Registry,
+	creds *credentials.Provider, secrets *credentials.SecretStore, recorder metering.Recorder,
+	elector *election.Elector, dashboardSecrets catalog.SecretReader) (*Controller, error) {
+	return &Controller{
+		BrokerConfigStore: catalog,
+		instances:         instances,
+		provisioners:      provisioners,
+		credentials:       creds,
+		secrets:           secrets,
+		metering:          recorder,
+		elector:           elector,
+		dashboardSecrets:  dashboardSecrets,
+		attempts:          newAttempts(),
+	}, nil
+}
+
+// traced starts the span of a handler and returns a copy of the controller
+// whose instance store records its requests as child spans
+func (c *Controller) traced(r *http.Request, handler string) (*Controller, trace.Span) {
+	ctx, span := tracing.Start(r.Context(), "controller."+handler)
+	vars := mux.Vars(r)
+	if id := vars["instance_id"]; id != "" {
+		span.SetAttributes(attribute.String("osb.instance_id", id))
+	}
+	if id := vars["binding_id"]; id != "" {
+		span.SetAttributes(attribute.String("osb.binding_id", id))
+	}
+	traced := *c
+	traced.instances = config.WithContext(ctx, c.instances)
+	return &traced, span
 }
 
 // Catalog serves catalog request and generate response.
-func (c *Controller) Catalog(w http.ResponseWriter, _ *http.Request) {
+func (c *Controller) Catalog(w http.ResponseWriter, r *http.Request) {
+	c, span := c.traced(r, "Catalog")
+	defer span.End()
 	glog.Infof("Fetching Service Broker Catalog...")
 	cat := c.catalog()
 	glog.V(2).Infof("Got catalog\n %#v", cat)
@@ -50,17 +116,432 @@ func (c *Controller) catalog() *osb.Catalog {
 	for k, s := range sc {
 		glog.V(2).Infof("loading service %q", k)
 		js := osb.NewService(s)
-		for pk, p := range c.ServicePlansByService(k) {
-			glog.V(2).Infof("loading service plan %q", pk)
-			jp := osb.NewServicePlan(p)
+		js.InstancesRetrievable = true
+		if class, ok := c.ServiceClassByID(s.GetEntry().GetId()); ok {
+			var err error
+			if js.DashboardClient, err = catalog.DashboardClient(class, c.dashboardSecrets); err != nil {
+				glog.Warningf("Service class %q: %v", k, err)
+			}
+		}
+		for _, p := range c.ServicePlanEntriesByService(k) {
+			// retired plans are only kept for their existing instances, and
+			// plans with an invalid lifecycle are not offered either
+			state, err := catalog.Lifecycle(&p)
+			if err != nil {
+				glog.Warningf("Service plan %q: %v", p.Key(), err)
+				continue
+			}
+			if state == catalog.Retired {
+				continue
+			}
+			glog.V(2).Infof("loading service plan %q", p.Key())
+			jp := osb.NewServicePlan(p.Spec.(*brokerconfig.ServicePlan))
+			if jp.MaintenanceInfo, err = catalog.MaintenanceInfo(&p); err != nil {
+				glog.Warningf("Service plan %q: %v", p.Key(), err)
+			}
+			if state == catalog.Deprecated {
+				jp.Metadata = map[string]interface{}{"deprecated": true}
+			}
 			js.AddPlan(jp)
 		}
+		// services are published with at least one plan
+		if len(js.Plans) == 0 {
+			glog.V(2).Infof("skipping service %q without plans", k)
+			continue
+		}
 		jc.AddService(js)
 	}
 	return jc
 }
 
-// nolint: unparam
+// Bind serves service binding request and delegates it to the provisioner of
+// the service class. Only instances whose provisioning completed are bound.
+// If a credentials provider is configured and the provisioner names a
+// subject, the response carries a client certificate for the subject, rotated
+// when the binding is requested again after two thirds of its lifetime. If a
+// secret store is configured, the credentials are written to a secret in the
+// Kubernetes namespace of the binding or of the instance, whose certificate
+// the leader rotates when it is due, and the response refers to the secret instead.
+func (c *Controller) Bind(w http.ResponseWriter, r *http.Request) {
+	c, span := c.traced(r, "Bind")
+	defer span.End()
+	vars := mux.Vars(r)
+	var req osb.BindRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("malformed request: %v", err))
+		return
+	}
+	if req.Context != nil {
+		if err := req.Context.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	// only provisioned instances are bound, as the bindings of other
+	// instances would be removed by the reconciler
+	existing, exists := c.findInstance(vars["instance_id"])
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown instance %q", vars["instance_id"]))
+		return
+	}
+	spec := existing.Spec.(*brokerproto.ServiceInstance)
+	switch {
+	case spec.GetOperation() != nil || attemptRunning(spec.State, spec.AttemptExpires):
+		writeConcurrencyError(w, vars["instance_id"])
+		return
+	case spec.State != brokerproto.CreationState_CREATED:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("instance %q is not provisioned", vars["instance_id"]))
+		return
+	case req.ServiceID != spec.ServiceId:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("instance %q is not an instance of service %q",
+			vars["instance_id"], req.ServiceID))
+		return
+	}
+	instance, p, err := c.resolveInstance(vars["instance_id"], req.ServiceID, req.PlanID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var format credentials.SecretFormat
+	if c.secrets != nil {
+		annotation := instance.Class.Annotations[credentials.SecretFormatAnnotation]
+		if format, err = credentials.LookupSecretFormat(annotation); err != nil {
+			glog.Errorf("Service %q: %v", req.ServiceID, err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	id := vars["binding_id"]
+	hash, err := requestHash(req.ServiceID, req.PlanID, req.Parameters, req.BindResource, req.Context)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	done, ok := c.attempts.begin(config.ServiceBinding.Type + "/" + bindingName(id))
+	if !ok {
+		writeConcurrencyError(w, id)
+		return
+	}
+	defer done()
+
+	glog.Infof("Binding %q to instance %q of %q", id, instance.ID, instance.Class.Key())
+	// the binding is stored first, so that its resources are never taken for orphans
+	record, creating, err := c.recordBinding(id, instance, &req, hash)
+	if err == errAttemptRunning {
+		writeConcurrencyError(w, id)
+		return
+	} else if err != nil {
+		glog.Errorf("Binding %q failed: %v", id, err)
+		writeProvisionerError(w, err)
+		return
+	}
+	result, err := p.Bind(provisioner.BindRequest{
+		Instance:     instance,
+		BindingID:    id,
+		Parameters:   req.Parameters,
+		BindResource: req.BindResource,
+		BindContext:  req.Context,
+	})
+	if err != nil {
+		glog.Errorf("Binding %q failed: %v", id, err)
+		if creating {
+			c.abandonBinding(p, instance, id, record, !rejected(err))
+		}
+		writeProvisionerError(w, err)
+		return
+	}
+
+	credential := result.Credentials
+	if credential == nil {
+		credential = &osb.BindingCredential{}
+	}
+	if c.credentials != nil && result.Subject != "" {
+		if credential.Credential, err = c.credentials.Issue(id, result.Subject); err != nil {
+			glog.Errorf("Issuing credentials of binding %q failed: %v", id, err)
+			c.rollbackBind(p, instance, id, result.Created, record, creating)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if c.secrets != nil {
+		var ref *osb.SecretReference
+		namespace := secretNamespace(req.Context, instance)
+		if ref, err = c.secrets.Write(id, instance.ID, namespace, format, credential); err != nil {
+			glog.Errorf("Storing credentials of binding %q failed: %v", id, err)
+			c.rollbackBind(p, instance, id, result.Created, record, creating)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// the response only refers to the secret holding the credentials
+		credential = &osb.BindingCredential{Service: credential.Service, Namespace: credential.Namespace, Secret: ref}
+	}
+	if creating {
+		if err = c.recordState(record, brokerproto.CreationState_CREATED); err != nil {
+			glog.Errorf("Binding %q failed: %v", id, err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	code := http.StatusOK
+	if result.Created {
+		code = http.StatusCreated
+		c.meter(metering.Bind, instance.ID, req.ServiceID, req.PlanID, id)
+	}
+	writeResponse(w, code, &osb.CreateServiceBindingResponse{Credentials: credential})
+}
+
+// secretNamespace is the namespace of the secret of a binding: the Kubernetes
+// namespace the binding or else its instance was requested in, or the
+// namespace of the service class on other platforms
+func secretNamespace(bind *osb.Context, instance provisioner.Instance) string {
+	for _, ctx := range []*osb.Context{bind, instance.Context} {
+		if ctx != nil && ctx.Platform == osb.PlatformKubernetes && ctx.Namespace != "" {
+			return ctx.Namespace
+		}
+	}
+	return instance.Class.Namespace
+}
+
+// rollbackBind removes a binding created by a failed bind request
+func (c *Controller) rollbackBind(p provisioner.Provisioner, instance provisioner.Instance, id string, created bool,
+	record config.Entry, creating bool) {
+	if created && c.credentials != nil {
+		if _, err := c.credentials.Revoke(id); err != nil {
+			glog.Errorf("Revoking the certificate of binding %q failed: %v", id, err)
+		}
+	}
+	if creating {
+		c.abandonBinding(p, instance, id, record, created)
+	} else if created {
+		if _, err := p.Unbind(provisioner.UnbindRequest{Instance: instance, BindingID: id}); err != nil {
+			glog.Errorf("Unbinding %q failed: %v", id, err)
+		}
+	}
+}
+
+// abandonBinding removes the resources of a failed binding, if it may have
+// created any, and the binding. The binding is kept as failed if its
+// resources cannot be removed, so that the unbinding by the platform removes them.
+func (c *Controller) abandonBinding(p provisioner.Provisioner, instance provisioner.Instance, id string,
+	record config.Entry, unbind bool) {
+	if unbind {
+		if _, err := p.Unbind(provisioner.UnbindRequest{Instance: instance, BindingID: id}); err != nil {
+			glog.Errorf("Unbinding %q failed: %v", id, err)
+			if err = c.recordState(record, brokerproto.CreationState_FAILED); err != nil {
+				glog.Errorf("Recording the failure of binding %q failed: %v", id, err)
+			}
+			return
+		}
+	}
+	c.removeRecord(record)
+}
+
+// Unbind serves service unbinding request, delegates it to the provisioner of
+// the service class, revokes the client certificate of the binding and
+// deletes its secret.
+func (c *Controller) Unbind(w http.ResponseWriter, r *http.Request) {
+	c, span := c.traced(r, "Unbind")
+	defer span.End()
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	instance, p, err := c.resolveInstance(vars["instance_id"], query.Get("service_id"), query.Get("plan_id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id := vars["binding_id"]
+	// the platform unbinds bindings whose creation failed or timed out
+	if !c.attempts.wait(config.ServiceBinding.Type+"/"+bindingName(id), attemptWait) {
+		writeConcurrencyError(w, id)
+		return
+	}
+	if existing, ok := c.instances.Get(config.ServiceBinding.Type, bindingName(id), instance.Class.Namespace); ok {
+		if spec, ok := existing.Spec.(*brokerproto.ServiceBinding); ok && attemptRunning(spec.State, spec.AttemptExpires) {
+			writeConcurrencyError(w, id)
+			return
+		}
+	}
+	glog.Infof("Unbinding %q", id)
+	found, err := p.Unbind(provisioner.UnbindRequest{Instance: instance, BindingID: id})
+	if err == nil {
+		var removed bool
+		removed, err = c.removeBinding(id, instance)
+		found = found || removed
+	}
+	if c.credentials != nil {
+		revoked, errRevoke := c.credentials.Revoke(id)
+		found = found || revoked
+		if errRevoke != nil {
+			glog.Errorf("Revoking the certificate of binding %q failed: %v", id, errRevoke)
+			if err == nil {
+				err = errRevoke
+			}
+		}
+	}
+	if c.secrets != nil {
+		deleted, errSecret := c.secrets.Delete(id)
+		found = found || deleted
+		if errSecret != nil {
+			glog.Errorf("Deleting secrets of binding %q failed: %v", id, errSecret)
+			if err == nil {
+				err = errSecret
+			}
+		}
+	}
+	switch {
+	case err != nil:
+		glog.Errorf("Unbinding %q failed: %v", id, err)
+		writeProvisionerError(w, err)
+	case !found:
+		writeResponse(w, http.StatusGone, struct{}{})
+	default:
+		c.meter(metering.Unbind, instance.ID, query.Get("service_id"), query.Get("plan_id"), id)
+		writeResponse(w, http.StatusOK, struct{}{})
+	}
+}
+
+// recordBinding stores a binding and reports whether its creation is
+// attempted, unless it is already created. A request differing from the
+// request of the stored binding, or binding another instance, is rejected as
+// a conflict.
+func (c *Controller) recordBinding(id string, instance provisioner.Instance, req *osb.BindRequest, hash string) (
+	config.Entry, bool, error) {
+	entry := config.Entry{
+		Meta: config.Meta{
+			Type:        config.ServiceBinding.Type,
+			Name:        bindingName(id),
+			Namespace:   instance.Class.Namespace,
+			Annotations: map[string]string{config.BindingIDAnnotation: id},
+		},
+	}
+	existing, exists := c.instances.Get(entry.Type, entry.Name, entry.Namespace)
+	if exists {
+		spec := existing.Spec.(*brokerproto.ServiceBinding)
+		if spec.InstanceId != instance.ID || spec.RequestHash != "" && spec.RequestHash != hash {
+			return entry, false, provisioner.ErrConflict
+		}
+		if spec.State == brokerproto.CreationState_CREATED {
+			return *existing, false, nil
+		}
+		if attemptRunning(spec.State, spec.AttemptExpires) {
+			return entry, false, errAttemptRunning
+		}
+		// a creation that failed or was interrupted is attempted again
+		entry.ResourceVersion = existing.ResourceVersion
+	}
+	spec := &brokerproto.ServiceBinding{
+		InstanceId:  instance.ID,
+		ServiceId:   instance.Class.Spec.(*brokerconfig.ServiceClass).GetEntry().GetId(),
+		PlanId:      req.PlanID,
+		Context:     contextMessage(req.Context),
+		State:       brokerproto.CreationState_CREATING,
+		RequestHash: hash,
+
+		AttemptExpires: attemptExpiry(),
+	}
+	if instance.Plan != nil {
+		spec.PlanId = instance.Plan.Spec.(*brokerconfig.ServicePlan).GetPlan().GetId()
+	}
+	if req.Parameters != nil {
+		params, err := json.Marshal(req.Parameters)
+		if err != nil {
+			return entry, false, err
+		}
+		spec.Parameters = string(params)
+	}
+	if req.BindResource != nil {
+		spec.AppGuid, spec.Route = req.BindResource.AppGUID, req.BindResource.Route
+	}
+	entry.Spec = spec
+	var err error
+	if exists {
+		entry.ResourceVersion, err = c.instances.Update(entry)
+	} else {
+		entry.ResourceVersion, err = c.instances.Create(entry)
+	}
+	return entry, err == nil, err
+}
+
+// removeBinding deletes the stored binding, if any, and reports whether it was found
+func (c *Controller) removeBinding(id string, instance provisioner.Instance) (bool, error) {
+	existing, exists := c.instances.Get(config.ServiceBinding.Type, bindingName(id), instance.Class.Namespace)
+	if !exists {
+		return false, nil
+	}
+	return true, c.instances.Delete(existing.Type, existing.Name, existing.Namespace)
+}
+
+// removeRecord deletes a stored instance or binding after a failed request
+func (c *Controller) removeRecord(entry config.Entry) {
+	if err := c.instances.Delete(entry.Type, entry.Name, entry.Namespace); err != nil {
+		glog.Errorf("Removing %s failed: %v", entry.Key(), err)
+	}
+}
+
+// bindingName is the config object name of a binding
+func bindingName(id string) string {
+	return config.ObjectName("", id)
+}
+
+// bindingID returns the id of a stored binding, which the name of the
+// binding only hashes or lower-cases
+func bindingID(entry config.Entry) string {
+	if id := entry.Annotations[config.BindingIDAnnotation]; id != "" {
+		return id
+	}
+	// the bindings stored before their id was recorded are named after it
+	return entry.Name
+}
+
+// RevocationList serves the PEM encoded list of the revoked client certificates
+func (c *Controller) RevocationList(w http.ResponseWriter, _ *http.Request) {
+	if c.credentials == nil {
+		writeError(w, http.StatusNotFound, "no credentials provider configured")
+		return
+	}
+	crl, err := c.credentials.CRL()
+	if err != nil {
+		glog.Errorf("Creating revocation list failed: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("content-type", "application/pkix-crl")
+	if _, err = w.Write(crl); err != nil {
+		glog.Errorf("Write response data error %s", err.Error())
+	}
+}
+
+// writeProvisionerError responds with the status of an error of a provisioner
+func writeProvisionerError(w http.ResponseWriter, err error) {
+	if _, ok := err.(provisioner.InvalidRequestError); ok {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch err {
+	case provisioner.ErrConflict:
+		writeResponse(w, http.StatusConflict, struct{}{})
+	case provisioner.ErrAsyncRequired:
+		writeResponse(w, http.StatusUnprocessableEntity, &osb.ErrorResponse{Error: "AsyncRequired", Description: err.Error()})
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// rejected reports whether a provisioner rejected a request before creating any resources
+func rejected(err error) bool {
+	if _, ok := err.(provisioner.InvalidRequestError); ok {
+		return true
+	}
+	return err == provisioner.ErrConflict || err == provisioner.ErrAsyncRequired
+}
+
+func writeError(w http.ResponseWriter, code int, description string) {
+	writeResponse(w, code, &osb.ErrorResponse{Description: description})
+}
+
 func writeResponse(w http.ResponseWriter, code int, object interface{}) {
 	data, err := json.Marshal(object)
 	if err != nil {
@@ -70,7 +551,7 @@ func writeResponse(w http.ResponseWriter, code int, object interface{}) {
 	}
 	w.Header().Set("content-type", "application/json")
 	w.WriteHeader(code)
-	if _, err = fmt.Fprintf(w, string(data)); err != nil {
+	if _, err = w.Write(data); err != nil {
 		glog.Errorf("Write response data error %s", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
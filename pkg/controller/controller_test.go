@@ -15,15 +15,29 @@
 package controller
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 
 	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/catalog"
+	"istio.io/broker/pkg/credentials"
 	"istio.io/broker/pkg/model/config"
 	"istio.io/broker/pkg/model/osb"
+	brokerproto "istio.io/broker/pkg/model/proto"
+	"istio.io/broker/pkg/platform/memory"
+	"istio.io/broker/pkg/provisioner"
+	"istio.io/broker/pkg/routing"
 )
 
 type testStore struct {
@@ -38,7 +52,7 @@ func initTestStore(t *testing.T) *testStore {
 	return &testStore{
 		ctrl,
 		mock,
-		&Controller{mock},
+		&Controller{BrokerConfigStore: mock, attempts: newAttempts()},
 	}
 }
 
@@ -46,9 +60,36 @@ func (r *testStore) shutdown() {
 	r.ctrl.Finish()
 }
 
+// provisionInstance provisions an instance of a plan of the service of the tests
+func provisionInstance(t *testing.T, c *Controller, id, planID string) {
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", c.Provision).Methods("PUT")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/service_instances/"+id,
+		strings.NewReader(`{"service_id": "`+serviceID+`", "plan_id": "`+planID+`"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("provision %s => got %d (%s), want %d", id, w.Code, w.Body.String(), http.StatusCreated)
+	}
+}
+
+// meshProvisioners provisions the service classes in a store of the Istio config types
+func meshProvisioners(t *testing.T, store config.Store) *provisioner.Registry {
+	registry := provisioner.NewRegistry()
+	if err := registry.Register(provisioner.MeshProvisioner, provisioner.NewMesh(routing.NewRouter(store))); err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
 func TestCatalog(t *testing.T) {
 	r := initTestStore(t)
 	defer r.shutdown()
+	r.controller.dashboardSecrets = func(namespace, name, key string) (string, error) {
+		if namespace != "default" || name != "grafana-oauth" || key != catalog.DefaultDashboardClientSecretKey {
+			return "", fmt.Errorf("secret %s/%s has no key %q", namespace, name, key)
+		}
+		return "s3cr3t", nil
+	}
 
 	sc := &brokerconfig.ServiceClass{
 		Deployment: &brokerconfig.Deployment{
@@ -72,10 +113,19 @@ func TestCatalog(t *testing.T) {
 		},
 	}
 
+	plan := func(annotations map[string]string) config.Entry {
+		return config.Entry{
+			Meta: config.Meta{Type: config.ServicePlan.Type, Name: "istio-yearly", Namespace: "default",
+				Annotations: annotations},
+			Spec: sp,
+		}
+	}
+
 	cases := []struct {
 		name         string
 		mockServices map[string]*brokerconfig.ServiceClass
-		mockPlans    map[string]*brokerconfig.ServicePlan
+		annotations  map[string]string
+		mockPlans    []config.Entry
 		want         *osb.Catalog
 	}{
 		{
@@ -83,15 +133,74 @@ func TestCatalog(t *testing.T) {
 			mockServices: map[string]*brokerconfig.ServiceClass{
 				"service-class/default/productpage-service-class": sc,
 			},
-			mockPlans: map[string]*brokerconfig.ServicePlan{
-				"service-plan/default/istio-yearly": sp,
+			mockPlans: []config.Entry{plan(nil)},
+			want: &osb.Catalog{
+				Services: []osb.Service{
+					{
+						Name:                 "istio-bookinfo-productpage",
+						ID:                   "4395a443-f49a-41b0-8d14-d17294cf612f",
+						Description:          "A book info service",
+						InstancesRetrievable: true,
+						Plans: []osb.ServicePlan{
+							{
+								Name:        "istio-yearly",
+								ID:          "cdd76b03-a28b-4638-b4e2-19ee44b36db7",
+								Description: "yearly subscription"}}}}},
+		},
+		{
+			name: "deprecated plan",
+			mockServices: map[string]*brokerconfig.ServiceClass{
+				"service-class/default/productpage-service-class": sc,
 			},
+			mockPlans: []config.Entry{plan(map[string]string{catalog.LifecycleAnnotation: catalog.Deprecated})},
 			want: &osb.Catalog{
 				Services: []osb.Service{
 					{
-						Name:        "istio-bookinfo-productpage",
-						ID:          "4395a443-f49a-41b0-8d14-d17294cf612f",
-						Description: "A book info service",
+						Name:                 "istio-bookinfo-productpage",
+						ID:                   "4395a443-f49a-41b0-8d14-d17294cf612f",
+						Description:          "A book info service",
+						InstancesRetrievable: true,
+						Plans: []osb.ServicePlan{
+							{
+								Name:        "istio-yearly",
+								ID:          "cdd76b03-a28b-4638-b4e2-19ee44b36db7",
+								Description: "yearly subscription",
+								Metadata:    map[string]interface{}{"deprecated": true}}}}}},
+		},
+		{
+			name: "retired plan",
+			mockServices: map[string]*brokerconfig.ServiceClass{
+				"service-class/default/productpage-service-class": sc,
+			},
+			mockPlans: []config.Entry{plan(map[string]string{catalog.LifecycleAnnotation: catalog.Retired})},
+			want:      &osb.Catalog{},
+		},
+		{
+			name: "invalid lifecycle",
+			mockServices: map[string]*brokerconfig.ServiceClass{
+				"service-class/default/productpage-service-class": sc,
+			},
+			mockPlans: []config.Entry{plan(map[string]string{catalog.LifecycleAnnotation: "sunset"})},
+			want:      &osb.Catalog{},
+		},
+		{
+			name: "dashboard client",
+			mockServices: map[string]*brokerconfig.ServiceClass{
+				"service-class/default/productpage-service-class": sc,
+			},
+			annotations: map[string]string{
+				catalog.DashboardClientIDAnnotation:         "grafana",
+				catalog.DashboardClientSecretNameAnnotation: "grafana-oauth",
+			},
+			mockPlans: []config.Entry{plan(nil)},
+			want: &osb.Catalog{
+				Services: []osb.Service{
+					{
+						Name:                 "istio-bookinfo-productpage",
+						ID:                   "4395a443-f49a-41b0-8d14-d17294cf612f",
+						Description:          "A book info service",
+						InstancesRetrievable: true,
+						DashboardClient:      &osb.DashboardClient{ID: "grafana", Secret: "s3cr3t"},
 						Plans: []osb.ServicePlan{
 							{
 								Name:        "istio-yearly",
@@ -101,9 +210,212 @@ func TestCatalog(t *testing.T) {
 	}
 	for _, c := range cases {
 		r.mock.EXPECT().ServiceClasses().Return(c.mockServices)
-		r.mock.EXPECT().ServicePlansByService("service-class/default/productpage-service-class").Return(c.mockPlans)
+		r.mock.EXPECT().ServiceClassByID(sc.GetEntry().GetId()).Return(&config.Entry{
+			Meta: config.Meta{Type: config.ServiceClass.Type, Name: "productpage-service-class", Namespace: "default",
+				Annotations: c.annotations},
+			Spec: sc,
+		}, true)
+		r.mock.EXPECT().ServicePlanEntriesByService("service-class/default/productpage-service-class").Return(c.mockPlans)
 		if got := r.controller.catalog(); !reflect.DeepEqual(got, c.want) {
 			t.Errorf("%v failed: \ngot %+vwant %+v", c.name, spew.Sdump(got), spew.Sdump(c.want))
 		}
 	}
 }
+
+func TestBindUnbind(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	store := memory.Make(config.IstioConfigTypes)
+	r.controller.instances = memory.Make(config.BrokerConfigTypes)
+	r.controller.provisioners = meshProvisioners(t, store)
+	ca, err := credentials.NewCA("broker-test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.controller.credentials = credentials.NewProvider(ca, time.Hour, r.controller.instances, "istio-system")
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", r.controller.Bind).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", r.controller.Unbind).Methods("DELETE")
+	router.HandleFunc("/crl", r.controller.RevocationList).Methods("GET")
+	provisionInstance(t, r.controller, "instance-1", monthlyID)
+	provisionInstance(t, r.controller, "instance-2", monthlyID)
+
+	path := "/v2/service_instances/instance-1/service_bindings/binding-1"
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"bind without consumer", "PUT", path, `{"service_id": "` + serviceID + `"}`, http.StatusBadRequest},
+		{"bind", "PUT", path, `{"service_id": "` + serviceID + `", "parameters": {"consumer": "reviews"}}`, http.StatusCreated},
+		{"bind again", "PUT", path, `{"service_id": "` + serviceID + `", "parameters": {"consumer": "reviews"}}`, http.StatusOK},
+		{"bind another consumer", "PUT", path, `{"service_id": "` + serviceID + `", "bind_resource": {"app_guid": "ratings"}}`,
+			http.StatusConflict},
+		{"bind another instance", "PUT", "/v2/service_instances/instance-2/service_bindings/binding-1",
+			`{"service_id": "` + serviceID + `", "parameters": {"consumer": "reviews"}}`, http.StatusConflict},
+		{"bind unknown service", "PUT", path, `{"service_id": "missing", "parameters": {"consumer": "reviews"}}`,
+			http.StatusBadRequest},
+		{"bind malformed", "PUT", path, `{`, http.StatusBadRequest},
+		{"unbind", "DELETE", path, "", http.StatusOK},
+		{"unbind again", "DELETE", path, "", http.StatusGone},
+	}
+	for _, c := range cases {
+		target := c.path
+		if c.method == "DELETE" {
+			target += "?service_id=" + serviceID
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(c.method, target, strings.NewReader(c.body)))
+		if w.Code != c.want {
+			t.Errorf("%s => got %d (%s), want %d", c.name, w.Code, w.Body.String(), c.want)
+		}
+		if c.name == "bind" {
+			if l, _ := store.List(config.RouteRule.Type, "default"); len(l) != 1 {
+				t.Errorf("%s => got %d route rule(s), want 1", c.name, len(l))
+			}
+			if !strings.Contains(w.Body.String(), `"certificate":"-----BEGIN CERTIFICATE-----`) {
+				t.Errorf("%s => got %s, want a client certificate", c.name, w.Body.String())
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/crl", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "-----BEGIN X509 CRL-----") {
+		t.Errorf("revocation list => got %d (%s), want a CRL", w.Code, w.Body.String())
+	}
+}
+
+func TestBindUnprovisioned(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	instances := memory.Make(config.BrokerConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = meshProvisioners(t, memory.Make(config.IstioConfigTypes))
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", r.controller.Bind).Methods("PUT")
+
+	records := map[string]*brokerproto.ServiceInstance{
+		"instance-failed": {ServiceId: serviceID, PlanId: monthlyID, State: brokerproto.CreationState_FAILED},
+		"instance-pending": {ServiceId: serviceID, PlanId: monthlyID, State: brokerproto.CreationState_CREATING,
+			Operation: &brokerproto.Operation{Id: "provision-1", Kind: brokerproto.Operation_PROVISION}},
+		"instance-updating": {ServiceId: serviceID, PlanId: monthlyID,
+			Operation: &brokerproto.Operation{Id: "update-1", Kind: brokerproto.Operation_UPDATE}},
+	}
+	for name, spec := range records {
+		if _, err := instances.Create(config.Entry{
+			Meta: config.Meta{Type: config.ServiceInstance.Type, Name: name, Namespace: "default"},
+			Spec: spec,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		instance string
+		want     int
+	}{
+		{"instance-missing", http.StatusNotFound},
+		{"instance-failed", http.StatusBadRequest},
+		{"instance-pending", http.StatusUnprocessableEntity},
+		{"instance-updating", http.StatusUnprocessableEntity},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/service_instances/"+c.instance+"/service_bindings/binding-1",
+			strings.NewReader(`{"service_id": "`+serviceID+`", "parameters": {"consumer": "reviews"}}`)))
+		if w.Code != c.want {
+			t.Errorf("bind %s => got %d (%s), want %d", c.instance, w.Code, w.Body.String(), c.want)
+		}
+	}
+	if l, _ := instances.List(config.ServiceBinding.Type, ""); len(l) != 0 {
+		t.Errorf("got %d stored binding(s), want none", len(l))
+	}
+}
+
+func TestBindSecret(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+
+	entry := &config.Entry{
+		Meta: config.Meta{
+			Type:        config.ServiceClass.Type,
+			Name:        "productpage-service-class",
+			Namespace:   "default",
+			Annotations: map[string]string{credentials.SecretFormatAnnotation: credentials.TLSSecretFormat},
+		},
+		Spec: &brokerconfig.ServiceClass{
+			Deployment: &brokerconfig.Deployment{Instance: "productpage"},
+			Entry:      &brokerconfig.CatalogEntry{Name: "istio-bookinfo-productpage", Id: serviceID},
+		},
+	}
+	r.mock.EXPECT().ServiceClassByID(serviceID).Return(entry, true).AnyTimes()
+	r.mock.EXPECT().ServicePlanByID(monthlyID).Return(&config.Entry{
+		Meta: config.Meta{Type: config.ServicePlan.Type, Name: "istio-monthly", Namespace: "default",
+			Annotations: map[string]string{routing.RequestsPerSecondAnnotation: "10"}},
+		Spec: &brokerconfig.ServicePlan{
+			Plan:     &brokerconfig.CatalogPlan{Name: "istio-monthly", Id: monthlyID},
+			Services: []string{entry.Key()},
+		},
+	}, true).AnyTimes()
+
+	ca, err := credentials.NewCA("broker-test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset()
+	r.controller.instances = memory.Make(config.BrokerConfigTypes)
+	r.controller.provisioners = meshProvisioners(t, memory.Make(config.IstioConfigTypes))
+	r.controller.credentials = credentials.NewProvider(ca, time.Hour, r.controller.instances, "istio-system")
+	r.controller.secrets = credentials.NewSecretStore(client)
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", r.controller.Bind).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", r.controller.Unbind).Methods("DELETE")
+	provisionInstance(t, r.controller, "instance-1", monthlyID)
+
+	path := "/v2/service_instances/instance-1/service_bindings/binding-1"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", path,
+		strings.NewReader(`{"service_id": "`+serviceID+`", "parameters": {"consumer": "reviews"}}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bind => got %d (%s), want %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"secret":{"name":"binding-binding-1","namespace":"default"}`) ||
+		strings.Contains(body, "private_key") {
+		t.Errorf("bind => got %s, want a reference to the secret only", body)
+	}
+	secret, err := client.CoreV1().Secrets("default").Get("binding-binding-1", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(secret.Data["tls.crt"]), "-----BEGIN CERTIFICATE-----") {
+		t.Errorf("bind => got secret data %v, want a client certificate", secret.Data)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", path+"?service_id="+serviceID, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("unbind => got %d (%s), want %d", w.Code, w.Body.String(), http.StatusOK)
+	}
+	if _, err = client.CoreV1().Secrets("default").Get("binding-binding-1", meta_v1.GetOptions{}); err == nil {
+		t.Error("unbind should delete the secret")
+	}
+
+	// the secret is written to the Kubernetes namespace of the binding
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/service_instances/instance-1/service_bindings/binding-2",
+		strings.NewReader(`{"service_id": "`+serviceID+`", "parameters": {"consumer": "reviews"}, `+
+			`"context": {"platform": "kubernetes", "namespace": "team-a"}}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bind in a namespace => got %d (%s), want %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+	if _, err = client.CoreV1().Secrets("team-a").Get("binding-binding-2", meta_v1.GetOptions{}); err != nil {
+		t.Errorf("bind in a namespace => got %v, want a secret in the namespace", err)
+	}
+}
@@ -0,0 +1,563 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/catalog"
+	"istio.io/broker/pkg/metering"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	brokerproto "istio.io/broker/pkg/model/proto"
+	"istio.io/broker/pkg/provisioner"
+)
+
+// Provision serves service instance provisioning request, stores the
+// instance with its platform context and delegates the request to the
+// provisioner of the service class. The response carries the dashboard URL
+// rendered from the template of the service class. A repeated request is
+// answered from the stored instance before the plan is checked, so that the
+// retirement of a plan does not fail the retries of the platform.
+func (c *Controller) Provision(w http.ResponseWriter, r *http.Request) {
+	c, span := c.traced(r, "Provision")
+	defer span.End()
+	id := mux.Vars(r)["instance_id"]
+	var req osb.ServiceInstance
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("malformed request: %v", err))
+		return
+	}
+	platform := req.PlatformContext()
+	if platform != nil {
+		if err := platform.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	hash, err := requestHash(req.ServiceID, req.PlanID, req.Parameters, platform, req.MaintenanceInfo)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	done, ok := c.attempts.begin(config.ServiceInstance.Type + "/" + instanceName(id))
+	if !ok {
+		writeConcurrencyError(w, id)
+		return
+	}
+	defer done()
+
+	// a repeated request is answered from the stored instance, even once its
+	// plan is no longer offered to new instances
+	existing, exists := c.findInstance(id)
+	if exists {
+		spec := existing.Spec.(*brokerproto.ServiceInstance)
+		op := spec.GetOperation()
+		switch {
+		case !sameInstanceRequest(spec, req.ServiceID, req.PlanID, hash):
+			writeResponse(w, http.StatusConflict, struct{}{})
+			return
+		case op != nil && op.Kind == brokerproto.Operation_PROVISION:
+			writeResponse(w, http.StatusAccepted,
+				&osb.CreateServiceInstanceResponse{DashboardURL: spec.DashboardUrl, Operation: op.Id})
+			return
+		case spec.State == brokerproto.CreationState_CREATED:
+			writeResponse(w, http.StatusOK, &osb.CreateServiceInstanceResponse{DashboardURL: spec.DashboardUrl})
+			return
+		case op != nil || attemptRunning(spec.State, spec.AttemptExpires):
+			writeConcurrencyError(w, id)
+			return
+		}
+	}
+
+	class, plan, err := c.resolvePlan(req.ServiceID, req.PlanID)
+	if err == nil {
+		err = deleted(class, plan)
+	}
+	if err == nil {
+		err = catalog.Available(plan)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	version := catalog.MaintenanceVersion(plan)
+	if req.MaintenanceInfo != nil && req.MaintenanceInfo.Version != version {
+		writeMaintenanceInfoConflict(w, req.MaintenanceInfo.Version, version)
+		return
+	}
+	namespace := class.Namespace
+	if platform != nil && platform.Namespace != "" {
+		namespace = platform.Namespace
+	}
+	// an invalid template is reported in the status of the service class
+	dashboard, err := catalog.DashboardURL(class, plan, id, namespace)
+	if err != nil {
+		glog.Warningf("Service class %q: %v", class.Key(), err)
+	}
+	p, err := c.provisioners.Lookup(class)
+	if err != nil {
+		glog.Errorf("Provisioning instance %q failed: %v", id, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	entry := config.Entry{
+		Meta: config.Meta{
+			Type:        config.ServiceInstance.Type,
+			Name:        instanceName(id),
+			Namespace:   class.Namespace,
+			Annotations: map[string]string{config.InstanceIDAnnotation: id},
+		},
+		Spec: &brokerproto.ServiceInstance{
+			ServiceId:    req.ServiceID,
+			PlanId:       req.PlanID,
+			ServiceClass: class.Key(),
+			ServicePlan:  plan.Key(),
+			Context:      contextMessage(platform),
+			State:        brokerproto.CreationState_CREATING,
+			RequestHash:  hash,
+
+			MaintenanceVersion: version,
+			DashboardUrl:       dashboard,
+			AttemptExpires:     attemptExpiry(),
+		},
+	}
+	if exists {
+		// a creation that failed or was interrupted is attempted again
+		glog.Infof("Resuming the provisioning of instance %q", id)
+		entry.Namespace, entry.ResourceVersion = existing.Namespace, existing.ResourceVersion
+		if entry.ResourceVersion, err = c.instances.Update(entry); err != nil {
+			glog.Errorf("Provisioning instance %q failed: %v", id, err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		glog.Infof("Provisioning instance %q of %q with plan %q", id, class.Key(), plan.Key())
+		// the instance is stored first, so that a failed creation can be cleaned up
+		if entry.ResourceVersion, err = c.instances.Create(entry); err != nil {
+			glog.Errorf("Provisioning instance %q failed: %v", id, err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	instance := provisioner.Instance{ID: id, Class: class, Plan: plan, Context: platform}
+	result, err := p.Provision(provisioner.ProvisionRequest{
+		Instance:          instance,
+		Parameters:        parameters(req.Parameters),
+		AcceptsIncomplete: acceptsIncomplete(r),
+	})
+	if err != nil {
+		glog.Errorf("Provisioning instance %q failed: %v", id, err)
+		c.abandonInstance(p, instance, entry, err)
+		writeProvisionerError(w, err)
+		return
+	}
+	if result.Async {
+		// the instance is created once the operation succeeds
+		op := &brokerproto.Operation{Id: result.Operation, Kind: brokerproto.Operation_PROVISION}
+		err = c.recordOperation(entry, op)
+	} else {
+		err = c.recordState(entry, brokerproto.CreationState_CREATED)
+	}
+	if err != nil {
+		glog.Errorf("Provisioning instance %q failed: %v", id, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !result.Async {
+		c.meter(metering.Provision, id, req.ServiceID, req.PlanID, "")
+	}
+	code := http.StatusCreated
+	if result.Async {
+		code = http.StatusAccepted
+	}
+	writeResponse(w, code, &osb.CreateServiceInstanceResponse{DashboardURL: dashboard, Operation: result.Operation})
+}
+
+// GetInstance serves the fetching of a service instance with its dashboard
+// URL. Instances are not found until their provisioning succeeds, and
+// instances being updated are reported as a concurrency error.
+func (c *Controller) GetInstance(w http.ResponseWriter, r *http.Request) {
+	c, span := c.traced(r, "GetInstance")
+	defer span.End()
+	id := mux.Vars(r)["instance_id"]
+	existing, exists := c.findInstance(id)
+	if !exists || existing.Spec.(*brokerproto.ServiceInstance).State != brokerproto.CreationState_CREATED {
+		writeResponse(w, http.StatusNotFound, struct{}{})
+		return
+	}
+	spec := existing.Spec.(*brokerproto.ServiceInstance)
+	if op := spec.GetOperation(); op != nil && op.Kind == brokerproto.Operation_UPDATE {
+		writeConcurrencyError(w, id)
+		return
+	}
+	resp := &osb.FetchServiceInstanceResponse{
+		ServiceID:    spec.ServiceId,
+		PlanID:       spec.PlanId,
+		DashboardURL: spec.DashboardUrl,
+	}
+	if spec.MaintenanceVersion != "" {
+		resp.MaintenanceInfo = &osb.MaintenanceInfo{Version: spec.MaintenanceVersion}
+	}
+	writeResponse(w, http.StatusOK, resp)
+}
+
+// UpdateInstance serves service instance update request, delegates it to the
+// provisioner of the service class and stores the new plan once the
+// provisioner accepts the update. An asynchronous update that fails restores
+// the previous plan. An update with the maintenance info of the plan upgrades
+// the instance to it. Only instances whose provisioning completed are updated.
+func (c *Controller) UpdateInstance(w http.ResponseWriter, r *http.Request) {
+	c, span := c.traced(r, "UpdateInstance")
+	defer span.End()
+	id := mux.Vars(r)["instance_id"]
+	var req osb.ServiceInstance
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("malformed request: %v", err))
+		return
+	}
+	done, ok := c.attempts.begin(config.ServiceInstance.Type + "/" + instanceName(id))
+	if !ok {
+		writeConcurrencyError(w, id)
+		return
+	}
+	defer done()
+
+	existing, exists := c.findInstance(id)
+	if !exists {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown service instance %q", id))
+		return
+	}
+	spec := existing.Spec.(*brokerproto.ServiceInstance)
+	switch {
+	case spec.GetOperation() != nil || attemptRunning(spec.State, spec.AttemptExpires):
+		writeConcurrencyError(w, id)
+		return
+	case spec.State != brokerproto.CreationState_CREATED:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("instance %q is not provisioned", id))
+		return
+	}
+	if req.PlanID == "" {
+		req.PlanID = spec.PlanId
+	}
+	class, plan, err := c.resolvePlan(spec.ServiceId, req.PlanID)
+	// instances keep their plan when it is deprecated or retired, and can leave it
+	if err == nil && spec.PlanId != req.PlanID {
+		if err = deleted(nil, plan); err == nil {
+			err = catalog.Available(plan)
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p, err := c.provisioners.Lookup(class)
+	if err != nil {
+		glog.Errorf("Updating instance %q failed: %v", id, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// instances changing plan take the maintenance version of the new plan
+	version := spec.MaintenanceVersion
+	if spec.PlanId != req.PlanID {
+		version = catalog.MaintenanceVersion(plan)
+	}
+	if req.MaintenanceInfo != nil {
+		if current := catalog.MaintenanceVersion(plan); req.MaintenanceInfo.Version != current {
+			writeMaintenanceInfoConflict(w, req.MaintenanceInfo.Version, current)
+			return
+		}
+		version = req.MaintenanceInfo.Version
+	}
+	previous, _ := c.ServicePlanByID(spec.PlanId)
+
+	changed := spec.PlanId != req.PlanID || spec.MaintenanceVersion != version
+	if spec.PlanId != req.PlanID {
+		glog.Infof("Changing plan of instance %q to %q", id, plan.Key())
+	}
+	if spec.MaintenanceVersion != version {
+		glog.Infof("Upgrading instance %q to maintenance version %q", id, version)
+	}
+	result, err := p.Update(provisioner.UpdateRequest{
+		Instance:          provisioner.Instance{ID: id, Class: class, Plan: plan, Context: platformContext(spec.Context)},
+		PreviousPlan:      previous,
+		Parameters:        parameters(req.Parameters),
+		AcceptsIncomplete: acceptsIncomplete(r),
+
+		MaintenanceVersion:         version,
+		PreviousMaintenanceVersion: spec.MaintenanceVersion,
+	})
+	if err != nil {
+		glog.Errorf("Updating instance %q failed: %v", id, err)
+		writeProvisionerError(w, err)
+		return
+	}
+
+	updated := proto.Clone(spec).(*brokerproto.ServiceInstance)
+	updated.PlanId = req.PlanID
+	updated.ServiceClass = class.Key()
+	updated.ServicePlan = plan.Key()
+	updated.MaintenanceVersion = version
+	existing.Spec = updated
+	if result.Async {
+		op := &brokerproto.Operation{Id: result.Operation, Kind: brokerproto.Operation_UPDATE, PreviousPlanId: spec.PlanId,
+			PreviousMaintenanceVersion: spec.MaintenanceVersion}
+		err = c.recordOperation(*existing, op)
+	} else if changed {
+		_, err = c.instances.Update(*existing)
+	}
+	if err != nil {
+		glog.Errorf("Updating instance %q failed: %v", id, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !result.Async && spec.PlanId != req.PlanID {
+		c.meter(metering.Update, id, spec.ServiceId, req.PlanID, "")
+	}
+	writeResult(w, http.StatusOK, result)
+}
+
+// Deprovision serves service instance deprovisioning request, delegates it to
+// the provisioner of the service class and removes the instance.
+func (c *Controller) Deprovision(w http.ResponseWriter, r *http.Request) {
+	c, span := c.traced(r, "Deprovision")
+	defer span.End()
+	id := mux.Vars(r)["instance_id"]
+	// the platform deprovisions instances whose provisioning failed or timed out
+	if !c.attempts.wait(config.ServiceInstance.Type+"/"+instanceName(id), attemptWait) {
+		writeConcurrencyError(w, id)
+		return
+	}
+	existing, exists := c.findInstance(id)
+	if !exists {
+		writeResponse(w, http.StatusGone, struct{}{})
+		return
+	}
+	spec := existing.Spec.(*brokerproto.ServiceInstance)
+	if spec.GetOperation() != nil || attemptRunning(spec.State, spec.AttemptExpires) {
+		writeConcurrencyError(w, id)
+		return
+	}
+	instance, p, err := c.resolveInstance(id, "", "")
+	if err != nil {
+		glog.Errorf("Deprovisioning instance %q failed: %v", id, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	glog.Infof("Deprovisioning instance %q", id)
+	result, err := p.Deprovision(provisioner.DeprovisionRequest{
+		Instance:          instance,
+		AcceptsIncomplete: acceptsIncomplete(r),
+	})
+	if err != nil {
+		glog.Errorf("Deprovisioning instance %q failed: %v", id, err)
+		writeProvisionerError(w, err)
+		return
+	}
+	if result.Async {
+		// the instance is removed once the operation succeeds
+		op := &brokerproto.Operation{Id: result.Operation, Kind: brokerproto.Operation_DEPROVISION}
+		err = c.recordOperation(*existing, op)
+	} else {
+		err = c.instances.Delete(existing.Type, existing.Name, existing.Namespace)
+	}
+	if err != nil {
+		glog.Errorf("Deprovisioning instance %q failed: %v", id, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !result.Async && spec.State == brokerproto.CreationState_CREATED {
+		c.meter(metering.Deprovision, id, spec.ServiceId, spec.PlanId, "")
+	}
+	writeResult(w, http.StatusOK, result)
+}
+
+// abandonInstance removes the resources of a failed provisioning and the
+// instance. The instance is kept as failed if its resources cannot be
+// removed, so that the deprovisioning by the platform removes them.
+func (c *Controller) abandonInstance(p provisioner.Provisioner, instance provisioner.Instance, entry config.Entry,
+	cause error) {
+	if !rejected(cause) {
+		if _, err := p.Deprovision(provisioner.DeprovisionRequest{Instance: instance}); err != nil {
+			glog.Errorf("Removing the resources of instance %q failed: %v", instance.ID, err)
+			if err = c.recordState(entry, brokerproto.CreationState_FAILED); err != nil {
+				glog.Errorf("Recording the failure of instance %q failed: %v", instance.ID, err)
+			}
+			return
+		}
+	}
+	c.removeRecord(entry)
+}
+
+// sameInstanceRequest reports whether a provision request repeats the request
+// of a stored instance. Only the service and plan are compared for the
+// instances stored without the hash of their request.
+func sameInstanceRequest(spec *brokerproto.ServiceInstance, serviceID, planID, hash string) bool {
+	if spec.RequestHash != "" {
+		return spec.RequestHash == hash
+	}
+	return spec.ServiceId == serviceID && spec.PlanId == planID
+}
+
+// resolvePlan finds the service class and plan of a request
+func (c *Controller) resolvePlan(serviceID, planID string) (*config.Entry, *config.Entry, error) {
+	class, ok := c.ServiceClassByID(serviceID)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown service %q", serviceID)
+	}
+	plan, ok := c.ServicePlanByID(planID)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown plan %q", planID)
+	}
+	offered := false
+	for _, service := range plan.Spec.(*brokerconfig.ServicePlan).GetServices() {
+		offered = offered || service == class.Key()
+	}
+	if !offered {
+		return nil, nil, fmt.Errorf("plan %q is not offered by service %q", planID, serviceID)
+	}
+	return class, plan, nil
+}
+
+// writeMaintenanceInfoConflict rejects requests for another maintenance version than the one of the plan
+func writeMaintenanceInfoConflict(w http.ResponseWriter, version, want string) {
+	writeResponse(w, http.StatusUnprocessableEntity, &osb.ErrorResponse{
+		Error:       "MaintenanceInfoConflict",
+		Description: fmt.Sprintf("maintenance version %q does not match the version %q of the plan", version, want),
+	})
+}
+
+// deleted rejects new instances of a service class or plan being deleted,
+// whose removal waits for its instances
+func deleted(class, plan *config.Entry) error {
+	if class != nil && class.Deleting() {
+		return fmt.Errorf("service %q is being deleted", class.Key())
+	}
+	if plan != nil && plan.Deleting() {
+		return fmt.Errorf("plan %q is being deleted", plan.Key())
+	}
+	return nil
+}
+
+// resolveInstance finds the catalog entries and the provisioner of a service
+// instance from the stored instance, or else from the ids of the request
+func (c *Controller) resolveInstance(id, serviceID, planID string) (
+	provisioner.Instance, provisioner.Provisioner, error) {
+	var platform *osb.Context
+	if existing, exists := c.findInstance(id); exists {
+		spec := existing.Spec.(*brokerproto.ServiceInstance)
+		serviceID, planID = spec.ServiceId, spec.PlanId
+		platform = platformContext(spec.Context)
+	}
+	class, ok := c.ServiceClassByID(serviceID)
+	if !ok {
+		return provisioner.Instance{}, nil, fmt.Errorf("unknown service %q", serviceID)
+	}
+	instance := provisioner.Instance{ID: id, Class: class, Context: platform}
+	if planID != "" {
+		instance.Plan, _ = c.ServicePlanByID(planID)
+	}
+	p, err := c.provisioners.Lookup(class)
+	return instance, p, err
+}
+
+// findInstance looks up a service instance by id across namespaces
+func (c *Controller) findInstance(id string) (*config.Entry, bool) {
+	entries, err := c.instances.ListWithOptions(config.ServiceInstance.Type, config.ListOptions{
+		FieldSelector: config.FieldName + "=" + instanceName(id),
+	})
+	if err != nil {
+		glog.Warningf("Looking up instance %q failed: %v", id, err)
+		return nil, false
+	}
+	if len(entries) == 0 {
+		return nil, false
+	}
+	return &entries[0], true
+}
+
+// contextMessage converts a platform context to its stored message
+func contextMessage(in *osb.Context) *brokerproto.Context {
+	if in == nil {
+		return nil
+	}
+	return &brokerproto.Context{
+		Platform:         in.Platform,
+		InstanceName:     in.InstanceName,
+		Namespace:        in.Namespace,
+		ClusterId:        in.ClusterID,
+		OrganizationGuid: in.OrganizationGUID,
+		SpaceGuid:        in.SpaceGUID,
+	}
+}
+
+// platformContext converts a stored context message to a platform context
+func platformContext(in *brokerproto.Context) *osb.Context {
+	if in == nil {
+		return nil
+	}
+	return &osb.Context{
+		Platform:         in.Platform,
+		InstanceName:     in.InstanceName,
+		Namespace:        in.Namespace,
+		ClusterID:        in.ClusterId,
+		OrganizationGUID: in.OrganizationGuid,
+		SpaceGUID:        in.SpaceGuid,
+	}
+}
+
+// instanceName is the config object name of a service instance
+func instanceName(id string) string {
+	return config.ObjectName("", id)
+}
+
+// instanceID returns the id of a stored service instance, which the name of
+// the instance only hashes or lower-cases
+func instanceID(entry config.Entry) string {
+	if id := entry.Annotations[config.InstanceIDAnnotation]; id != "" {
+		return id
+	}
+	// the instances stored before their id was recorded are named after it
+	return entry.Name
+}
+
+// parameters of a request, ignoring values that are not JSON objects
+func parameters(in interface{}) map[string]interface{} {
+	out, _ := in.(map[string]interface{})
+	return out
+}
+
+// acceptsIncomplete reports whether the platform polls asynchronous operations
+func acceptsIncomplete(r *http.Request) bool {
+	return r.URL.Query().Get("accepts_incomplete") == "true"
+}
+
+// writeResult responds to an instance operation, accepting asynchronous operations
+func writeResult(w http.ResponseWriter, code int, result provisioner.Result) {
+	if result.Async {
+		writeResponse(w, http.StatusAccepted, &osb.OperationResponse{Operation: result.Operation})
+		return
+	}
+	writeResponse(w, code, struct{}{})
+}
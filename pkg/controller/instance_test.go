@@ -0,0 +1,930 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	"k8s.io/client-go/kubernetes/fake"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/catalog"
+	"istio.io/broker/pkg/election"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	brokerproto "istio.io/broker/pkg/model/proto"
+	"istio.io/broker/pkg/platform/memory"
+	"istio.io/broker/pkg/provisioner"
+	"istio.io/broker/pkg/routing"
+)
+
+const (
+	serviceID = "4395a443-f49a-41b0-8d14-d17294cf612f"
+	monthlyID = "58646b26-867a-4954-a1b9-233dac07815b"
+	yearlyID  = "cdd76b03-a28b-4638-b4e2-19ee44b36db7"
+	unusedID  = "0c3e4a5a-1e41-4a3e-9b0a-c1b2d3e4f5a6"
+	retiredID = "9a7b1c3e-5f2d-4b8a-a6c4-e1d3f5b7c9a0"
+)
+
+// expectCatalog serves a service class with a monthly, a yearly and a retired plan, and a plan of another class
+func expectCatalog(mock *config.MockBrokerConfigStore) {
+	class := &config.Entry{
+		Meta: config.Meta{Type: config.ServiceClass.Type, Name: "productpage", Namespace: "default"},
+		Spec: &brokerconfig.ServiceClass{
+			Deployment: &brokerconfig.Deployment{Instance: "productpage"},
+			Entry:      &brokerconfig.CatalogEntry{Name: "istio-bookinfo-productpage", Id: serviceID},
+		},
+	}
+	plan := func(name, id string, annotations map[string]string, services ...string) *config.Entry {
+		return &config.Entry{
+			Meta: config.Meta{Type: config.ServicePlan.Type, Name: name, Namespace: "default", Annotations: annotations},
+			Spec: &brokerconfig.ServicePlan{
+				Plan:     &brokerconfig.CatalogPlan{Name: name, Id: id},
+				Services: services,
+			},
+		}
+	}
+	mock.EXPECT().ServiceClassByID(serviceID).Return(class, true).AnyTimes()
+	mock.EXPECT().ServiceClassByID(gomock.Not(serviceID)).Return(nil, false).AnyTimes()
+	mock.EXPECT().ServicePlanByID(monthlyID).Return(plan("istio-monthly", monthlyID,
+		map[string]string{routing.RequestsPerSecondAnnotation: "10", catalog.MaintenanceVersionAnnotation: "1.1.0"},
+		class.Key()), true).AnyTimes()
+	mock.EXPECT().ServicePlanByID(yearlyID).Return(plan("istio-yearly", yearlyID,
+		map[string]string{routing.RequestsPerSecondAnnotation: "100", routing.RequestsPerDayAnnotation: "100000"},
+		class.Key()), true).AnyTimes()
+	mock.EXPECT().ServicePlanByID(unusedID).Return(plan("unused", unusedID, nil, "service-class/default/other"), true).AnyTimes()
+	mock.EXPECT().ServicePlanByID(retiredID).Return(plan("istio-legacy", retiredID,
+		map[string]string{catalog.LifecycleAnnotation: catalog.Retired}, class.Key()), true).AnyTimes()
+	mock.EXPECT().ServicePlanByID("missing").Return(nil, false).AnyTimes()
+}
+
+func TestInstanceLifecycle(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	instances := memory.Make(config.BrokerConfigTypes)
+	mesh := memory.Make(config.IstioConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = meshProvisioners(t, mesh)
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.UpdateInstance).Methods("PATCH")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Deprovision).Methods("DELETE")
+
+	path := "/v2/service_instances/instance-1"
+	request := func(planID string) string {
+		return `{"service_id": "` + serviceID + `", "plan_id": "` + planID + `"}`
+	}
+	quotas := func() int {
+		l, _ := mesh.List(config.Quota.Type, "")
+		return len(l)
+	}
+	// the quota is enforced on the consumers bound to the instance
+	if _, err := routing.NewRouter(mesh).Bind(routing.Binding{ID: "binding-1", InstanceID: "instance-1",
+		Service: "productpage", Consumer: "reviews", Namespace: "default"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+		quotas int
+	}{
+		{"provision unknown plan", "PUT", request("missing"), http.StatusBadRequest, 0},
+		{"provision plan of another service", "PUT", request(unusedID), http.StatusBadRequest, 0},
+		{"provision", "PUT", request(monthlyID), http.StatusCreated, 1},
+		{"provision again", "PUT", request(monthlyID), http.StatusOK, 1},
+		{"provision another plan", "PUT", request(yearlyID), http.StatusConflict, 1},
+		{"provision other parameters", "PUT", `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID +
+			`", "parameters": {"tier": "gold"}}`, http.StatusConflict, 1},
+		{"upgrade", "PATCH", `{"plan_id": "` + yearlyID + `"}`, http.StatusOK, 2},
+		{"update unchanged", "PATCH", `{}`, http.StatusOK, 2},
+		{"downgrade", "PATCH", `{"plan_id": "` + monthlyID + `"}`, http.StatusOK, 1},
+		{"deprovision", "DELETE", "", http.StatusOK, 0},
+		{"deprovision again", "DELETE", "", http.StatusGone, 0},
+		{"update missing", "PATCH", `{"plan_id": "` + yearlyID + `"}`, http.StatusBadRequest, 0},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(c.method, path, strings.NewReader(c.body)))
+		if w.Code != c.want {
+			t.Errorf("%s => got %d (%s), want %d", c.name, w.Code, w.Body.String(), c.want)
+		}
+		if got := quotas(); got != c.quotas {
+			t.Errorf("%s => got %d quota(s), want %d", c.name, got, c.quotas)
+		}
+	}
+	if l, _ := instances.List(config.ServiceInstance.Type, ""); len(l) != 0 {
+		t.Errorf("got %d instance(s) left", len(l))
+	}
+}
+
+func TestPlanLifecycle(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	instances := memory.Make(config.BrokerConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = meshProvisioners(t, memory.Make(config.IstioConfigTypes))
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.UpdateInstance).Methods("PATCH")
+
+	// an instance created before the plan was retired
+	legacy := config.Entry{
+		Meta: config.Meta{Type: config.ServiceInstance.Type, Name: "instance-legacy", Namespace: "default"},
+		Spec: &brokerproto.ServiceInstance{ServiceId: serviceID, PlanId: retiredID},
+	}
+	if _, err := instances.Create(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"provision retired plan", "PUT", "/v2/service_instances/instance-1",
+			`{"service_id": "` + serviceID + `", "plan_id": "` + retiredID + `"}`, http.StatusBadRequest},
+		{"repeat provision on retired plan", "PUT", "/v2/service_instances/instance-legacy",
+			`{"service_id": "` + serviceID + `", "plan_id": "` + retiredID + `"}`, http.StatusOK},
+		{"conflicting provision on retired plan", "PUT", "/v2/service_instances/instance-legacy",
+			`{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"}`, http.StatusConflict},
+		{"update on retired plan", "PATCH", "/v2/service_instances/instance-legacy", `{}`, http.StatusOK},
+		{"leave retired plan", "PATCH", "/v2/service_instances/instance-legacy",
+			`{"plan_id": "` + monthlyID + `"}`, http.StatusOK},
+		{"return to retired plan", "PATCH", "/v2/service_instances/instance-legacy",
+			`{"plan_id": "` + retiredID + `"}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if w.Code != c.want {
+			t.Errorf("%s => got %d (%s), want %d", c.name, w.Code, w.Body.String(), c.want)
+		}
+	}
+}
+
+func TestUpdateUnprovisioned(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	instances := memory.Make(config.BrokerConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = meshProvisioners(t, memory.Make(config.IstioConfigTypes))
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.UpdateInstance).Methods("PATCH")
+
+	expires := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	records := map[string]*brokerproto.ServiceInstance{
+		"instance-failed":   {ServiceId: serviceID, PlanId: monthlyID, State: brokerproto.CreationState_FAILED},
+		"instance-creating": {ServiceId: serviceID, PlanId: monthlyID, State: brokerproto.CreationState_CREATING},
+		"instance-attempted": {ServiceId: serviceID, PlanId: monthlyID, State: brokerproto.CreationState_CREATING,
+			AttemptExpires: expires},
+		"instance-local": {ServiceId: serviceID, PlanId: monthlyID},
+	}
+	for name, spec := range records {
+		if _, err := instances.Create(config.Entry{
+			Meta: config.Meta{Type: config.ServiceInstance.Type, Name: name, Namespace: "default"},
+			Spec: spec,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the provisioning of an instance in progress in the replica
+	done, _ := r.controller.attempts.begin(config.ServiceInstance.Type + "/instance-local")
+	defer done()
+
+	cases := []struct {
+		instance string
+		want     int
+	}{
+		{"instance-failed", http.StatusBadRequest},
+		{"instance-creating", http.StatusBadRequest},
+		{"instance-attempted", http.StatusUnprocessableEntity},
+		{"instance-local", http.StatusUnprocessableEntity},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("PATCH", "/v2/service_instances/"+c.instance,
+			strings.NewReader(`{"plan_id": "`+yearlyID+`"}`)))
+		if w.Code != c.want {
+			t.Errorf("update %s => got %d (%s), want %d", c.instance, w.Code, w.Body.String(), c.want)
+		}
+		entry, _ := instances.Get(config.ServiceInstance.Type, c.instance, "default")
+		if got := entry.Spec.(*brokerproto.ServiceInstance).PlanId; got != monthlyID {
+			t.Errorf("update %s => got plan %q, want %q", c.instance, got, monthlyID)
+		}
+	}
+}
+
+// upgradeProvisioner records the maintenance versions of the updates, and fails them with err if set
+type upgradeProvisioner struct {
+	provisioner.Provisioner
+	upgrades []string
+	err      error
+}
+
+func (p *upgradeProvisioner) Provision(req provisioner.ProvisionRequest) (provisioner.Result, error) {
+	return provisioner.Result{}, nil
+}
+
+func (p *upgradeProvisioner) Update(req provisioner.UpdateRequest) (provisioner.Result, error) {
+	p.upgrades = append(p.upgrades, req.PreviousMaintenanceVersion+"->"+req.MaintenanceVersion)
+	return provisioner.Result{}, p.err
+}
+
+func TestMaintenanceInfo(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	p := &upgradeProvisioner{}
+	r.controller.instances = memory.Make(config.BrokerConfigTypes)
+	r.controller.provisioners = provisioner.NewRegistry()
+	if err := r.controller.provisioners.Register(provisioner.DefaultProvisioner, p); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.UpdateInstance).Methods("PATCH")
+
+	path := "/v2/service_instances/instance-1"
+	ids := `"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"`
+	serve := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	version := func() string {
+		existing, exists := r.controller.findInstance("instance-1")
+		if !exists {
+			return ""
+		}
+		return existing.Spec.(*brokerproto.ServiceInstance).MaintenanceVersion
+	}
+
+	w := serve("PUT", `{`+ids+`, "maintenance_info": {"version": "1.0.0"}}`)
+	if conflict := `"error":"MaintenanceInfoConflict"`; w.Code != http.StatusUnprocessableEntity ||
+		!strings.Contains(w.Body.String(), conflict) {
+		t.Errorf("provision older version => got %d (%s), want a maintenance info conflict", w.Code, w.Body.String())
+	}
+	if w = serve("PUT", `{`+ids+`, "maintenance_info": {"version": "1.1.0"}}`); w.Code != http.StatusCreated {
+		t.Fatalf("provision => got %d (%s), want %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+	if got := version(); got != "1.1.0" {
+		t.Errorf("provision => got maintenance version %q, want 1.1.0", got)
+	}
+
+	// an instance provisioned before the version of the plan was bumped
+	existing, _ := r.controller.findInstance("instance-1")
+	existing.Spec.(*brokerproto.ServiceInstance).MaintenanceVersion = "1.0.0"
+	if _, err := r.controller.instances.Update(*existing); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		body    string
+		want    int
+		version string
+	}{
+		{"update without upgrade", `{}`, http.StatusOK, "1.0.0"},
+		{"upgrade to another version", `{"maintenance_info": {"version": "2.0.0"}}`, http.StatusUnprocessableEntity, "1.0.0"},
+		{"upgrade", `{"maintenance_info": {"version": "1.1.0"}}`, http.StatusOK, "1.1.0"},
+	}
+	for _, c := range cases {
+		if w = serve("PATCH", c.body); w.Code != c.want {
+			t.Errorf("%s => got %d (%s), want %d", c.name, w.Code, w.Body.String(), c.want)
+		}
+		if got := version(); got != c.version {
+			t.Errorf("%s => got maintenance version %q, want %q", c.name, got, c.version)
+		}
+	}
+	if want := []string{"1.0.0->1.0.0", "1.0.0->1.1.0"}; !reflect.DeepEqual(p.upgrades, want) {
+		t.Errorf("got updates %v, want %v", p.upgrades, want)
+	}
+
+	// a failed update keeps the plan and version of the instance
+	p.err = errors.New("unavailable")
+	if w = serve("PATCH", `{"plan_id": "`+yearlyID+`"}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("failed update => got %d (%s), want %d", w.Code, w.Body.String(), http.StatusInternalServerError)
+	}
+	existing, _ = r.controller.findInstance("instance-1")
+	if spec := existing.Spec.(*brokerproto.ServiceInstance); spec.PlanId != monthlyID || spec.MaintenanceVersion != "1.1.0" {
+		t.Errorf("failed update => got plan %q at version %q, want the previous ones", spec.PlanId, spec.MaintenanceVersion)
+	}
+}
+
+// asyncProvisioner provisions and deprovisions instances in the background
+type asyncProvisioner struct {
+	provisioner.Provisioner
+	state string
+}
+
+func (p *asyncProvisioner) Provision(req provisioner.ProvisionRequest) (provisioner.Result, error) {
+	if !req.AcceptsIncomplete {
+		return provisioner.Result{}, provisioner.ErrAsyncRequired
+	}
+	return provisioner.Result{Async: true, Operation: "provision-" + req.ID}, nil
+}
+
+func (p *asyncProvisioner) Deprovision(req provisioner.DeprovisionRequest) (provisioner.Result, error) {
+	return provisioner.Result{Async: true, Operation: "deprovision-" + req.ID}, nil
+}
+
+func (p *asyncProvisioner) Update(req provisioner.UpdateRequest) (provisioner.Result, error) {
+	return provisioner.Result{Async: true, Operation: "update-" + req.ID}, nil
+}
+
+func (p *asyncProvisioner) LastOperation(req provisioner.LastOperationRequest) (osb.LastOperation, error) {
+	switch req.Operation {
+	case "provision-" + req.ID, "update-" + req.ID, "deprovision-" + req.ID:
+		return osb.LastOperation{State: p.state, Description: req.Operation + " " + p.state}, nil
+	}
+	return osb.LastOperation{}, provisioner.Invalidf("unknown operation %q", req.Operation)
+}
+
+func TestAsyncProvision(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	p := &asyncProvisioner{}
+	instances := memory.Make(config.BrokerConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = provisioner.NewRegistry()
+	if err := r.controller.provisioners.Register(provisioner.DefaultProvisioner, p); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Deprovision).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", r.controller.LastOperation).Methods("GET")
+
+	path := "/v2/service_instances/instance-1"
+	poll := path + "/last_operation"
+	body := `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"}`
+	cases := []struct {
+		name      string
+		method    string
+		path      string
+		state     string
+		want      int
+		body      string
+		instances int
+	}{
+		{"provision synchronously", "PUT", path, "", http.StatusUnprocessableEntity, `"error":"AsyncRequired"`, 0},
+		{"provision", "PUT", path + "?accepts_incomplete=true", "", http.StatusAccepted,
+			`{"operation":"provision-instance-1"}`, 1},
+		{"provision again", "PUT", path + "?accepts_incomplete=true", "", http.StatusAccepted,
+			`{"operation":"provision-instance-1"}`, 1},
+		{"deprovision while provisioning", "DELETE", path, "", http.StatusUnprocessableEntity,
+			`"error":"ConcurrencyError"`, 1},
+		{"poll", "GET", poll, osb.OperationInProgress, http.StatusOK, `"state":"in progress"`, 1},
+		{"poll provisioned", "GET", poll, osb.OperationSucceeded, http.StatusOK, `"state":"succeeded"`, 1},
+		{"provision after completion", "PUT", path + "?accepts_incomplete=true", "", http.StatusOK, "", 1},
+		{"deprovision", "DELETE", path + "?accepts_incomplete=true", osb.OperationInProgress, http.StatusAccepted,
+			`{"operation":"deprovision-instance-1"}`, 1},
+		{"poll deprovisioning", "GET", poll, "", http.StatusOK, `"state":"in progress"`, 1},
+		{"poll deprovisioned", "GET", poll, osb.OperationSucceeded, http.StatusOK, `"state":"succeeded"`, 0},
+		{"poll removed", "GET", poll, "", http.StatusGone, "", 0},
+	}
+	for _, c := range cases {
+		if c.state != "" {
+			p.state = c.state
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader(body)))
+		if w.Code != c.want || !strings.Contains(w.Body.String(), c.body) {
+			t.Errorf("%s => got %d (%s), want %d (%s)", c.name, w.Code, w.Body.String(), c.want, c.body)
+		}
+		if l, _ := instances.List(config.ServiceInstance.Type, ""); len(l) != c.instances {
+			t.Errorf("%s => got %d instance(s), want %d", c.name, len(l), c.instances)
+		}
+	}
+}
+
+func TestCompletedOperations(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	p := &asyncProvisioner{}
+	instances := memory.Make(config.BrokerConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = provisioner.NewRegistry()
+	if err := r.controller.provisioners.Register(provisioner.DefaultProvisioner, p); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.UpdateInstance).Methods("PATCH")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Deprovision).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", r.controller.LastOperation).Methods("GET")
+
+	path := "/v2/service_instances/instance-1"
+	poll := path + "/last_operation"
+	provision := `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"}`
+	update := `{"plan_id": "` + yearlyID + `"}`
+	// the leader completes the operations before the platform polls
+	cases := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		state    string
+		want     int
+		response string
+		plan     string
+	}{
+		{"provision", "PUT", path + "?accepts_incomplete=true", provision, osb.OperationFailed, http.StatusAccepted,
+			`{"operation":"provision-instance-1"}`, monthlyID},
+		{"poll failed provisioning", "GET", poll, "", "", http.StatusOK,
+			`{"state":"failed","description":"provision-instance-1 failed"`, monthlyID},
+		{"deprovision failed instance", "DELETE", path + "?accepts_incomplete=true", "", osb.OperationSucceeded,
+			http.StatusAccepted, `{"operation":"deprovision-instance-1"}`, ""},
+		{"poll removed", "GET", poll, "", "", http.StatusGone, "", ""},
+		{"provision again", "PUT", path + "?accepts_incomplete=true", provision, osb.OperationSucceeded,
+			http.StatusAccepted, `{"operation":"provision-instance-1"}`, monthlyID},
+		{"poll provisioned", "GET", poll, "", "", http.StatusOK, `{"state":"succeeded"`, monthlyID},
+		{"update", "PATCH", path + "?accepts_incomplete=true", update, osb.OperationFailed, http.StatusAccepted,
+			`{"operation":"update-instance-1"}`, monthlyID},
+		{"poll failed update", "GET", poll, "", "", http.StatusOK, `{"state":"failed"`, monthlyID},
+		{"update again", "PATCH", path + "?accepts_incomplete=true", update, osb.OperationSucceeded,
+			http.StatusAccepted, `{"operation":"update-instance-1"}`, yearlyID},
+		{"poll updated", "GET", poll, "", "", http.StatusOK, `{"state":"succeeded"`, yearlyID},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if w.Code != c.want || !strings.Contains(w.Body.String(), c.response) {
+			t.Errorf("%s => got %d (%s), want %d (%s)", c.name, w.Code, w.Body.String(), c.want, c.response)
+		}
+		if c.state != "" {
+			p.state = c.state
+			if err := r.controller.CompleteOperations(); err != nil {
+				t.Fatalf("%s => completing operations: %v", c.name, err)
+			}
+		}
+		plan := ""
+		if existing, exists := r.controller.findInstance("instance-1"); exists {
+			plan = existing.Spec.(*brokerproto.ServiceInstance).PlanId
+		}
+		if plan != c.plan {
+			t.Errorf("%s => got plan %q, want %q", c.name, plan, c.plan)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+
+	class := &config.Entry{
+		Meta: config.Meta{Type: config.ServiceClass.Type, Name: "productpage", Namespace: "default",
+			Annotations: map[string]string{
+				catalog.DashboardURLAnnotation: "https://grafana.example.com/d/{{.Namespace}}/{{.InstanceID}}?plan={{.Plan}}",
+			}},
+		Spec: &brokerconfig.ServiceClass{
+			Deployment: &brokerconfig.Deployment{Instance: "productpage"},
+			Entry:      &brokerconfig.CatalogEntry{Name: "istio-bookinfo-productpage", Id: serviceID},
+		},
+	}
+	plan := &config.Entry{
+		Meta: config.Meta{Type: config.ServicePlan.Type, Name: "istio-monthly", Namespace: "default",
+			Annotations: map[string]string{catalog.MaintenanceVersionAnnotation: "1.1.0"}},
+		Spec: &brokerconfig.ServicePlan{
+			Plan:     &brokerconfig.CatalogPlan{Name: "istio-monthly", Id: monthlyID},
+			Services: []string{class.Key()},
+		},
+	}
+	r.mock.EXPECT().ServiceClassByID(serviceID).Return(class, true).AnyTimes()
+	r.mock.EXPECT().ServicePlanByID(monthlyID).Return(plan, true).AnyTimes()
+
+	p := &asyncProvisioner{}
+	r.controller.instances = memory.Make(config.BrokerConfigTypes)
+	r.controller.provisioners = provisioner.NewRegistry()
+	if err := r.controller.provisioners.Register(provisioner.DefaultProvisioner, p); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.GetInstance).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", r.controller.LastOperation).Methods("GET")
+
+	path := "/v2/service_instances/instance-1"
+	body := `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `",
+		"context": {"platform": "kubernetes", "namespace": "team-a"}}`
+	dashboard := `"dashboard_url":"https://grafana.example.com/d/team-a/instance-1?plan=istio-monthly"`
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		state  string
+		want   int
+		body   string
+	}{
+		{"fetch unknown", "GET", path, "", http.StatusNotFound, ""},
+		{"provision", "PUT", path + "?accepts_incomplete=true", "", http.StatusAccepted, dashboard},
+		{"fetch while provisioning", "GET", path, "", http.StatusNotFound, ""},
+		{"provision again", "PUT", path + "?accepts_incomplete=true", "", http.StatusAccepted, dashboard},
+		{"poll provisioned", "GET", path + "/last_operation", osb.OperationSucceeded, http.StatusOK, ""},
+		{"provision after completion", "PUT", path + "?accepts_incomplete=true", "", http.StatusOK, dashboard},
+		{"fetch", "GET", path, "", http.StatusOK, dashboard},
+	}
+	for _, c := range cases {
+		if c.state != "" {
+			p.state = c.state
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader(body)))
+		if w.Code != c.want || !strings.Contains(w.Body.String(), c.body) {
+			t.Errorf("%s => got %d (%s), want %d (%s)", c.name, w.Code, w.Body.String(), c.want, c.body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var got osb.FetchServiceInstanceResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := osb.FetchServiceInstanceResponse{
+		ServiceID:       serviceID,
+		PlanID:          monthlyID,
+		DashboardURL:    "https://grafana.example.com/d/team-a/instance-1?plan=istio-monthly",
+		MaintenanceInfo: &osb.MaintenanceInfo{Version: "1.1.0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fetch => got %+v, want %+v", got, want)
+	}
+}
+
+func TestInstanceContext(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	mesh := memory.Make(config.IstioConfigTypes)
+	r.controller.instances = memory.Make(config.BrokerConfigTypes)
+	r.controller.provisioners = meshProvisioners(t, mesh)
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.UpdateInstance).Methods("PATCH")
+
+	request := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+	ids := `"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"`
+	cases := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"kubernetes", `{` + ids + `, "context": {"platform": "kubernetes", "namespace": "team-a"}}`,
+			http.StatusCreated},
+		{"kubernetes without namespace", `{` + ids + `, "context": {"platform": "kubernetes"}}`,
+			http.StatusBadRequest},
+		{"cloudfoundry without space", `{` + ids + `, "context": {"platform": "cloudfoundry", "organization_guid": "org"}}`,
+			http.StatusBadRequest},
+		{"context without platform", `{` + ids + `, "context": {"namespace": "team-a"}}`, http.StatusBadRequest},
+	}
+	for i, c := range cases {
+		if got := request("PUT", fmt.Sprintf("/v2/service_instances/instance-%d", i), c.body); got != c.want {
+			t.Errorf("%s => got %d, want %d", c.name, got, c.want)
+		}
+	}
+
+	// the context is kept across plan changes and targets the mesh configuration
+	if _, err := routing.NewRouter(mesh).Bind(routing.Binding{ID: "binding-0", InstanceID: "instance-0",
+		Service: "productpage", Consumer: "reviews", Namespace: "team-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := request("PATCH", "/v2/service_instances/instance-0", `{"plan_id": "`+yearlyID+`"}`); got != http.StatusOK {
+		t.Fatalf("upgrade => got %d", got)
+	}
+	existing, exists := r.controller.findInstance("instance-0")
+	if !exists {
+		t.Fatal("instance not found")
+	}
+	spec := existing.Spec.(*brokerproto.ServiceInstance)
+	if spec.PlanId != yearlyID || spec.GetContext().GetNamespace() != "team-a" {
+		t.Errorf("got stored instance %v", spec)
+	}
+	if l, _ := mesh.List(config.Quota.Type, "team-a"); len(l) != 2 {
+		t.Errorf("got %d quota(s) in the context namespace, want 2", len(l))
+	}
+
+	// legacy organization and space fields are stored as a cloudfoundry context
+	if got := request("PUT", "/v2/service_instances/instance-legacy",
+		`{`+ids+`, "organization_guid": "org", "space_guid": "space"}`); got != http.StatusCreated {
+		t.Fatalf("provision with legacy fields => got %d", got)
+	}
+	existing, _ = r.controller.findInstance("instance-legacy")
+	if ctx := existing.Spec.(*brokerproto.ServiceInstance).GetContext(); ctx.GetPlatform() != osb.PlatformCloudFoundry ||
+		ctx.GetSpaceGuid() != "space" {
+		t.Errorf("got stored context %v", ctx)
+	}
+}
+
+func TestFollowerOperations(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	p := &asyncProvisioner{}
+	instances := memory.Make(config.BrokerConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = provisioner.NewRegistry()
+	if err := r.controller.provisioners.Register(provisioner.DefaultProvisioner, p); err != nil {
+		t.Fatal(err)
+	}
+	// an elector that did not win the election
+	cfg := election.DefaultConfig
+	cfg.Identity = "10.0.0.2:9091"
+	elector, err := election.NewElector(fake.NewSimpleClientset(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.controller.elector = elector
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", r.controller.LastOperation).Methods("GET")
+
+	path := "/v2/service_instances/instance-1"
+	body := `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", path+"?accepts_incomplete=true", strings.NewReader(body)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("provision => got %d (%s), want %d", w.Code, w.Body.String(), http.StatusAccepted)
+	}
+	pending := func() bool {
+		entry, exists := r.controller.findInstance("instance-1")
+		return exists && entry.Spec.(*brokerproto.ServiceInstance).GetOperation() != nil
+	}
+
+	// the followers report the state without completing the operation
+	p.state = osb.OperationSucceeded
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", path+"/last_operation", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"state":"succeeded"`) {
+		t.Errorf("poll => got %d (%s), want the succeeded state", w.Code, w.Body.String())
+	}
+	if !pending() {
+		t.Error("operation completed by a follower")
+	}
+
+	if err = r.controller.CompleteOperations(); err != nil {
+		t.Fatal(err)
+	}
+	if pending() {
+		t.Error("operation not completed")
+	}
+}
+
+// failingProvisioner fails to create instances and bindings, and to remove
+// their resources until it recovers
+type failingProvisioner struct {
+	provisioner.Provisioner
+	recovered bool
+}
+
+var errUnavailable = errors.New("backend unavailable")
+
+func (p *failingProvisioner) Provision(req provisioner.ProvisionRequest) (provisioner.Result, error) {
+	return provisioner.Result{}, errUnavailable
+}
+
+func (p *failingProvisioner) Deprovision(req provisioner.DeprovisionRequest) (provisioner.Result, error) {
+	if !p.recovered {
+		return provisioner.Result{}, errUnavailable
+	}
+	return provisioner.Result{}, nil
+}
+
+func (p *failingProvisioner) Bind(req provisioner.BindRequest) (provisioner.BindResult, error) {
+	return provisioner.BindResult{}, errUnavailable
+}
+
+func (p *failingProvisioner) Unbind(req provisioner.UnbindRequest) (bool, error) {
+	if !p.recovered {
+		return false, errUnavailable
+	}
+	return true, nil
+}
+
+func TestOrphanMitigation(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	p := &failingProvisioner{}
+	instances := memory.Make(config.BrokerConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = provisioner.NewRegistry()
+	if err := r.controller.provisioners.Register(provisioner.DefaultProvisioner, p); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	instancePath := "/v2/service_instances/{instance_id}"
+	bindingPath := instancePath + "/service_bindings/{binding_id}"
+	router.HandleFunc(instancePath, r.controller.Provision).Methods("PUT")
+	router.HandleFunc(instancePath, r.controller.Deprovision).Methods("DELETE")
+	router.HandleFunc(bindingPath, r.controller.Bind).Methods("PUT")
+	router.HandleFunc(bindingPath, r.controller.Unbind).Methods("DELETE")
+
+	serve := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+	state := func(typ, name string) (brokerproto.CreationState, bool) {
+		entry, exists := instances.Get(typ, name, "default")
+		if !exists {
+			return 0, false
+		}
+		switch spec := entry.Spec.(type) {
+		case *brokerproto.ServiceInstance:
+			return spec.State, true
+		case *brokerproto.ServiceBinding:
+			return spec.State, true
+		}
+		return 0, true
+	}
+
+	// the failed instance is kept until its resources are removed
+	body := `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"}`
+	path := "/v2/service_instances/instance-1"
+	if got := serve("PUT", path, body); got != http.StatusInternalServerError {
+		t.Errorf("provision => got %d, want %d", got, http.StatusInternalServerError)
+	}
+	if got, exists := state(config.ServiceInstance.Type, "instance-1"); got != brokerproto.CreationState_FAILED {
+		t.Errorf("provision => got state %v (stored %t), want %v", got, exists, brokerproto.CreationState_FAILED)
+	}
+	if got := serve("PUT", path, body); got != http.StatusInternalServerError {
+		t.Errorf("provision again => got %d, want %d", got, http.StatusInternalServerError)
+	}
+	if got := serve("DELETE", path, ""); got != http.StatusInternalServerError {
+		t.Errorf("deprovision => got %d, want %d", got, http.StatusInternalServerError)
+	}
+
+	// bindings are stored as failed as well
+	created := &config.Entry{
+		Meta: config.Meta{Type: config.ServiceInstance.Type, Name: "instance-2", Namespace: "default"},
+		Spec: &brokerproto.ServiceInstance{ServiceId: serviceID, PlanId: monthlyID},
+	}
+	if _, err := instances.Create(*created); err != nil {
+		t.Fatal(err)
+	}
+	bindPath := "/v2/service_instances/instance-2/service_bindings/binding-1"
+	bindBody := `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"}`
+	if got := serve("PUT", bindPath, bindBody); got != http.StatusInternalServerError {
+		t.Errorf("bind => got %d, want %d", got, http.StatusInternalServerError)
+	}
+	if got, exists := state(config.ServiceBinding.Type, "binding-1"); got != brokerproto.CreationState_FAILED {
+		t.Errorf("bind => got state %v (stored %t), want %v", got, exists, brokerproto.CreationState_FAILED)
+	}
+	otherBody := `{"service_id": "` + serviceID + `", "parameters": {"consumer": "ratings"}}`
+	if got := serve("PUT", bindPath, otherBody); got != http.StatusConflict {
+		t.Errorf("bind another consumer => got %d, want %d", got, http.StatusConflict)
+	}
+
+	// the platform removes the orphans once the provisioner recovers
+	p.recovered = true
+	if got := serve("DELETE", bindPath+"?service_id="+serviceID, ""); got != http.StatusOK {
+		t.Errorf("unbind => got %d, want %d", got, http.StatusOK)
+	}
+	if got := serve("DELETE", path, ""); got != http.StatusOK {
+		t.Errorf("deprovision => got %d, want %d", got, http.StatusOK)
+	}
+	left := [][2]string{{config.ServiceInstance.Type, "instance-1"}, {config.ServiceBinding.Type, "binding-1"}}
+	for _, key := range left {
+		if _, exists := state(key[0], key[1]); exists {
+			t.Errorf("got %s/%s left", key[0], key[1])
+		}
+	}
+
+	// a failed creation whose resources are removed leaves nothing behind
+	if got := serve("PUT", path, body); got != http.StatusInternalServerError {
+		t.Errorf("provision => got %d, want %d", got, http.StatusInternalServerError)
+	}
+	if _, exists := state(config.ServiceInstance.Type, "instance-1"); exists {
+		t.Error("got instance-1 left after its resources were removed")
+	}
+}
+
+func TestLeaderChange(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	instances := memory.Make(config.BrokerConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = provisioner.NewRegistry()
+	p := &failingProvisioner{recovered: true}
+	if err := r.controller.provisioners.Register(provisioner.DefaultProvisioner, p); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	instancePath := "/v2/service_instances/{instance_id}"
+	bindingPath := instancePath + "/service_bindings/{binding_id}"
+	router.HandleFunc(instancePath, r.controller.Provision).Methods("PUT")
+	router.HandleFunc(instancePath, r.controller.Deprovision).Methods("DELETE")
+	router.HandleFunc(bindingPath, r.controller.Bind).Methods("PUT")
+	router.HandleFunc(bindingPath, r.controller.Unbind).Methods("DELETE")
+	serve := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	// the creations attempted by the previous leader are recorded with their expiry
+	expires := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	records := []config.Entry{{
+		Meta: config.Meta{Type: config.ServiceInstance.Type, Name: "instance-1", Namespace: "default"},
+		Spec: &brokerproto.ServiceInstance{ServiceId: serviceID, PlanId: monthlyID,
+			State: brokerproto.CreationState_CREATING, AttemptExpires: expires},
+	}, {
+		Meta: config.Meta{Type: config.ServiceInstance.Type, Name: "instance-2", Namespace: "default"},
+		Spec: &brokerproto.ServiceInstance{ServiceId: serviceID, PlanId: monthlyID},
+	}, {
+		Meta: config.Meta{Type: config.ServiceBinding.Type, Name: "binding-1", Namespace: "default"},
+		Spec: &brokerproto.ServiceBinding{InstanceId: "instance-2", ServiceId: serviceID, PlanId: monthlyID,
+			State: brokerproto.CreationState_CREATING, AttemptExpires: expires},
+	}}
+	for _, record := range records {
+		if _, err := instances.Create(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := "/v2/service_instances/instance-1"
+	body := `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"}`
+	bindPath := "/v2/service_instances/instance-2/service_bindings/binding-1"
+	cases := []struct {
+		method, path, body string
+	}{
+		{"PUT", path, body},
+		{"DELETE", path, ""},
+		{"PUT", bindPath, body},
+		{"DELETE", bindPath + "?service_id=" + serviceID, ""},
+	}
+	for _, c := range cases {
+		if got := serve(c.method, c.path, c.body); got != http.StatusUnprocessableEntity {
+			t.Errorf("%s %s during the creation => got %d, want %d",
+				c.method, c.path, got, http.StatusUnprocessableEntity)
+		}
+	}
+
+	// the creations are interrupted once their attempts expire
+	expired := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	for _, record := range records {
+		entry, _ := instances.Get(record.Type, record.Name, record.Namespace)
+		switch spec := entry.Spec.(type) {
+		case *brokerproto.ServiceInstance:
+			spec.AttemptExpires = expired
+		case *brokerproto.ServiceBinding:
+			spec.AttemptExpires = expired
+		}
+		if _, err := instances.Update(*entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := serve("DELETE", bindPath+"?service_id="+serviceID, ""); got != http.StatusOK {
+		t.Errorf("unbind => got %d, want %d", got, http.StatusOK)
+	}
+	if got := serve("DELETE", path, ""); got != http.StatusOK {
+		t.Errorf("deprovision => got %d, want %d", got, http.StatusOK)
+	}
+}
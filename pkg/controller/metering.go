@@ -0,0 +1,101 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+
+	"istio.io/broker/pkg/metering"
+)
+
+// meter records a completed change of an instance or binding, if metering is configured.
+// Failures are only logged since the change already happened.
+func (c *Controller) meter(typ metering.EventType, id, serviceID, planID, bindingID string) {
+	if c.metering == nil {
+		return
+	}
+	event := metering.Event{
+		Time:       time.Now().UTC(),
+		Type:       typ,
+		InstanceID: id,
+		ServiceID:  serviceID,
+		PlanID:     planID,
+		BindingID:  bindingID,
+	}
+	if err := c.metering.Record(event); err != nil {
+		glog.Errorf("Recording %s of instance %q failed: %v", typ, id, err)
+	}
+}
+
+// Usage serves the usage of the plans by the instances during a period. The
+// period is given by the RFC 3339 from and to query parameters and defaults to
+// the current month. The report is JSON, or CSV with format=csv.
+func (c *Controller) Usage(w http.ResponseWriter, r *http.Request) {
+	if c.metering == nil {
+		writeError(w, http.StatusNotFound, "metering is not configured")
+		return
+	}
+	query := r.URL.Query()
+	now := time.Now().UTC()
+	from, err := parseTime(query.Get("from"), time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := parseTime(query.Get("to"), now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !to.After(from) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("empty period from %s to %s", query.Get("from"), query.Get("to")))
+		return
+	}
+
+	events, err := c.metering.Events()
+	if err != nil {
+		glog.Errorf("Reading metering events failed: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	report := metering.Compute(events, from, to)
+	switch format := query.Get("format"); format {
+	case "", "json":
+		writeResponse(w, http.StatusOK, &report)
+	case "csv":
+		w.Header().Set("content-type", "text/csv")
+		if err = metering.WriteCSV(w, report); err != nil {
+			glog.Errorf("Write response data error %s", err.Error())
+		}
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown format %q", format))
+	}
+}
+
+// parseTime parses an RFC 3339 time, using a default for empty values
+func parseTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %v", value, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"istio.io/broker/pkg/metering"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	"istio.io/broker/pkg/platform/memory"
+	"istio.io/broker/pkg/provisioner"
+)
+
+// eventTypes lists the types of the recorded events
+func eventTypes(t *testing.T, r metering.Recorder) []metering.EventType {
+	events, err := r.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []metering.EventType
+	for _, event := range events {
+		out = append(out, event.Type)
+	}
+	return out
+}
+
+func TestMeterLifecycle(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	recorder := metering.NewMemoryRecorder()
+	r.controller.instances = memory.Make(config.BrokerConfigTypes)
+	r.controller.provisioners = meshProvisioners(t, memory.Make(config.IstioConfigTypes))
+	r.controller.metering = recorder
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.UpdateInstance).Methods("PATCH")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Deprovision).Methods("DELETE")
+
+	path := "/v2/service_instances/instance-1"
+	requests := []struct {
+		method string
+		body   string
+	}{
+		{"PUT", `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"}`},
+		// provisioning again and unchanged updates are not metered
+		{"PUT", `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"}`},
+		{"PATCH", `{"plan_id": "` + yearlyID + `"}`},
+		{"PATCH", `{}`},
+		{"DELETE", ""},
+		{"DELETE", ""},
+	}
+	for _, req := range requests {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, path, strings.NewReader(req.body)))
+	}
+
+	want := []metering.EventType{metering.Provision, metering.Update, metering.Deprovision}
+	if got := eventTypes(t, recorder); !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+	events, _ := recorder.Events()
+	if events[1].InstanceID != "instance-1" || events[1].ServiceID != serviceID || events[1].PlanID != yearlyID {
+		t.Errorf("got update event %+v", events[1])
+	}
+}
+
+func TestMeterAsync(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	p := &asyncProvisioner{}
+	recorder := metering.NewMemoryRecorder()
+	r.controller.instances = memory.Make(config.BrokerConfigTypes)
+	r.controller.provisioners = provisioner.NewRegistry()
+	if err := r.controller.provisioners.Register(provisioner.DefaultProvisioner, p); err != nil {
+		t.Fatal(err)
+	}
+	r.controller.metering = recorder
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Deprovision).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", r.controller.LastOperation).Methods("GET")
+
+	path := "/v2/service_instances/instance-1"
+	body := `{"service_id": "` + serviceID + `", "plan_id": "` + monthlyID + `"}`
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		state  string
+		want   []metering.EventType
+	}{
+		{"provision", "PUT", path + "?accepts_incomplete=true", "", nil},
+		{"poll", "GET", path + "/last_operation", osb.OperationInProgress, nil},
+		{"poll provisioned", "GET", path + "/last_operation", osb.OperationSucceeded,
+			[]metering.EventType{metering.Provision}},
+		{"deprovision", "DELETE", path + "?accepts_incomplete=true", "", []metering.EventType{metering.Provision}},
+		{"poll deprovisioned", "GET", path + "/last_operation", osb.OperationSucceeded,
+			[]metering.EventType{metering.Provision, metering.Deprovision}},
+	}
+	for _, c := range cases {
+		if c.state != "" {
+			p.state = c.state
+		}
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(c.method, c.path, strings.NewReader(body)))
+		if got := eventTypes(t, recorder); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s => got events %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	c := &Controller{}
+	w := httptest.NewRecorder()
+	c.Usage(w, httptest.NewRequest("GET", "/metering/usage", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Usage() without metering => got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	start := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	c.metering = metering.NewMemoryRecorder()
+	for _, event := range []metering.Event{
+		{Time: start, Type: metering.Provision, InstanceID: "instance-1", ServiceID: serviceID, PlanID: monthlyID},
+		{Time: start.Add(36 * time.Hour), Type: metering.Deprovision, InstanceID: "instance-1"},
+	} {
+		if err := c.metering.Record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name  string
+		query string
+		want  int
+		body  string
+	}{
+		{"json", "?from=2017-09-01T00:00:00Z&to=2017-09-02T00:00:00Z", http.StatusOK, `"hours":24`},
+		{"csv", "?from=2017-09-01T12:00:00Z&to=2017-10-01T00:00:00Z&format=csv", http.StatusOK,
+			"instance-1," + serviceID + "," + monthlyID + ",2017-09-01T12:00:00Z,2017-09-02T12:00:00Z,24.000,0"},
+		{"invalid time", "?from=yesterday", http.StatusBadRequest, "invalid time"},
+		{"empty period", "?from=2017-09-02T00:00:00Z&to=2017-09-01T00:00:00Z", http.StatusBadRequest, "empty period"},
+		{"unknown format", "?format=xml", http.StatusBadRequest, "unknown format"},
+	}
+	for _, tc := range cases {
+		w = httptest.NewRecorder()
+		c.Usage(w, httptest.NewRequest("GET", "/metering/usage"+tc.query, nil))
+		if w.Code != tc.want || !strings.Contains(w.Body.String(), tc.body) {
+			t.Errorf("%s => got %d (%s), want %d (%s)", tc.name, w.Code, w.Body.String(), tc.want, tc.body)
+		}
+	}
+
+	// the period defaults to the current month, which ends after the deprovisioning
+	w = httptest.NewRecorder()
+	c.Usage(w, httptest.NewRequest("GET", "/metering/usage", nil))
+	var report metering.UsageReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.From.Day() != 1 || len(report.Usage) != 0 {
+		t.Errorf("Usage() of the current month => got %+v", report)
+	}
+}
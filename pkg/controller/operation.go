@@ -0,0 +1,202 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+	multierror "github.com/hashicorp/go-multierror"
+
+	"istio.io/broker/pkg/metering"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	brokerproto "istio.io/broker/pkg/model/proto"
+	"istio.io/broker/pkg/provisioner"
+)
+
+// LastOperation serves the polling of the pending asynchronous operation of
+// an instance. The state is fetched from the provisioner of the service class
+// and the instance is updated when the operation completes. Once completed,
+// the operation is answered from the final state kept on the instance, since
+// the leader may complete it before the platform polls.
+func (c *Controller) LastOperation(w http.ResponseWriter, r *http.Request) {
+	c, span := c.traced(r, "LastOperation")
+	defer span.End()
+	id := mux.Vars(r)["instance_id"]
+	existing, exists := c.findInstance(id)
+	if !exists {
+		writeResponse(w, http.StatusGone, struct{}{})
+		return
+	}
+	spec := existing.Spec.(*brokerproto.ServiceInstance)
+	op := spec.GetOperation()
+	if op == nil {
+		// the instances stored before the final state was kept completed their operations
+		last := &osb.LastOperation{State: osb.OperationSucceeded}
+		if done := spec.GetLastOperation(); done != nil {
+			last = &osb.LastOperation{State: done.State, Description: done.Description}
+		}
+		writeResponse(w, http.StatusOK, last)
+		return
+	}
+	instance, p, err := c.resolveInstance(id, "", "")
+	if err != nil {
+		glog.Errorf("Polling operation of instance %q failed: %v", id, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	state, err := p.LastOperation(provisioner.LastOperationRequest{Instance: instance, Operation: op.Id})
+	if err != nil {
+		glog.Errorf("Polling operation of instance %q failed: %v", id, err)
+		writeProvisionerError(w, err)
+		return
+	}
+	// the followers only report the state, the leader completes the operation
+	if c.elector.IsLeader() {
+		if err = c.settleOperation(id, *existing, op, state); err != nil {
+			glog.Errorf("Completing operation of instance %q failed: %v", id, err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	writeResponse(w, http.StatusOK, &state)
+}
+
+// RunOperations completes the pending operations periodically until stop is
+// closed, so that operations complete even if the platform stops polling or
+// polls a follower
+func (c *Controller) RunOperations(period time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.CompleteOperations(); err != nil {
+				glog.Warningf("completing operations: %v", err)
+			}
+		}
+	}
+}
+
+// CompleteOperations polls the provisioners for the state of the pending
+// operations and completes the operations that succeeded or failed
+func (c *Controller) CompleteOperations() error {
+	entries, err := c.instances.List(config.ServiceInstance.Type, "")
+	if err != nil {
+		return err
+	}
+	var errs error
+	for _, entry := range entries {
+		spec, ok := entry.Spec.(*brokerproto.ServiceInstance)
+		if !ok || spec.GetOperation() == nil {
+			continue
+		}
+		id, op := instanceID(entry), spec.GetOperation()
+		instance, p, err := c.resolveInstance(id, "", "")
+		if err == nil {
+			var state osb.LastOperation
+			if state, err = p.LastOperation(provisioner.LastOperationRequest{Instance: instance, Operation: op.Id}); err == nil {
+				err = c.settleOperation(id, entry, op, state)
+			}
+		}
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("instance %q: %v", id, err))
+		}
+	}
+	return errs
+}
+
+// settleOperation completes an operation that succeeded or failed
+func (c *Controller) settleOperation(id string, entry config.Entry, op *brokerproto.Operation,
+	state osb.LastOperation) error {
+	switch state.State {
+	case osb.OperationSucceeded, osb.OperationFailed:
+		glog.Infof("Operation %q of instance %q %s", op.Id, id, state.State)
+		done := proto.Clone(op).(*brokerproto.Operation)
+		done.State, done.Description = state.State, state.Description
+		return c.completeOperation(id, entry, done)
+	}
+	return nil
+}
+
+// recordOperation stores the pending asynchronous operation of an instance
+func (c *Controller) recordOperation(entry config.Entry, op *brokerproto.Operation) error {
+	spec := proto.Clone(entry.Spec).(*brokerproto.ServiceInstance)
+	spec.Operation = op
+	entry.Spec = spec
+	_, err := c.instances.Update(entry)
+	return err
+}
+
+// completeOperation updates an instance after its pending operation completes
+// with the final state of the operation. A successful deprovisioning removes
+// the instance, and the other operations are kept as the last operation of
+// the instance. A successful provisioning marks the instance created, and a
+// failed one marks it failed, so that the platform polls the failure and then
+// deprovisions the instance as orphan mitigation. A failed update restores the
+// previous plan and maintenance version. Successful operations are metered.
+func (c *Controller) completeOperation(id string, entry config.Entry, op *brokerproto.Operation) error {
+	spec := proto.Clone(entry.Spec).(*brokerproto.ServiceInstance)
+	succeeded := op.State == osb.OperationSucceeded
+	if op.Kind == brokerproto.Operation_DEPROVISION && succeeded {
+		if err := c.instances.Delete(entry.Type, entry.Name, entry.Namespace); err != nil {
+			return err
+		}
+		if spec.State == brokerproto.CreationState_CREATED {
+			c.meter(metering.Deprovision, id, spec.ServiceId, spec.PlanId, "")
+		}
+		return nil
+	}
+	spec.Operation = nil
+	spec.LastOperation = op
+	if op.Kind == brokerproto.Operation_PROVISION && succeeded {
+		spec.State = brokerproto.CreationState_CREATED
+	} else if op.Kind == brokerproto.Operation_PROVISION {
+		spec.State = brokerproto.CreationState_FAILED
+	}
+	if op.Kind == brokerproto.Operation_UPDATE && !succeeded && op.PreviousPlanId != "" {
+		spec.PlanId = op.PreviousPlanId
+		spec.MaintenanceVersion = op.PreviousMaintenanceVersion
+		if plan, ok := c.ServicePlanByID(op.PreviousPlanId); ok {
+			spec.ServicePlan = plan.Key()
+		}
+	}
+	entry.Spec = spec
+	if _, err := c.instances.Update(entry); err != nil {
+		return err
+	}
+	if succeeded && op.Kind == brokerproto.Operation_PROVISION {
+		c.meter(metering.Provision, id, spec.ServiceId, spec.PlanId, "")
+	} else if succeeded && op.Kind == brokerproto.Operation_UPDATE && op.PreviousPlanId != spec.PlanId {
+		c.meter(metering.Update, id, spec.ServiceId, spec.PlanId, "")
+	}
+	return nil
+}
+
+// writeConcurrencyError rejects requests on an instance or binding with a pending operation
+func writeConcurrencyError(w http.ResponseWriter, id string) {
+	writeResponse(w, http.StatusUnprocessableEntity, &osb.ErrorResponse{
+		Error:       "ConcurrencyError",
+		Description: fmt.Sprintf("another operation is in progress for %q", id),
+	})
+}
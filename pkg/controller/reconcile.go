@@ -0,0 +1,316 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	multierror "github.com/hashicorp/go-multierror"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	brokerproto "istio.io/broker/pkg/model/proto"
+	"istio.io/broker/pkg/provisioner"
+)
+
+const (
+	// minBackoff is the delay before reconciling an object again after a first failure
+	minBackoff = time.Second
+
+	// maxBackoff bounds the delay between the attempts to reconcile a failing object
+	maxBackoff = 5 * time.Minute
+)
+
+// failure tracks the failed attempts to reconcile an object
+type failure struct {
+	attempts int
+	retry    time.Time
+}
+
+// Reconciler converges the resources of the stored instances and bindings
+// through the provisioners supporting reconciliation, so that operations
+// interrupted part way, e.g. by a crash of the broker, and changes of the
+// generated resources are repaired. Resources of instances and bindings that
+// are no longer stored are removed. Objects failing to reconcile are retried
+// with an exponential backoff.
+type Reconciler struct {
+	ctr     *Controller
+	changed chan struct{}
+	now     func() time.Time
+
+	mu       sync.Mutex
+	failures map[string]*failure
+}
+
+// NewReconciler creates a reconciler of the instances and bindings of a controller
+func NewReconciler(c *Controller) *Reconciler {
+	return &Reconciler{
+		ctr:      c,
+		changed:  make(chan struct{}, 1),
+		now:      time.Now,
+		failures: make(map[string]*failure),
+	}
+}
+
+// Notify requests a reconciliation, e.g. on a change event of the store
+func (r *Reconciler) Notify() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run reconciles after each change, when failed objects are due for a retry
+// and at least once per period, until stop is closed
+func (r *Reconciler) Run(period time.Duration, stop <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-r.changed:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+		if err := r.Reconcile(); err != nil {
+			glog.Warningf("instance reconciliation: %v", err)
+		}
+		next := period
+		if retry, ok := r.nextRetry(); ok && retry < next {
+			next = retry
+		}
+		timer.Reset(next)
+	}
+}
+
+// Reconcile converges the resources of all stored instances and bindings
+// once, skipping the failed objects that are not due for a retry
+func (r *Reconciler) Reconcile() error {
+	c := r.ctr
+	reconcilers := c.provisioners.Reconcilers()
+	if len(reconcilers) == 0 {
+		return nil
+	}
+	// the resources are listed ahead of the records, which are stored before
+	// the resources are created, so that new resources are never taken for orphans
+	owners := make(map[string][2][]string)
+	var errs error
+	for name, p := range reconcilers {
+		instances, bindings, err := p.Owners()
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("provisioner %q: %v", name, err))
+			continue
+		}
+		owners[name] = [2][]string{instances, bindings}
+	}
+	instances, err := c.instances.List(config.ServiceInstance.Type, "")
+	if err != nil {
+		return multierror.Append(errs, err)
+	}
+	bindings, err := c.instances.List(config.ServiceBinding.Type, "")
+	if err != nil {
+		return multierror.Append(errs, err)
+	}
+
+	known := make(map[string]bool)
+	for _, entry := range instances {
+		known[entry.Name] = true
+		if err = r.attempt(entry.Key(), func() error { return r.reconcileInstance(entry) }); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	bound := make(map[string]bool)
+	for _, entry := range bindings {
+		bound[entry.Name] = true
+		if err = r.attempt(entry.Key(), func() error { return r.reconcileBinding(entry, known) }); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	names := make([]string, 0, len(owners))
+	for name := range owners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := reconcilers[name]
+		for _, id := range owners[name][0] {
+			if known[instanceName(id)] {
+				continue
+			}
+			glog.Infof("Removing resources of orphaned instance %q", id)
+			if err = r.attempt(name+"/instance/"+id, func() error { return p.RemoveInstance(id) }); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+		for _, id := range owners[name][1] {
+			if bound[bindingName(id)] {
+				continue
+			}
+			glog.Infof("Removing resources of orphaned binding %q", id)
+			if err = r.attempt(name+"/binding/"+id, func() error { return p.RemoveBinding(id) }); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// reconcileInstance applies the resources of an instance again, unless an
+// operation is pending on the instance or its creation did not complete
+func (r *Reconciler) reconcileInstance(entry config.Entry) error {
+	spec, ok := entry.Spec.(*brokerproto.ServiceInstance)
+	if !ok || spec.GetOperation() != nil || spec.State != brokerproto.CreationState_CREATED {
+		return nil
+	}
+	instance, p, err := r.ctr.resolveInstance(instanceID(entry), spec.ServiceId, spec.PlanId)
+	if err != nil {
+		return err
+	}
+	reconciler, ok := p.(provisioner.Reconciler)
+	if !ok {
+		return nil
+	}
+	glog.V(2).Infof("reconciling instance %q", instance.ID)
+	return reconciler.ReconcileInstance(instance)
+}
+
+// reconcileBinding applies the resources of a binding again, unless its
+// creation did not complete. Bindings of removed instances are unbound and removed.
+func (r *Reconciler) reconcileBinding(entry config.Entry, instances map[string]bool) error {
+	spec, ok := entry.Spec.(*brokerproto.ServiceBinding)
+	if !ok {
+		return nil
+	}
+	id := bindingID(entry)
+	instance, p, err := r.ctr.resolveInstance(spec.InstanceId, spec.ServiceId, spec.PlanId)
+	if err != nil {
+		return err
+	}
+	if !instances[instanceName(spec.InstanceId)] {
+		glog.Infof("Removing binding %q of removed instance %q", id, spec.InstanceId)
+		if _, err = p.Unbind(provisioner.UnbindRequest{Instance: instance, BindingID: id}); err != nil {
+			return err
+		}
+		if r.ctr.credentials != nil {
+			if _, err = r.ctr.credentials.Revoke(id); err != nil {
+				return err
+			}
+		}
+		if r.ctr.secrets != nil {
+			if _, err = r.ctr.secrets.Delete(id); err != nil {
+				return err
+			}
+		}
+		return r.ctr.instances.Delete(entry.Type, entry.Name, entry.Namespace)
+	}
+	reconciler, ok := p.(provisioner.Reconciler)
+	if !ok || spec.State != brokerproto.CreationState_CREATED {
+		return nil
+	}
+	req, err := storedBindRequest(id, instance, spec)
+	if err != nil {
+		return err
+	}
+	glog.V(2).Infof("reconciling binding %q", id)
+	return reconciler.ReconcileBinding(req)
+}
+
+// storedBindRequest rebuilds the bind request of a stored binding
+func storedBindRequest(id string, instance provisioner.Instance, spec *brokerproto.ServiceBinding) (
+	provisioner.BindRequest, error) {
+	req := provisioner.BindRequest{
+		Instance:    instance,
+		BindingID:   id,
+		BindContext: platformContext(spec.Context),
+	}
+	if spec.Parameters != "" {
+		if err := json.Unmarshal([]byte(spec.Parameters), &req.Parameters); err != nil {
+			return req, fmt.Errorf("malformed parameters: %v", err)
+		}
+	}
+	if spec.AppGuid != "" || spec.Route != "" {
+		req.BindResource = &osb.BindResource{AppGUID: spec.AppGuid, Route: spec.Route}
+	}
+	return req, nil
+}
+
+// attempt reconciles an object unless it is backing off after a failure, and
+// tracks the failures of the object
+func (r *Reconciler) attempt(key string, reconcile func() error) error {
+	now := r.now()
+	r.mu.Lock()
+	f, failed := r.failures[key]
+	r.mu.Unlock()
+	if failed && now.Before(f.retry) {
+		return nil
+	}
+
+	err := reconcile()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		delete(r.failures, key)
+		return nil
+	}
+	if !failed {
+		f = &failure{}
+		r.failures[key] = f
+	}
+	f.attempts++
+	backoff := maxBackoff
+	if f.attempts <= 20 {
+		if d := minBackoff << uint(f.attempts-1); d < maxBackoff {
+			backoff = d
+		}
+	}
+	f.retry = now.Add(backoff)
+	return fmt.Errorf("%s (attempt %d, retry in %v): %v", key, f.attempts, backoff, err)
+}
+
+// nextRetry returns the delay until the next failed object is due for a retry, if any
+func (r *Reconciler) nextRetry() (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failures) == 0 {
+		return 0, false
+	}
+	var next time.Time
+	for _, f := range r.failures {
+		if next.IsZero() || f.retry.Before(next) {
+			next = f.retry
+		}
+	}
+	if d := next.Sub(r.now()); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// OnChange returns a store event handler notifying the reconciler
+func (r *Reconciler) OnChange() func(config.Entry, config.Event) {
+	return func(entry config.Entry, event config.Event) {
+		glog.V(3).Infof("%s %s: reconciling", event, entry.Key())
+		r.Notify()
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/platform/memory"
+	"istio.io/broker/pkg/routing"
+)
+
+func TestReconcile(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	store := memory.Make(config.IstioConfigTypes)
+	instances := memory.Make(config.BrokerConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = meshProvisioners(t, store)
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", r.controller.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", r.controller.Bind).Methods("PUT")
+	request := func(path, body string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("PUT", path, strings.NewReader(body)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s => got %d (%s), want %d", path, w.Code, w.Body.String(), http.StatusCreated)
+		}
+	}
+	request("/v2/service_instances/instance-1", `{"service_id": "`+serviceID+`", "plan_id": "`+monthlyID+`"}`)
+	request("/v2/service_instances/instance-1/service_bindings/binding-1",
+		`{"service_id": "`+serviceID+`", "plan_id": "`+monthlyID+`", "parameters": {"consumer": "reviews"}}`)
+	if l, _ := instances.List(config.ServiceBinding.Type, ""); len(l) != 1 {
+		t.Fatalf("bind => got %d stored binding(s), want 1", len(l))
+	}
+
+	count := func(schema config.Schema) int {
+		l, _ := store.List(schema.Type, "")
+		return len(l)
+	}
+	removeAll := func(schema config.Schema) {
+		l, _ := store.List(schema.Type, "")
+		for _, entry := range l {
+			if err := store.Delete(entry.Type, entry.Name, entry.Namespace); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	reconciler := NewReconciler(r.controller)
+
+	// the configuration lost part way is applied again
+	removeAll(config.RouteRule)
+	removeAll(config.MixerRule)
+	if err := reconciler.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if count(config.RouteRule) != 1 || count(config.MixerRule) != 1 {
+		t.Errorf("Reconcile() => got %d route rule(s) and %d mixer rule(s), want 1",
+			count(config.RouteRule), count(config.MixerRule))
+	}
+
+	// the configuration of unknown instances and bindings is removed
+	router2 := routing.NewRouter(store)
+	if _, err := router2.Bind(routing.Binding{ID: "binding-2", InstanceID: "instance-1", Service: "productpage",
+		Consumer: "ratings", Namespace: "default"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router2.Bind(routing.Binding{ID: "binding-3", InstanceID: "instance-2", Service: "productpage",
+		Consumer: "ratings", Namespace: "default"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := router2.ApplyQuota(routing.Instance{ID: "instance-2", Service: "productpage", Namespace: "default"},
+		routing.Quota{RequestsPerSecond: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconciler.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if count(config.RouteRule) != 1 || count(config.MixerRule) != 1 {
+		t.Errorf("Reconcile() => got %d route rule(s) and %d mixer rule(s) with orphans, want 1",
+			count(config.RouteRule), count(config.MixerRule))
+	}
+
+	// the bindings of removed instances are removed
+	if err := instances.Delete(config.ServiceInstance.Type, "instance-1", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconciler.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := instances.List(config.ServiceBinding.Type, ""); len(l) != 0 {
+		t.Errorf("Reconcile() => got %d stored binding(s) of a removed instance", len(l))
+	}
+	for _, schema := range config.IstioConfigTypes {
+		if n := count(schema); n != 0 {
+			t.Errorf("Reconcile() => got %d %s left of a removed instance", n, schema.Plural)
+		}
+	}
+}
+
+func TestReconcileIDs(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	store := memory.Make(config.IstioConfigTypes)
+	instances := memory.Make(config.BrokerConfigTypes)
+	r.controller.instances = instances
+	r.controller.provisioners = meshProvisioners(t, store)
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", r.controller.Bind).Methods("PUT")
+
+	// ids that are not valid names are hashed in the names of the records
+	provisionInstance(t, r.controller, "Instance_1", monthlyID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/service_instances/Instance_1/service_bindings/Binding_1",
+		strings.NewReader(`{"service_id": "`+serviceID+`", "parameters": {"consumer": "reviews"}}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bind => got %d (%s), want %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+	instance, exists := instances.Get(config.ServiceInstance.Type, instanceName("Instance_1"), "default")
+	if !exists || instance.Name == "instance_1" || instanceID(*instance) != "Instance_1" {
+		t.Fatalf("provision => got instance %+v, want a valid name recording the id", instance)
+	}
+	binding, exists := instances.Get(config.ServiceBinding.Type, bindingName("Binding_1"), "default")
+	if !exists || bindingID(*binding) != "Binding_1" {
+		t.Fatalf("bind => got binding %+v, want a valid name recording the id", binding)
+	}
+
+	// the configuration is reconciled for the ids of the requests
+	total := func() int {
+		n := 0
+		for _, schema := range config.IstioConfigTypes {
+			l, _ := store.List(schema.Type, "")
+			n += len(l)
+		}
+		return n
+	}
+	want := total()
+	reconciler := NewReconciler(r.controller)
+	for i := 0; i < 2; i++ {
+		if err := reconciler.Reconcile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := total(); got != want {
+		t.Errorf("Reconcile() => got %d config object(s), want %d", got, want)
+	}
+}
+
+func TestReconcileBackoff(t *testing.T) {
+	reconciler := NewReconciler(&Controller{})
+	now := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	reconciler.now = func() time.Time { return now }
+	calls := 0
+	failing := func() error {
+		calls++
+		return errors.New("unavailable")
+	}
+
+	if err := reconciler.attempt("service-instance/default/instance-1", failing); err == nil {
+		t.Error("attempt() => got no error")
+	}
+	if retry, ok := reconciler.nextRetry(); !ok || retry != minBackoff {
+		t.Errorf("nextRetry() => got %v, %t, want %v", retry, ok, minBackoff)
+	}
+	// the object is skipped until it is due for a retry
+	if err := reconciler.attempt("service-instance/default/instance-1", failing); err != nil || calls != 1 {
+		t.Errorf("attempt() while backing off => got %v after %d call(s), want 1 call", err, calls)
+	}
+	now = now.Add(minBackoff)
+	if err := reconciler.attempt("service-instance/default/instance-1", failing); err == nil || calls != 2 {
+		t.Errorf("attempt() when due => got %v after %d call(s), want 2 calls", err, calls)
+	}
+	if retry, _ := reconciler.nextRetry(); retry != 2*minBackoff {
+		t.Errorf("nextRetry() => got %v, want %v", retry, 2*minBackoff)
+	}
+
+	// the backoff is bounded
+	for i := 0; i < 30; i++ {
+		now = now.Add(maxBackoff)
+		_ = reconciler.attempt("service-instance/default/instance-1", failing)
+	}
+	if retry, _ := reconciler.nextRetry(); retry != maxBackoff {
+		t.Errorf("nextRetry() => got %v, want %v", retry, maxBackoff)
+	}
+
+	now = now.Add(maxBackoff)
+	if err := reconciler.attempt("service-instance/default/instance-1", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reconciler.nextRetry(); ok {
+		t.Error("nextRetry() => got a retry after success")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	multierror "github.com/hashicorp/go-multierror"
+
+	"istio.io/broker/pkg/credentials"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	brokerproto "istio.io/broker/pkg/model/proto"
+)
+
+// RunRotations rotates the client certificates due for rotation periodically
+// until stop is closed, so that the certificates in the secrets of bindings
+// do not expire. Without a secret store, the platform only receives new
+// certificates when it requests the bindings again.
+func (c *Controller) RunRotations(period time.Duration, stop <-chan struct{}) {
+	if c.credentials == nil || c.secrets == nil {
+		return
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.RotateCredentials(); err != nil {
+				glog.Warningf("rotating credentials: %v", err)
+			}
+		}
+	}
+}
+
+// RotateCredentials issues new client certificates to the bindings whose
+// certificates are due for rotation and rewrites their secrets. The
+// certificates of removed bindings are revoked.
+func (c *Controller) RotateCredentials() error {
+	if c.credentials == nil || c.secrets == nil {
+		return nil
+	}
+	due, err := c.credentials.Due()
+	if err != nil || len(due) == 0 {
+		return err
+	}
+	entries, err := c.instances.List(config.ServiceBinding.Type, "")
+	if err != nil {
+		return err
+	}
+	bindings := make(map[string]config.Entry, len(entries))
+	for _, entry := range entries {
+		bindings[bindingID(entry)] = entry
+	}
+	var errs error
+	for _, id := range due {
+		if err = c.rotateBinding(id, bindings); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("binding %q: %v", id, err))
+		}
+	}
+	return errs
+}
+
+// rotateBinding rotates the certificate of a binding, unless a request on
+// the binding is in progress or its creation did not complete
+func (c *Controller) rotateBinding(id string, bindings map[string]config.Entry) error {
+	done, ok := c.attempts.begin(config.ServiceBinding.Type + "/" + bindingName(id))
+	if !ok {
+		return nil
+	}
+	defer done()
+
+	entry, exists := bindings[id]
+	if !exists {
+		// the bindings are stored before their certificates are issued
+		glog.Infof("Revoking the certificate of removed binding %q", id)
+		_, err := c.credentials.Revoke(id)
+		return err
+	}
+	spec, ok := entry.Spec.(*brokerproto.ServiceBinding)
+	if !ok || spec.State != brokerproto.CreationState_CREATED {
+		return nil
+	}
+	instance, p, err := c.resolveInstance(spec.InstanceId, spec.ServiceId, spec.PlanId)
+	if err != nil {
+		return err
+	}
+	format, err := credentials.LookupSecretFormat(instance.Class.Annotations[credentials.SecretFormatAnnotation])
+	if err != nil {
+		return err
+	}
+	req, err := storedBindRequest(id, instance, spec)
+	if err != nil {
+		return err
+	}
+	// the provisioner renders the credentials of the binding again
+	result, err := p.Bind(req)
+	if err != nil || result.Subject == "" {
+		return err
+	}
+	credential := result.Credentials
+	if credential == nil {
+		credential = &osb.BindingCredential{}
+	}
+	glog.Infof("Rotating the certificate of binding %q", id)
+	if credential.Credential, err = c.credentials.Rotate(id, result.Subject); err != nil {
+		return err
+	}
+	_, err = c.secrets.Write(id, instance.ID, secretNamespace(req.BindContext, instance), format, credential)
+	return err
+}
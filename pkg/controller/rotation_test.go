@@ -0,0 +1,85 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"istio.io/broker/pkg/credentials"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/platform/memory"
+)
+
+func TestRotateCredentials(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+	expectCatalog(r.mock)
+
+	ca, err := credentials.NewCA("broker-test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset()
+	r.controller.instances = memory.Make(config.BrokerConfigTypes)
+	r.controller.provisioners = meshProvisioners(t, memory.Make(config.IstioConfigTypes))
+	r.controller.credentials = credentials.NewProvider(ca, 300*time.Millisecond, r.controller.instances, "istio-system")
+	r.controller.secrets = credentials.NewSecretStore(client)
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", r.controller.Bind).Methods("PUT")
+	provisionInstance(t, r.controller, "instance-1", monthlyID)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/service_instances/instance-1/service_bindings/binding-1",
+		strings.NewReader(`{"service_id": "`+serviceID+`", "parameters": {"consumer": "reviews"}}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bind => got %d (%s), want %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+	certificate := func() string {
+		secret, errGet := client.CoreV1().Secrets("default").Get("binding-binding-1", meta_v1.GetOptions{})
+		if errGet != nil {
+			t.Fatal(errGet)
+		}
+		return string(secret.Data["certificate"])
+	}
+	issued := certificate()
+
+	// the certificates are not rotated before two thirds of their lifetime
+	if err = r.controller.RotateCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if got := certificate(); got != issued {
+		t.Error("RotateCredentials() => got the certificate rotated before it is due")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if err = r.controller.RotateCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	rotated := certificate()
+	if rotated == issued || !strings.HasPrefix(rotated, "-----BEGIN CERTIFICATE-----") {
+		t.Errorf("RotateCredentials() => got certificate %q, want a new certificate", rotated)
+	}
+	if due, errDue := r.controller.credentials.Due(); errDue != nil || len(due) != 0 {
+		t.Errorf("RotateCredentials() => got %v due, %v, want none", due, errDue)
+	}
+}
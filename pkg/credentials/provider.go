@@ -0,0 +1,337 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	multierror "github.com/hashicorp/go-multierror"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	brokerproto "istio.io/broker/pkg/model/proto"
+)
+
+// renewFraction of the lifetime of a certificate after which it is rotated
+const renewFraction = 2.0 / 3
+
+// Provider issues a short-lived client certificate per binding and rotates
+// the certificate when it is issued again after two thirds of its lifetime,
+// or when the certificates due for rotation are rotated. Replaced and unbound
+// certificates are revoked until they expire.
+//
+// The certificates are recorded in a config store shared by the replicas,
+// so that any replica serves the revocation list and a new leader revokes
+// the certificates issued by the previous one. The private keys are only
+// kept in memory: a binding requested again from a replica that did not
+// issue its certificate gets a new certificate, and the previous one is revoked.
+type Provider struct {
+	ca        *CA
+	ttl       time.Duration
+	now       func() time.Time
+	store     config.Store
+	namespace string
+
+	mu sync.Mutex
+	// credentials issued by the replica by serial number
+	credentials map[string]*osb.Credential
+}
+
+// NewProvider creates a provider of certificates valid for ttl signed by a
+// CA, recording the certificates in a namespace of a config store
+func NewProvider(ca *CA, ttl time.Duration, store config.Store, namespace string) *Provider {
+	return &Provider{
+		ca:          ca,
+		ttl:         ttl,
+		now:         time.Now,
+		store:       store,
+		namespace:   namespace,
+		credentials: make(map[string]*osb.Credential),
+	}
+}
+
+// Issue returns the credential of a binding for a subject, issuing a new
+// certificate if the binding has none for the subject or if it is due for rotation.
+func (p *Provider) Issue(binding, subject string) (*osb.Credential, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current, err := p.current(binding)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && current.spec.Subject == subject && p.now().Before(current.renewAt) {
+		if credential, ok := p.credentials[current.spec.Serial]; ok {
+			return credential, nil
+		}
+	}
+	return p.issue(binding, subject, current)
+}
+
+// Due lists the bindings whose certificates are due for rotation
+func (p *Provider) Due() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	certs, err := p.certificates("")
+	if err != nil {
+		return nil, err
+	}
+	now := p.now()
+	seen := make(map[string]bool)
+	var out []string
+	for _, cert := range certs {
+		if cert.spec.RevokedAt != "" || now.Before(cert.renewAt) || seen[cert.spec.BindingId] {
+			continue
+		}
+		seen[cert.spec.BindingId] = true
+		out = append(out, cert.spec.BindingId)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Rotate issues a new certificate of a binding for a subject and revokes
+// the current one, if any
+func (p *Provider) Rotate(binding, subject string) (*osb.Credential, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current, err := p.current(binding)
+	if err != nil {
+		return nil, err
+	}
+	return p.issue(binding, subject, current)
+}
+
+// certificate is the record of an issued certificate
+type certificate struct {
+	entry    config.Entry
+	spec     *brokerproto.Certificate
+	notAfter time.Time
+	renewAt  time.Time
+}
+
+// certificates lists the recorded certificates matching a label selector
+func (p *Provider) certificates(selector string) ([]certificate, error) {
+	entries, err := p.store.ListWithOptions(config.BindingCertificate.Type, config.ListOptions{
+		Namespace:     p.namespace,
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]certificate, 0, len(entries))
+	for _, entry := range entries {
+		spec, ok := entry.Spec.(*brokerproto.Certificate)
+		if !ok {
+			continue
+		}
+		notAfter, errTime := time.Parse(time.RFC3339Nano, spec.NotAfter)
+		if errTime != nil {
+			glog.Warningf("certificate %q: invalid expiration %q", entry.Name, spec.NotAfter)
+			continue
+		}
+		renewAt, _ := time.Parse(time.RFC3339Nano, spec.RenewAt)
+		out = append(out, certificate{entry: entry, spec: spec, notAfter: notAfter, renewAt: renewAt})
+	}
+	return out, nil
+}
+
+// current finds the unrevoked certificate of a binding, if any
+func (p *Provider) current(binding string) (*certificate, error) {
+	certs, err := p.certificates(config.BindingLabel + "=" + config.LabelValue(binding))
+	if err != nil {
+		return nil, err
+	}
+	var out *certificate
+	for i := range certs {
+		cert := &certs[i]
+		if cert.spec.BindingId != binding || cert.spec.RevokedAt != "" {
+			continue
+		}
+		if out == nil || cert.notAfter.After(out.notAfter) {
+			out = cert
+		}
+	}
+	return out, nil
+}
+
+// issue signs and records a new certificate for a binding and revokes the
+// replaced one, if any. Callers must hold the lock.
+func (p *Provider) issue(binding, subject string, replaced *certificate) (*osb.Credential, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := p.now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         subject,
+			OrganizationalUnit: []string{binding},
+		},
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    now.Add(p.ttl),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := p.ca.sign(template, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &brokerproto.Certificate{
+		BindingId: binding,
+		Subject:   subject,
+		Serial:    fmt.Sprintf("%x", serial),
+		NotAfter:  template.NotAfter.UTC().Format(time.RFC3339Nano),
+		RenewAt:   now.Add(time.Duration(float64(p.ttl) * renewFraction)).UTC().Format(time.RFC3339Nano),
+	}
+	// the certificate is recorded before it is handed out, so that it can be revoked
+	if _, err = p.store.Create(config.Entry{
+		Meta: config.Meta{
+			Type:        config.BindingCertificate.Type,
+			Name:        "certificate-" + spec.Serial,
+			Namespace:   p.namespace,
+			Labels:      map[string]string{config.BindingLabel: config.LabelValue(binding)},
+			Annotations: map[string]string{config.BindingIDAnnotation: binding},
+		},
+		Spec: spec,
+	}); err != nil {
+		return nil, err
+	}
+	credential := &osb.Credential{
+		Certificate:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKey:    string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		CACertificate: string(p.ca.Certificate()),
+		Expiration:    template.NotAfter.UTC().Format(time.RFC3339),
+	}
+	p.credentials[spec.Serial] = credential
+	if replaced != nil {
+		glog.V(2).Infof("rotating certificate %s of binding %q", replaced.spec.Serial, binding)
+		if err = p.revoke(*replaced, now); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.prune(now); err != nil {
+		glog.Warningf("removing expired certificates: %v", err)
+	}
+	return credential, nil
+}
+
+// revoke records the revocation time of a certificate. Callers must hold the lock.
+func (p *Provider) revoke(cert certificate, at time.Time) error {
+	spec := proto.Clone(cert.spec).(*brokerproto.Certificate)
+	spec.RevokedAt = at.UTC().Format(time.RFC3339Nano)
+	cert.entry.Spec = spec
+	if _, err := p.store.Update(cert.entry); err != nil {
+		return err
+	}
+	delete(p.credentials, spec.Serial)
+	return nil
+}
+
+// prune removes the records of the expired certificates, which no longer
+// need to be listed as revoked, and forgets the credentials of the
+// certificates revoked or removed by any replica. Callers must hold the lock.
+func (p *Provider) prune(now time.Time) error {
+	certs, err := p.certificates("")
+	if err != nil {
+		return err
+	}
+	valid := make(map[string]bool)
+	var errs error
+	for _, cert := range certs {
+		if !now.After(cert.notAfter) {
+			valid[cert.spec.Serial] = cert.spec.RevokedAt == ""
+			continue
+		}
+		if err = p.store.Delete(cert.entry.Type, cert.entry.Name, cert.entry.Namespace); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	for serial := range p.credentials {
+		if !valid[serial] {
+			delete(p.credentials, serial)
+		}
+	}
+	return errs
+}
+
+// Revoke revokes the certificate of a binding and reports whether it had one
+func (p *Provider) Revoke(binding string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cert, err := p.current(binding)
+	if err != nil || cert == nil {
+		return false, err
+	}
+	glog.V(2).Infof("revoking certificate %s of binding %q", cert.spec.Serial, binding)
+	if err = p.revoke(*cert, p.now()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CRL returns the PEM encoded revocation list of the unexpired revoked
+// certificates, valid for the lifetime of the client certificates.
+func (p *Provider) CRL() ([]byte, error) {
+	certs, err := p.certificates("")
+	if err != nil {
+		return nil, err
+	}
+	now := p.now()
+	var revoked []pkix.RevokedCertificate
+	for _, cert := range certs {
+		if cert.spec.RevokedAt == "" || now.After(cert.notAfter) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(cert.spec.Serial, 16)
+		revokedAt, errTime := time.Parse(time.RFC3339Nano, cert.spec.RevokedAt)
+		if !ok || errTime != nil {
+			glog.Warningf("certificate %q: invalid serial %q or revocation time %q",
+				cert.entry.Name, cert.spec.Serial, cert.spec.RevokedAt)
+			continue
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: revokedAt,
+		})
+	}
+
+	der, err := p.ca.cert.CreateCRL(rand.Reader, p.ca.key, revoked, now, now.Add(p.ttl))
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
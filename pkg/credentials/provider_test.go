@@ -0,0 +1,240 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	"istio.io/broker/pkg/platform/memory"
+)
+
+const stateNamespace = "istio-system"
+
+func makeProvider(t *testing.T, ttl time.Duration) (*Provider, *time.Time) {
+	ca, err := NewCA("broker-test", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProvider(ca, ttl, memory.Make(config.Descriptor{config.BindingCertificate}), stateNamespace)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	return p, &now
+}
+
+// replica creates a provider sharing the CA, store and clock of another provider
+func replica(p *Provider) *Provider {
+	out := NewProvider(p.ca, p.ttl, p.store, p.namespace)
+	out.now = p.now
+	return out
+}
+
+// revocations parses the revocation list of a provider into the revocation
+// times by serial number
+func revocations(t *testing.T, p *Provider) map[string]time.Time {
+	data, err := p.CRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "X509 CRL" {
+		t.Fatalf("no CRL in %q", data)
+	}
+	crl, err := x509.ParseCRL(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.ca.cert.CheckCRLSignature(crl); err != nil {
+		t.Errorf("invalid CRL signature: %v", err)
+	}
+	out := make(map[string]time.Time)
+	for _, entry := range crl.TBSCertList.RevokedCertificates {
+		out[serialOf(entry.SerialNumber)] = entry.RevocationTime
+	}
+	return out
+}
+
+func serialOf(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
+
+func parseCertificate(t *testing.T, credential *osb.Credential) *x509.Certificate {
+	if _, err := tls.X509KeyPair([]byte(credential.Certificate), []byte(credential.PrivateKey)); err != nil {
+		t.Fatalf("key pair mismatch: %v", err)
+	}
+	block, _ := pem.Decode([]byte(credential.Certificate))
+	if block == nil {
+		t.Fatalf("no certificate in %q", credential.Certificate)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestIssue(t *testing.T) {
+	p, _ := makeProvider(t, time.Hour)
+	credential, err := p.Issue("binding-1", "reviews.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseCertificate(t, credential)
+	if cert.Subject.CommonName != "reviews.default" {
+		t.Errorf("got common name %q, want %q", cert.Subject.CommonName, "reviews.default")
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(credential.CACertificate)) {
+		t.Fatalf("invalid CA certificate %q", credential.CACertificate)
+	}
+	if _, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Errorf("client certificate does not verify: %v", err)
+	}
+
+	again, err := p.Issue("binding-1", "reviews.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != credential {
+		t.Error("issuing again should return the same credential")
+	}
+	other, err := p.Issue("binding-1", "ratings.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == credential {
+		t.Error("issuing for another subject should return a new credential")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	p, now := makeProvider(t, 3*time.Hour)
+	credential, err := p.Issue("binding-1", "reviews.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Issue("binding-2", "ratings.default"); err != nil {
+		t.Fatal(err)
+	}
+
+	*now = now.Add(time.Hour)
+	if due, err := p.Due(); err != nil || len(due) != 0 {
+		t.Errorf("Due before renewal => got %v, %v, want none", due, err)
+	}
+	// a certificate issued for another subject replaces the one of binding-2
+	if _, err = p.Issue("binding-2", "details.default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the certificates issued two thirds of their lifetime ago are due
+	*now = now.Add(90 * time.Minute)
+	due, err := p.Due()
+	if err != nil || !reflect.DeepEqual(due, []string{"binding-1"}) {
+		t.Fatalf("Due after renewal => got %v, %v, want [binding-1]", due, err)
+	}
+	rotated, err := p.Rotate("binding-1", "reviews.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated == credential {
+		t.Fatal("Rotate should issue a new certificate")
+	}
+	if _, ok := revocations(t, p)[serialOf(parseCertificate(t, credential).SerialNumber)]; !ok {
+		t.Error("rotated certificate should be revoked")
+	}
+	if due, err = p.Due(); err != nil || len(due) != 0 {
+		t.Errorf("Due after rotation => got %v, %v, want none", due, err)
+	}
+	if again, err := p.Issue("binding-1", "reviews.default"); err != nil || again != rotated {
+		t.Errorf("Issue after rotation => got %v, %v, want the rotated credential", again, err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	p, now := makeProvider(t, time.Hour)
+	credential, err := p.Issue("binding-1", "reviews.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedAt := *now
+	if revoked, errRevoke := p.Revoke("binding-1"); !revoked || errRevoke != nil {
+		t.Errorf("Revoke of an issued binding => got %t, %v, want success", revoked, errRevoke)
+	}
+	if revoked, errRevoke := p.Revoke("binding-1"); revoked || errRevoke != nil {
+		t.Errorf("Revoke of a revoked binding => got %t, %v, want no certificate", revoked, errRevoke)
+	}
+
+	serial := serialOf(parseCertificate(t, credential).SerialNumber)
+	*now = now.Add(10 * time.Minute)
+	if at, ok := revocations(t, p)[serial]; !ok {
+		t.Error("CRL should list the revoked certificate")
+	} else if !at.Equal(revokedAt.Truncate(time.Second)) {
+		t.Errorf("CRL => got revocation time %v, want %v", at, revokedAt)
+	}
+
+	*now = now.Add(2 * time.Hour)
+	if _, ok := revocations(t, p)[serial]; ok {
+		t.Error("CRL should not list expired certificates")
+	}
+	// the expired certificates are removed when the next one is issued
+	if _, err = p.Issue("binding-2", "reviews.default"); err != nil {
+		t.Fatal(err)
+	}
+	if certs, _ := p.certificates(""); len(certs) != 1 {
+		t.Errorf("got %d recorded certificates, want the unexpired one", len(certs))
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	leader, _ := makeProvider(t, time.Hour)
+	credential, err := leader.Issue("binding-1", "reviews.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := serialOf(parseCertificate(t, credential).SerialNumber)
+
+	// a new leader replaces the certificate, whose private key it does not have
+	next := replica(leader)
+	again, err := next.Issue("binding-1", "reviews.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Certificate == credential.Certificate {
+		t.Error("issuing from another replica should return a new credential")
+	}
+	follower := replica(leader)
+	if _, ok := revocations(t, follower)[serial]; !ok {
+		t.Error("CRL of a follower should list the certificate replaced by the new leader")
+	}
+
+	if revoked, errRevoke := leader.Revoke("binding-1"); !revoked || errRevoke != nil {
+		t.Errorf("Revoke of a certificate issued by another replica => got %t, %v, want success", revoked, errRevoke)
+	}
+	if _, ok := revocations(t, follower)[serialOf(parseCertificate(t, again).SerialNumber)]; !ok {
+		t.Error("CRL of a follower should list the certificate revoked by the leader")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	multierror "github.com/hashicorp/go-multierror"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+)
+
+const (
+	// SecretFormatAnnotation on a service class names the format of the
+	// secrets holding the credentials of its bindings
+	SecretFormatAnnotation = "credentials.broker.istio.io/secret-format"
+
+	// DefaultSecretFormat stores each credential field under its own key
+	DefaultSecretFormat = "opaque"
+
+	// TLSSecretFormat stores the client certificate as a Kubernetes TLS secret
+	TLSSecretFormat = "tls"
+)
+
+// SecretFormat renders the credentials of a binding as the type and data of a secret
+type SecretFormat interface {
+	Secret(credential *osb.BindingCredential) (v1.SecretType, map[string][]byte, error)
+}
+
+// SecretFormatFunc adapts a function to a secret format
+type SecretFormatFunc func(credential *osb.BindingCredential) (v1.SecretType, map[string][]byte, error)
+
+// Secret calls the function
+func (f SecretFormatFunc) Secret(credential *osb.BindingCredential) (v1.SecretType, map[string][]byte, error) {
+	return f(credential)
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[string]SecretFormat{
+		DefaultSecretFormat: SecretFormatFunc(opaqueSecret),
+		TLSSecretFormat:     SecretFormatFunc(tlsSecret),
+	}
+)
+
+// RegisterSecretFormat makes a secret format available to service classes by name
+func RegisterSecretFormat(name string, format SecretFormat) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats[name] = format
+}
+
+// LookupSecretFormat finds a secret format by name. An empty name selects the default format.
+func LookupSecretFormat(name string) (SecretFormat, error) {
+	if name == "" {
+		name = DefaultSecretFormat
+	}
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	format, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown secret format %q", name)
+	}
+	return format, nil
+}
+
+// opaqueSecret stores the values and the fields of the credentials under their JSON names
+func opaqueSecret(credential *osb.BindingCredential) (v1.SecretType, map[string][]byte, error) {
+	data := make(map[string][]byte, len(credential.Values)+6)
+	for key, value := range credential.Values {
+		data[key] = []byte(value)
+	}
+	if credential.Service != "" {
+		data["service"] = []byte(credential.Service)
+		data["namespace"] = []byte(credential.Namespace)
+	}
+	if tls := credential.Credential; tls != nil {
+		data["certificate"] = []byte(tls.Certificate)
+		data["private_key"] = []byte(tls.PrivateKey)
+		data["ca_certificate"] = []byte(tls.CACertificate)
+		data["expiration"] = []byte(tls.Expiration)
+	}
+	return v1.SecretTypeOpaque, data, nil
+}
+
+// tlsSecret stores the client certificate under the keys of Kubernetes TLS secrets
+func tlsSecret(credential *osb.BindingCredential) (v1.SecretType, map[string][]byte, error) {
+	tls := credential.Credential
+	if tls == nil {
+		return "", nil, errors.New("TLS secrets require a client certificate")
+	}
+	return v1.SecretTypeTLS, map[string][]byte{
+		v1.TLSCertKey:       []byte(tls.Certificate),
+		v1.TLSPrivateKeyKey: []byte(tls.PrivateKey),
+		"ca.crt":            []byte(tls.CACertificate),
+		"service":           []byte(credential.Service),
+		"namespace":         []byte(credential.Namespace),
+	}, nil
+}
+
+// SecretStore keeps the credentials of bindings in Kubernetes secrets, so
+// that they survive the platform failing before it receives the bind response.
+type SecretStore struct {
+	client kubernetes.Interface
+}
+
+// NewSecretStore creates a store of binding secrets
+func NewSecretStore(client kubernetes.Interface) *SecretStore {
+	return &SecretStore{client: client}
+}
+
+// Write creates or updates the secret of a binding in a namespace and returns
+// a reference to it. Existing secrets not written for the binding are kept.
+func (s *SecretStore) Write(binding, instance, namespace string, format SecretFormat,
+	credential *osb.BindingCredential) (*osb.SecretReference, error) {
+	typ, data, err := format.Secret(credential)
+	if err != nil {
+		return nil, err
+	}
+	secret := &v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      config.ObjectName("binding-", binding),
+			Namespace: namespace,
+			Labels: map[string]string{
+				config.BindingLabel:  config.LabelValue(binding),
+				config.InstanceLabel: config.LabelValue(instance),
+			},
+			Annotations: map[string]string{
+				config.BindingIDAnnotation:  binding,
+				config.InstanceIDAnnotation: instance,
+			},
+		},
+		Type: typ,
+		Data: data,
+	}
+
+	secrets := s.client.CoreV1().Secrets(namespace)
+	existing, err := secrets.Get(secret.Name, meta_v1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		glog.V(2).Infof("creating secret %s/%s for binding %q", namespace, secret.Name, binding)
+		_, err = secrets.Create(secret)
+	case err == nil:
+		// the namespace and the name come from the platform, so that only the
+		// secrets of the binding are overwritten
+		if !ownedBy(existing, binding) {
+			return nil, fmt.Errorf("secret %s/%s exists and is not owned by binding %q", namespace, secret.Name, binding)
+		}
+		if existing.Type != secret.Type {
+			return nil, fmt.Errorf("secret %s/%s exists with type %q", namespace, secret.Name, existing.Type)
+		}
+		glog.V(2).Infof("updating secret %s/%s for binding %q", namespace, secret.Name, binding)
+		secret.ResourceVersion = existing.ResourceVersion
+		_, err = secrets.Update(secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &osb.SecretReference{Name: secret.Name, Namespace: namespace}, nil
+}
+
+// ownedBy reports whether a secret was written for a binding
+func ownedBy(secret *v1.Secret, binding string) bool {
+	return secret.Labels[config.BindingLabel] == config.LabelValue(binding) &&
+		secret.Annotations[config.BindingIDAnnotation] == binding
+}
+
+// Delete removes the secrets of a binding and reports whether any was found
+func (s *SecretStore) Delete(binding string) (bool, error) {
+	list, err := s.client.CoreV1().Secrets(meta_v1.NamespaceAll).List(meta_v1.ListOptions{
+		LabelSelector: config.BindingLabel + "=" + config.LabelValue(binding),
+	})
+	if err != nil {
+		return false, err
+	}
+	var errs error
+	for _, secret := range list.Items {
+		glog.V(2).Infof("deleting secret %s/%s of binding %q", secret.Namespace, secret.Name, binding)
+		err = s.client.CoreV1().Secrets(secret.Namespace).Delete(secret.Name, &meta_v1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = multierror.Append(errs, fmt.Errorf("%s/%s: %v", secret.Namespace, secret.Name, err))
+		}
+	}
+	return len(list.Items) > 0, errs
+}
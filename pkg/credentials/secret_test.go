@@ -0,0 +1,145 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"istio.io/broker/pkg/model/osb"
+)
+
+func TestSecretFormats(t *testing.T) {
+	credential := &osb.BindingCredential{
+		Service:   "productpage",
+		Namespace: "default",
+		Credential: &osb.Credential{
+			Certificate:   "cert",
+			PrivateKey:    "key",
+			CACertificate: "ca",
+			Expiration:    "2017-10-01T00:00:00Z",
+		},
+	}
+	cases := []struct {
+		format  string
+		typ     v1.SecretType
+		key     string
+		want    string
+		invalid bool
+	}{
+		{format: "", typ: v1.SecretTypeOpaque, key: "private_key", want: "key"},
+		{format: DefaultSecretFormat, typ: v1.SecretTypeOpaque, key: "service", want: "productpage"},
+		{format: TLSSecretFormat, typ: v1.SecretTypeTLS, key: v1.TLSCertKey, want: "cert"},
+		{format: "custom", typ: "broker.istio.io/custom", key: "endpoint", want: "productpage.default"},
+		{format: "missing", invalid: true},
+	}
+	RegisterSecretFormat("custom", SecretFormatFunc(
+		func(credential *osb.BindingCredential) (v1.SecretType, map[string][]byte, error) {
+			return "broker.istio.io/custom", map[string][]byte{
+				"endpoint": []byte(credential.Service + "." + credential.Namespace),
+			}, nil
+		}))
+
+	for _, c := range cases {
+		format, err := LookupSecretFormat(c.format)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("LookupSecretFormat(%q) should fail", c.format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("LookupSecretFormat(%q) => unexpected error %v", c.format, err)
+			continue
+		}
+		typ, data, err := format.Secret(credential)
+		if err != nil || typ != c.typ || string(data[c.key]) != c.want {
+			t.Errorf("format %q => got %q, %q=%q, %v, want %q, %q=%q",
+				c.format, typ, c.key, data[c.key], err, c.typ, c.key, c.want)
+		}
+	}
+
+	format, _ := LookupSecretFormat(TLSSecretFormat)
+	if _, _, err := format.Secret(&osb.BindingCredential{Service: "productpage"}); err == nil {
+		t.Error("TLS secrets without a certificate should fail")
+	}
+}
+
+func TestSecretStore(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := NewSecretStore(client)
+	format, err := LookupSecretFormat(DefaultSecretFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential := &osb.BindingCredential{Service: "productpage", Namespace: "default"}
+	ref, err := store.Write("Binding-1", "instance-1", "bookinfo", format, credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Name != "binding-binding-1" || ref.Namespace != "bookinfo" {
+		t.Errorf("Write => got reference %+v", ref)
+	}
+
+	credential.Service = "reviews"
+	if _, err = store.Write("Binding-1", "instance-1", "bookinfo", format, credential); err != nil {
+		t.Fatalf("Write again => unexpected error %v", err)
+	}
+	secret, err := client.CoreV1().Secrets("bookinfo").Get(ref.Name, meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["service"]) != "reviews" {
+		t.Errorf("Write again => got service %q, want the updated credentials", secret.Data["service"])
+	}
+
+	// the secrets written for other bindings or by others are kept
+	if _, err = store.Write("binding-1", "instance-1", "bookinfo", format, credential); err == nil {
+		t.Error("Write of a binding with the same secret name should fail")
+	}
+	if _, err = client.CoreV1().Secrets("bookinfo").Create(&v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "binding-binding-2", Namespace: "bookinfo"},
+		Type:       v1.SecretTypeOpaque,
+		Data:       map[string][]byte{"password": []byte("secret")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Write("binding-2", "instance-1", "bookinfo", format, credential); err == nil {
+		t.Error("Write over a secret of another owner should fail")
+	}
+	other, err := client.CoreV1().Secrets("bookinfo").Get("binding-binding-2", meta_v1.GetOptions{})
+	if err != nil || string(other.Data["password"]) != "secret" {
+		t.Errorf("Write over a secret of another owner => got %v, %v, want the secret unchanged", other, err)
+	}
+
+	tls, _ := LookupSecretFormat(TLSSecretFormat)
+	credential.Credential = &osb.Credential{Certificate: "cert", PrivateKey: "key"}
+	if _, err = store.Write("Binding-1", "instance-1", "bookinfo", tls, credential); err == nil {
+		t.Error("Write with another secret type should fail")
+	}
+
+	found, err := store.Delete("Binding-1")
+	if err != nil || !found {
+		t.Errorf("Delete => got %t, %v, want true", found, err)
+	}
+	found, err = store.Delete("Binding-1")
+	if err != nil || found {
+		t.Errorf("Delete again => got %t, %v, want false", found, err)
+	}
+}
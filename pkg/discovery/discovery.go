@@ -0,0 +1,285 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery synthesizes the service classes and plans of Kubernetes
+// services annotated for the broker catalog. The generated objects are
+// labeled with their service, so that they are updated with the service and
+// removed once the service or its annotations are gone.
+package discovery
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	multierror "github.com/hashicorp/go-multierror"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/model/config"
+)
+
+// Annotations of the Kubernetes services published in the catalog
+const (
+	// NameAnnotation is the catalog name of the service class. Services
+	// without the annotation are not published.
+	NameAnnotation = "catalog.broker.istio.io/name"
+
+	// DescriptionAnnotation is the catalog description of the service class
+	DescriptionAnnotation = "catalog.broker.istio.io/description"
+
+	// IDAnnotation overrides the catalog id of the service class. By default
+	// the id is derived from the namespace and name of the service.
+	IDAnnotation = "catalog.broker.istio.io/id"
+
+	// PlansAnnotation lists the names of the plans of the service class,
+	// e.g. "free,premium". A single "default" plan is generated by default.
+	PlansAnnotation = "catalog.broker.istio.io/plans"
+
+	// ServiceLabel marks the generated service classes and plans with the name
+	// of their Kubernetes service
+	ServiceLabel = "discovery.broker.istio.io/service"
+
+	// defaultPlan is the plan of services without the plans annotation
+	defaultPlan = "default"
+)
+
+// Discovery modes
+const (
+	// MemoryMode keeps the generated catalog objects in memory
+	MemoryMode = "memory"
+
+	// CRDMode writes the generated catalog objects as CRDs
+	CRDMode = "crd"
+)
+
+// planName matches the plan names usable in object names
+var planName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Generate creates the service class and plans published for a service, or
+// nothing if the service is not annotated for the catalog
+func Generate(service *v1.Service) ([]config.Entry, error) {
+	name, ok := service.Annotations[NameAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%s/%s: empty %s", service.Namespace, service.Name, NameAnnotation)
+	}
+	id := service.Annotations[IDAnnotation]
+	if id == "" {
+		id = nameUUID(service.Namespace, service.Name)
+	}
+	plans := []string{defaultPlan}
+	if value, exists := service.Annotations[PlansAnnotation]; exists {
+		plans = nil
+		for _, plan := range strings.Split(value, ",") {
+			plan = strings.TrimSpace(plan)
+			if !planName.MatchString(plan) {
+				return nil, fmt.Errorf("%s/%s: invalid plan %q in %s",
+					service.Namespace, service.Name, plan, PlansAnnotation)
+			}
+			plans = append(plans, plan)
+		}
+	}
+
+	meta := func(schema config.Schema, name string) config.Meta {
+		return config.Meta{
+			Type:      schema.Type,
+			Name:      name,
+			Namespace: service.Namespace,
+			Labels:    map[string]string{ServiceLabel: service.Name},
+		}
+	}
+	class := config.Entry{
+		Meta: meta(config.ServiceClass, "discovered-"+service.Name),
+		Spec: &brokerconfig.ServiceClass{
+			Deployment: &brokerconfig.Deployment{Instance: service.Name},
+			Entry: &brokerconfig.CatalogEntry{
+				Name:        name,
+				Id:          id,
+				Description: service.Annotations[DescriptionAnnotation],
+			},
+		},
+	}
+	out := []config.Entry{class}
+	for _, plan := range plans {
+		out = append(out, config.Entry{
+			Meta: meta(config.ServicePlan, "discovered-"+service.Name+"-"+plan),
+			Spec: &brokerconfig.ServicePlan{
+				Plan: &brokerconfig.CatalogPlan{
+					Name:        plan,
+					Id:          nameUUID(id, plan),
+					Description: fmt.Sprintf("%s plan of %s", plan, name),
+				},
+				Services: []string{class.Key()},
+			},
+		})
+	}
+	return out, nil
+}
+
+// nameUUID derives a stable UUID in the format of name-based UUIDs from names
+func nameUUID(names ...string) string {
+	sum := sha1.Sum([]byte("broker.istio.io/" + strings.Join(names, "/")))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// Discoverer watches the Kubernetes services and keeps the generated catalog
+// objects of a config store in sync with them. The store holds the objects in
+// memory or as CRDs.
+type Discoverer struct {
+	target    config.Store
+	namespace string
+	informer  cache.SharedIndexInformer
+}
+
+// NewDiscoverer creates a discoverer of the services in a namespace writing to
+// a store. Use "" for the namespace to discover the services of all namespaces.
+func NewDiscoverer(client kubernetes.Interface, target config.Store, namespace string,
+	resync time.Duration) *Discoverer {
+	services := client.CoreV1().Services(namespace)
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(opts meta_v1.ListOptions) (runtime.Object, error) {
+				return services.List(opts)
+			},
+			WatchFunc: func(opts meta_v1.ListOptions) (watch.Interface, error) {
+				return services.Watch(opts)
+			},
+		},
+		&v1.Service{},
+		resync,
+		cache.Indexers{})
+	return &Discoverer{
+		target:    target,
+		namespace: namespace,
+		informer:  informer,
+	}
+}
+
+// Run watches the services and synchronizes the catalog after each change until stop is closed
+func (d *Discoverer) Run(stop <-chan struct{}) {
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	d.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	})
+	go d.informer.Run(stop)
+	if !cache.WaitForCacheSync(stop, d.informer.HasSynced) {
+		glog.Error("Unable to sync the service cache")
+		return
+	}
+
+	// remove the objects of the services deleted while the broker was down
+	notify()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-changed:
+			var services []*v1.Service
+			for _, obj := range d.informer.GetStore().List() {
+				services = append(services, obj.(*v1.Service))
+			}
+			if err := d.Sync(services); err != nil {
+				glog.Warningf("catalog discovery: %v", err)
+			}
+		}
+	}
+}
+
+// Sync converges the generated catalog objects of the store to the services.
+// Objects of services that are removed or no longer annotated are deleted,
+// and the objects written by hand are never modified.
+func (d *Discoverer) Sync(services []*v1.Service) error {
+	var errs error
+	desired := make(map[string]config.Entry)
+	// the objects of services with invalid annotations are left unchanged
+	invalid := make(map[string]bool)
+	for _, service := range services {
+		entries, err := Generate(service)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			invalid[service.Namespace+"/"+service.Name] = true
+			continue
+		}
+		for _, entry := range entries {
+			desired[entry.Key()] = entry
+		}
+	}
+
+	opts := config.ListOptions{Namespace: d.namespace, LabelSelector: ServiceLabel}
+	existing := make(map[string]config.Entry)
+	for _, schema := range []config.Schema{config.ServiceClass, config.ServicePlan} {
+		entries, err := d.target.ListWithOptions(schema.Type, opts)
+		if err != nil {
+			return multierror.Append(errs, err)
+		}
+		for _, entry := range entries {
+			existing[entry.Key()] = entry
+		}
+	}
+
+	for key, entry := range desired {
+		old, exists := existing[key]
+		delete(existing, key)
+		var err error
+		switch {
+		case !exists:
+			glog.V(2).Infof("creating %s for service %s/%s", key, entry.Namespace, entry.Labels[ServiceLabel])
+			_, err = d.target.Create(entry)
+		case !proto.Equal(old.Spec, entry.Spec) || !reflect.DeepEqual(old.Labels, entry.Labels):
+			glog.V(2).Infof("updating %s for service %s/%s", key, entry.Namespace, entry.Labels[ServiceLabel])
+			entry.ResourceVersion = old.ResourceVersion
+			// keep the annotations added to the objects, e.g. the quota of a plan,
+			// and the finalizers of the broker
+			entry.Annotations = old.Annotations
+			entry.Finalizers = old.Finalizers
+			_, err = d.target.Update(entry)
+		}
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", key, err))
+		}
+	}
+	for key, entry := range existing {
+		if invalid[entry.Namespace+"/"+entry.Labels[ServiceLabel]] {
+			continue
+		}
+		glog.V(2).Infof("deleting %s of service %s/%s", key, entry.Namespace, entry.Labels[ServiceLabel])
+		if err := d.target.Delete(entry.Type, entry.Name, entry.Namespace); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", key, err))
+		}
+	}
+	return errs
+}
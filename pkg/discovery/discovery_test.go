@@ -0,0 +1,149 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/platform/memory"
+)
+
+func makeService(name string, annotations map[string]string) *v1.Service {
+	return &v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations}}
+}
+
+func TestGenerate(t *testing.T) {
+	entries, err := Generate(makeService("productpage", map[string]string{
+		NameAnnotation:        "bookinfo-productpage",
+		DescriptionAnnotation: "A book info service",
+		PlansAnnotation:       "free, premium",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Generate() => got %d object(s), want 3", len(entries))
+	}
+	class := entries[0].Spec.(*brokerconfig.ServiceClass)
+	if entries[0].Key() != "service-class/default/discovered-productpage" ||
+		class.GetDeployment().GetInstance() != "productpage" || class.GetEntry().GetName() != "bookinfo-productpage" {
+		t.Errorf("Generate() => got class %s %v", entries[0].Key(), class)
+	}
+	for i, name := range []string{"free", "premium"} {
+		entry := entries[i+1]
+		plan := entry.Spec.(*brokerconfig.ServicePlan)
+		if entry.Name != "discovered-productpage-"+name || plan.GetPlan().GetName() != name ||
+			len(plan.Services) != 1 || plan.Services[0] != entries[0].Key() {
+			t.Errorf("Generate() => got plan %s %v", entry.Key(), plan)
+		}
+	}
+	for _, entry := range entries {
+		if entry.Labels[ServiceLabel] != "productpage" {
+			t.Errorf("Generate() => got labels %v on %s", entry.Labels, entry.Key())
+		}
+	}
+
+	// ids are stable
+	again, _ := Generate(makeService("productpage", map[string]string{NameAnnotation: "bookinfo-productpage"}))
+	if id := again[0].Spec.(*brokerconfig.ServiceClass).GetEntry().GetId(); id != class.GetEntry().GetId() {
+		t.Errorf("Generate() => got id %q, want %q", id, class.GetEntry().GetId())
+	}
+	if len(again) != 2 || again[1].Name != "discovered-productpage-default" {
+		t.Errorf("Generate() without plans => got %v, want the default plan", again)
+	}
+
+	if entries, err = Generate(makeService("reviews", nil)); err != nil || len(entries) != 0 {
+		t.Errorf("Generate() without annotations => got %v, %v", entries, err)
+	}
+	if _, err = Generate(makeService("reviews", map[string]string{NameAnnotation: "reviews",
+		PlansAnnotation: "Gold Plan"})); err == nil {
+		t.Error("Generate() with an invalid plan => got no error")
+	}
+}
+
+func TestSync(t *testing.T) {
+	store := memory.Make(config.BrokerConfigTypes)
+	d := &Discoverer{target: store}
+	count := func(schema config.Schema) int {
+		l, _ := store.List(schema.Type, "")
+		return len(l)
+	}
+
+	// objects written by hand are left alone
+	manual := config.Entry{
+		Meta: config.Meta{Type: config.ServiceClass.Type, Name: "manual", Namespace: "default"},
+		Spec: &brokerconfig.ServiceClass{Entry: &brokerconfig.CatalogEntry{Name: "manual", Id: "manual-id"}},
+	}
+	if _, err := store.Create(manual); err != nil {
+		t.Fatal(err)
+	}
+
+	productpage := makeService("productpage", map[string]string{NameAnnotation: "productpage", PlansAnnotation: "a,b"})
+	reviews := makeService("reviews", map[string]string{NameAnnotation: "reviews"})
+	if err := d.Sync([]*v1.Service{productpage, reviews, makeService("ratings", nil)}); err != nil {
+		t.Fatal(err)
+	}
+	if count(config.ServiceClass) != 3 || count(config.ServicePlan) != 3 {
+		t.Errorf("Sync() => got %d class(es) and %d plan(s), want 3 and 3",
+			count(config.ServiceClass), count(config.ServicePlan))
+	}
+
+	// annotations added to the generated objects survive updates
+	plan, _ := store.Get(config.ServicePlan.Type, "discovered-productpage-a", "default")
+	plan.Annotations = map[string]string{"quota.broker.istio.io/requests-per-second": "10"}
+	if _, err := store.Update(*plan); err != nil {
+		t.Fatal(err)
+	}
+	productpage.Annotations[DescriptionAnnotation] = "updated"
+	productpage.Annotations[PlansAnnotation] = "a"
+	if err := d.Sync([]*v1.Service{productpage, reviews}); err != nil {
+		t.Fatal(err)
+	}
+	class, _ := store.Get(config.ServiceClass.Type, "discovered-productpage", "default")
+	if class.Spec.(*brokerconfig.ServiceClass).GetEntry().GetDescription() != "updated" {
+		t.Errorf("Sync() => got class %v, want updated description", class.Spec)
+	}
+	if plan, _ = store.Get(config.ServicePlan.Type, "discovered-productpage-a", "default"); len(plan.Annotations) != 1 {
+		t.Errorf("Sync() => got plan annotations %v", plan.Annotations)
+	}
+	if count(config.ServicePlan) != 2 {
+		t.Errorf("Sync() => got %d plan(s), want 2", count(config.ServicePlan))
+	}
+
+	// invalid annotations keep the objects of the service
+	productpage.Annotations[PlansAnnotation] = "Invalid Plan"
+	if err := d.Sync([]*v1.Service{productpage}); err == nil {
+		t.Error("Sync() with invalid annotations => got no error")
+	}
+	if count(config.ServiceClass) != 2 || count(config.ServicePlan) != 1 {
+		t.Errorf("Sync() => got %d class(es) and %d plan(s), want 2 and 1",
+			count(config.ServiceClass), count(config.ServicePlan))
+	}
+
+	if err := d.Sync(nil); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := store.List(config.ServiceClass.Type, ""); len(l) != 1 || l[0].Name != "manual" {
+		t.Errorf("Sync() without services => got %v, want the manual class", l)
+	}
+	if count(config.ServicePlan) != 0 {
+		t.Errorf("Sync() without services => got %d plan(s) left", count(config.ServicePlan))
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package election elects a leader among the replicas of the broker with a
+// Kubernetes Lease. All replicas serve the reads of the OSB API, while the
+// leader alone executes the operations and runs the reconciliation loops.
+package election
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// LeaseName is the name of the Lease held by the leader
+	LeaseName = "istio-broker"
+
+	// ForwardedHeader marks the requests forwarded to the leader, so that
+	// they are not forwarded again while the leadership changes hands
+	ForwardedHeader = "X-Broker-Forwarded-By"
+)
+
+// Config of the leader election
+type Config struct {
+	// Namespace of the Lease
+	Namespace string
+
+	// Identity of the replica, the host:port address at which the other
+	// replicas forward the requests to the replica while it leads
+	Identity string
+
+	// LeaseDuration is the time the followers wait before taking over a lease that is not renewed
+	LeaseDuration time.Duration
+
+	// RenewDeadline is the time the leader retries renewing the lease before giving up the leadership
+	RenewDeadline time.Duration
+
+	// RetryPeriod is the interval between the attempts to acquire or renew the lease
+	RetryPeriod time.Duration
+
+	// TLS verifies the serving certificate of the leader, to which the
+	// followers forward the requests over HTTPS. The requests carry the
+	// originating identity of the platform and the responses the private keys
+	// of the bindings, so they are only forwarded over plain HTTP if nil and
+	// MeshMTLS is set.
+	TLS *tls.Config
+
+	// MeshMTLS states that the replicas run inside a service mesh enforcing
+	// mutual TLS between them, which encrypts the forwarded requests
+	MeshMTLS bool
+}
+
+// DefaultConfig hands over the leadership within seconds of a leader failure
+var DefaultConfig = Config{
+	LeaseDuration: 15 * time.Second,
+	RenewDeadline: 10 * time.Second,
+	RetryPeriod:   2 * time.Second,
+}
+
+// Task runs while the replica leads, until stop is closed
+type Task func(stop <-chan struct{})
+
+// Elector takes part in the election of the leader of the replicas
+type Elector struct {
+	config Config
+	lock   resourcelock.Interface
+
+	// transport forwards the requests to the leader
+	transport http.RoundTripper
+
+	mu     sync.RWMutex
+	leader string
+	tasks  []Task
+}
+
+// NewElector creates an elector holding the lease with a Kubernetes client
+func NewElector(client kubernetes.Interface, config Config) (*Elector, error) {
+	if config.Identity == "" {
+		return nil, fmt.Errorf("missing identity of the replica")
+	}
+	if config.RenewDeadline >= config.LeaseDuration || config.RetryPeriod >= config.RenewDeadline {
+		return nil, fmt.Errorf("retry period %v, renew deadline %v and lease duration %v must increase",
+			config.RetryPeriod, config.RenewDeadline, config.LeaseDuration)
+	}
+	if config.TLS == nil && !config.MeshMTLS {
+		return nil, fmt.Errorf("forwarding the requests to the leader requires TLS or the mutual TLS of a mesh")
+	}
+	return &Elector{
+		config: config,
+		lock: &resourcelock.LeaseLock{
+			LeaseMeta:  meta_v1.ObjectMeta{Name: LeaseName, Namespace: config.Namespace},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: config.Identity},
+		},
+		transport: forwardTransport(config.TLS),
+	}, nil
+}
+
+// forwardTransport returns the transport of the requests forwarded to the leader
+func forwardTransport(config *tls.Config) http.RoundTripper {
+	if config == nil {
+		return http.DefaultTransport
+	}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     config,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// scheme of the requests forwarded to the leader
+func (e *Elector) scheme() string {
+	if e.config.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// OnLeading registers a task started whenever the replica becomes the
+// leader and stopped as soon as it loses the leadership
+func (e *Elector) OnLeading(task Task) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tasks = append(e.tasks, task)
+}
+
+// Leader returns the identity of the current leader, if known
+func (e *Elector) Leader() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader
+}
+
+// IsLeader tells whether the replica leads. A nil elector always leads, as
+// the single replica of the broker.
+func (e *Elector) IsLeader() bool {
+	if e == nil {
+		return true
+	}
+	return e.Leader() == e.config.Identity
+}
+
+func (e *Elector) setLeader(identity string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leader = identity
+}
+
+// Run campaigns for the leadership until stop is closed. A replica losing
+// the leadership stops its tasks and campaigns again. The lease is released
+// on stop, so that another replica takes over without waiting for it to expire.
+func (e *Elector) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            e.lock,
+		LeaseDuration:   e.config.LeaseDuration,
+		RenewDeadline:   e.config.RenewDeadline,
+		RetryPeriod:     e.config.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: e.lead,
+			OnStoppedLeading: func() {
+				glog.Infof("Replica %q stopped leading", e.config.Identity)
+				e.setLeader("")
+			},
+			OnNewLeader: func(identity string) {
+				glog.Infof("Replica %q leads", identity)
+				e.setLeader(identity)
+			},
+		},
+		Name: LeaseName,
+	})
+	if err != nil {
+		glog.Errorf("Unable to run the leader election: %v", err)
+		return
+	}
+	for {
+		le.Run(ctx)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// lead runs the tasks until the leadership is lost
+func (e *Elector) lead(ctx context.Context) {
+	glog.Infof("Replica %q started leading", e.config.Identity)
+	e.setLeader(e.config.Identity)
+	e.mu.RLock()
+	tasks := append([]Task(nil), e.tasks...)
+	e.mu.RUnlock()
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task Task) {
+			defer wg.Done()
+			task(ctx.Done())
+		}(task)
+	}
+	wg.Wait()
+}
+
+// Forward serves a request with next on the leader and forwards it to the
+// leader on the followers, over HTTPS if the elector has a TLS config.
+// Requests are served directly without an elector.
+func Forward(e *Elector, next http.HandlerFunc) http.HandlerFunc {
+	if e == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if e.IsLeader() {
+			next(w, r)
+			return
+		}
+		leader := e.Leader()
+		if leader == "" || r.Header.Get(ForwardedHeader) != "" {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(e.config.RetryPeriod.Seconds())+1))
+			http.Error(w, "no leader elected among the broker replicas", http.StatusServiceUnavailable)
+			return
+		}
+		glog.V(2).Infof("Forwarding %s %s to leader %q", r.Method, r.URL.Path, leader)
+		r.Header.Set(ForwardedHeader, e.config.Identity)
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: e.scheme(), Host: leader})
+		proxy.Transport = e.transport
+		proxy.ServeHTTP(w, r)
+	}
+}
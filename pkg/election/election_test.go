@@ -0,0 +1,201 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package election
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var testConfig = Config{
+	Namespace:     "istio-system",
+	Identity:      "10.0.0.1:9091",
+	LeaseDuration: time.Second,
+	RenewDeadline: 500 * time.Millisecond,
+	RetryPeriod:   100 * time.Millisecond,
+	MeshMTLS:      true,
+}
+
+func TestNewElector(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	if _, err := NewElector(client, Config{LeaseDuration: time.Second}); err == nil {
+		t.Error("expected an error for a missing identity")
+	}
+	cfg := testConfig
+	cfg.RenewDeadline = cfg.LeaseDuration
+	if _, err := NewElector(client, cfg); err == nil {
+		t.Error("expected an error for a renew deadline as long as the lease")
+	}
+	cfg = testConfig
+	cfg.MeshMTLS = false
+	if _, err := NewElector(client, cfg); err == nil {
+		t.Error("expected an error for forwarding over plain HTTP outside a mesh")
+	}
+	cfg.TLS = &tls.Config{}
+	if _, err := NewElector(client, cfg); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewElector(client, testConfig); err != nil {
+		t.Error(err)
+	}
+	var e *Elector
+	if !e.IsLeader() {
+		t.Error("a single replica without elector must lead")
+	}
+}
+
+func TestRun(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	e, err := NewElector(client, testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	e.OnLeading(func(stop <-chan struct{}) {
+		close(started)
+		<-stop
+		close(stopped)
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		e.Run(stop)
+		close(done)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replica did not start leading")
+	}
+	if !e.IsLeader() || e.Leader() != testConfig.Identity {
+		t.Errorf("got leader %q, want %q", e.Leader(), testConfig.Identity)
+	}
+	lease, err := client.CoordinationV1().Leases(testConfig.Namespace).Get(LeaseName, meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := lease.Spec.HolderIdentity; holder == nil || *holder != testConfig.Identity {
+		t.Errorf("got lease holder %v, want %q", holder, testConfig.Identity)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("election did not stop")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task did not stop")
+	}
+	// the lease is released for a fast handover
+	lease, err = client.CoordinationV1().Leases(testConfig.Namespace).Get(LeaseName, meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder == testConfig.Identity {
+		t.Errorf("lease still held by %q", *holder)
+	}
+}
+
+func TestForward(t *testing.T) {
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ForwardedHeader) != testConfig.Identity {
+			t.Errorf("got %s %q, want %q", ForwardedHeader, r.Header.Get(ForwardedHeader), testConfig.Identity)
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("leader"))
+	}))
+	defer leader.Close()
+	local := func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("local"))
+	}
+
+	serve := func(handler http.HandlerFunc, forwarded bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/v2/service_instances/instance-1", strings.NewReader("{}"))
+		if forwarded {
+			req.Header.Set(ForwardedHeader, "10.0.0.3:9091")
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	if w := serve(Forward(nil, local), false); w.Body.String() != "local" {
+		t.Errorf("got %q without elector, want the local response", w.Body.String())
+	}
+
+	e := &Elector{config: testConfig}
+	if w := serve(Forward(e, local), false); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d without leader, want %d with Retry-After", w.Code, http.StatusServiceUnavailable)
+	}
+
+	e.setLeader(strings.TrimPrefix(leader.URL, "http://"))
+	if w := serve(Forward(e, local), false); w.Code != http.StatusCreated || w.Body.String() != "leader" {
+		t.Errorf("got %d (%s) on a follower, want the response of the leader", w.Code, w.Body.String())
+	}
+	if w := serve(Forward(e, local), true); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d for a forwarded request, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	e.setLeader(testConfig.Identity)
+	if w := serve(Forward(e, local), true); w.Body.String() != "local" {
+		t.Errorf("got %q on the leader, want the local response", w.Body.String())
+	}
+}
+
+func TestForwardTLS(t *testing.T) {
+	leader := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("leader"))
+	}))
+	defer leader.Close()
+	local := func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("local"))
+	}
+	serve := func(e *Elector) *httptest.ResponseRecorder {
+		e.setLeader(strings.TrimPrefix(leader.URL, "https://"))
+		w := httptest.NewRecorder()
+		Forward(e, local)(w, httptest.NewRequest("PUT", "/v2/service_instances/instance-1", strings.NewReader("{}")))
+		return w
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leader.Certificate())
+	cfg := testConfig
+	cfg.MeshMTLS = false
+	cfg.TLS = &tls.Config{RootCAs: roots}
+	if w := serve(&Elector{config: cfg, transport: forwardTransport(cfg.TLS)}); w.Code != http.StatusCreated ||
+		w.Body.String() != "leader" {
+		t.Errorf("got %d (%s) over TLS, want the response of the leader", w.Code, w.Body.String())
+	}
+
+	// the certificate of the leader is verified
+	cfg.TLS = &tls.Config{RootCAs: x509.NewCertPool()}
+	if w := serve(&Elector{config: cfg, transport: forwardTransport(cfg.TLS)}); w.Code != http.StatusBadGateway {
+		t.Errorf("got %d (%s) for an untrusted leader, want %d", w.Code, w.Body.String(), http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metering records the lifecycle events of service instances and
+// bindings and computes the usage of each plan by each instance over a period.
+package metering
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"istio.io/broker/pkg/model/config"
+	brokerproto "istio.io/broker/pkg/model/proto"
+)
+
+// EventType is the kind of a metering event
+type EventType string
+
+// Metering events
+const (
+	// Provision records an instance created with a plan
+	Provision EventType = "provision"
+
+	// Update records an instance moved to another plan
+	Update EventType = "update"
+
+	// Deprovision records an instance removed
+	Deprovision EventType = "deprovision"
+
+	// Bind records a binding created
+	Bind EventType = "bind"
+
+	// Unbind records a binding removed
+	Unbind EventType = "unbind"
+)
+
+// Event is a completed change of an instance or binding
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       EventType `json:"type"`
+	InstanceID string    `json:"instance_id"`
+	ServiceID  string    `json:"service_id"`
+	PlanID     string    `json:"plan_id"`
+	BindingID  string    `json:"binding_id,omitempty"`
+}
+
+// Recorder persists metering events
+type Recorder interface {
+	// Record appends an event
+	Record(event Event) error
+
+	// Events lists all recorded events in the order they were recorded
+	Events() ([]Event, error)
+}
+
+// memoryRecorder keeps events in memory
+type memoryRecorder struct {
+	mu     sync.RWMutex
+	events []Event
+}
+
+// NewMemoryRecorder creates a recorder keeping the events in memory, e.g. for tests
+func NewMemoryRecorder() Recorder {
+	return &memoryRecorder{}
+}
+
+func (r *memoryRecorder) Record(event Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *memoryRecorder) Events() ([]Event, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Event(nil), r.events...), nil
+}
+
+// fileRecorder appends events to a file as JSON lines
+type fileRecorder struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileRecorder creates a recorder appending the events to a file, one JSON
+// object per line. The file should be on a persistent volume, since the usage
+// is computed from the whole history of the instances.
+func NewFileRecorder(path string) Recorder {
+	return &fileRecorder{path: path}
+}
+
+func (r *fileRecorder) Record(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (r *fileRecorder) Events() ([]Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := os.Open(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var out []Event
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		var event Event
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", r.path, n, err)
+		}
+		out = append(out, event)
+	}
+	return out, scanner.Err()
+}
+
+// storeRecorder keeps the events as config objects, shared by the replicas
+type storeRecorder struct {
+	store     config.Store
+	namespace string
+}
+
+// NewStoreRecorder creates a recorder keeping the events as config objects in
+// a namespace of a store, so that every replica reports the usage and the
+// events survive a change of leader
+func NewStoreRecorder(store config.Store, namespace string) Recorder {
+	return &storeRecorder{store: store, namespace: namespace}
+}
+
+func (r *storeRecorder) Record(event Event) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	_, err := r.store.Create(config.Entry{
+		Meta: config.Meta{
+			Type:      config.MeteringEvent.Type,
+			Name:      fmt.Sprintf("%s-%d-%s", event.Type, event.Time.UnixNano(), hex.EncodeToString(suffix)),
+			Namespace: r.namespace,
+		},
+		Spec: &brokerproto.MeteringEvent{
+			Time:       event.Time.UTC().Format(time.RFC3339Nano),
+			Type:       string(event.Type),
+			InstanceId: event.InstanceID,
+			ServiceId:  event.ServiceID,
+			PlanId:     event.PlanID,
+			BindingId:  event.BindingID,
+		},
+	})
+	return err
+}
+
+// Events lists the recorded events by time, since the store does not keep
+// the order in which they were recorded
+func (r *storeRecorder) Events() ([]Event, error) {
+	entries, err := r.store.List(config.MeteringEvent.Type, r.namespace)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Event, 0, len(entries))
+	for _, entry := range entries {
+		spec, ok := entry.Spec.(*brokerproto.MeteringEvent)
+		if !ok {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339Nano, spec.Time)
+		if err != nil {
+			return nil, fmt.Errorf("event %q: %v", entry.Name, err)
+		}
+		out = append(out, Event{
+			Time:       at,
+			Type:       EventType(spec.Type),
+			InstanceID: spec.InstanceId,
+			ServiceID:  spec.ServiceId,
+			PlanID:     spec.PlanId,
+			BindingID:  spec.BindingId,
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
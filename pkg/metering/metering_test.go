@@ -0,0 +1,81 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metering
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/platform/memory"
+)
+
+func TestRecorders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "events.log")
+
+	start := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Time: start, Type: Provision, InstanceID: "instance-1", ServiceID: "service", PlanID: "monthly"},
+		{Time: start.Add(time.Hour), Type: Bind, InstanceID: "instance-1", ServiceID: "service", PlanID: "monthly",
+			BindingID: "binding-1"},
+	}
+	store := memory.Make(config.Descriptor{config.MeteringEvent})
+	recorders := map[string]Recorder{
+		"memory": NewMemoryRecorder(),
+		"file":   NewFileRecorder(path),
+		"store":  NewStoreRecorder(store, "istio-system"),
+	}
+	for name, r := range recorders {
+		if got, err := r.Events(); err != nil || len(got) != 0 {
+			t.Errorf("%s: Events() of an empty recorder => got %v, %v", name, got, err)
+		}
+		for _, event := range events {
+			if err := r.Record(event); err != nil {
+				t.Fatalf("%s: Record() => got %v", name, err)
+			}
+		}
+		got, err := r.Events()
+		if err != nil {
+			t.Fatalf("%s: Events() => got %v", name, err)
+		}
+		if !reflect.DeepEqual(got, events) {
+			t.Errorf("%s: Events() => got %v, want %v", name, got, events)
+		}
+	}
+
+	// the file keeps the events of previous runs, and the store shares them with the other replicas
+	if got, err := NewFileRecorder(path).Events(); err != nil || len(got) != len(events) {
+		t.Errorf("Events() after a restart => got %v, %v", got, err)
+	}
+	if got, err := NewStoreRecorder(store, "istio-system").Events(); err != nil || !reflect.DeepEqual(got, events) {
+		t.Errorf("Events() of another replica => got %v, %v", got, err)
+	}
+
+	if err = ioutil.WriteFile(path, []byte("{}\nnot json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewFileRecorder(path).Events(); err == nil {
+		t.Error("Events() of a corrupted file => got no error")
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metering
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Usage is the use of a plan by an instance during a period
+type Usage struct {
+	InstanceID string `json:"instance_id"`
+	ServiceID  string `json:"service_id"`
+	PlanID     string `json:"plan_id"`
+
+	// Start and End of the use of the plan within the period
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Hours the instance was on the plan within the period
+	Hours float64 `json:"hours"`
+
+	// PeakBindings is the largest number of bindings of the instance on the plan within the period
+	PeakBindings int `json:"peak_bindings"`
+}
+
+// UsageReport lists the usage of the plans during a period
+type UsageReport struct {
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Usage []Usage   `json:"usage"`
+}
+
+// segment is the current plan of an instance
+type segment struct {
+	serviceID string
+	planID    string
+	start     time.Time
+	bindings  map[string]bool
+	peak      int
+
+	// last is the time of the last event of the instance
+	last time.Time
+}
+
+// Compute aggregates the events into the usage of each plan by each instance
+// within [from, to). A change of plan starts a new usage, and instances still
+// provisioned at the end of the period are accounted until the end. The
+// usage is sorted by instance and start.
+func Compute(events []Event, from, to time.Time) UsageReport {
+	sorted := append([]Event(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	report := UsageReport{From: from, To: to}
+	segments := make(map[string]*segment)
+	open := func(event Event) *segment {
+		s := &segment{
+			serviceID: event.ServiceID,
+			planID:    event.PlanID,
+			start:     event.Time,
+			bindings:  make(map[string]bool),
+			last:      event.Time,
+		}
+		segments[event.InstanceID] = s
+		return s
+	}
+	// observe accounts the bindings held from the last event of the instance until t
+	observe := func(s *segment, t time.Time) {
+		if t.After(from) && s.last.Before(to) && len(s.bindings) > s.peak {
+			s.peak = len(s.bindings)
+		}
+		s.last = t
+	}
+	closeSegment := func(id string, s *segment, end time.Time) {
+		observe(s, end)
+		start := s.start
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			return
+		}
+		report.Usage = append(report.Usage, Usage{
+			InstanceID:   id,
+			ServiceID:    s.serviceID,
+			PlanID:       s.planID,
+			Start:        start,
+			End:          end,
+			Hours:        end.Sub(start).Hours(),
+			PeakBindings: s.peak,
+		})
+	}
+
+	for _, event := range sorted {
+		if !event.Time.Before(to) {
+			break
+		}
+		s, exists := segments[event.InstanceID]
+		switch event.Type {
+		case Provision:
+			if exists {
+				closeSegment(event.InstanceID, s, event.Time)
+			}
+			open(event)
+		case Update:
+			if !exists {
+				open(event)
+				continue
+			}
+			if event.PlanID == s.planID {
+				continue
+			}
+			closeSegment(event.InstanceID, s, event.Time)
+			// the bindings are kept on the new plan
+			open(event).bindings = s.bindings
+		case Deprovision:
+			if exists {
+				closeSegment(event.InstanceID, s, event.Time)
+				delete(segments, event.InstanceID)
+			}
+		case Bind:
+			if !exists {
+				// instances provisioned before the metering started
+				s = open(event)
+			}
+			observe(s, event.Time)
+			s.bindings[event.BindingID] = true
+			observe(s, event.Time)
+		case Unbind:
+			if exists {
+				observe(s, event.Time)
+				delete(s.bindings, event.BindingID)
+			}
+		}
+	}
+	for id, s := range segments {
+		closeSegment(id, s, to)
+	}
+
+	sort.Slice(report.Usage, func(i, j int) bool {
+		a, b := report.Usage[i], report.Usage[j]
+		if a.InstanceID != b.InstanceID {
+			return a.InstanceID < b.InstanceID
+		}
+		return a.Start.Before(b.Start)
+	})
+	return report
+}
+
+// WriteJSON writes a usage report as a JSON object
+func WriteJSON(w io.Writer, report UsageReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// WriteCSV writes a usage report as CSV with a header row. Times are in RFC 3339 format.
+func WriteCSV(w io.Writer, report UsageReport) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{
+		"instance_id", "service_id", "plan_id", "start", "end", "hours", "peak_bindings",
+	}); err != nil {
+		return err
+	}
+	for _, u := range report.Usage {
+		if err := out.Write([]string{
+			u.InstanceID,
+			u.ServiceID,
+			u.PlanID,
+			u.Start.UTC().Format(time.RFC3339),
+			u.End.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(u.Hours, 'f', 3, 64),
+			strconv.Itoa(u.PeakBindings),
+		}); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metering
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+
+func at(hours int) time.Time {
+	return start.Add(time.Duration(hours) * time.Hour)
+}
+
+func event(hours int, typ EventType, id, plan, binding string) Event {
+	return Event{Time: at(hours), Type: typ, InstanceID: id, ServiceID: "service", PlanID: plan, BindingID: binding}
+}
+
+func TestCompute(t *testing.T) {
+	events := []Event{
+		event(2, Provision, "instance-1", "monthly", ""),
+		event(3, Bind, "instance-1", "monthly", "binding-1"),
+		event(4, Bind, "instance-1", "monthly", "binding-2"),
+		event(5, Unbind, "instance-1", "monthly", "binding-1"),
+		event(10, Update, "instance-1", "yearly", ""),
+		event(12, Update, "instance-1", "yearly", ""),
+		event(20, Deprovision, "instance-1", "yearly", ""),
+		event(20, Unbind, "instance-1", "yearly", "binding-2"),
+		// out of order
+		event(6, Provision, "instance-2", "monthly", ""),
+		event(-10, Provision, "instance-3", "monthly", ""),
+		event(-5, Deprovision, "instance-3", "monthly", ""),
+		event(30, Provision, "instance-4", "monthly", ""),
+	}
+	usage := func(id, plan string, from, to, peak int) Usage {
+		return Usage{
+			InstanceID:   id,
+			ServiceID:    "service",
+			PlanID:       plan,
+			Start:        at(from),
+			End:          at(to),
+			Hours:        float64(to - from),
+			PeakBindings: peak,
+		}
+	}
+
+	cases := []struct {
+		name     string
+		from, to int
+		want     []Usage
+	}{
+		{"whole history", -24, 48, []Usage{
+			usage("instance-1", "monthly", 2, 10, 2),
+			usage("instance-1", "yearly", 10, 20, 1),
+			usage("instance-2", "monthly", 6, 48, 0),
+			usage("instance-3", "monthly", -10, -5, 0),
+			usage("instance-4", "monthly", 30, 48, 0),
+		}},
+		{"partial period", 4, 8, []Usage{
+			usage("instance-1", "monthly", 4, 8, 2),
+			usage("instance-2", "monthly", 6, 8, 0),
+		}},
+		{"after the unbinding", 6, 10, []Usage{
+			usage("instance-1", "monthly", 6, 10, 1),
+			usage("instance-2", "monthly", 6, 10, 0),
+		}},
+		{"later period", 40, 48, []Usage{
+			usage("instance-2", "monthly", 40, 48, 0),
+			usage("instance-4", "monthly", 40, 48, 0),
+		}},
+	}
+	for _, c := range cases {
+		got := Compute(events, at(c.from), at(c.to))
+		if !reflect.DeepEqual(got.Usage, c.want) {
+			t.Errorf("%s: Compute() => got %+v, want %+v", c.name, got.Usage, c.want)
+		}
+	}
+}
+
+func TestComputeUnknownInstance(t *testing.T) {
+	// instances provisioned before the metering started are accounted from their first event
+	events := []Event{event(5, Bind, "instance-1", "monthly", "binding-1")}
+	got := Compute(events, at(0), at(10)).Usage
+	want := []Usage{{
+		InstanceID:   "instance-1",
+		ServiceID:    "service",
+		PlanID:       "monthly",
+		Start:        at(5),
+		End:          at(10),
+		Hours:        5,
+		PeakBindings: 1,
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Compute() => got %+v, want %+v", got, want)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	report := Compute([]Event{event(0, Provision, "instance-1", "monthly", "")}, at(0), start.Add(90*time.Minute))
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	want := "instance_id,service_id,plan_id,start,end,hours,peak_bindings\n" +
+		"instance-1,service,monthly,2017-09-01T00:00:00Z,2017-09-01T01:30:00Z,1.500,0\n"
+	if buf.String() != want {
+		t.Errorf("WriteCSV() => got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := WriteJSON(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	var decoded UsageReport
+	if err := json.NewDecoder(strings.NewReader(buf.String())).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Usage, report.Usage) {
+		t.Errorf("WriteJSON() => got %+v, want %+v", decoded.Usage, report.Usage)
+	}
+}
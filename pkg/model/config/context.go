@@ -0,0 +1,36 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"golang.org/x/net/context"
+)
+
+// ContextStore is implemented by stores that can bind the requests they
+// make to a context, e.g. to record them as child spans of the current span
+// or to cancel them with the request being served.
+type ContextStore interface {
+	// WithContext returns a view of the store making its requests with ctx
+	WithContext(ctx context.Context) Store
+}
+
+// WithContext binds a store to a context if the store supports it, and
+// returns the store itself otherwise
+func WithContext(ctx context.Context, store Store) Store {
+	if cs, ok := store.(ContextStore); ok {
+		return cs.WithContext(ctx)
+	}
+	return store
+}
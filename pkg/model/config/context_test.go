@@ -0,0 +1,51 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+type contextKey struct{}
+
+// contextStore records the context it is bound to
+type contextStore struct {
+	Store
+	ctx context.Context
+}
+
+func (s *contextStore) WithContext(ctx context.Context) Store {
+	return &contextStore{Store: s.Store, ctx: ctx}
+}
+
+func TestWithContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), contextKey{}, "request")
+
+	store := &contextStore{}
+	bound, ok := WithContext(ctx, store).(*contextStore)
+	if !ok || bound == store || bound.ctx != ctx {
+		t.Errorf("WithContext() = %#v, want a copy bound to the context", bound)
+	}
+	if store.ctx != nil {
+		t.Errorf("WithContext() bound the original store")
+	}
+
+	var plain Store = struct{ Store }{}
+	if got := WithContext(ctx, plain); got != plain {
+		t.Errorf("WithContext() = %#v, want the store itself", got)
+	}
+}
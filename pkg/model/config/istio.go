@@ -0,0 +1,82 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	// register the struct message of the mixer types
+	_ "github.com/golang/protobuf/ptypes/struct"
+
+	// register the Istio traffic management messages
+	_ "istio.io/api/proxy/v1/config"
+)
+
+// Istio traffic management types written by the broker. The CRDs of these
+// types are owned and registered by the Istio control plane.
+var (
+	// RouteRule describes route rules
+	RouteRule = Schema{
+		Type:        "route-rule",
+		Plural:      "route-rules",
+		MessageName: "istio.proxy.v1.config.RouteRule",
+	}
+
+	// DestinationPolicy describes destination rules
+	DestinationPolicy = Schema{
+		Type:        "destination-policy",
+		Plural:      "destination-policies",
+		MessageName: "istio.proxy.v1.config.DestinationPolicy",
+	}
+
+	// EgressRule describes egress rules
+	EgressRule = Schema{
+		Type:        "egress-rule",
+		Plural:      "egress-rules",
+		MessageName: "istio.proxy.v1.config.EgressRule",
+	}
+
+	// The messages of the mixer adapters and templates are not part of the
+	// Istio API, so the mixer types hold their spec as a struct.
+
+	// MemQuota describes memquota adapter handlers
+	MemQuota = Schema{
+		Type:        "memquota",
+		Plural:      "memquotas",
+		MessageName: "google.protobuf.Struct",
+	}
+
+	// Quota describes quota template instances
+	Quota = Schema{
+		Type:        "quota",
+		Plural:      "quotas",
+		MessageName: "google.protobuf.Struct",
+	}
+
+	// MixerRule describes mixer policy rules
+	MixerRule = Schema{
+		Type:        "rule",
+		Plural:      "rules",
+		MessageName: "google.protobuf.Struct",
+	}
+
+	// IstioConfigTypes lists the Istio types generated by the broker
+	IstioConfigTypes = Descriptor{
+		RouteRule,
+		DestinationPolicy,
+		EgressRule,
+		MemQuota,
+		Quota,
+		MixerRule,
+	}
+)
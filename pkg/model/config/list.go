@@ -0,0 +1,97 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// FieldName selects objects by name in field selectors
+	FieldName = "metadata.name"
+
+	// FieldNamespace selects objects by namespace in field selectors
+	FieldNamespace = "metadata.namespace"
+)
+
+// ListOptions selects the configuration objects returned by a list operation
+type ListOptions struct {
+	// Namespace restricts the results to a namespace.
+	// Use "" to list across namespaces.
+	Namespace string
+
+	// LabelSelector restricts the results by labels using the Kubernetes
+	// selector syntax, e.g. "tenant=acme,env in (prod,staging)".
+	LabelSelector string
+
+	// FieldSelector restricts the results by metadata fields using the Kubernetes
+	// selector syntax. Only FieldName and FieldNamespace are supported,
+	// e.g. "metadata.name!=legacy".
+	FieldSelector string
+
+	// Limit is the maximum number of objects returned by ListPage.
+	// Use 0 to return all objects in a single page.
+	Limit int64
+
+	// Continue is the opaque token returned by a previous ListPage call to
+	// resume listing from the next page. The other options must not change
+	// between the pages.
+	Continue string
+}
+
+// Matcher compiles the options into a predicate for stores that filter in memory
+func (o ListOptions) Matcher() (func(Entry) bool, error) {
+	ls, err := labels.Parse(o.LabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector %q: %v", o.LabelSelector, err)
+	}
+	fs, err := fields.ParseSelector(o.FieldSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid field selector %q: %v", o.FieldSelector, err)
+	}
+	for _, r := range fs.Requirements() {
+		if r.Field != FieldName && r.Field != FieldNamespace {
+			return nil, fmt.Errorf("unsupported field %q in field selector", r.Field)
+		}
+	}
+
+	return func(entry Entry) bool {
+		if o.Namespace != "" && entry.Namespace != o.Namespace {
+			return false
+		}
+		return ls.Matches(labels.Set(entry.Labels)) &&
+			fs.Matches(fields.Set{FieldName: entry.Name, FieldNamespace: entry.Namespace})
+	}, nil
+}
+
+// Paginate selects a page of entries for stores that filter in memory.
+// The continue token is the key of the last entry in the page, so the entries
+// must be sorted by key.
+func Paginate(entries []Entry, opts ListOptions) ([]Entry, string) {
+	start := 0
+	if opts.Continue != "" {
+		start = sort.Search(len(entries), func(i int) bool { return entries[i].Key() > opts.Continue })
+	}
+	entries = entries[start:]
+	if opts.Limit <= 0 || int64(len(entries)) <= opts.Limit {
+		return entries, ""
+	}
+	page := entries[:opts.Limit]
+	return page, page[len(page)-1].Key()
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListOptionsMatcher(t *testing.T) {
+	entry := Entry{
+		Meta: Meta{
+			Name:      "productpage",
+			Namespace: "default",
+			Labels:    map[string]string{"tenant": "acme", "env": "prod"},
+		},
+	}
+
+	cases := []struct {
+		opts  ListOptions
+		match bool
+	}{
+		{ListOptions{}, true},
+		{ListOptions{Namespace: "default"}, true},
+		{ListOptions{Namespace: "other"}, false},
+		{ListOptions{LabelSelector: "tenant=acme"}, true},
+		{ListOptions{LabelSelector: "tenant=acme,env in (staging)"}, false},
+		{ListOptions{LabelSelector: "!legacy"}, true},
+		{ListOptions{FieldSelector: "metadata.name=productpage"}, true},
+		{ListOptions{FieldSelector: "metadata.name!=productpage"}, false},
+		{ListOptions{FieldSelector: "metadata.namespace=default", LabelSelector: "env=prod"}, true},
+	}
+	for _, c := range cases {
+		match, err := c.opts.Matcher()
+		if err != nil {
+			t.Errorf("Matcher(%+v) => got %v", c.opts, err)
+			continue
+		}
+		if got := match(entry); got != c.match {
+			t.Errorf("Matcher(%+v) => got %t, want %t", c.opts, got, c.match)
+		}
+	}
+
+	for _, opts := range []ListOptions{
+		{LabelSelector: "tenant in acme"},
+		{FieldSelector: "spec.instance=productpage"},
+	} {
+		if _, err := opts.Matcher(); err == nil {
+			t.Errorf("Matcher(%+v) => expected error", opts)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	var entries []Entry
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		entries = append(entries, Entry{Meta: Meta{Type: "fake-config", Name: name, Namespace: "default"}})
+	}
+
+	cases := []struct {
+		opts ListOptions
+		want []string
+		next string
+	}{
+		{ListOptions{}, []string{"a", "b", "c", "d", "e"}, ""},
+		{ListOptions{Limit: 2}, []string{"a", "b"}, "fake-config/default/b"},
+		{ListOptions{Limit: 2, Continue: "fake-config/default/b"}, []string{"c", "d"}, "fake-config/default/d"},
+		{ListOptions{Limit: 2, Continue: "fake-config/default/d"}, []string{"e"}, ""},
+		{ListOptions{Limit: 5}, []string{"a", "b", "c", "d", "e"}, ""},
+		{ListOptions{Limit: 2, Continue: "fake-config/default/bb"}, []string{"c", "d"}, "fake-config/default/d"},
+		{ListOptions{Limit: 2, Continue: "fake-config/default/e"}, []string{}, ""},
+	}
+	for _, c := range cases {
+		page, next := Paginate(entries, c.opts)
+		got := make([]string, 0, len(page))
+		for _, entry := range page {
+			got = append(got, entry.Name)
+		}
+		if !reflect.DeepEqual(got, c.want) || next != c.next {
+			t.Errorf("Paginate(%+v) => got %v, %q, want %v, %q", c.opts, got, next, c.want, c.next)
+		}
+	}
+}
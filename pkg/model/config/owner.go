@@ -0,0 +1,74 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// The objects the broker creates for instances and bindings, e.g. the mesh
+// configuration and the secrets of the credentials, record their owner.
+const (
+	// BindingLabel ties an object to the binding that requested it
+	BindingLabel = "broker.istio.io/binding"
+
+	// InstanceLabel records the service instance of an object
+	InstanceLabel = "broker.istio.io/instance"
+
+	// BindingIDAnnotation and InstanceIDAnnotation record the ids of the
+	// binding and instance of an object, which the labels hash when they are
+	// not valid label values
+	BindingIDAnnotation  = "broker.istio.io/binding-id"
+	InstanceIDAnnotation = "broker.istio.io/instance-id"
+
+	// maxLength bounds label values and the names of the objects
+	maxLength = 63
+)
+
+var (
+	// labelValue matches the valid label values
+	labelValue = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?)?$`)
+
+	// dnsLabel matches the valid names of the objects
+	dnsLabel = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+// LabelValue returns the value of the label recording an OSB id: the id if it
+// is a valid label value, or its hash otherwise
+func LabelValue(id string) string {
+	if len(id) <= maxLength && labelValue.MatchString(id) {
+		return id
+	}
+	return hash(id)
+}
+
+// ObjectName returns the name of an object created for an OSB id: the
+// prefixed lower-case id if it is a valid DNS label, or the prefixed hash of
+// the id otherwise. OSB ids are arbitrary strings, usually GUIDs.
+func ObjectName(prefix, id string) string {
+	if name := prefix + strings.ToLower(id); len(name) <= maxLength && dnsLabel.MatchString(name) {
+		return name
+	}
+	return prefix + hash(id)
+}
+
+// hash shortens an id to a hex digest valid in names and label values
+func hash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOwnerNames(t *testing.T) {
+	long := strings.Repeat("a", 80)
+	cases := []struct {
+		id           string
+		label, name  string
+		hashedLabel  bool
+		hashedObject bool
+	}{
+		{id: "8E0D2A4F-77B5-4B4A-9E5C-1F0C8A2C1B3D", label: "8E0D2A4F-77B5-4B4A-9E5C-1F0C8A2C1B3D",
+			name: "binding-8e0d2a4f-77b5-4b4a-9e5c-1f0c8a2c1b3d"},
+		{id: "my_binding", label: "my_binding", hashedObject: true},
+		{id: "binding/1", hashedLabel: true, hashedObject: true},
+		{id: long, hashedLabel: true, hashedObject: true},
+	}
+	for _, c := range cases {
+		label, name := LabelValue(c.id), ObjectName("binding-", c.id)
+		if c.hashedLabel {
+			c.label = hash(c.id)
+		}
+		if c.hashedObject {
+			c.name = "binding-" + hash(c.id)
+		}
+		if label != c.label || name != c.name {
+			t.Errorf("%q => got label %q and name %q, want %q and %q", c.id, label, name, c.label, c.name)
+		}
+		if len(label) > maxLength || len(name) > maxLength {
+			t.Errorf("%q => got label %q and name %q longer than %d", c.id, label, name, maxLength)
+		}
+	}
+}
@@ -15,6 +15,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/golang/protobuf/proto"
 )
 
@@ -57,6 +59,40 @@ type Meta struct {
 	// An empty revision carries a special meaning that the associated object has
 	// not been stored and assigned a revision.
 	ResourceVersion string `json:"resourceVersion,omitempty"`
+
+	// Finalizers hold the removal of a deleted object until they are all
+	// removed from the object, e.g. once the objects depending on it are gone
+	Finalizers []string `json:"finalizers,omitempty"`
+
+	// DeletionTimestamp is the time the deletion of the object was requested,
+	// set by the store while finalizers hold the removal of the object
+	DeletionTimestamp *time.Time `json:"deletionTimestamp,omitempty"`
+}
+
+// Deleting reports whether the deletion of the object was requested
+func (meta *Meta) Deleting() bool {
+	return meta.DeletionTimestamp != nil
+}
+
+// HasFinalizer reports whether a finalizer holds the removal of the object
+func (meta *Meta) HasFinalizer(finalizer string) bool {
+	for _, f := range meta.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveFinalizer removes a finalizer from the object
+func (meta *Meta) RemoveFinalizer(finalizer string) {
+	var out []string
+	for _, f := range meta.Finalizers {
+		if f != finalizer {
+			out = append(out, f)
+		}
+	}
+	meta.Finalizers = out
 }
 
 // Entry is a configuration unit consisting of the type of configuration, the
@@ -67,4 +103,106 @@ type Entry struct {
 
 	// Spec holds the configuration object as a protobuf message
 	Spec proto.Message
+
+	// Status is the observed state of the object, if any was reported
+	Status *Status
+}
+
+// ConditionType identifies an aspect of the observed state of a configuration object
+type ConditionType string
+
+const (
+	// ConditionReady indicates that the object was accepted and is in effect
+	ConditionReady ConditionType = "Ready"
+
+	// ConditionInvalid indicates that the object content was rejected
+	ConditionInvalid ConditionType = "Invalid"
+
+	// ConditionOrphaned indicates that the objects referenced by the object do not exist
+	ConditionOrphaned ConditionType = "Orphaned"
+
+	// ConditionTerminating indicates that the removal of a deleted object waits
+	// for the objects depending on it
+	ConditionTerminating ConditionType = "Terminating"
+)
+
+// ConditionStatus is the state of a condition
+type ConditionStatus string
+
+const (
+	// ConditionTrue means the condition holds
+	ConditionTrue ConditionStatus = "True"
+
+	// ConditionFalse means the condition does not hold
+	ConditionFalse ConditionStatus = "False"
+
+	// ConditionUnknown means the condition could not be determined
+	ConditionUnknown ConditionStatus = "Unknown"
+)
+
+// Condition describes one aspect of the observed state of a configuration object
+type Condition struct {
+	// Type of the condition
+	Type ConditionType
+
+	// Status of the condition
+	Status ConditionStatus
+
+	// Reason is a brief CamelCase cause of the last transition
+	Reason string
+
+	// Message is a human readable explanation of the last transition
+	Message string
+
+	// LastTransitionTime is the time the status of the condition last changed
+	LastTransitionTime time.Time
+}
+
+// Status is the observed state of a configuration object as reported by the broker
+type Status struct {
+	Conditions []Condition
+}
+
+// GetCondition finds a condition by type
+func (s *Status) GetCondition(typ ConditionType) (Condition, bool) {
+	if s != nil {
+		for _, c := range s.Conditions {
+			if c.Type == typ {
+				return c, true
+			}
+		}
+	}
+	return Condition{}, false
+}
+
+// SetCondition adds or replaces a condition by type.
+// The transition time is kept if the status of the condition is unchanged.
+func (s *Status) SetCondition(cond Condition) {
+	for i, c := range s.Conditions {
+		if c.Type == cond.Type {
+			if c.Status == cond.Status {
+				cond.LastTransitionTime = c.LastTransitionTime
+			}
+			s.Conditions[i] = cond
+			return
+		}
+	}
+	s.Conditions = append(s.Conditions, cond)
+}
+
+// Equal compares the conditions of two statuses ignoring transition times
+func (s *Status) Equal(other *Status) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	if len(s.Conditions) != len(other.Conditions) {
+		return false
+	}
+	for _, c := range s.Conditions {
+		o, ok := other.GetCondition(c.Type)
+		if !ok || o.Status != c.Status || o.Reason != c.Reason || o.Message != c.Message {
+			return false
+		}
+	}
+	return true
 }
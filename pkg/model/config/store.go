@@ -16,10 +16,13 @@ package config
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/golang/glog"
 
 	brokerconfig "istio.io/api/broker/v1/config"
+	// register the broker model messages
+	_ "istio.io/broker/pkg/model/proto"
 )
 
 // Store describes a set of platform agnostic APIs that must be supported
@@ -62,6 +65,16 @@ type Store interface {
 	// Use "" for the namespace to list across namespaces.
 	List(typ, namespace string) ([]Entry, error)
 
+	// ListWithOptions returns objects by type matching the namespace, label
+	// and field selectors in the options. All matching objects are returned;
+	// stores that fetch objects in pages use opts.Limit as the page size.
+	ListWithOptions(typ string, opts ListOptions) ([]Entry, error)
+
+	// ListPage returns at most opts.Limit objects by type matching the list
+	// options, starting from the page identified by opts.Continue. It returns
+	// the continue token of the next page, or "" after the last page.
+	ListPage(typ string, opts ListOptions) (entries []Entry, next string, err error)
+
 	// Create adds a new configuration object to the store. If an object with the
 	// same name and namespace for the type already exists, the operation fails
 	// with no side effects.
@@ -78,6 +91,68 @@ type Store interface {
 	Delete(typ, name, namespace string) error
 }
 
+// Event represents a registry update event
+type Event int
+
+const (
+	// EventAdd is sent when an object is added
+	EventAdd Event = iota
+
+	// EventUpdate is sent when an object is modified
+	EventUpdate
+
+	// EventDelete is sent when an object is deleted
+	EventDelete
+)
+
+func (event Event) String() string {
+	switch event {
+	case EventAdd:
+		return "add"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// StoreCache is a local fully-replicated cache of the config store. The cache
+// actively synchronizes its local state with the remote store and provides a
+// notification mechanism to receive update events. As such, the notification
+// handlers must be registered prior to calling _Run_, and the cache requires
+// initial synchronization grace period after calling  _Run_.
+//
+// Update notifications require the following consistency guarantee: the view
+// in the cache must be AT LEAST as fresh as the moment notification arrives, but
+// MAY BE more fresh (e.g. if _Delete_ cancels an _Add_ event).
+//
+// Handlers execute on the single worker queue in the order they are appended.
+// Handlers receive the notification event and the associated object.  Note
+// that all handlers must be registered before starting the cache controller.
+type StoreCache interface {
+	Store
+
+	// RegisterEventHandler adds a handler to receive config update events for a
+	// configuration type
+	RegisterEventHandler(typ string, handler func(Entry, Event))
+
+	// Run until a signal is received
+	Run(stop <-chan struct{})
+
+	// HasSynced returns true after initial cache synchronization is complete
+	HasSynced() bool
+}
+
+// StatusUpdater is implemented by stores that persist the observed status of
+// configuration objects separately from their specification.
+type StatusUpdater interface {
+	// UpdateStatus replaces the status of an existing configuration object
+	// with the entry status. Like _Update_, it requires the revision of the
+	// object and returns a new revision if the operation succeeds.
+	UpdateStatus(entry Entry) (newRevision string, err error)
+}
+
 // Key function for the configuration objects
 func Key(typ, name, namespace string) string {
 	return fmt.Sprintf("%s/%s/%s", typ, namespace, name)
@@ -91,14 +166,25 @@ func (entry *Entry) Key() string {
 // BrokerConfigStore is a specialized interface to access config store using
 // Broker configuration types.
 type BrokerConfigStore interface {
-	// ServiceClasses lists all service classes.
+	// ServiceClasses lists all service classes, except the ones being deleted.
 	ServiceClasses() map[string]*brokerconfig.ServiceClass
 
-	// ServicePlans lists all service plans.
+	// ServicePlans lists all service plans, except the ones being deleted.
 	ServicePlans() map[string]*brokerconfig.ServicePlan
 
 	// ServicePlansByService lists all service plans contains the specified service class
 	ServicePlansByService(service string) map[string]*brokerconfig.ServicePlan
+
+	// ServicePlanEntriesByService lists the stored service plans offering the
+	// specified service class with their metadata, except the ones being deleted,
+	// sorted by key.
+	ServicePlanEntriesByService(service string) []Entry
+
+	// ServiceClassByID finds the service class published under a catalog service id
+	ServiceClassByID(id string) (*Entry, bool)
+
+	// ServicePlanByID finds the service plan published under a catalog plan id
+	ServicePlanByID(id string) (*Entry, bool)
 }
 
 const (
@@ -124,10 +210,42 @@ var (
 		MessageName: "istio.broker.v1.config.ServicePlan",
 	}
 
+	// ServiceInstance describes provisioned service instances
+	ServiceInstance = Schema{
+		Type:        "service-instance",
+		Plural:      "service-instances",
+		MessageName: "istio.broker.v1.model.ServiceInstance",
+	}
+
+	// ServiceBinding describes the bindings to service instances
+	ServiceBinding = Schema{
+		Type:        "service-binding",
+		Plural:      "service-bindings",
+		MessageName: "istio.broker.v1.model.ServiceBinding",
+	}
+
+	// BindingCertificate describes the client certificates issued for bindings
+	BindingCertificate = Schema{
+		Type:        "binding-certificate",
+		Plural:      "binding-certificates",
+		MessageName: "istio.broker.v1.model.Certificate",
+	}
+
+	// MeteringEvent describes the lifecycle events of instances and bindings
+	MeteringEvent = Schema{
+		Type:        "metering-event",
+		Plural:      "metering-events",
+		MessageName: "istio.broker.v1.model.MeteringEvent",
+	}
+
 	// BrokerConfigTypes lists all types with schemas and validation
 	BrokerConfigTypes = Descriptor{
 		ServiceClass,
 		ServicePlan,
+		ServiceInstance,
+		ServiceBinding,
+		BindingCertificate,
+		MeteringEvent,
 	}
 )
 
@@ -135,22 +253,40 @@ var (
 // from the generic config registry
 type brokerConfigStore struct {
 	Store
+
+	// selector restricts the catalog to a subset of the configuration
+	selector *ListOptions
 }
 
 // MakeBrokerConfigStore creates a wrapper around a store
 func MakeBrokerConfigStore(store Store) BrokerConfigStore {
-	return &brokerConfigStore{store}
+	return &brokerConfigStore{Store: store}
+}
+
+// MakeSelectedBrokerConfigStore creates a wrapper around a store that only
+// exposes the service classes and plans matching the list options, e.g. to
+// publish the catalog of a single tenant or environment.
+func MakeSelectedBrokerConfigStore(store Store, selector ListOptions) BrokerConfigStore {
+	return &brokerConfigStore{Store: store, selector: &selector}
+}
+
+// list returns the selected objects of a type
+func (i brokerConfigStore) list(typ string) ([]Entry, error) {
+	if i.selector == nil {
+		return i.List(typ, "")
+	}
+	return i.ListWithOptions(typ, *i.selector)
 }
 
 func (i brokerConfigStore) ServiceClasses() map[string]*brokerconfig.ServiceClass {
 	out := make(map[string]*brokerconfig.ServiceClass)
-	rs, err := i.List(ServiceClass.Type, "")
+	rs, err := i.list(ServiceClass.Type)
 	if err != nil {
 		glog.V(2).Infof("ServiceClasses => %v", err)
 		return out
 	}
 	for _, r := range rs {
-		if c, ok := r.Spec.(*brokerconfig.ServiceClass); ok {
+		if c, ok := r.Spec.(*brokerconfig.ServiceClass); ok && !r.Deleting() {
 			out[r.Key()] = c
 		}
 	}
@@ -159,13 +295,13 @@ func (i brokerConfigStore) ServiceClasses() map[string]*brokerconfig.ServiceClas
 
 func (i brokerConfigStore) ServicePlans() map[string]*brokerconfig.ServicePlan {
 	out := make(map[string]*brokerconfig.ServicePlan)
-	rs, err := i.List(ServicePlan.Type, "")
+	rs, err := i.list(ServicePlan.Type)
 	if err != nil {
 		glog.V(2).Infof("ServicePlans => %v", err)
 		return out
 	}
 	for _, r := range rs {
-		if c, ok := r.Spec.(*brokerconfig.ServicePlan); ok {
+		if c, ok := r.Spec.(*brokerconfig.ServicePlan); ok && !r.Deleting() {
 			out[r.Key()] = c
 		}
 	}
@@ -186,3 +322,54 @@ func (i brokerConfigStore) ServicePlansByService(service string) map[string]*bro
 
 	return out
 }
+
+func (i brokerConfigStore) ServicePlanEntriesByService(service string) []Entry {
+	var out []Entry
+	rs, err := i.list(ServicePlan.Type)
+	if err != nil {
+		glog.V(2).Infof("ServicePlanEntriesByService => %v", err)
+		return out
+	}
+	for _, r := range rs {
+		p, ok := r.Spec.(*brokerconfig.ServicePlan)
+		if !ok || r.Deleting() {
+			continue
+		}
+		for _, s := range p.GetServices() {
+			if s == service {
+				out = append(out, r)
+				break
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key() < out[j].Key() })
+	return out
+}
+
+func (i brokerConfigStore) ServiceClassByID(id string) (*Entry, bool) {
+	rs, err := i.list(ServiceClass.Type)
+	if err != nil {
+		glog.V(2).Infof("ServiceClassByID => %v", err)
+		return nil, false
+	}
+	for _, r := range rs {
+		if c, ok := r.Spec.(*brokerconfig.ServiceClass); ok && c.GetEntry().GetId() == id {
+			return &r, true
+		}
+	}
+	return nil, false
+}
+
+func (i brokerConfigStore) ServicePlanByID(id string) (*Entry, bool) {
+	rs, err := i.list(ServicePlan.Type)
+	if err != nil {
+		glog.V(2).Infof("ServicePlanByID => %v", err)
+		return nil, false
+	}
+	for _, r := range rs {
+		if p, ok := r.Spec.(*brokerconfig.ServicePlan); ok && p.GetPlan().GetId() == id {
+			return &r, true
+		}
+	}
+	return nil, false
+}
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/mock/gomock"
@@ -199,3 +200,96 @@ func TestServicePlansByService(t *testing.T) {
 		}
 	}
 }
+
+func TestSelectedServiceClasses(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+
+	sc := &brokerconfig.ServiceClass{
+		Entry: &brokerconfig.CatalogEntry{
+			Name: "istio-bookinfo-productpage",
+			Id:   "4395a443-f49a-41b0-8d14-d17294cf612f",
+		},
+	}
+	selector := ListOptions{LabelSelector: "tenant=acme"}
+	store := MakeSelectedBrokerConfigStore(r.mock, selector)
+
+	r.mock.EXPECT().ListWithOptions(ServiceClass.Type, selector).Return([]Entry{
+		{Meta: Meta{Name: "productpage-service-class"}, Spec: sc},
+	}, nil)
+	want := map[string]*brokerconfig.ServiceClass{
+		"//productpage-service-class": sc,
+	}
+	if got := store.ServiceClasses(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+vwant %+v", spew.Sdump(got), spew.Sdump(want))
+	}
+}
+
+func TestServiceClassByID(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+
+	sc := &brokerconfig.ServiceClass{
+		Deployment: &brokerconfig.Deployment{
+			Instance: "productpage",
+		},
+		Entry: &brokerconfig.CatalogEntry{
+			Name: "istio-bookinfo-productpage",
+			Id:   "4395a443-f49a-41b0-8d14-d17294cf612f",
+		},
+	}
+	entry := Entry{Meta: Meta{Type: ServiceClass.Type, Name: "productpage-service-class", Namespace: "default"}, Spec: sc}
+
+	r.mock.EXPECT().List(ServiceClass.Type, "").Return([]Entry{entry}, nil).Times(2)
+	if got, ok := r.store.ServiceClassByID("4395a443-f49a-41b0-8d14-d17294cf612f"); !ok || !reflect.DeepEqual(*got, entry) {
+		t.Errorf("ServiceClassByID() => got %+v, %t, want %+v", got, ok, entry)
+	}
+	if got, ok := r.store.ServiceClassByID("missing"); ok {
+		t.Errorf("ServiceClassByID(missing) => got %+v", got)
+	}
+}
+
+func TestServicePlanByID(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+
+	sp := &brokerconfig.ServicePlan{
+		Plan: &brokerconfig.CatalogPlan{
+			Name: "istio-monthly",
+			Id:   "58646b26-867a-4954-a1b9-233dac07815b",
+		},
+	}
+	entry := Entry{Meta: Meta{Type: ServicePlan.Type, Name: "monthly-service-plan", Namespace: "default"}, Spec: sp}
+
+	r.mock.EXPECT().List(ServicePlan.Type, "").Return([]Entry{entry}, nil).Times(2)
+	if got, ok := r.store.ServicePlanByID("58646b26-867a-4954-a1b9-233dac07815b"); !ok || !reflect.DeepEqual(*got, entry) {
+		t.Errorf("ServicePlanByID() => got %+v, %t, want %+v", got, ok, entry)
+	}
+	if got, ok := r.store.ServicePlanByID("missing"); ok {
+		t.Errorf("ServicePlanByID(missing) => got %+v", got)
+	}
+}
+
+func TestServicePlanEntriesByService(t *testing.T) {
+	r := initTestStore(t)
+	defer r.shutdown()
+
+	plan := func(name string, services ...string) Entry {
+		return Entry{
+			Meta: Meta{Type: ServicePlan.Type, Name: name, Namespace: "default"},
+			Spec: &brokerconfig.ServicePlan{
+				Plan:     &brokerconfig.CatalogPlan{Name: name, Id: name},
+				Services: services,
+			},
+		}
+	}
+	yearly, monthly, other := plan("yearly", "productpage"), plan("monthly", "other", "productpage"), plan("other", "other")
+	deleted := plan("deleted", "productpage")
+	deleted.DeletionTimestamp = &time.Time{}
+
+	r.mock.EXPECT().List(ServicePlan.Type, "").Return([]Entry{yearly, monthly, other, deleted}, nil)
+	want := []Entry{monthly, yearly}
+	if got := r.store.ServicePlanEntriesByService("productpage"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+vwant %+v", spew.Sdump(got), spew.Sdump(want))
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package osb
+
+import "fmt"
+
+// Platforms of OSB context profiles.
+const (
+	PlatformKubernetes   = "kubernetes"
+	PlatformCloudFoundry = "cloudfoundry"
+)
+
+// Context defines OSB context object of the platform creating an instance or binding.
+// The fields of the kubernetes and cloudfoundry profiles are known, other platforms
+// only provide the platform name.
+type Context struct {
+	Platform     string `json:"platform"`
+	InstanceName string `json:"instance_name,omitempty"`
+
+	// kubernetes profile
+	Namespace string `json:"namespace,omitempty"`
+	ClusterID string `json:"clusterid,omitempty"`
+
+	// cloudfoundry profile
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+}
+
+// Validate checks the fields required by the profile of the platform.
+func (c *Context) Validate() error {
+	switch c.Platform {
+	case "":
+		return fmt.Errorf("context: platform is required")
+	case PlatformKubernetes:
+		if c.Namespace == "" {
+			return fmt.Errorf("context: namespace is required for platform %q", c.Platform)
+		}
+	case PlatformCloudFoundry:
+		if c.OrganizationGUID == "" || c.SpaceGUID == "" {
+			return fmt.Errorf("context: organization_guid and space_guid are required for platform %q", c.Platform)
+		}
+	}
+	return nil
+}
+
+// PlatformContext returns the context of a service instance request, derived from the
+// legacy organization and space GUIDs for platforms that do not send a context.
+// It returns nil if the request carries neither.
+func (s *ServiceInstance) PlatformContext() *Context {
+	if s.Context != nil {
+		return s.Context
+	}
+	if s.OrganizationGUID == "" && s.SpaceGUID == "" {
+		return nil
+	}
+	return &Context{
+		Platform:         PlatformCloudFoundry,
+		OrganizationGUID: s.OrganizationGUID,
+		SpaceGUID:        s.SpaceGUID,
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package osb
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidateContext(t *testing.T) {
+	cases := []struct {
+		in    Context
+		valid bool
+	}{
+		{Context{Platform: PlatformKubernetes, Namespace: "default"}, true},
+		{Context{Platform: PlatformKubernetes}, false},
+		{Context{Platform: PlatformCloudFoundry, OrganizationGUID: "org", SpaceGUID: "space"}, true},
+		{Context{Platform: PlatformCloudFoundry, SpaceGUID: "space"}, false},
+		{Context{Platform: "other"}, true},
+		{Context{Namespace: "default"}, false},
+	}
+	for _, c := range cases {
+		if err := c.in.Validate(); (err == nil) != c.valid {
+			t.Errorf("Validate(%+v) => got %v", c.in, err)
+		}
+	}
+}
+
+func TestPlatformContext(t *testing.T) {
+	cases := []struct {
+		body string
+		want *Context
+	}{
+		{`{"context": {"platform": "kubernetes", "namespace": "default", "clusterid": "c1"}}`,
+			&Context{Platform: PlatformKubernetes, Namespace: "default", ClusterID: "c1"}},
+		{`{"organization_guid": "org", "space_guid": "space"}`,
+			&Context{Platform: PlatformCloudFoundry, OrganizationGUID: "org", SpaceGUID: "space"}},
+		{`{"organization_guid": "legacy", "context": {"platform": "cloudfoundry", "organization_guid": "org"}}`,
+			&Context{Platform: PlatformCloudFoundry, OrganizationGUID: "org"}},
+		{`{}`, nil},
+	}
+	for _, c := range cases {
+		var in ServiceInstance
+		if err := json.Unmarshal([]byte(c.body), &in); err != nil {
+			t.Fatal(err)
+		}
+		if got := in.PlatformContext(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("PlatformContext(%s) => got %+v, want %+v", c.body, got, c.want)
+		}
+	}
+}
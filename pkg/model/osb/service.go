@@ -26,9 +26,19 @@ type Service struct {
 	Tags           []string `json:"tags, omitempty"`
 	Requires       []string `json:"requires, omitempty"`
 
-	Metadata        interface{}   `json:"metadata, omitempty"`
-	Plans           []ServicePlan `json:"plans"`
-	DashboardClient interface{}   `json:"dashboard_client"`
+	InstancesRetrievable bool `json:"instances_retrievable,omitempty"`
+
+	Metadata        interface{}      `json:"metadata, omitempty"`
+	Plans           []ServicePlan    `json:"plans"`
+	DashboardClient *DashboardClient `json:"dashboard_client,omitempty"`
+}
+
+// DashboardClient defines the OAuth client of a service dashboard, created by
+// the platform to enable single sign-on.
+type DashboardClient struct {
+	ID          string `json:"id"`
+	Secret      string `json:"secret"`
+	RedirectURI string `json:"redirect_uri,omitempty"`
 }
 
 // AddPlan adds a service plan into the service's plans.
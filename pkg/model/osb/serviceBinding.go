@@ -14,6 +14,8 @@
 
 package osb
 
+import "encoding/json"
+
 // ServiceBinding defines OSB service binding data structure.
 type ServiceBinding struct {
 	ID                string `json:"id"`
@@ -24,15 +26,73 @@ type ServiceBinding struct {
 	ServiceInstanceID string `json:"service_instance_id"`
 }
 
+// BindRequest defines OSB service binding request data structure.
+type BindRequest struct {
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	BindResource *BindResource          `json:"bind_resource,omitempty"`
+	Context      *Context               `json:"context,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// BindResource defines OSB bind resource data structure.
+type BindResource struct {
+	AppGUID string `json:"app_guid,omitempty"`
+	Route   string `json:"route,omitempty"`
+}
+
 // CreateServiceBindingResponse defines OSB service binding response data structure.
 type CreateServiceBindingResponse struct {
 	// SyslogDrainUrl string      `json:"syslog_drain_url, omitempty"`
 	Credentials interface{} `json:"credentials"`
 }
 
-// Credential defines OSB credential data structure.
+// BindingCredential defines the credentials of a service binding: the mesh
+// service bound to and, if issued, a mutual TLS client certificate or the
+// secret it is stored in. Values are further credentials of the backend,
+// e.g. a database URI, serialized alongside the fields.
+type BindingCredential struct {
+	Service   string            `json:"service,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Secret    *SecretReference  `json:"secret,omitempty"`
+	Values    map[string]string `json:"-"`
+	*Credential
+}
+
+// MarshalJSON merges the values with the fields of the credentials. Fields take
+// precedence over values with the same name.
+func (c BindingCredential) MarshalJSON() ([]byte, error) {
+	type fields BindingCredential
+	data, err := json.Marshal(fields(c))
+	if err != nil || len(c.Values) == 0 {
+		return data, err
+	}
+	out := make(map[string]interface{})
+	if err = json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	for key, value := range c.Values {
+		if _, exists := out[key]; !exists {
+			out[key] = value
+		}
+	}
+	return json.Marshal(out)
+}
+
+// SecretReference defines the Kubernetes secret holding the credentials of a binding.
+type SecretReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// Credential defines OSB credential data structure: the address and user of
+// the service, or a PEM encoded client certificate, its private key and the
+// CA certificate to verify the service with.
 type Credential struct {
-	PublicIP   string `json:"public_ip"`
-	UserName   string `json:"username"`
-	PrivateKey string `json:"private_key"`
+	PublicIP      string `json:"public_ip,omitempty"`
+	UserName      string `json:"username,omitempty"`
+	PrivateKey    string `json:"private_key,omitempty"`
+	Certificate   string `json:"certificate,omitempty"`
+	CACertificate string `json:"ca_certificate,omitempty"`
+	Expiration    string `json:"expiration,omitempty"`
 }
@@ -24,9 +24,13 @@ type ServiceInstance struct {
 	OrganizationGUID string `json:"organization_guid"`
 	SpaceGUID        string `json:"space_guid"`
 
+	Context *Context `json:"context,omitempty"`
+
 	LastOperation *LastOperation `json:"last_operation, omitempty"`
 
 	Parameters interface{} `json:"parameters, omitempty"`
+
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
 }
 
 // LastOperation defines OSB last operation data structure.
@@ -38,6 +42,26 @@ type LastOperation struct {
 
 // CreateServiceInstanceResponse defines OSB service instance response data structure.
 type CreateServiceInstanceResponse struct {
-	DashboardURL  string         `json:"dashboard_url"`
-	LastOperation *LastOperation `json:"last_operation, omitempty"`
+	DashboardURL string `json:"dashboard_url,omitempty"`
+	Operation    string `json:"operation,omitempty"`
+}
+
+// FetchServiceInstanceResponse defines OSB response data structure of fetched service instances.
+type FetchServiceInstanceResponse struct {
+	ServiceID       string           `json:"service_id"`
+	PlanID          string           `json:"plan_id"`
+	DashboardURL    string           `json:"dashboard_url,omitempty"`
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+// States of OSB last operation.
+const (
+	OperationInProgress = "in progress"
+	OperationSucceeded  = "succeeded"
+	OperationFailed     = "failed"
+)
+
+// OperationResponse defines OSB response data structure of accepted asynchronous operations.
+type OperationResponse struct {
+	Operation string `json:"operation,omitempty"`
 }
@@ -23,6 +23,14 @@ type ServicePlan struct {
 	Description string      `json:"description"`
 	Metadata    interface{} `json:"metadata, omitempty"`
 	Free        bool        `json:"free, omitempty"`
+
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+// MaintenanceInfo defines the OSB maintenance info data structure of plans and instances.
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
 }
 
 // NewServicePlan creates a service plan from service plan config proto.
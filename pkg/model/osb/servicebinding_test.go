@@ -0,0 +1,52 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package osb
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMarshalBindingCredential(t *testing.T) {
+	cases := []struct {
+		name string
+		in   *BindingCredential
+		want string
+	}{
+		{
+			name: "fields",
+			in: &BindingCredential{
+				Service:    "productpage",
+				Namespace:  "default",
+				Credential: &Credential{Certificate: "cert", Expiration: "never"},
+			},
+			want: `{"service":"productpage","namespace":"default","certificate":"cert","expiration":"never"}`,
+		},
+		{
+			name: "values",
+			in: &BindingCredential{
+				Secret: &SecretReference{Name: "binding-1", Namespace: "default"},
+				Values: map[string]string{"uri": "memory://instance-1", "secret": "ignored"},
+			},
+			want: `{"secret":{"name":"binding-1","namespace":"default"},"uri":"memory://instance-1"}`,
+		},
+	}
+	for _, c := range cases {
+		got, err := json.Marshal(c.in)
+		if err != nil || string(got) != c.want {
+			t.Errorf("%s => got %s, %v, want %s", c.name, got, err, c.want)
+		}
+	}
+}
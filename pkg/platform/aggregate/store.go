@@ -0,0 +1,135 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package aggregate merges config stores holding the same types, e.g. to
+// serve the catalog objects generated in memory alongside the CRDs.
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"istio.io/broker/pkg/model/config"
+)
+
+// store reads from all stores and writes new objects to the primary store.
+// Existing objects are modified in the store that holds them.
+type store struct {
+	primary config.Store
+	stores  []config.Store
+}
+
+// Make creates a store merging the objects of a primary store and other stores.
+// Objects of the primary store shadow the objects with the same key in the others.
+func Make(primary config.Store, others ...config.Store) config.Store {
+	return &store{
+		primary: primary,
+		stores:  append([]config.Store{primary}, others...),
+	}
+}
+
+func (s *store) Descriptor() config.Descriptor {
+	return s.primary.Descriptor()
+}
+
+func (s *store) Get(typ, name, namespace string) (*config.Entry, bool) {
+	for _, st := range s.stores {
+		if entry, exists := st.Get(typ, name, namespace); exists {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+func (s *store) List(typ, namespace string) ([]config.Entry, error) {
+	return s.ListWithOptions(typ, config.ListOptions{Namespace: namespace})
+}
+
+// ListWithOptions merges the objects of all stores sorted by key
+func (s *store) ListWithOptions(typ string, opts config.ListOptions) ([]config.Entry, error) {
+	opts.Continue = ""
+	seen := make(map[string]bool)
+	var out []config.Entry
+	for _, st := range s.stores {
+		entries, err := st.ListWithOptions(typ, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !seen[entry.Key()] {
+				seen[entry.Key()] = true
+				out = append(out, entry)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key() < out[j].Key() })
+	return out, nil
+}
+
+// ListPage pages through the merged objects, so the continue tokens are object keys
+func (s *store) ListPage(typ string, opts config.ListOptions) ([]config.Entry, string, error) {
+	entries, err := s.ListWithOptions(typ, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	out, next := config.Paginate(entries, opts)
+	return out, next, nil
+}
+
+func (s *store) Create(entry config.Entry) (string, error) {
+	if _, exists := s.Get(entry.Type, entry.Name, entry.Namespace); exists {
+		return "", fmt.Errorf("%s already exists", entry.Key())
+	}
+	return s.primary.Create(entry)
+}
+
+func (s *store) Update(entry config.Entry) (string, error) {
+	st, err := s.holder(entry.Type, entry.Name, entry.Namespace)
+	if err != nil {
+		return "", err
+	}
+	return st.Update(entry)
+}
+
+// UpdateStatus implements status updater interface for the stores supporting status updates
+func (s *store) UpdateStatus(entry config.Entry) (string, error) {
+	st, err := s.holder(entry.Type, entry.Name, entry.Namespace)
+	if err != nil {
+		return "", err
+	}
+	status, ok := st.(config.StatusUpdater)
+	if !ok {
+		return "", errors.New("config store does not support status updates")
+	}
+	return status.UpdateStatus(entry)
+}
+
+func (s *store) Delete(typ, name, namespace string) error {
+	st, err := s.holder(typ, name, namespace)
+	if err != nil {
+		return err
+	}
+	return st.Delete(typ, name, namespace)
+}
+
+// holder finds the store holding an object
+func (s *store) holder(typ, name, namespace string) (config.Store, error) {
+	for _, st := range s.stores {
+		if _, exists := st.Get(typ, name, namespace); exists {
+			return st, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not found", config.Key(typ, name, namespace))
+}
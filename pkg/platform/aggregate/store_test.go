@@ -0,0 +1,86 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"testing"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/platform/memory"
+	"istio.io/broker/pkg/testing/mock"
+)
+
+func makeStores() (config.Store, config.Store) {
+	types := append(config.BrokerConfigTypes, mock.FakeConfig)
+	return memory.Make(types), memory.Make(types)
+}
+
+func TestStoreInvariant(t *testing.T) {
+	primary, other := makeStores()
+	mock.CheckMapInvariant(Make(primary, other), t, "some-namespace", 10)
+}
+
+func TestListPage(t *testing.T) {
+	primary, other := makeStores()
+	mock.CheckListPage(Make(primary, other), t, "some-namespace", 7, 3)
+}
+
+func TestMerge(t *testing.T) {
+	primary, other := makeStores()
+	s := Make(primary, other)
+
+	for i, st := range []config.Store{primary, other, other} {
+		if _, err := st.Create(mock.Make("some-namespace", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// shadowed by the primary store
+	if _, err := other.Create(mock.Make("some-namespace", 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := s.List(mock.FakeConfig.Type, "")
+	if err != nil || len(l) != 3 {
+		t.Fatalf("List() => got %d object(s), %v, want 3", len(l), err)
+	}
+	for i := 1; i < len(l); i++ {
+		if l[i-1].Key() >= l[i].Key() {
+			t.Errorf("List() => got %s before %s", l[i-1].Key(), l[i].Key())
+		}
+	}
+
+	elt := mock.Make("some-namespace", 1)
+	if _, err = s.Create(elt); err == nil {
+		t.Error("Create() of an object of another store => got no error")
+	}
+	got, _ := s.Get(elt.Type, elt.Name, elt.Namespace)
+	elt.ResourceVersion = got.ResourceVersion
+	elt.Status = &config.Status{Conditions: []config.Condition{
+		{Type: config.ConditionReady, Status: config.ConditionTrue},
+	}}
+	if _, err = s.(config.StatusUpdater).UpdateStatus(elt); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = other.Get(elt.Type, elt.Name, elt.Namespace); got.Status == nil {
+		t.Error("UpdateStatus() => status not written to the store holding the object")
+	}
+
+	if err = s.Delete(elt.Type, elt.Name, elt.Namespace); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := other.Get(elt.Type, elt.Name, elt.Namespace); exists {
+		t.Error("Delete() => object left in the store holding it")
+	}
+}
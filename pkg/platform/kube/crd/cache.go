@@ -0,0 +1,404 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/tracing"
+)
+
+const (
+	// queueSize is the number of pending notifications before the watches block
+	queueSize = 1024
+
+	// retryPeriod is the interval between the attempts to list or watch a type after a failure
+	retryPeriod = time.Second
+)
+
+// CacheOptions configure the config cache
+type CacheOptions struct {
+	// Namespace the cache watches; use "" for all namespaces
+	Namespace string
+
+	// Types restricts the cached config types; use nil for all types of the client
+	Types config.Descriptor
+
+	// ResyncPeriod is the interval between notifications of all cached
+	// objects as updated; use 0 to disable resync
+	ResyncPeriod time.Duration
+
+	// PageSize is the number of objects fetched per request when listing;
+	// use 0 for the default page size
+	PageSize int64
+}
+
+// storeCache is a config store cache of the CRDs, listed page by page and
+// kept up to date by watches
+type storeCache struct {
+	client     *Client
+	descriptor config.Descriptor
+	options    CacheOptions
+	kinds      map[string]*cacheHandler
+	queue      chan func()
+}
+
+type cacheHandler struct {
+	schema   config.Schema
+	store    cache.Store
+	synced   int32
+	handlers []func(config.Entry, config.Event)
+}
+
+// NewCache creates a config store cache for the CRDs of a client.
+// The cache lists the CRDs in pages of at most options.PageSize objects and
+// adds each page to the cache before fetching the next one, so that warming
+// up on a large catalog holds at most one page besides the cached objects.
+func NewCache(client *Client, options CacheOptions) config.StoreCache {
+	if options.PageSize <= 0 {
+		options.PageSize = listPageSize
+	}
+	out := &storeCache{
+		client:     client,
+		descriptor: client.descriptor,
+		options:    options,
+		kinds:      make(map[string]*cacheHandler),
+		queue:      make(chan func(), queueSize),
+	}
+	if options.Types != nil {
+		out.descriptor = options.Types
+	}
+	for _, schema := range out.descriptor {
+		out.kinds[schema.Type] = &cacheHandler{schema: schema, store: cache.NewStore(objectKey)}
+	}
+	return out
+}
+
+// objectKey is the cache key of an object, its namespace and name
+func objectKey(obj interface{}) (string, error) {
+	item, ok := obj.(IstioObject)
+	if !ok {
+		return "", fmt.Errorf("unexpected object %T", obj)
+	}
+	meta := item.GetObjectMeta()
+	if meta.Namespace == "" {
+		return meta.Name, nil
+	}
+	return meta.Namespace + "/" + meta.Name, nil
+}
+
+// reflect lists and watches the objects of a type until stop is closed.
+// Closed watches resume from the last seen version, and the objects are
+// listed again after errors, e.g. when the version expired.
+func (c *storeCache) reflect(handler *cacheHandler, stop <-chan struct{}) {
+	version := ""
+	for {
+		var err error
+		if version == "" {
+			version, err = c.relist(handler)
+		}
+		if err == nil {
+			atomic.StoreInt32(&handler.synced, 1)
+			version, err = c.watch(handler, version, stop)
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			glog.Warningf("%s cache: %v", handler.schema.Type, err)
+			version = ""
+			select {
+			case <-stop:
+				return
+			case <-time.After(retryPeriod):
+			}
+		}
+	}
+}
+
+// relist adds the objects of a type to the cache page by page and removes
+// the cached objects that no longer exist. It returns the version of the
+// list, from which the changes are watched. The pages are recorded as
+// child spans of the span of the list.
+func (c *storeCache) relist(handler *cacheHandler) (string, error) {
+	_, _, p, _ := resourceNames(handler.schema)
+	ctx, span := tracing.Start(context.Background(), "crd.Relist",
+		trace.WithAttributes(attribute.String("config.type", handler.schema.Type)))
+	page := config.ListOptions{Namespace: c.options.Namespace, Limit: c.options.PageSize}
+	seen := make(map[string]bool)
+	for {
+		list, err := c.client.listPage(ctx, handler.schema, page)
+		if err != nil {
+			tracing.End(span, err)
+			return "", err
+		}
+		for _, item := range list.GetItems() {
+			key, _ := objectKey(item)
+			seen[key] = true
+			c.store(handler, item)
+		}
+		glog.V(2).Infof("listed %d %s", len(seen), p)
+		// all pages are served from the snapshot of the first page
+		if page.Continue = list.GetContinue(); page.Continue == "" {
+			for _, key := range handler.store.ListKeys() {
+				if obj, exists, _ := handler.store.GetByKey(key); exists && !seen[key] {
+					c.remove(handler, obj.(IstioObject))
+				}
+			}
+			span.SetAttributes(attribute.Int("config.count", len(seen)))
+			tracing.End(span, nil)
+			return list.GetResourceVersion(), nil
+		}
+	}
+}
+
+// watch applies the changes of the objects of a type from a version to the
+// cache until the watch closes or stop is closed, and returns the version of
+// the last change
+func (c *storeCache) watch(handler *cacheHandler, version string, stop <-chan struct{}) (string, error) {
+	_, _, p, _ := resourceNames(handler.schema)
+	// the span covers opening the watch, not the lifetime of the watch
+	_, span := tracing.Start(context.Background(), "crd.Watch", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("config.type", handler.schema.Type)))
+	w, err := c.client.dynamic.Get().
+		Namespace(c.options.Namespace).
+		Resource(p).
+		VersionedParams(&meta_v1.ListOptions{Watch: true, ResourceVersion: version}, meta_v1.ParameterCodec).
+		Watch()
+	tracing.End(span, err)
+	if err != nil {
+		return "", err
+	}
+	defer w.Stop()
+
+	var resync <-chan time.Time
+	if c.options.ResyncPeriod > 0 {
+		ticker := time.NewTicker(c.options.ResyncPeriod)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+	for {
+		select {
+		case <-stop:
+			return version, nil
+		case <-resync:
+			for _, obj := range handler.store.List() {
+				c.notify(handler, obj.(IstioObject), config.EventUpdate)
+			}
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return version, nil
+			}
+			if event.Type == watch.Error {
+				return "", apierrors.FromObject(event.Object)
+			}
+			item, ok := event.Object.(IstioObject)
+			if !ok {
+				return "", errors.New("unexpected object in watch event")
+			}
+			if event.Type == watch.Deleted {
+				c.remove(handler, item)
+			} else {
+				c.store(handler, item)
+			}
+			version = item.GetObjectMeta().ResourceVersion
+		}
+	}
+}
+
+// store adds or updates an object in the cache and notifies the change
+func (c *storeCache) store(handler *cacheHandler, item IstioObject) {
+	old, exists, _ := handler.store.Get(item)
+	if err := handler.store.Update(item); err != nil {
+		glog.Warning(err)
+		return
+	}
+	switch {
+	case !exists:
+		c.notify(handler, item, config.EventAdd)
+	case !reflect.DeepEqual(old, item):
+		c.notify(handler, item, config.EventUpdate)
+	}
+}
+
+// remove deletes an object from the cache and notifies the deletion
+func (c *storeCache) remove(handler *cacheHandler, item IstioObject) {
+	if err := handler.store.Delete(item); err != nil {
+		glog.Warning(err)
+		return
+	}
+	c.notify(handler, item, config.EventDelete)
+}
+
+// notify converts a cached object and queues the handlers of the type
+func (c *storeCache) notify(handler *cacheHandler, item IstioObject, event config.Event) {
+	if len(handler.handlers) == 0 {
+		return
+	}
+	entry, err := convertObject(handler.schema, item)
+	if err != nil {
+		glog.Warningf("error translating object %s: %v", item.GetObjectMeta().Name, err)
+		return
+	}
+	for _, h := range handler.handlers {
+		h := h
+		c.queue <- func() { h(*entry, event) }
+	}
+}
+
+func (c *storeCache) RegisterEventHandler(typ string, f func(config.Entry, config.Event)) {
+	if handler, ok := c.kinds[typ]; ok {
+		handler.handlers = append(handler.handlers, f)
+	}
+}
+
+func (c *storeCache) HasSynced() bool {
+	for typ, handler := range c.kinds {
+		if atomic.LoadInt32(&handler.synced) == 0 {
+			glog.V(2).Infof("controller %q is syncing...", typ)
+			return false
+		}
+	}
+	return true
+}
+
+func (c *storeCache) Run(stop <-chan struct{}) {
+	for _, handler := range c.kinds {
+		go c.reflect(handler, stop)
+	}
+
+	for {
+		select {
+		case task := <-c.queue:
+			task()
+		case <-stop:
+			glog.V(2).Info("config cache terminated")
+			return
+		}
+	}
+}
+
+func (c *storeCache) Descriptor() config.Descriptor {
+	return c.descriptor
+}
+
+func (c *storeCache) Get(typ, name, namespace string) (*config.Entry, bool) {
+	schema, exists := c.descriptor.GetByType(typ)
+	if !exists {
+		return nil, false
+	}
+
+	key := name
+	if namespace != "" {
+		key = namespace + "/" + name
+	}
+	obj, exists, err := c.kinds[typ].store.GetByKey(key)
+	if err != nil || !exists {
+		return nil, false
+	}
+
+	out, err := convertObject(schema, obj.(IstioObject))
+	if err != nil {
+		glog.Warning(err)
+		return nil, false
+	}
+	return out, true
+}
+
+func (c *storeCache) List(typ, namespace string) ([]config.Entry, error) {
+	return c.ListWithOptions(typ, config.ListOptions{Namespace: namespace})
+}
+
+// ListWithOptions implements store interface.
+// The selectors are evaluated on the cached objects.
+func (c *storeCache) ListWithOptions(typ string, opts config.ListOptions) ([]config.Entry, error) {
+	schema, exists := c.descriptor.GetByType(typ)
+	if !exists {
+		return nil, fmt.Errorf("missing type %q", typ)
+	}
+	match, err := opts.Matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]config.Entry, 0)
+	for _, obj := range c.kinds[typ].store.List() {
+		entry, err := convertObject(schema, obj.(IstioObject))
+		if err != nil {
+			glog.Warning(err)
+			continue
+		}
+		if match(*entry) {
+			out = append(out, *entry)
+		}
+	}
+	// return objects in key order for stable pagination
+	sort.Slice(out, func(i, j int) bool { return out[i].Key() < out[j].Key() })
+	return out, nil
+}
+
+// ListPage implements store interface.
+// Continue tokens are the keys of the cached objects and do not expire.
+func (c *storeCache) ListPage(typ string, opts config.ListOptions) ([]config.Entry, string, error) {
+	entries, err := c.ListWithOptions(typ, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	out, next := config.Paginate(entries, opts)
+	return out, next, nil
+}
+
+// WithContext implements context store interface.
+// The reads are served from the cache, and the writes are made by the
+// client with ctx.
+func (c *storeCache) WithContext(ctx context.Context) config.Store {
+	out := *c
+	out.client = c.client.WithContext(ctx).(*Client)
+	return &out
+}
+
+func (c *storeCache) Create(entry config.Entry) (string, error) {
+	return c.client.Create(entry)
+}
+
+func (c *storeCache) Update(entry config.Entry) (string, error) {
+	return c.client.Update(entry)
+}
+
+// UpdateStatus implements status updater interface
+func (c *storeCache) UpdateStatus(entry config.Entry) (string, error) {
+	return c.client.UpdateStatus(entry)
+}
+
+func (c *storeCache) Delete(typ, name, namespace string) error {
+	return c.client.Delete(typ, name, namespace)
+}
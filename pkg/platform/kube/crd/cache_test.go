@@ -0,0 +1,91 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/testing/mock"
+)
+
+func TestCacheWarmup(t *testing.T) {
+	client, ns, cleanup := makeTempClient(t)
+	defer cleanup()
+
+	const n = 7
+	for i := 0; i < n; i++ {
+		if _, err := client.Create(mock.Make(ns, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a page size smaller than the number of objects forces several pages
+	store := NewCache(client, CacheOptions{Namespace: ns, PageSize: 3})
+	added := make(chan config.Entry, n)
+	deleted := make(chan config.Entry, 1)
+	store.RegisterEventHandler(mock.FakeConfig.Type, func(entry config.Entry, event config.Event) {
+		switch event {
+		case config.EventAdd:
+			added <- entry
+		case config.EventDelete:
+			deleted <- entry
+		}
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go store.Run(stop)
+	if !cache.WaitForCacheSync(stop, store.HasSynced) {
+		t.Fatal("cache failed to sync")
+	}
+
+	l, err := store.List(mock.FakeConfig.Type, ns)
+	if err != nil || len(l) != n {
+		t.Errorf("List() => got %d element(s) (%v), want %d", len(l), err, n)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-added:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got %d add event(s), want %d", i, n)
+		}
+	}
+
+	elt := mock.Make(ns, 0)
+	got, ok := store.Get(elt.Type, elt.Name, elt.Namespace)
+	if !ok || !mock.Compare(elt, *got) {
+		t.Errorf("Get() => got %v, want %v", got, elt)
+	}
+
+	// the changes after the warm-up are watched
+	if err = client.Delete(elt.Type, elt.Name, elt.Namespace); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-deleted:
+		if got.Name != elt.Name {
+			t.Errorf("got delete event of %q, want %q", got.Name, elt.Name)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("got no delete event")
+	}
+	if _, ok = store.Get(elt.Type, elt.Name, elt.Namespace); ok {
+		t.Error("Get() after delete => got the deleted object")
+	}
+}
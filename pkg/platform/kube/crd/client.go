@@ -24,7 +24,10 @@ import (
 
 	"github.com/golang/glog"
 	multierror "github.com/hashicorp/go-multierror"
-	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -32,6 +35,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	// import GKE cluster authentication plugin
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	// import OIDC cluster authentication plugin, e.g. for Tectonic
@@ -40,6 +44,7 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 
 	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/tracing"
 )
 
 // IstioObject is a k8s wrapper interface for config objects
@@ -47,6 +52,8 @@ type IstioObject interface {
 	runtime.Object
 	GetSpec() map[string]interface{}
 	SetSpec(map[string]interface{})
+	GetStatus() *IstioStatus
+	SetStatus(*IstioStatus)
 	GetObjectMeta() meta_v1.ObjectMeta
 	SetObjectMeta(meta_v1.ObjectMeta)
 }
@@ -55,8 +62,15 @@ type IstioObject interface {
 type IstioObjectList interface {
 	runtime.Object
 	GetItems() []IstioObject
+	SetItems([]IstioObject)
+	GetContinue() string
+	GetResourceVersion() string
+	SetResourceVersion(string)
 }
 
+// listPageSize is the number of objects fetched per request when listing all objects
+const listPageSize = 500
+
 // resourceNames creates the k8s crd resource names from the schema.
 // Returns Kind, Singular name, Plural name, and CRD resource name.
 func resourceNames(s config.Schema) (string, string, string, string) {
@@ -69,11 +83,18 @@ func resourceNames(s config.Schema) (string, string, string, string) {
 type Client struct {
 	descriptor config.Descriptor
 
+	// versions served for the CRDs; the client uses the preferred version
+	versions VersionSet
+
 	// restconfig for REST type descriptors
 	restconfig *rest.Config
 
 	// dynamic REST client for accessing config CRDs
 	dynamic *rest.RESTClient
+
+	// ctx of the requests to the API server, whose span is the parent of
+	// the request spans; nil for the background context
+	ctx context.Context
 }
 
 // resolveConfig checks whether to use the in-cluster or out-of-cluster config.
@@ -99,7 +120,30 @@ func resolveConfig(kubeconfig string) (string, error) {
 }
 
 // CreateRESTConfig for cluster API server, pass empty config file for in-cluster
-func CreateRESTConfig(kubeconfig string) (restconfig *rest.Config, err error) {
+func CreateRESTConfig(kubeconfig string) (*rest.Config, error) {
+	return createRESTConfig(kubeconfig, config.IstioAPIVersion)
+}
+
+// CreateInterface creates a client of the core Kubernetes API, pass empty config file for in-cluster
+func CreateInterface(kubeconfig string) (kubernetes.Interface, error) {
+	kube, err := resolveConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	var restconfig *rest.Config
+	if kube == "" {
+		restconfig, err = rest.InClusterConfig()
+	} else {
+		restconfig, err = clientcmd.BuildConfigFromFlags("", kube)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restconfig)
+}
+
+// createRESTConfig for the config types at an API version of the Istio group
+func createRESTConfig(kubeconfig, apiVersion string) (restconfig *rest.Config, err error) {
 	if kubeconfig == "" {
 		restconfig, err = rest.InClusterConfig()
 	} else {
@@ -112,7 +156,7 @@ func CreateRESTConfig(kubeconfig string) (restconfig *rest.Config, err error) {
 
 	version := schema.GroupVersion{
 		Group:   config.IstioAPIGroup,
-		Version: config.IstioAPIVersion,
+		Version: apiVersion,
 	}
 
 	restconfig.GroupVersion = &version
@@ -122,14 +166,18 @@ func CreateRESTConfig(kubeconfig string) (restconfig *rest.Config, err error) {
 	types := runtime.NewScheme()
 	schemeBuilder := runtime.NewSchemeBuilder(
 		func(scheme *runtime.Scheme) error {
+			// register by the kind of the objects, which differs from
+			// the Go type name for the lower case mixer kinds
 			for _, kind := range knownTypes {
-				scheme.AddKnownTypes(version, kind.object, kind.collection)
+				name := kind.object.GetObjectKind().GroupVersionKind().Kind
+				scheme.AddKnownTypeWithName(version.WithKind(name), kind.object)
+				scheme.AddKnownTypeWithName(version.WithKind(name+"List"), kind.collection)
 			}
 			meta_v1.AddToGroupVersion(scheme, version)
 			return nil
 		})
 	err = schemeBuilder.AddToScheme(types)
-	restconfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: serializer.NewCodecFactory(types)}
+	restconfig.NegotiatedSerializer = serializer.WithoutConversionCodecFactory{CodecFactory: serializer.NewCodecFactory(types)}
 
 	return
 }
@@ -138,6 +186,16 @@ func CreateRESTConfig(kubeconfig string) (restconfig *rest.Config, err error) {
 // Use an empty value for `kubeconfig` to use the in-cluster config.
 // If the kubeconfig file is empty, defaults to in-cluster config as well.
 func NewClient(config string, descriptor config.Descriptor) (*Client, error) {
+	return NewVersionedClient(config, descriptor, DefaultVersions)
+}
+
+// NewVersionedClient creates a client for CRDs served at multiple API versions.
+// The client reads and writes objects at the preferred version.
+func NewVersionedClient(config string, descriptor config.Descriptor, versions VersionSet) (*Client, error) {
+	if err := versions.validate(); err != nil {
+		return nil, err
+	}
+
 	for _, typ := range descriptor {
 		if _, exists := knownTypes[typ.Type]; !exists {
 			return nil, fmt.Errorf("missing known type for %q", typ.Type)
@@ -149,7 +207,7 @@ func NewClient(config string, descriptor config.Descriptor) (*Client, error) {
 		return nil, err
 	}
 
-	restconfig, err := CreateRESTConfig(kubeconfig)
+	restconfig, err := createRESTConfig(kubeconfig, versions.preferred())
 	if err != nil {
 		return nil, err
 	}
@@ -161,6 +219,7 @@ func NewClient(config string, descriptor config.Descriptor) (*Client, error) {
 
 	out := &Client{
 		descriptor: descriptor,
+		versions:   versions,
 		restconfig: restconfig,
 		dynamic:    dynamic,
 	}
@@ -175,26 +234,23 @@ func (cl *Client) RegisterResources() error {
 		return err
 	}
 
+	crds := clientset.ApiextensionsV1().CustomResourceDefinitions()
 	for _, schema := range cl.descriptor {
-		k, s, p, name := resourceNames(schema)
-		rd := &apiextensionsv1beta1.CustomResourceDefinition{
-			ObjectMeta: meta_v1.ObjectMeta{
-				Name: name,
-			},
-			Spec: apiextensionsv1beta1.CustomResourceDefinitionSpec{
-				Group:   config.IstioAPIGroup,
-				Version: config.IstioAPIVersion,
-				Scope:   apiextensionsv1beta1.NamespaceScoped,
-				Names: apiextensionsv1beta1.CustomResourceDefinitionNames{
-					Singular: s,
-					Plural:   p,
-					Kind:     k,
-				},
-			},
+		rd, err := cl.resourceDefinition(schema)
+		if err != nil {
+			return err
 		}
 		glog.V(2).Infof("registering CRD %q", rd)
-		_, err = clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Create(rd)
-		if err != nil && !apierrors.IsAlreadyExists(err) {
+		_, err = crds.Create(rd)
+		if apierrors.IsAlreadyExists(err) {
+			// refresh the versions and schema of a CRD registered by an older broker
+			var existing *apiextensionsv1.CustomResourceDefinition
+			if existing, err = crds.Get(rd.Name, meta_v1.GetOptions{}); err == nil {
+				existing.Spec = rd.Spec
+				_, err = crds.Update(existing)
+			}
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -204,19 +260,19 @@ func (cl *Client) RegisterResources() error {
 	descriptor:
 		for _, schema := range cl.descriptor {
 			_, _, _, name := resourceNames(schema)
-			rd, errGet := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Get(name, meta_v1.GetOptions{})
+			rd, errGet := crds.Get(name, meta_v1.GetOptions{})
 			if errGet != nil {
 				return false, errGet
 			}
 			for _, cond := range rd.Status.Conditions {
 				switch cond.Type {
-				case apiextensionsv1beta1.Established:
-					if cond.Status == apiextensionsv1beta1.ConditionTrue {
+				case apiextensionsv1.Established:
+					if cond.Status == apiextensionsv1.ConditionTrue {
 						glog.V(2).Infof("established CRD %q", name)
 						continue descriptor
 					}
-				case apiextensionsv1beta1.NamesAccepted:
-					if cond.Status == apiextensionsv1beta1.ConditionFalse {
+				case apiextensionsv1.NamesAccepted:
+					if cond.Status == apiextensionsv1.ConditionFalse {
 						errGet = multierror.Append(errGet, fmt.Errorf("name conflict: %v", cond.Reason))
 					}
 				}
@@ -230,14 +286,58 @@ func (cl *Client) RegisterResources() error {
 	if errPoll != nil {
 		deleteErr := cl.DeregisterResources()
 		if deleteErr != nil {
-			return multierror.Append(err, deleteErr)
+			return multierror.Append(errPoll, deleteErr)
 		}
-		return err
+		return errPoll
 	}
 
 	return nil
 }
 
+// resourceDefinition creates the CRD of a config type serving all client versions
+func (cl *Client) resourceDefinition(schema config.Schema) (*apiextensionsv1.CustomResourceDefinition, error) {
+	k, s, p, name := resourceNames(schema)
+	validation, err := validationSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]apiextensionsv1.CustomResourceDefinitionVersion, 0, len(cl.versions.Served))
+	for _, v := range cl.versions.Served {
+		versions = append(versions, apiextensionsv1.CustomResourceDefinitionVersion{
+			Name:    v,
+			Served:  true,
+			Storage: v == cl.versions.Storage,
+			Schema: &apiextensionsv1.CustomResourceValidation{
+				OpenAPIV3Schema: validation,
+			},
+			AdditionalPrinterColumns: printerColumns[schema.Type],
+			Subresources: &apiextensionsv1.CustomResourceSubresources{
+				Status: &apiextensionsv1.CustomResourceSubresourceStatus{},
+			},
+		})
+	}
+
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name: name,
+		},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: config.IstioAPIGroup,
+			Scope: apiextensionsv1.NamespaceScoped,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Singular:   s,
+				Plural:     p,
+				Kind:       k,
+				ShortNames: shortNames[schema.Type],
+				Categories: resourceCategories(schema),
+			},
+			Versions:   versions,
+			Conversion: cl.versions.conversion(),
+		},
+	}, nil
+}
+
 // DeregisterResources removes third party resources
 func (cl *Client) DeregisterResources() error {
 	clientset, err := apiextensionsclient.NewForConfig(cl.restconfig)
@@ -248,7 +348,7 @@ func (cl *Client) DeregisterResources() error {
 	var errs error
 	for _, schema := range cl.descriptor {
 		_, _, _, name := resourceNames(schema)
-		err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(name, nil)
+		err := clientset.ApiextensionsV1().CustomResourceDefinitions().Delete(name, nil)
 		errs = multierror.Append(errs, err)
 	}
 	return errs
@@ -259,6 +359,32 @@ func (cl *Client) Descriptor() config.Descriptor {
 	return cl.descriptor
 }
 
+// WithContext implements context store interface.
+// The returned client makes its requests with ctx, and records them as
+// child spans of the span of ctx.
+func (cl *Client) WithContext(ctx context.Context) config.Store {
+	out := *cl
+	out.ctx = ctx
+	return &out
+}
+
+// start creates a client span for a request to the API server on the
+// objects of a type, and returns the context of the request
+func (cl *Client) start(name, typ, namespace, objectName string) (context.Context, trace.Span) {
+	ctx := cl.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	attrs := []attribute.KeyValue{attribute.String("config.type", typ)}
+	if namespace != "" {
+		attrs = append(attrs, attribute.String("config.namespace", namespace))
+	}
+	if objectName != "" {
+		attrs = append(attrs, attribute.String("config.name", objectName))
+	}
+	return tracing.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
 // Get implements store interface
 func (cl *Client) Get(typ, name, namespace string) (*config.Entry, bool) {
 	schema, exists := cl.descriptor.GetByType(typ)
@@ -267,12 +393,20 @@ func (cl *Client) Get(typ, name, namespace string) (*config.Entry, bool) {
 	}
 	_, _, p, _ := resourceNames(schema)
 
+	ctx, span := cl.start("crd.Get", typ, namespace, name)
 	entry := knownTypes[typ].object.DeepCopyObject().(IstioObject)
 	err := cl.dynamic.Get().
+		Context(ctx).
 		Namespace(namespace).
 		Resource(p).
 		Name(name).
 		Do().Into(entry)
+	// a missing object is an answer rather than a failure of the request
+	if apierrors.IsNotFound(err) {
+		tracing.End(span, nil)
+	} else {
+		tracing.End(span, err)
+	}
 
 	if err != nil {
 		glog.Warning(err)
@@ -298,18 +432,21 @@ func (cl *Client) Create(entry config.Entry) (string, error) {
 		return "", multierror.Prefix(err, "validation error:")
 	}
 
-	out, err := convertConfig(schema, entry)
+	out, err := convertConfig(schema, entry, cl.versions.preferred())
 	if err != nil {
 		return "", err
 	}
 
 	_, _, p, _ := resourceNames(schema)
+	ctx, span := cl.start("crd.Create", entry.Type, out.GetObjectMeta().Namespace, out.GetObjectMeta().Name)
 	obj := knownTypes[schema.Type].object.DeepCopyObject().(IstioObject)
 	err = cl.dynamic.Post().
+		Context(ctx).
 		Namespace(out.GetObjectMeta().Namespace).
 		Resource(p).
 		Body(out).
 		Do().Into(obj)
+	tracing.End(span, err)
 	if err != nil {
 		return "", err
 	}
@@ -332,19 +469,57 @@ func (cl *Client) Update(entry config.Entry) (string, error) {
 		return "", fmt.Errorf("revision is required")
 	}
 
-	out, err := convertConfig(schema, entry)
+	out, err := convertConfig(schema, entry, cl.versions.preferred())
+	if err != nil {
+		return "", err
+	}
+
+	_, _, p, _ := resourceNames(schema)
+	ctx, span := cl.start("crd.Update", entry.Type, out.GetObjectMeta().Namespace, out.GetObjectMeta().Name)
+	obj := knownTypes[schema.Type].object.DeepCopyObject().(IstioObject)
+	err = cl.dynamic.Put().
+		Context(ctx).
+		Namespace(out.GetObjectMeta().Namespace).
+		Resource(p).
+		Name(out.GetObjectMeta().Name).
+		Body(out).
+		Do().Into(obj)
+	tracing.End(span, err)
+	if err != nil {
+		return "", err
+	}
+
+	return obj.GetObjectMeta().ResourceVersion, nil
+}
+
+// UpdateStatus implements status updater interface
+func (cl *Client) UpdateStatus(entry config.Entry) (string, error) {
+	schema, exists := cl.descriptor.GetByType(entry.Type)
+	if !exists {
+		return "", fmt.Errorf("unrecognized type %q", entry.Type)
+	}
+
+	if entry.ResourceVersion == "" {
+		return "", fmt.Errorf("revision is required")
+	}
+
+	out, err := convertConfig(schema, entry, cl.versions.preferred())
 	if err != nil {
 		return "", err
 	}
 
 	_, _, p, _ := resourceNames(schema)
+	ctx, span := cl.start("crd.UpdateStatus", entry.Type, out.GetObjectMeta().Namespace, out.GetObjectMeta().Name)
 	obj := knownTypes[schema.Type].object.DeepCopyObject().(IstioObject)
 	err = cl.dynamic.Put().
+		Context(ctx).
 		Namespace(out.GetObjectMeta().Namespace).
 		Resource(p).
 		Name(out.GetObjectMeta().Name).
+		SubResource("status").
 		Body(out).
 		Do().Into(obj)
+	tracing.End(span, err)
 	if err != nil {
 		return "", err
 	}
@@ -360,34 +535,107 @@ func (cl *Client) Delete(typ, name, namespace string) error {
 	}
 
 	_, _, p, _ := resourceNames(schema)
-	return cl.dynamic.Delete().
+	ctx, span := cl.start("crd.Delete", typ, namespace, name)
+	err := cl.dynamic.Delete().
+		Context(ctx).
 		Namespace(namespace).
 		Resource(p).
 		Name(name).
 		Do().Error()
+	tracing.End(span, err)
+	return err
 }
 
 // List implements store interface
 func (cl *Client) List(typ, namespace string) ([]config.Entry, error) {
+	return cl.ListWithOptions(typ, config.ListOptions{Namespace: namespace})
+}
+
+// ListWithOptions implements store interface.
+// Label and field selectors are evaluated by the API server, and the objects
+// are fetched in pages of at most listPageSize objects.
+func (cl *Client) ListWithOptions(typ string, opts config.ListOptions) ([]config.Entry, error) {
 	schema, exists := cl.descriptor.GetByType(typ)
 	if !exists {
 		return nil, fmt.Errorf("missing type %q", typ)
 	}
-	list := knownTypes[schema.Type].collection.DeepCopyObject().(IstioObjectList) // nolint
-	_, _, p, _ := resourceNames(schema)
-	errs := cl.dynamic.Get().
-		Namespace(namespace).
-		Resource(p).
-		Do().Into(list)
+	// reject malformed selectors before the round trip
+	if _, err := opts.Matcher(); err != nil {
+		return nil, err
+	}
+
+	if opts.Limit <= 0 {
+		opts.Limit = listPageSize
+	}
+	opts.Continue = ""
 
+	// the pages are child spans of the list
+	ctx, span := cl.start("crd.List", typ, opts.Namespace, "")
+	var errs error
 	out := make([]config.Entry, 0)
-	for _, item := range list.GetItems() { // nolint
-		obj, err := convertObject(schema, item)
+	for {
+		list, err := cl.listPage(ctx, schema, opts)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			tracing.End(span, errs)
+			return out, errs
+		}
+		entries, err := convertList(schema, list)
 		if err != nil {
 			errs = multierror.Append(errs, err)
-		} else {
-			out = append(out, *obj)
 		}
+		out = append(out, entries...)
+		if opts.Continue = list.GetContinue(); opts.Continue == "" {
+			tracing.End(span, errs)
+			return out, errs
+		}
+	}
+}
+
+// ListPage implements store interface.
+// Continue tokens are issued by the API server and expire with the etcd compaction window.
+func (cl *Client) ListPage(typ string, opts config.ListOptions) ([]config.Entry, string, error) {
+	schema, exists := cl.descriptor.GetByType(typ)
+	if !exists {
+		return nil, "", fmt.Errorf("missing type %q", typ)
+	}
+	if _, err := opts.Matcher(); err != nil {
+		return nil, "", err
+	}
+
+	list, err := cl.listPage(cl.ctx, schema, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	out, err := convertList(schema, list)
+	return out, list.GetContinue(), err
+}
+
+// listPage fetches a single page of objects from the API server, recorded
+// as a child span of the span of ctx
+func (cl *Client) listPage(ctx context.Context, schema config.Schema,
+	opts config.ListOptions) (IstioObjectList, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracing.Start(ctx, "crd.ListPage", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("config.type", schema.Type), attribute.Int64("config.limit", opts.Limit)))
+	list := knownTypes[schema.Type].collection.DeepCopyObject().(IstioObjectList) // nolint
+	_, _, p, _ := resourceNames(schema)
+	err := cl.dynamic.Get().
+		Context(ctx).
+		Namespace(opts.Namespace).
+		Resource(p).
+		VersionedParams(&meta_v1.ListOptions{
+			LabelSelector: opts.LabelSelector,
+			FieldSelector: opts.FieldSelector,
+			Limit:         opts.Limit,
+			Continue:      opts.Continue,
+		}, meta_v1.ParameterCodec).
+		Do().Into(list)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
 	}
-	return out, errs
+	return list, nil
 }
@@ -103,3 +103,15 @@ func TestBrokerConfig(t *testing.T) {
 	defer cleanup()
 	mock.CheckBrokerConfigTypes(client, ns, t)
 }
+
+func TestListOptions(t *testing.T) {
+	client, ns, cleanup := makeTempClient(t)
+	defer cleanup()
+	mock.CheckListOptions(client, t, ns, 5)
+}
+
+func TestListPage(t *testing.T) {
+	client, ns, cleanup := makeTempClient(t)
+	defer cleanup()
+	mock.CheckListPage(client, t, ns, 7, 3)
+}
@@ -17,7 +17,9 @@ package crd
 import (
 	"strings"
 
+	multierror "github.com/hashicorp/go-multierror"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sschema "k8s.io/apimachinery/pkg/runtime/schema"
 
 	"istio.io/broker/pkg/model/config"
 )
@@ -29,7 +31,7 @@ func convertObject(schema config.Schema, object IstioObject) (*config.Entry, err
 		return nil, err
 	}
 	meta := object.GetObjectMeta()
-	return &config.Entry{
+	out := &config.Entry{
 		Meta: config.Meta{
 			Type:            schema.Type,
 			Name:            meta.Name,
@@ -37,26 +39,56 @@ func convertObject(schema config.Schema, object IstioObject) (*config.Entry, err
 			Labels:          meta.Labels,
 			Annotations:     meta.Annotations,
 			ResourceVersion: meta.ResourceVersion,
+			Finalizers:      meta.Finalizers,
 		},
-		Spec: data,
-	}, nil
+		Spec:   data,
+		Status: convertStatus(object.GetStatus()),
+	}
+	if meta.DeletionTimestamp != nil {
+		deleted := meta.DeletionTimestamp.Time
+		out.DeletionTimestamp = &deleted
+	}
+	return out, nil
 }
 
-// convertConfig translates Broker config to k8s config JSON
-func convertConfig(schema config.Schema, entry config.Entry) (IstioObject, error) {
+// convertList translates the items of a k8s list, skipping the items that fail to convert
+func convertList(schema config.Schema, list IstioObjectList) ([]config.Entry, error) {
+	var errs error
+	out := make([]config.Entry, 0, len(list.GetItems()))
+	for _, item := range list.GetItems() {
+		obj, err := convertObject(schema, item)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		} else {
+			out = append(out, *obj)
+		}
+	}
+	return out, errs
+}
+
+// convertConfig translates Broker config to k8s config JSON at an API version of the Istio group
+func convertConfig(schema config.Schema, entry config.Entry, apiVersion string) (IstioObject, error) {
 	spec, err := schema.ToJSONMap(entry.Spec)
 	if err != nil {
 		return nil, err
 	}
 	out := knownTypes[schema.Type].object.DeepCopyObject().(IstioObject)
+	// the known types are declared at the default version
+	out.GetObjectKind().SetGroupVersionKind(k8sschema.GroupVersionKind{
+		Group:   config.IstioAPIGroup,
+		Version: apiVersion,
+		Kind:    out.GetObjectKind().GroupVersionKind().Kind,
+	})
 	out.SetObjectMeta(meta_v1.ObjectMeta{
 		Name:            entry.Name,
 		Namespace:       entry.Namespace,
 		ResourceVersion: entry.ResourceVersion,
 		Labels:          entry.Labels,
 		Annotations:     entry.Annotations,
+		Finalizers:      entry.Finalizers,
 	})
 	out.SetSpec(spec)
+	out.SetStatus(convertConfigStatus(entry.Status))
 
 	return out, nil
 }
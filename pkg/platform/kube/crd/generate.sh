@@ -58,7 +58,7 @@ var knownTypes = map[string]struct {
 }{
 EOF
 
-CRDS="ServiceClass ServicePlan"
+CRDS="ServiceClass ServicePlan ServiceInstance ServiceBinding BindingCertificate MeteringEvent RouteRule DestinationPolicy EgressRule"
 
 for crd in $CRDS; do
 cat << EOF
@@ -75,6 +75,28 @@ EOF
 
 done
 
+# Mixer kinds are lower case, so the Go types are named after the config types
+MIXER="MemQuota:memquota Quota:quota MixerRule:rule"
+
+MIXER_TYPES=""
+for pair in $MIXER; do
+crd=${pair%%:*}
+kind=${pair##*:}
+MIXER_TYPES="$MIXER_TYPES $crd"
+cat << EOF
+	config.$crd.Type: {
+		object: &${crd}{
+			TypeMeta: meta_v1.TypeMeta{
+				Kind:       "${kind}",
+				APIVersion: config.IstioAPIVersion,
+			},
+		},
+		collection: &${crd}List{},
+	},
+EOF
+
+done
+
 TEST="FakeConfig"
 
 for crd in $TEST; do
@@ -96,7 +118,7 @@ cat <<EOF
 }
 EOF
 
-for crd in $CRDS $TEST; do
+for crd in $CRDS $MIXER_TYPES $TEST; do
   sed -e "1,22d;s/IstioKind/$crd/g" pkg/platform/kube/crd/template.go
 done
 
@@ -0,0 +1,82 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	"istio.io/broker/pkg/model/config"
+)
+
+// This file describes how broker config types are presented by kubectl.
+
+// brokerCategory groups all broker resources, e.g. "kubectl get istio-broker"
+const brokerCategory = "istio-broker"
+
+// shortNames lists the kubectl aliases per config type
+var shortNames = map[string][]string{
+	config.ServiceClass.Type:    {"brkclass"},
+	config.ServicePlan.Type:     {"brkplan"},
+	config.ServiceInstance.Type: {"brkinst"},
+	config.ServiceBinding.Type:  {"brkbind"},
+
+	config.BindingCertificate.Type: {"brkcert"},
+	config.MeteringEvent.Type:      {"brkmeter"},
+}
+
+// printerColumns lists the additional kubectl columns per config type
+var printerColumns = map[string][]apiextensionsv1.CustomResourceColumnDefinition{
+	config.ServiceClass.Type: {
+		{Name: "Service", Type: "string", JSONPath: ".spec.entry.name", Description: "OSB service name"},
+		{Name: "OSB ID", Type: "string", JSONPath: ".spec.entry.id", Description: "OSB service id"},
+		{Name: "Instance", Type: "string", JSONPath: ".spec.deployment.instance", Description: "Backing mesh service"},
+		readyColumn,
+		{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+	},
+	config.ServicePlan.Type: {
+		{Name: "Plan", Type: "string", JSONPath: ".spec.plan.name", Description: "OSB plan name"},
+		{Name: "OSB ID", Type: "string", JSONPath: ".spec.plan.id", Description: "OSB plan id"},
+		{Name: "Services", Type: "string", JSONPath: ".spec.services", Description: "Service classes offering the plan"},
+		readyColumn,
+		{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+	},
+	config.ServiceInstance.Type: {
+		{Name: "Class", Type: "string", JSONPath: ".spec.serviceClass", Description: "Service class of the instance"},
+		{Name: "Plan", Type: "string", JSONPath: ".spec.servicePlan", Description: "Service plan of the instance"},
+		{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+	},
+	config.ServiceBinding.Type: {
+		{Name: "Instance", Type: "string", JSONPath: ".spec.instanceId", Description: "Service instance bound to"},
+		{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+	},
+	config.BindingCertificate.Type: {
+		{Name: "Binding", Type: "string", JSONPath: ".spec.bindingId", Description: "Binding the certificate was issued for"},
+		{Name: "Expires", Type: "string", JSONPath: ".spec.notAfter", Description: "Expiration of the certificate"},
+		{Name: "Revoked", Type: "string", JSONPath: ".spec.revokedAt", Description: "Revocation of the certificate"},
+	},
+	config.MeteringEvent.Type: {
+		{Name: "Type", Type: "string", JSONPath: ".spec.type", Description: "Kind of the change"},
+		{Name: "Instance", Type: "string", JSONPath: ".spec.instanceId", Description: "Service instance changed"},
+		{Name: "Time", Type: "string", JSONPath: ".spec.time", Description: "Time of the change"},
+	},
+}
+
+// resourceCategories lists the kubectl categories of a config type
+func resourceCategories(s config.Schema) []string {
+	if _, ok := config.BrokerConfigTypes.GetByType(s.Type); ok {
+		return []string{brokerCategory}
+	}
+	return nil
+}
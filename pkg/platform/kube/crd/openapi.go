@@ -0,0 +1,267 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	"istio.io/broker/pkg/model/config"
+)
+
+// describedMessage is implemented by generated protobuf messages that carry
+// their compressed file descriptor.
+type describedMessage interface {
+	proto.Message
+	Descriptor() ([]byte, []int)
+}
+
+var preserveUnknownFields = true
+
+// wellKnownSchemas maps protobuf well-known types to the schema of their
+// canonical JSON encoding.
+var wellKnownSchemas = map[string]apiextensionsv1.JSONSchemaProps{
+	"google.protobuf.Any":         {Type: "object", XPreserveUnknownFields: &preserveUnknownFields},
+	"google.protobuf.Struct":      {Type: "object", XPreserveUnknownFields: &preserveUnknownFields},
+	"google.protobuf.Value":       {XPreserveUnknownFields: &preserveUnknownFields},
+	"google.protobuf.ListValue":   {Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &apiextensionsv1.JSONSchemaProps{XPreserveUnknownFields: &preserveUnknownFields}}},
+	"google.protobuf.Duration":    {Type: "string"},
+	"google.protobuf.Timestamp":   {Type: "string", Format: "date-time"},
+	"google.protobuf.StringValue": {Type: "string"},
+	"google.protobuf.BytesValue":  {Type: "string", Format: "byte"},
+	"google.protobuf.BoolValue":   {Type: "boolean"},
+	"google.protobuf.DoubleValue": {Type: "number"},
+	"google.protobuf.FloatValue":  {Type: "number"},
+	"google.protobuf.Int32Value":  {Type: "integer", Format: "int32"},
+	"google.protobuf.UInt32Value": {Type: "integer"},
+	"google.protobuf.Int64Value":  {XIntOrString: true},
+	"google.protobuf.UInt64Value": {XIntOrString: true},
+}
+
+// validationSchema generates the OpenAPI v3 validation schema of a custom
+// resource from the protobuf descriptor of its spec message.
+// The schema follows the canonical proto3 JSON encoding used by the store.
+func validationSchema(s config.Schema) (*apiextensionsv1.JSONSchemaProps, error) {
+	spec, err := messageSchema(s.MessageName, map[string]bool{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate schema for %q: %v", s.Type, err)
+	}
+	return &apiextensionsv1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"spec":   *spec,
+			"status": statusSchema,
+		},
+	}, nil
+}
+
+// messageSchema generates the schema for a message by its full name.
+// Visiting tracks the messages on the current path to stop on recursive types.
+func messageSchema(name string, visiting map[string]bool) (*apiextensionsv1.JSONSchemaProps, error) {
+	if wk, ok := wellKnownSchemas[name]; ok {
+		return &wk, nil
+	}
+	if visiting[name] {
+		return &apiextensionsv1.JSONSchemaProps{Type: "object", XPreserveUnknownFields: &preserveUnknownFields}, nil
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	md, err := messageDescriptor(name)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &apiextensionsv1.JSONSchemaProps{
+		Type:       "object",
+		Properties: make(map[string]apiextensionsv1.JSONSchemaProps, len(md.GetField())),
+	}
+	for _, field := range md.GetField() {
+		fs, err := fieldSchema(md, field, visiting)
+		if err != nil {
+			return nil, fmt.Errorf("field %s.%s: %v", name, field.GetName(), err)
+		}
+		out.Properties[jsonName(field)] = *fs
+	}
+	return out, nil
+}
+
+// fieldSchema generates the schema for a single message field
+func fieldSchema(parent *descpb.DescriptorProto, field *descpb.FieldDescriptorProto,
+	visiting map[string]bool) (*apiextensionsv1.JSONSchemaProps, error) {
+	if field.GetLabel() == descpb.FieldDescriptorProto_LABEL_REPEATED {
+		// map fields are encoded as repeated synthetic entry messages
+		if entry := mapEntry(parent, field); entry != nil {
+			value, err := scalarSchema(entry.GetField()[1], visiting)
+			if err != nil {
+				return nil, err
+			}
+			return &apiextensionsv1.JSONSchemaProps{
+				Type:                 "object",
+				AdditionalProperties: &apiextensionsv1.JSONSchemaPropsOrBool{Allows: true, Schema: value},
+			}, nil
+		}
+		item, err := scalarSchema(field, visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &apiextensionsv1.JSONSchemaProps{
+			Type:  "array",
+			Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: item},
+		}, nil
+	}
+	return scalarSchema(field, visiting)
+}
+
+// scalarSchema generates the schema for a singular value of the field type
+func scalarSchema(field *descpb.FieldDescriptorProto, visiting map[string]bool) (*apiextensionsv1.JSONSchemaProps, error) {
+	switch field.GetType() {
+	case descpb.FieldDescriptorProto_TYPE_STRING:
+		return &apiextensionsv1.JSONSchemaProps{Type: "string"}, nil
+	case descpb.FieldDescriptorProto_TYPE_BYTES:
+		return &apiextensionsv1.JSONSchemaProps{Type: "string", Format: "byte"}, nil
+	case descpb.FieldDescriptorProto_TYPE_BOOL:
+		return &apiextensionsv1.JSONSchemaProps{Type: "boolean"}, nil
+	case descpb.FieldDescriptorProto_TYPE_DOUBLE, descpb.FieldDescriptorProto_TYPE_FLOAT:
+		return &apiextensionsv1.JSONSchemaProps{Type: "number"}, nil
+	case descpb.FieldDescriptorProto_TYPE_INT32, descpb.FieldDescriptorProto_TYPE_SINT32,
+		descpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return &apiextensionsv1.JSONSchemaProps{Type: "integer", Format: "int32"}, nil
+	case descpb.FieldDescriptorProto_TYPE_UINT32, descpb.FieldDescriptorProto_TYPE_FIXED32:
+		return &apiextensionsv1.JSONSchemaProps{Type: "integer"}, nil
+	case descpb.FieldDescriptorProto_TYPE_INT64, descpb.FieldDescriptorProto_TYPE_SINT64,
+		descpb.FieldDescriptorProto_TYPE_SFIXED64, descpb.FieldDescriptorProto_TYPE_UINT64,
+		descpb.FieldDescriptorProto_TYPE_FIXED64:
+		// 64-bit integers are encoded as JSON strings but decoded from either form
+		return &apiextensionsv1.JSONSchemaProps{XIntOrString: true}, nil
+	case descpb.FieldDescriptorProto_TYPE_ENUM:
+		return enumSchema(typeName(field))
+	case descpb.FieldDescriptorProto_TYPE_MESSAGE:
+		return messageSchema(typeName(field), visiting)
+	default:
+		return nil, fmt.Errorf("unsupported field type %v", field.GetType())
+	}
+}
+
+// enumSchema generates a string schema restricted to the enum value names
+func enumSchema(name string) (*apiextensionsv1.JSONSchemaProps, error) {
+	values := proto.EnumValueMap(name)
+	if values == nil {
+		return nil, fmt.Errorf("unknown enum type %q", name)
+	}
+	names := make([]string, 0, len(values))
+	for v := range values {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+
+	out := &apiextensionsv1.JSONSchemaProps{Type: "string"}
+	for _, v := range names {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		out.Enum = append(out.Enum, apiextensionsv1.JSON{Raw: raw})
+	}
+	return out, nil
+}
+
+// mapEntry returns the synthetic map entry type of the field if it is a map field
+func mapEntry(parent *descpb.DescriptorProto, field *descpb.FieldDescriptorProto) *descpb.DescriptorProto {
+	if field.GetType() != descpb.FieldDescriptorProto_TYPE_MESSAGE {
+		return nil
+	}
+	name := typeName(field)
+	for _, nested := range parent.GetNestedType() {
+		if nested.GetOptions().GetMapEntry() && strings.HasSuffix(name, "."+nested.GetName()) {
+			return nested
+		}
+	}
+	return nil
+}
+
+// messageDescriptor locates the descriptor of a registered message by its full name
+func messageDescriptor(name string) (*descpb.DescriptorProto, error) {
+	t := proto.MessageType(name)
+	if t == nil {
+		return nil, fmt.Errorf("unknown message type %q", name)
+	}
+	msg, ok := reflect.New(t.Elem()).Interface().(describedMessage)
+	if !ok {
+		return nil, fmt.Errorf("message type %q does not expose a descriptor", name)
+	}
+
+	gz, path := msg.Descriptor()
+	fd, err := decodeFileDescriptor(gz)
+	if err != nil {
+		return nil, fmt.Errorf("bad descriptor for %q: %v", name, err)
+	}
+	if len(path) == 0 || path[0] >= len(fd.GetMessageType()) {
+		return nil, fmt.Errorf("bad descriptor path %v for %q", path, name)
+	}
+	md := fd.GetMessageType()[path[0]]
+	for _, i := range path[1:] {
+		if i >= len(md.GetNestedType()) {
+			return nil, fmt.Errorf("bad descriptor path %v for %q", path, name)
+		}
+		md = md.GetNestedType()[i]
+	}
+	return md, nil
+}
+
+// decodeFileDescriptor unpacks a gzipped serialized file descriptor
+func decodeFileDescriptor(gz []byte) (*descpb.FileDescriptorProto, error) {
+	r, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	fd := &descpb.FileDescriptorProto{}
+	if err = proto.Unmarshal(b, fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// typeName strips the leading dot of a fully qualified type reference
+func typeName(field *descpb.FieldDescriptorProto) string {
+	return strings.TrimPrefix(field.GetTypeName(), ".")
+}
+
+// jsonName returns the lowerCamelCase proto3 JSON name of a field
+func jsonName(field *descpb.FieldDescriptorProto) string {
+	if field.GetJsonName() != "" {
+		return field.GetJsonName()
+	}
+	words := strings.Split(field.GetName(), "_")
+	out := words[0]
+	for _, word := range words[1:] {
+		out = out + strings.Title(word)
+	}
+	return out
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/testing/mock"
+)
+
+// lookup walks the object properties of a schema along a path
+func lookup(s *apiextensionsv1.JSONSchemaProps, path ...string) (*apiextensionsv1.JSONSchemaProps, bool) {
+	for _, p := range path {
+		if s.Type == "array" && s.Items != nil {
+			s = s.Items.Schema
+		}
+		next, ok := s.Properties[p]
+		if !ok {
+			return nil, false
+		}
+		s = &next
+	}
+	return s, true
+}
+
+func TestValidationSchema(t *testing.T) {
+	cases := []struct {
+		schema config.Schema
+		path   []string
+		want   string
+	}{
+		{config.ServiceClass, []string{"spec"}, "object"},
+		{config.ServiceClass, []string{"spec", "deployment", "instance"}, "string"},
+		{config.ServiceClass, []string{"spec", "entry", "id"}, "string"},
+		{config.ServicePlan, []string{"spec", "plan", "description"}, "string"},
+		{config.ServicePlan, []string{"spec", "services"}, "array"},
+		{mock.FakeConfig, []string{"spec", "key"}, "string"},
+		{mock.FakeConfig, []string{"spec", "pairs"}, "array"},
+		{mock.FakeConfig, []string{"spec", "pairs", "value"}, "string"},
+	}
+
+	for _, c := range cases {
+		s, err := validationSchema(c.schema)
+		if err != nil {
+			t.Errorf("validationSchema(%s) => got %v", c.schema.Type, err)
+			continue
+		}
+		got, ok := lookup(s, c.path...)
+		if !ok {
+			t.Errorf("validationSchema(%s) => missing %v", c.schema.Type, c.path)
+			continue
+		}
+		if got.Type != c.want {
+			t.Errorf("validationSchema(%s) at %v => got %q, want %q", c.schema.Type, c.path, got.Type, c.want)
+		}
+	}
+
+	if _, err := validationSchema(config.Schema{Type: "missing", MessageName: "missing.Message"}); err == nil {
+		t.Error("expected error for unknown message type")
+	}
+}
+
+func TestJSONName(t *testing.T) {
+	cases := []struct {
+		field *descpb.FieldDescriptorProto
+		want  string
+	}{
+		{&descpb.FieldDescriptorProto{Name: proto.String("instance")}, "instance"},
+		{&descpb.FieldDescriptorProto{Name: proto.String("plan_updateable")}, "planUpdateable"},
+		{&descpb.FieldDescriptorProto{Name: proto.String("a_b"), JsonName: proto.String("aB")}, "aB"},
+	}
+	for _, c := range cases {
+		if got := jsonName(c.field); got != c.want {
+			t.Errorf("jsonName(%q) => got %q, want %q", c.field.GetName(), got, c.want)
+		}
+	}
+}
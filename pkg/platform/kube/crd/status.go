@@ -0,0 +1,118 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/broker/pkg/model/config"
+)
+
+// IstioStatus is the status subresource shared by all config kinds
+type IstioStatus struct {
+	Conditions []IstioCondition `json:"conditions,omitempty"`
+}
+
+// IstioCondition is a single status condition of a config kind
+type IstioCondition struct {
+	Type               string       `json:"type"`
+	Status             string       `json:"status"`
+	Reason             string       `json:"reason,omitempty"`
+	Message            string       `json:"message,omitempty"`
+	LastTransitionTime meta_v1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// DeepCopy copies the receiver, creating a new IstioStatus.
+func (in *IstioStatus) DeepCopy() *IstioStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioStatus)
+	if in.Conditions != nil {
+		out.Conditions = make([]IstioCondition, len(in.Conditions))
+		for i := range in.Conditions {
+			out.Conditions[i] = in.Conditions[i]
+			in.Conditions[i].LastTransitionTime.DeepCopyInto(&out.Conditions[i].LastTransitionTime)
+		}
+	}
+	return out
+}
+
+// statusSchema is the structural schema of the status subresource
+var statusSchema = apiextensionsv1.JSONSchemaProps{
+	Type: "object",
+	Properties: map[string]apiextensionsv1.JSONSchemaProps{
+		"conditions": {
+			Type: "array",
+			Items: &apiextensionsv1.JSONSchemaPropsOrArray{
+				Schema: &apiextensionsv1.JSONSchemaProps{
+					Type:     "object",
+					Required: []string{"type", "status"},
+					Properties: map[string]apiextensionsv1.JSONSchemaProps{
+						"type":               {Type: "string"},
+						"status":             {Type: "string"},
+						"reason":             {Type: "string"},
+						"message":            {Type: "string"},
+						"lastTransitionTime": {Type: "string", Format: "date-time"},
+					},
+				},
+			},
+		},
+	},
+}
+
+// readyColumn shows the Ready condition of an object in kubectl
+var readyColumn = apiextensionsv1.CustomResourceColumnDefinition{
+	Name:     "Ready",
+	Type:     "string",
+	JSONPath: `.status.conditions[?(@.type=="Ready")].status`,
+}
+
+// convertStatus translates k8s status to Broker status
+func convertStatus(in *IstioStatus) *config.Status {
+	if in == nil {
+		return nil
+	}
+	out := &config.Status{}
+	for _, c := range in.Conditions {
+		out.Conditions = append(out.Conditions, config.Condition{
+			Type:               config.ConditionType(c.Type),
+			Status:             config.ConditionStatus(c.Status),
+			Reason:             c.Reason,
+			Message:            c.Message,
+			LastTransitionTime: c.LastTransitionTime.Time,
+		})
+	}
+	return out
+}
+
+// convertConfigStatus translates Broker status to k8s status
+func convertConfigStatus(in *config.Status) *IstioStatus {
+	if in == nil {
+		return nil
+	}
+	out := &IstioStatus{}
+	for _, c := range in.Conditions {
+		out.Conditions = append(out.Conditions, IstioCondition{
+			Type:               string(c.Type),
+			Status:             string(c.Status),
+			Reason:             c.Reason,
+			Message:            c.Message,
+			LastTransitionTime: meta_v1.NewTime(c.LastTransitionTime),
+		})
+	}
+	return out
+}
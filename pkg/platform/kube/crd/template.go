@@ -26,6 +26,7 @@ type IstioKind struct {
 	meta_v1.TypeMeta   `json:",inline"`
 	meta_v1.ObjectMeta `json:"metadata"`
 	Spec               map[string]interface{} `json:"spec"`
+	Status             *IstioStatus           `json:"status,omitempty"`
 }
 
 // GetSpec from a wrapper
@@ -38,6 +39,16 @@ func (in *IstioKind) SetSpec(spec map[string]interface{}) {
 	in.Spec = spec
 }
 
+// GetStatus from a wrapper
+func (in *IstioKind) GetStatus() *IstioStatus {
+	return in.Status
+}
+
+// SetStatus for a wrapper
+func (in *IstioKind) SetStatus(status *IstioStatus) {
+	in.Status = status
+}
+
 // GetObjectMeta from a wrapper
 func (in *IstioKind) GetObjectMeta() meta_v1.ObjectMeta {
 	return in.ObjectMeta
@@ -64,12 +75,21 @@ func (in *IstioKindList) GetItems() []IstioObject {
 	return out
 }
 
+// SetItems for a wrapper
+func (in *IstioKindList) SetItems(items []IstioObject) {
+	in.Items = make([]*IstioKind, len(items))
+	for i, v := range items {
+		in.Items[i] = v.(*IstioKind)
+	}
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IstioKind) DeepCopyInto(out *IstioKind) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	out.Spec = in.Spec
+	out.Status = in.Status.DeepCopy()
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioKind.
@@ -100,7 +120,7 @@ func (in *IstioKindList) DeepCopyInto(out *IstioKindList) {
 		in, out := &in.Items, &out.Items
 		*out = make([]*IstioKind, len(*in))
 		for i := range *in {
-			(*in)[i].DeepCopyInto((*out)[i])
+			(*out)[i] = (*in)[i].DeepCopy()
 		}
 	}
 }
@@ -0,0 +1,162 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"errors"
+	"fmt"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	"istio.io/broker/pkg/model/config"
+)
+
+// VersionSet describes the API versions served for the config custom resources.
+type VersionSet struct {
+	// Served lists the served API versions. The first version is preferred
+	// and used by the client to read and write objects.
+	Served []string
+
+	// Storage is the API version persisted by the API server. It must be served.
+	Storage string
+
+	// Conversions converts object specs between the served versions. If nil,
+	// all versions share one schema and only the API version is rewritten.
+	Conversions *Conversions
+
+	// Webhook locates the conversion webhook serving the conversions.
+	// Required if conversions are set.
+	Webhook *apiextensionsv1.WebhookClientConfig
+}
+
+// DefaultVersions serves the config types at the single Istio API version
+var DefaultVersions = VersionSet{
+	Served:  []string{config.IstioAPIVersion},
+	Storage: config.IstioAPIVersion,
+}
+
+// ConversionPath is the path of the conversion webhook on the broker server
+const ConversionPath = "/crd/convert"
+
+// NewVersionSet serves the config types at the versions, the first one being
+// preferred, and stores them at the storage version, the preferred version if
+// empty. If a webhook URL is set, the API server converts objects between the
+// versions by calling the webhook, verified with the PEM CA bundle, which
+// applies the conversions of the broker config types.
+func NewVersionSet(served []string, storage, webhook string, caBundle []byte) VersionSet {
+	if len(served) == 0 {
+		return DefaultVersions
+	}
+	v := VersionSet{Served: served, Storage: storage}
+	if v.Storage == "" {
+		v.Storage = v.preferred()
+	}
+	if webhook != "" {
+		v.Conversions = BrokerConversions()
+		v.Webhook = &apiextensionsv1.WebhookClientConfig{URL: &webhook, CABundle: caBundle}
+	}
+	return v
+}
+
+// BrokerConversions returns the conversions between the API versions of the
+// broker config types. Register a conversion of each pair of served versions
+// here when the schema of a type changes.
+func BrokerConversions() *Conversions {
+	return NewConversions()
+}
+
+// preferred returns the version used by the client to read and write objects
+func (v VersionSet) preferred() string {
+	return v.Served[0]
+}
+
+// validate checks that the storage version is one of the served versions
+func (v VersionSet) validate() error {
+	if len(v.Served) == 0 {
+		return errors.New("no served API versions")
+	}
+	if v.Conversions != nil && v.Webhook == nil {
+		return errors.New("conversions require a conversion webhook")
+	}
+	seen := make(map[string]bool, len(v.Served))
+	for _, version := range v.Served {
+		if seen[version] {
+			return fmt.Errorf("duplicate API version %q", version)
+		}
+		seen[version] = true
+	}
+	if !seen[v.Storage] {
+		return fmt.Errorf("storage version %q is not served", v.Storage)
+	}
+	return nil
+}
+
+// conversion returns the CRD conversion strategy for the versions
+func (v VersionSet) conversion() *apiextensionsv1.CustomResourceConversion {
+	if v.Conversions == nil {
+		return &apiextensionsv1.CustomResourceConversion{
+			Strategy: apiextensionsv1.NoneConverter,
+		}
+	}
+	return &apiextensionsv1.CustomResourceConversion{
+		Strategy: apiextensionsv1.WebhookConverter,
+		Webhook: &apiextensionsv1.WebhookConversion{
+			ClientConfig:             v.Webhook,
+			ConversionReviewVersions: []string{"v1"},
+		},
+	}
+}
+
+// ConversionFunc converts the spec of a config object from one API version to another.
+// The input spec must not be modified.
+type ConversionFunc func(spec map[string]interface{}) (map[string]interface{}, error)
+
+type conversionKey struct {
+	typ, from, to string
+}
+
+// Conversions is a registry of spec conversions between API versions of config types
+type Conversions struct {
+	funcs map[conversionKey]ConversionFunc
+	types map[string]bool
+}
+
+// NewConversions creates an empty conversion registry
+func NewConversions() *Conversions {
+	return &Conversions{
+		funcs: make(map[conversionKey]ConversionFunc),
+		types: make(map[string]bool),
+	}
+}
+
+// Register adds a conversion of a config type between two API versions.
+// Conversions are not transitive, so register every pair of served versions.
+func (c *Conversions) Register(typ, from, to string, fn ConversionFunc) {
+	c.funcs[conversionKey{typ, from, to}] = fn
+	c.types[typ] = true
+}
+
+// Convert translates the spec of a config type between API versions.
+// Types without registered conversions have the same schema in all versions.
+func (c *Conversions) Convert(typ, from, to string, spec map[string]interface{}) (map[string]interface{}, error) {
+	if from == to || !c.types[typ] {
+		return spec, nil
+	}
+	fn, ok := c.funcs[conversionKey{typ, from, to}]
+	if !ok {
+		return nil, fmt.Errorf("no conversion of %q from %q to %q", typ, from, to)
+	}
+	return fn(spec)
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/model/config"
+)
+
+// renameInstance moves "deployment.instance" to "deployment.service" in a copy of the spec
+func renameInstance(spec map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(spec))
+	for k, v := range spec {
+		out[k] = v
+	}
+	if d, ok := spec["deployment"].(map[string]interface{}); ok {
+		out["deployment"] = map[string]interface{}{"service": d["instance"]}
+	}
+	return out, nil
+}
+
+func TestVersionSetValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		versions VersionSet
+		valid    bool
+	}{
+		{"default", DefaultVersions, true},
+		{"multiple", VersionSet{Served: []string{"v1beta1", "v1alpha2"}, Storage: "v1alpha2"}, true},
+		{"empty", VersionSet{}, false},
+		{"duplicate", VersionSet{Served: []string{"v1alpha2", "v1alpha2"}, Storage: "v1alpha2"}, false},
+		{"storage not served", VersionSet{Served: []string{"v1beta1"}, Storage: "v1alpha2"}, false},
+		{"no webhook", VersionSet{Served: []string{"v1alpha2"}, Storage: "v1alpha2", Conversions: NewConversions()}, false},
+	}
+	for _, c := range cases {
+		if err := c.versions.validate(); (err == nil) != c.valid {
+			t.Errorf("%s: validate() => got %v, want valid %t", c.name, err, c.valid)
+		}
+	}
+}
+
+func TestNewVersionSet(t *testing.T) {
+	if got := NewVersionSet(nil, "", "", nil); !reflect.DeepEqual(got, DefaultVersions) {
+		t.Errorf("NewVersionSet() without versions => got %+v, want the default versions", got)
+	}
+	v := NewVersionSet([]string{"v1beta1", "v1alpha2"}, "", "", nil)
+	if v.Storage != "v1beta1" || v.Conversions != nil || v.conversion().Strategy != apiextensionsv1.NoneConverter {
+		t.Errorf("NewVersionSet() without webhook => got %+v", v)
+	}
+	v = NewVersionSet([]string{"v1beta1", "v1alpha2"}, "v1alpha2", "https://broker.istio-system:9443/crd/convert",
+		[]byte("ca"))
+	if err := v.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if v.Storage != "v1alpha2" || v.conversion().Strategy != apiextensionsv1.WebhookConverter ||
+		*v.Webhook.URL != "https://broker.istio-system:9443/crd/convert" {
+		t.Errorf("NewVersionSet() with webhook => got %+v", v)
+	}
+}
+
+func TestConvertConfigVersion(t *testing.T) {
+	entry := config.Entry{
+		Meta: config.Meta{Type: config.ServiceClass.Type, Name: "productpage", Namespace: "default"},
+		Spec: &brokerconfig.ServiceClass{Deployment: &brokerconfig.Deployment{Instance: "productpage"}},
+	}
+	out, err := convertConfig(config.ServiceClass, entry, "v1beta1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.GetObjectKind().GroupVersionKind(); got.GroupVersion().String() != "config.istio.io/v1beta1" ||
+		got.Kind != "ServiceClass" {
+		t.Errorf("convertConfig() => got %v, want the preferred version", got)
+	}
+	// the known types are left at the default version
+	if got := knownTypes[config.ServiceClass.Type].object.GetObjectKind().GroupVersionKind().Version; got !=
+		config.IstioAPIVersion {
+		t.Errorf("known type => got version %q, want %q", got, config.IstioAPIVersion)
+	}
+}
+
+func TestConversions(t *testing.T) {
+	conversions := NewConversions()
+	conversions.Register(config.ServiceClass.Type, "v1alpha2", "v1beta1", renameInstance)
+
+	spec := map[string]interface{}{
+		"deployment": map[string]interface{}{"instance": "productpage"},
+	}
+
+	got, err := conversions.Convert(config.ServiceClass.Type, "v1alpha2", "v1beta1", spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"deployment": map[string]interface{}{"service": "productpage"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Convert() => got %v, want %v", got, want)
+	}
+
+	if got, err = conversions.Convert(config.ServiceClass.Type, "v1alpha2", "v1alpha2", spec); err != nil || !reflect.DeepEqual(got, spec) {
+		t.Errorf("Convert() to the same version => got %v, %v", got, err)
+	}
+	if got, err = conversions.Convert(config.ServicePlan.Type, "v1alpha2", "v1beta1", spec); err != nil || !reflect.DeepEqual(got, spec) {
+		t.Errorf("Convert() of a type without conversions => got %v, %v", got, err)
+	}
+	if _, err = conversions.Convert(config.ServiceClass.Type, "v1beta1", "v1alpha2", spec); err == nil {
+		t.Error("expected error for a missing conversion")
+	}
+}
+
+func TestConversionHandler(t *testing.T) {
+	conversions := NewConversions()
+	conversions.Register(config.ServiceClass.Type, "v1alpha2", "v1beta1", renameInstance)
+	handler := NewConversionHandler(config.BrokerConfigTypes, conversions)
+
+	obj := []byte(`{"apiVersion":"config.istio.io/v1alpha2","kind":"ServiceClass",` +
+		`"metadata":{"name":"productpage"},"spec":{"deployment":{"instance":"productpage"}}}`)
+	review := apiextensionsv1.ConversionReview{
+		Request: &apiextensionsv1.ConversionRequest{
+			UID:               "review",
+			DesiredAPIVersion: "config.istio.io/v1beta1",
+			Objects:           []runtime.RawExtension{{Raw: obj}},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/convert", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() => got status %d", w.Code)
+	}
+
+	got := apiextensionsv1.ConversionReview{}
+	if err = json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Response == nil || got.Response.Result.Status != meta_v1.StatusSuccess || len(got.Response.ConvertedObjects) != 1 {
+		t.Fatalf("ServeHTTP() => got response %+v", got.Response)
+	}
+	converted := make(map[string]interface{})
+	if err = json.Unmarshal(got.Response.ConvertedObjects[0].Raw, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if converted["apiVersion"] != "config.istio.io/v1beta1" {
+		t.Errorf("converted apiVersion => got %v", converted["apiVersion"])
+	}
+	want := map[string]interface{}{"deployment": map[string]interface{}{"service": "productpage"}}
+	if !reflect.DeepEqual(converted["spec"], want) {
+		t.Errorf("converted spec => got %v, want %v", converted["spec"], want)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"istio.io/broker/pkg/model/config"
+)
+
+// NewConversionHandler creates the CRD conversion webhook for the descriptor types.
+// The API server must reach the handler over TLS as configured in VersionSet.Webhook.
+func NewConversionHandler(descriptor config.Descriptor, conversions *Conversions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		review := apiextensionsv1.ConversionReview{}
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+			http.Error(w, "malformed conversion review", http.StatusBadRequest)
+			return
+		}
+
+		review.Response = convertReview(descriptor, conversions, review.Request)
+		review.Request = nil
+
+		w.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(review); err != nil {
+			glog.Errorf("Write conversion review error %s", err.Error())
+		}
+	})
+}
+
+// convertReview converts all objects of a review request or fails as a whole
+func convertReview(descriptor config.Descriptor, conversions *Conversions,
+	req *apiextensionsv1.ConversionRequest) *apiextensionsv1.ConversionResponse {
+	out := &apiextensionsv1.ConversionResponse{
+		UID:    req.UID,
+		Result: meta_v1.Status{Status: meta_v1.StatusSuccess},
+	}
+	for _, obj := range req.Objects {
+		converted, err := convertVersion(descriptor, conversions, obj.Raw, req.DesiredAPIVersion)
+		if err != nil {
+			glog.Warningf("conversion to %s failed: %v", req.DesiredAPIVersion, err)
+			return &apiextensionsv1.ConversionResponse{
+				UID: req.UID,
+				Result: meta_v1.Status{
+					Status:  meta_v1.StatusFailure,
+					Message: err.Error(),
+				},
+			}
+		}
+		out.ConvertedObjects = append(out.ConvertedObjects, runtime.RawExtension{Raw: converted})
+	}
+	return out
+}
+
+// convertVersion converts a serialized config object to the desired "group/version"
+func convertVersion(descriptor config.Descriptor, conversions *Conversions, raw []byte, desired string) ([]byte, error) {
+	obj := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+
+	kind, _ := obj["kind"].(string)
+	schema, ok := schemaByKind(descriptor, kind)
+	if !ok {
+		return nil, fmt.Errorf("unrecognized kind %q", kind)
+	}
+
+	apiVersion, _ := obj["apiVersion"].(string)
+	from, to := versionOf(apiVersion), versionOf(desired)
+	if spec, ok := obj["spec"].(map[string]interface{}); ok {
+		converted, err := conversions.Convert(schema.Type, from, to, spec)
+		if err != nil {
+			return nil, err
+		}
+		obj["spec"] = converted
+	}
+	obj["apiVersion"] = desired
+
+	return json.Marshal(obj)
+}
+
+// schemaByKind finds a schema by its CRD kind
+func schemaByKind(descriptor config.Descriptor, kind string) (config.Schema, bool) {
+	for _, s := range descriptor {
+		if k, _, _, _ := resourceNames(s); k == kind {
+			return s, true
+		}
+	}
+	return config.Schema{}, false
+}
+
+// versionOf strips the group from "group/version"
+func versionOf(apiVersion string) string {
+	return apiVersion[strings.LastIndex(apiVersion, "/")+1:]
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory provides an in-memory implementation of the config store
+// for tests and for configuration that does not need to be persisted.
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+
+	"istio.io/broker/pkg/model/config"
+)
+
+var (
+	errNotFound      = errors.New("item not found")
+	errAlreadyExists = errors.New("item already exists")
+	errConflict      = errors.New("conflicting resource version, try again")
+)
+
+// store is a thread-safe map of configuration objects keyed by type and key
+type store struct {
+	descriptor config.Descriptor
+
+	mu       sync.RWMutex
+	data     map[string]map[string]config.Entry
+	revision int
+}
+
+// Make creates an in-memory config store from a config descriptor
+func Make(descriptor config.Descriptor) config.Store {
+	out := &store{
+		descriptor: descriptor,
+		data:       make(map[string]map[string]config.Entry),
+	}
+	for _, typ := range descriptor.Types() {
+		out.data[typ] = make(map[string]config.Entry)
+	}
+	return out
+}
+
+func (s *store) Descriptor() config.Descriptor {
+	return s.descriptor
+}
+
+func (s *store) Get(typ, name, namespace string) (*config.Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries, ok := s.data[typ]
+	if !ok {
+		return nil, false
+	}
+	entry, ok := entries[config.Key(typ, name, namespace)]
+	if !ok {
+		return nil, false
+	}
+	return &entry, true
+}
+
+func (s *store) List(typ, namespace string) ([]config.Entry, error) {
+	return s.ListWithOptions(typ, config.ListOptions{Namespace: namespace})
+}
+
+func (s *store) ListWithOptions(typ string, opts config.ListOptions) ([]config.Entry, error) {
+	match, err := opts.Matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries, ok := s.data[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", typ)
+	}
+	out := make([]config.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if match(entry) {
+			out = append(out, entry)
+		}
+	}
+	// return objects in key order for stable results
+	sort.Slice(out, func(i, j int) bool { return out[i].Key() < out[j].Key() })
+	return out, nil
+}
+
+// ListPage implements store interface.
+// Continue tokens are object keys, so a page resumes after the last returned
+// object even if objects were deleted in the meantime.
+func (s *store) ListPage(typ string, opts config.ListOptions) ([]config.Entry, string, error) {
+	entries, err := s.ListWithOptions(typ, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	out, next := config.Paginate(entries, opts)
+	return out, next, nil
+}
+
+func (s *store) Create(entry config.Entry) (string, error) {
+	if err := s.validate(entry); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := entry.Key()
+	if _, exists := s.data[entry.Type][key]; exists {
+		return "", errAlreadyExists
+	}
+	entry.ResourceVersion = s.next()
+	s.data[entry.Type][key] = entry
+	return entry.ResourceVersion, nil
+}
+
+func (s *store) Update(entry config.Entry) (string, error) {
+	if err := s.validate(entry); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.existing(entry)
+	if err != nil {
+		return "", err
+	}
+	// status is written separately
+	entry.Status = old.Status
+	entry.DeletionTimestamp = old.DeletionTimestamp
+	entry.ResourceVersion = s.next()
+	if entry.Deleting() && len(entry.Finalizers) == 0 {
+		// the last finalizer of a deleted object was removed
+		delete(s.data[entry.Type], entry.Key())
+		return entry.ResourceVersion, nil
+	}
+	s.data[entry.Type][entry.Key()] = entry
+	return entry.ResourceVersion, nil
+}
+
+// UpdateStatus implements status updater interface
+func (s *store) UpdateStatus(entry config.Entry) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[entry.Type]; !ok {
+		return "", fmt.Errorf("unknown type %q", entry.Type)
+	}
+	old, err := s.existing(entry)
+	if err != nil {
+		return "", err
+	}
+	old.Status = entry.Status
+	old.ResourceVersion = s.next()
+	s.data[entry.Type][entry.Key()] = old
+	return old.ResourceVersion, nil
+}
+
+func (s *store) Delete(typ, name, namespace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, ok := s.data[typ]
+	if !ok {
+		return fmt.Errorf("unknown type %q", typ)
+	}
+	key := config.Key(typ, name, namespace)
+	old, exists := entries[key]
+	if !exists {
+		return errNotFound
+	}
+	if len(old.Finalizers) > 0 {
+		// the finalizers hold the removal of the object, like in Kubernetes
+		if !old.Deleting() {
+			now := time.Now()
+			old.DeletionTimestamp = &now
+			old.ResourceVersion = s.next()
+			entries[key] = old
+		}
+		return nil
+	}
+	delete(entries, key)
+	return nil
+}
+
+// validate checks the type and content of an entry
+func (s *store) validate(entry config.Entry) error {
+	schema, ok := s.descriptor.GetByType(entry.Type)
+	if !ok {
+		return fmt.Errorf("unknown type %q", entry.Type)
+	}
+	if err := schema.Validate(entry.Spec); err != nil {
+		return multierror.Prefix(err, "validation error:")
+	}
+	return nil
+}
+
+// existing finds the stored object at the revision of the entry.
+// Callers must hold the write lock.
+func (s *store) existing(entry config.Entry) (config.Entry, error) {
+	if entry.ResourceVersion == "" {
+		return config.Entry{}, errors.New("revision is required")
+	}
+	old, exists := s.data[entry.Type][entry.Key()]
+	if !exists {
+		return config.Entry{}, errNotFound
+	}
+	if old.ResourceVersion != entry.ResourceVersion {
+		return config.Entry{}, errConflict
+	}
+	return old, nil
+}
+
+// next allocates a new revision. Callers must hold the write lock.
+func (s *store) next() string {
+	s.revision++
+	return strconv.Itoa(s.revision)
+}
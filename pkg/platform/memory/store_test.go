@@ -0,0 +1,99 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"testing"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/testing/mock"
+)
+
+func makeStore() config.Store {
+	return Make(append(config.BrokerConfigTypes, mock.FakeConfig))
+}
+
+func TestStoreInvariant(t *testing.T) {
+	mock.CheckMapInvariant(makeStore(), t, "some-namespace", 10)
+}
+
+func TestBrokerConfig(t *testing.T) {
+	mock.CheckBrokerConfigTypes(makeStore(), "some-namespace", t)
+}
+
+func TestListOptions(t *testing.T) {
+	mock.CheckListOptions(makeStore(), t, "some-namespace", 5)
+}
+
+func TestListPage(t *testing.T) {
+	mock.CheckListPage(makeStore(), t, "some-namespace", 7, 3)
+}
+
+func TestUpdateStatus(t *testing.T) {
+	store := makeStore()
+	elt := mock.Make("some-namespace", 0)
+	rev, err := store.Create(elt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elt.ResourceVersion = rev
+	elt.Status = &config.Status{Conditions: []config.Condition{
+		{Type: config.ConditionReady, Status: config.ConditionTrue},
+	}}
+	if _, err = store.(config.StatusUpdater).UpdateStatus(elt); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := store.Get(elt.Type, elt.Name, elt.Namespace)
+	if !ok || !got.Status.Equal(elt.Status) {
+		t.Errorf("Get() => got %+v, want status %+v", got, elt.Status)
+	}
+	if !mock.Compare(*got, elt) {
+		t.Errorf("UpdateStatus() modified the spec: got %+v", got)
+	}
+
+	// a stale revision is rejected
+	if _, err = store.(config.StatusUpdater).UpdateStatus(elt); err == nil {
+		t.Error("expected error updating status with a stale revision")
+	}
+}
+
+func TestFinalizers(t *testing.T) {
+	store := makeStore()
+	elt := mock.Make("some-namespace", 0)
+	elt.Finalizers = []string{"test/finalizer"}
+	if _, err := store.Create(elt); err != nil {
+		t.Fatal(err)
+	}
+
+	// the finalizer holds the removal of the deleted object
+	if err := store.Delete(elt.Type, elt.Name, elt.Namespace); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := store.Get(elt.Type, elt.Name, elt.Namespace)
+	if !ok || !got.Deleting() {
+		t.Fatalf("Delete() with a finalizer => got %+v, want the object being deleted", got)
+	}
+
+	// removing the last finalizer removes the object
+	got.RemoveFinalizer("test/finalizer")
+	if _, err := store.Update(*got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = store.Get(elt.Type, elt.Name, elt.Namespace); ok {
+		t.Error("Update() without finalizers => got the deleted object")
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisioner
+
+import (
+	multierror "github.com/hashicorp/go-multierror"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	"istio.io/broker/pkg/routing"
+)
+
+const (
+	// MeshProvisioner exposes the mesh services of service class deployments
+	MeshProvisioner = "mesh"
+
+	// consumerParameter is the bind parameter naming the mesh service of the application
+	consumerParameter = "consumer"
+)
+
+// Mesh provisions service classes deployed in the mesh or backed by external
+// endpoints: instances open the mesh to the external endpoint and enforce the
+// quota of their plan on the consumers bound to the service, and bindings
+// route the consumer to it.
+type Mesh struct {
+	router *routing.Router
+}
+
+// NewMesh creates a provisioner applying the mesh configuration with a router
+func NewMesh(router *routing.Router) *Mesh {
+	return &Mesh{router: router}
+}
+
+// Provision opens the mesh to the external endpoint of the class and enforces
+// the quota of the plan on the service
+func (m *Mesh) Provision(req ProvisionRequest) (Result, error) {
+	return Result{}, m.apply(req.Instance)
+}
+
+// Update applies the quota of the new plan. The configuration is applied even
+// if the plan is unchanged to pick up changes of the class and plan, which
+// upgrades the instance to the maintenance version of the plan.
+func (m *Mesh) Update(req UpdateRequest) (Result, error) {
+	return Result{}, m.apply(req.Instance)
+}
+
+// Deprovision removes the egress and quota configuration of the instance
+func (m *Mesh) Deprovision(req DeprovisionRequest) (Result, error) {
+	var errs error
+	if err := m.router.RemoveEgress(req.ID); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if err := m.router.RemoveQuota(req.ID); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	return Result{}, errs
+}
+
+func (m *Mesh) apply(instance Instance) error {
+	target, err := routingInstance(instance)
+	if err != nil {
+		return err
+	}
+	if err = m.router.ApplyEgress(target); err != nil {
+		return err
+	}
+	return m.applyQuota(target, instance.Plan)
+}
+
+// applyQuota enforces the quota of a plan on the consumers bound to an instance
+func (m *Mesh) applyQuota(target routing.Instance, plan *config.Entry) error {
+	quota, err := routing.PlanQuota(*plan)
+	if err != nil {
+		return InvalidRequestError(err.Error())
+	}
+	return m.router.ApplyQuota(target, quota)
+}
+
+// Bind routes the consumer named by the bind parameters, or the application
+// of the bind resource, to the mesh service or the external endpoint of the
+// instance, and extends the quota of the instance to the consumer. The
+// credentials of external endpoints name the host instead of a mesh service.
+func (m *Mesh) Bind(req BindRequest) (BindResult, error) {
+	target, binding, err := routingBinding(&req)
+	if err != nil {
+		return BindResult{}, err
+	}
+	created, err := m.router.Bind(binding)
+	if err == routing.ErrConflict {
+		return BindResult{}, ErrConflict
+	} else if err != nil {
+		return BindResult{}, err
+	}
+	if req.Plan != nil {
+		if err = m.applyQuota(target, req.Plan); err != nil {
+			return BindResult{}, err
+		}
+	}
+
+	credentials := &osb.BindingCredential{Service: target.Service, Namespace: req.Class.Namespace}
+	if target.External != nil {
+		credentials = &osb.BindingCredential{Service: target.External.Host}
+		if uri := target.External.URI(); uri != "" {
+			credentials.Values = map[string]string{"uri": uri}
+		}
+	}
+	return BindResult{
+		Created:     created,
+		Credentials: credentials,
+		Subject:     binding.Consumer,
+	}, nil
+}
+
+// routingBinding identifies the routing instance of a binding and the binding of the consumer to it
+func routingBinding(req *BindRequest) (routing.Instance, routing.Binding, error) {
+	target, err := routingInstance(req.Instance)
+	if err != nil {
+		return routing.Instance{}, routing.Binding{}, err
+	}
+	if target.Service == "" && target.External == nil {
+		return routing.Instance{}, routing.Binding{}, Invalidf("service %q is not deployed in the mesh", req.Class.Key())
+	}
+	consumer := bindConsumer(req)
+	if consumer == "" {
+		return routing.Instance{}, routing.Binding{}, Invalidf("bind parameter %q is required", consumerParameter)
+	}
+	return target, routing.Binding{
+		ID:               req.BindingID,
+		InstanceID:       req.ID,
+		Service:          target.Service,
+		External:         target.External,
+		Consumer:         consumer,
+		Namespace:        target.Namespace,
+		ServiceNamespace: target.ServiceNamespace,
+	}, nil
+}
+
+// bindConsumer finds the consumer of a binding in the bind parameters,
+// falling back to the application of the bind resource
+func bindConsumer(req *BindRequest) string {
+	if consumer, ok := req.Parameters[consumerParameter].(string); ok && consumer != "" {
+		return consumer
+	}
+	if req.BindResource != nil {
+		return req.BindResource.AppGUID
+	}
+	return ""
+}
+
+// Unbind removes the traffic configuration of the binding and the consumer
+// from the quota of the instance
+func (m *Mesh) Unbind(req UnbindRequest) (bool, error) {
+	found, err := m.router.Unbind(req.BindingID)
+	if err != nil || req.Class == nil || req.Plan == nil {
+		return found, err
+	}
+	target, err := routingInstance(req.Instance)
+	if err != nil {
+		return found, err
+	}
+	return found, m.applyQuota(target, req.Plan)
+}
+
+// ReconcileInstance applies the egress and quota configuration of an instance again
+func (m *Mesh) ReconcileInstance(instance Instance) error {
+	if instance.Plan == nil {
+		return Invalidf("instance %q has no plan", instance.ID)
+	}
+	return m.apply(instance)
+}
+
+// ReconcileBinding applies the traffic configuration of a binding again,
+// replacing the objects changed since the binding was created, and the quota
+// of the instance on its consumer
+func (m *Mesh) ReconcileBinding(req BindRequest) error {
+	target, binding, err := routingBinding(&req)
+	if err != nil {
+		return err
+	}
+	if err = m.router.ApplyBinding(binding); err != nil || req.Plan == nil {
+		return err
+	}
+	return m.applyQuota(target, req.Plan)
+}
+
+// Owners lists the ids of the instances and bindings having mesh configuration
+func (m *Mesh) Owners() ([]string, []string, error) {
+	return m.router.Owners()
+}
+
+// RemoveInstance removes the egress and quota configuration of an instance
+func (m *Mesh) RemoveInstance(id string) error {
+	_, err := m.Deprovision(DeprovisionRequest{Instance: Instance{ID: id}})
+	return err
+}
+
+// RemoveBinding removes the traffic configuration of a binding
+func (m *Mesh) RemoveBinding(id string) error {
+	_, err := m.router.Unbind(id)
+	return err
+}
+
+// LastOperation reports success since the mesh configuration is applied synchronously
+func (m *Mesh) LastOperation(req LastOperationRequest) (osb.LastOperation, error) {
+	return osb.LastOperation{State: osb.OperationSucceeded}, nil
+}
+
+// routingInstance identifies the mesh service or the external endpoint of the service class of an instance.
+// The configuration is created in the Kubernetes namespace the instance is provisioned in, or else in the
+// namespace of the service class.
+func routingInstance(instance Instance) (routing.Instance, error) {
+	external, err := routing.ParseExternal(*instance.Class)
+	if err != nil {
+		return routing.Instance{}, InvalidRequestError(err.Error())
+	}
+	out := routing.Instance{
+		ID:        instance.ID,
+		External:  external,
+		Namespace: instance.Class.Namespace,
+	}
+	if ctx := instance.Context; ctx != nil && ctx.Platform == osb.PlatformKubernetes && ctx.Namespace != "" &&
+		ctx.Namespace != instance.Class.Namespace {
+		out.Namespace = ctx.Namespace
+		out.ServiceNamespace = instance.Class.Namespace
+	}
+	if external == nil {
+		out.Service = instance.Class.Spec.(*brokerconfig.ServiceClass).GetDeployment().GetInstance()
+	}
+	return out, nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisioner
+
+import (
+	"testing"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	proxyconfig "istio.io/api/proxy/v1/config"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	"istio.io/broker/pkg/platform/memory"
+	"istio.io/broker/pkg/routing"
+)
+
+func TestMeshExternal(t *testing.T) {
+	store := memory.Make(config.IstioConfigTypes)
+	m := NewMesh(routing.NewRouter(store))
+	instance := Instance{
+		ID: "instance-1",
+		Class: &config.Entry{
+			Meta: config.Meta{Type: config.ServiceClass.Type, Name: "weather", Namespace: "default",
+				Annotations: map[string]string{
+					routing.ExternalHostAnnotation:  "api.weather.example.com",
+					routing.ExternalPortsAnnotation: "443/https",
+				}},
+			Spec: &brokerconfig.ServiceClass{Entry: &brokerconfig.CatalogEntry{Name: "weather", Id: "weather-id"}},
+		},
+		Plan: &config.Entry{
+			Meta: config.Meta{Type: config.ServicePlan.Type, Name: "basic", Namespace: "default",
+				Annotations: map[string]string{routing.RequestsPerSecondAnnotation: "10"}},
+			Spec: &brokerconfig.ServicePlan{Plan: &brokerconfig.CatalogPlan{Name: "basic", Id: "basic-id"}},
+		},
+	}
+	count := func(schema config.Schema) int {
+		l, _ := store.List(schema.Type, "")
+		return len(l)
+	}
+
+	if _, err := m.Provision(ProvisionRequest{Instance: instance}); err != nil {
+		t.Fatal(err)
+	}
+	if count(config.EgressRule) != 1 || count(config.MixerRule) != 0 {
+		t.Errorf("Provision() => got %d egress rule(s) and %d mixer rule(s), want 1 and 0",
+			count(config.EgressRule), count(config.MixerRule))
+	}
+
+	result, err := m.Bind(BindRequest{
+		Instance:   instance,
+		BindingID:  "binding-1",
+		Parameters: map[string]interface{}{consumerParameter: "reviews"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds := result.Credentials; creds.Service != "api.weather.example.com" ||
+		creds.Values["uri"] != "http://api.weather.example.com:443" {
+		t.Errorf("Bind() => got credentials %+v", creds)
+	}
+	if count(config.RouteRule) != 1 || count(config.DestinationPolicy) != 0 || count(config.MixerRule) != 1 {
+		t.Errorf("Bind() => got %d route rule(s), %d destination policies and %d mixer rule(s), want 1, 0 and 1",
+			count(config.RouteRule), count(config.DestinationPolicy), count(config.MixerRule))
+	}
+
+	if _, err = m.Unbind(UnbindRequest{Instance: instance, BindingID: "binding-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if count(config.MixerRule) != 0 {
+		t.Errorf("Unbind() => got %d mixer rule(s) without consumers, want 0", count(config.MixerRule))
+	}
+	if _, err = m.Deprovision(DeprovisionRequest{Instance: instance}); err != nil {
+		t.Fatal(err)
+	}
+	for _, schema := range config.IstioConfigTypes {
+		if n := count(schema); n != 0 {
+			t.Errorf("Deprovision() => got %d %s left", n, schema.Plural)
+		}
+	}
+
+	instance.Class.Annotations[routing.ExternalPortsAnnotation] = "5432/tcp"
+	if _, err = m.Provision(ProvisionRequest{Instance: instance}); err == nil {
+		t.Error("Provision() with an invalid port => got no error")
+	} else if _, ok := err.(InvalidRequestError); !ok {
+		t.Errorf("Provision() with an invalid port => got %v, want an invalid request", err)
+	}
+}
+
+func TestMeshContextNamespace(t *testing.T) {
+	store := memory.Make(config.IstioConfigTypes)
+	m := NewMesh(routing.NewRouter(store))
+	instance := Instance{
+		ID: "instance-1",
+		Class: &config.Entry{
+			Meta: config.Meta{Type: config.ServiceClass.Type, Name: "productpage", Namespace: "default"},
+			Spec: &brokerconfig.ServiceClass{Deployment: &brokerconfig.Deployment{Instance: "productpage"}},
+		},
+		Plan: &config.Entry{
+			Meta: config.Meta{Type: config.ServicePlan.Type, Name: "basic", Namespace: "default",
+				Annotations: map[string]string{routing.RequestsPerSecondAnnotation: "10"}},
+			Spec: &brokerconfig.ServicePlan{Plan: &brokerconfig.CatalogPlan{Name: "basic", Id: "basic-id"}},
+		},
+		Context: &osb.Context{Platform: osb.PlatformKubernetes, Namespace: "team-a"},
+	}
+
+	if _, err := m.Provision(ProvisionRequest{Instance: instance}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := m.Bind(BindRequest{
+		Instance:   instance,
+		BindingID:  "binding-1",
+		Parameters: map[string]interface{}{consumerParameter: "reviews"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, _ := store.List(config.MixerRule.Type, "team-a")
+	if len(rules) != 1 {
+		t.Fatalf("Bind() => got %d mixer rule(s) in the context namespace, want 1", len(rules))
+	}
+	if match := rules[0].Spec.(*structpb.Struct).Fields["match"].GetStringValue(); match !=
+		`destination.service == "productpage.default.svc.cluster.local" && `+
+			`(source.service == "reviews.team-a.svc.cluster.local")` {
+		t.Errorf("Bind() => got rule match %q", match)
+	}
+	if creds := result.Credentials; creds.Service != "productpage" || creds.Namespace != "default" {
+		t.Errorf("Bind() => got credentials %+v", creds)
+	}
+	route, exists := store.Get(config.RouteRule.Type, "binding-binding-1", "team-a")
+	if !exists {
+		t.Fatal("Bind() => got no route rule in the context namespace")
+	}
+	if dest := route.Spec.(*proxyconfig.RouteRule).GetDestination(); dest.GetName() != "productpage" ||
+		dest.GetNamespace() != "default" {
+		t.Errorf("Bind() => got route destination %v", dest)
+	}
+
+	// other platforms keep the configuration in the namespace of the service class
+	instance.ID = "instance-2"
+	instance.Context = &osb.Context{Platform: osb.PlatformCloudFoundry, OrganizationGUID: "org", SpaceGUID: "space"}
+	if _, err = m.Provision(ProvisionRequest{Instance: instance}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Bind(BindRequest{
+		Instance:   instance,
+		BindingID:  "binding-2",
+		Parameters: map[string]interface{}{consumerParameter: "reviews"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := store.List(config.MixerRule.Type, "default"); len(l) != 1 {
+		t.Errorf("Bind() => got %d mixer rule(s) in the class namespace, want 1", len(l))
+	}
+}
+
+func TestMeshReconcile(t *testing.T) {
+	store := memory.Make(config.IstioConfigTypes)
+	m := NewMesh(routing.NewRouter(store))
+	registry := NewRegistry()
+	if err := registry.Register(MeshProvisioner, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := registry.Reconcilers()[MeshProvisioner]; !ok {
+		t.Fatal("Reconcilers() => mesh provisioner missing")
+	}
+	instance := Instance{
+		ID: "instance-1",
+		Class: &config.Entry{
+			Meta: config.Meta{Type: config.ServiceClass.Type, Name: "weather", Namespace: "default",
+				Annotations: map[string]string{
+					routing.ExternalHostAnnotation:  "api.weather.example.com",
+					routing.ExternalPortsAnnotation: "443/https",
+				}},
+			Spec: &brokerconfig.ServiceClass{Entry: &brokerconfig.CatalogEntry{Name: "weather", Id: "weather-id"}},
+		},
+		Plan: &config.Entry{
+			Meta: config.Meta{Type: config.ServicePlan.Type, Name: "basic", Namespace: "default"},
+			Spec: &brokerconfig.ServicePlan{Plan: &brokerconfig.CatalogPlan{Name: "basic", Id: "basic-id"}},
+		},
+	}
+	bind := BindRequest{
+		Instance:   instance,
+		BindingID:  "binding-1",
+		Parameters: map[string]interface{}{consumerParameter: "reviews"},
+	}
+	if _, err := m.Provision(ProvisionRequest{Instance: instance}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Bind(bind); err != nil {
+		t.Fatal(err)
+	}
+	removeAll := func(schema config.Schema) {
+		l, _ := store.List(schema.Type, "")
+		for _, entry := range l {
+			if err := store.Delete(entry.Type, entry.Name, entry.Namespace); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	count := func(schema config.Schema) int {
+		l, _ := store.List(schema.Type, "")
+		return len(l)
+	}
+
+	// the configuration lost part way is applied again
+	removeAll(config.EgressRule)
+	removeAll(config.RouteRule)
+	if err := m.ReconcileInstance(instance); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReconcileBinding(bind); err != nil {
+		t.Fatal(err)
+	}
+	if count(config.EgressRule) != 1 || count(config.RouteRule) != 1 {
+		t.Errorf("Reconcile => got %d egress rule(s) and %d route rule(s), want 1",
+			count(config.EgressRule), count(config.RouteRule))
+	}
+
+	instances, bindings, err := m.Owners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0] != "instance-1" || len(bindings) != 1 || bindings[0] != "binding-1" {
+		t.Errorf("Owners() => got %v and %v", instances, bindings)
+	}
+	if err = m.RemoveBinding("binding-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.RemoveInstance("instance-1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, schema := range config.IstioConfigTypes {
+		if n := count(schema); n != 0 {
+			t.Errorf("Remove => got %d %s left", n, schema.Plural)
+		}
+	}
+
+	instance.Plan = nil
+	if err = m.ReconcileInstance(instance); err == nil {
+		t.Error("ReconcileInstance() without plan => got no error")
+	}
+}
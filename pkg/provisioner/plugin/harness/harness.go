@@ -0,0 +1,123 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package harness runs provisioner plugins locally to test them against the
+// broker side of the gRPC contract, without a cluster or a broker.
+package harness
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"istio.io/broker/pkg/model/osb"
+	"istio.io/broker/pkg/provisioner"
+	"istio.io/broker/pkg/provisioner/plugin/proto"
+)
+
+const (
+	// BindingID is the binding created by the lifecycle
+	BindingID = "harness-binding"
+
+	// AppGUID is the application bound by the lifecycle
+	AppGUID = "harness-app"
+
+	// pollInterval between the polls of asynchronous operations
+	pollInterval = 10 * time.Millisecond
+)
+
+// Start serves a plugin on a local port and returns its endpoint and a function stopping the server
+func Start(server proto.ProvisionerServer) (string, func(), error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	s := grpc.NewServer()
+	proto.RegisterProvisionerServer(s, server)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	return lis.Addr().String(), s.Stop, nil
+}
+
+// Lifecycle provisions an instance with a provisioner, binds and unbinds an
+// application and deprovisions the instance. Asynchronous operations are
+// polled until they complete or the timeout expires.
+func Lifecycle(t *testing.T, p provisioner.Provisioner, instance provisioner.Instance, timeout time.Duration) {
+	result, err := p.Provision(provisioner.ProvisionRequest{Instance: instance, AcceptsIncomplete: true})
+	if err != nil {
+		t.Fatalf("Provision => %v", err)
+	}
+	Wait(t, p, instance, result, timeout)
+
+	bind := provisioner.BindRequest{
+		Instance:     instance,
+		BindingID:    BindingID,
+		BindResource: &osb.BindResource{AppGUID: AppGUID},
+	}
+	first, err := p.Bind(bind)
+	if err != nil {
+		t.Fatalf("Bind => %v", err)
+	}
+	if !first.Created || first.Credentials == nil {
+		t.Errorf("Bind => got %+v, want created binding with credentials", first)
+	}
+	again, err := p.Bind(bind)
+	if err != nil {
+		t.Fatalf("Bind again => %v", err)
+	}
+	if again.Created {
+		t.Errorf("Bind again => created another binding")
+	}
+
+	unbind := provisioner.UnbindRequest{Instance: instance, BindingID: BindingID}
+	if found, errUnbind := p.Unbind(unbind); errUnbind != nil || !found {
+		t.Errorf("Unbind => got %t, %v, want binding found", found, errUnbind)
+	}
+	if found, errUnbind := p.Unbind(unbind); errUnbind != nil || found {
+		t.Errorf("Unbind again => got %t, %v, want binding not found", found, errUnbind)
+	}
+
+	result, err = p.Deprovision(provisioner.DeprovisionRequest{Instance: instance, AcceptsIncomplete: true})
+	if err != nil {
+		t.Fatalf("Deprovision => %v", err)
+	}
+	Wait(t, p, instance, result, timeout)
+}
+
+// Wait polls an asynchronous operation until it succeeds, and fails the test
+// if the operation fails or does not complete before the timeout
+func Wait(t *testing.T, p provisioner.Provisioner, instance provisioner.Instance, result provisioner.Result,
+	timeout time.Duration) {
+	if !result.Async {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := p.LastOperation(provisioner.LastOperationRequest{Instance: instance, Operation: result.Operation})
+		switch {
+		case err != nil:
+			t.Fatalf("LastOperation(%q) => %v", result.Operation, err)
+		case state.State == osb.OperationSucceeded:
+			return
+		case state.State == osb.OperationFailed:
+			t.Fatalf("LastOperation(%q) => failed: %s", result.Operation, state.Description)
+		case time.Now().After(deadline):
+			t.Fatalf("LastOperation(%q) => still %s after %v", result.Operation, state.State, timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
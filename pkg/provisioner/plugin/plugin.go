@@ -0,0 +1,379 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package plugin delegates the provisioning of service classes to
+// out-of-process plugins implementing the provisioner gRPC contract.
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	multierror "github.com/hashicorp/go-multierror"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	"istio.io/broker/pkg/provisioner"
+	"istio.io/broker/pkg/provisioner/plugin/proto"
+)
+
+const (
+	// ProvisionerName selects the plugins in the provisioner annotation of service classes
+	ProvisionerName = "plugin"
+
+	// EndpointAnnotation on a service class is the gRPC address of its plugin, e.g. "db-plugin.default:9000"
+	EndpointAnnotation = "plugin.broker.istio.io/endpoint"
+
+	// DefaultTimeout of the calls to plugins
+	DefaultTimeout = 30 * time.Second
+)
+
+// Plugin is a provisioner calling a plugin over gRPC. The connection is not
+// encrypted, since the traffic to the plugin is secured by the mesh.
+type Plugin struct {
+	conn    *grpc.ClientConn
+	client  proto.ProvisionerClient
+	timeout time.Duration
+}
+
+// Dial connects to the plugin at an endpoint. The connection is established in the background.
+func Dial(endpoint string, timeout time.Duration) (*Plugin, error) {
+	conn, err := grpc.Dial(endpoint, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	return &Plugin{
+		conn:    conn,
+		client:  proto.NewProvisionerClient(conn),
+		timeout: timeout,
+	}, nil
+}
+
+// Close closes the connection to the plugin
+func (p *Plugin) Close() error {
+	return p.conn.Close()
+}
+
+func (p *Plugin) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), p.timeout)
+}
+
+// Provision calls the plugin to create the resources of an instance
+func (p *Plugin) Provision(req provisioner.ProvisionRequest) (provisioner.Result, error) {
+	params, err := toStruct(req.Parameters)
+	if err != nil {
+		return provisioner.Result{}, provisioner.Invalidf("invalid parameters: %v", err)
+	}
+	ctx, cancel := p.context()
+	defer cancel()
+	out, err := p.client.Provision(ctx, &proto.ProvisionRequest{
+		Instance:          toInstance(req.Instance),
+		Parameters:        params,
+		AcceptsIncomplete: req.AcceptsIncomplete,
+	})
+	if err != nil {
+		return provisioner.Result{}, fromStatus(err)
+	}
+	return provisioner.Result{Async: out.Async, Operation: out.Operation}, nil
+}
+
+// Update calls the plugin to apply a change of plan or parameters
+func (p *Plugin) Update(req provisioner.UpdateRequest) (provisioner.Result, error) {
+	params, err := toStruct(req.Parameters)
+	if err != nil {
+		return provisioner.Result{}, provisioner.Invalidf("invalid parameters: %v", err)
+	}
+	previous := ""
+	if req.PreviousPlan != nil {
+		previous = planID(req.PreviousPlan)
+	}
+	ctx, cancel := p.context()
+	defer cancel()
+	out, err := p.client.Update(ctx, &proto.UpdateRequest{
+		Instance:          toInstance(req.Instance),
+		PreviousPlanId:    previous,
+		Parameters:        params,
+		AcceptsIncomplete: req.AcceptsIncomplete,
+
+		MaintenanceVersion:         req.MaintenanceVersion,
+		PreviousMaintenanceVersion: req.PreviousMaintenanceVersion,
+	})
+	if err != nil {
+		return provisioner.Result{}, fromStatus(err)
+	}
+	return provisioner.Result{Async: out.Async, Operation: out.Operation}, nil
+}
+
+// Deprovision calls the plugin to remove the resources of an instance
+func (p *Plugin) Deprovision(req provisioner.DeprovisionRequest) (provisioner.Result, error) {
+	ctx, cancel := p.context()
+	defer cancel()
+	out, err := p.client.Deprovision(ctx, &proto.DeprovisionRequest{
+		Instance:          toInstance(req.Instance),
+		AcceptsIncomplete: req.AcceptsIncomplete,
+	})
+	if err != nil {
+		return provisioner.Result{}, fromStatus(err)
+	}
+	return provisioner.Result{Async: out.Async, Operation: out.Operation}, nil
+}
+
+// Bind calls the plugin to grant an application access to an instance
+func (p *Plugin) Bind(req provisioner.BindRequest) (provisioner.BindResult, error) {
+	params, err := toStruct(req.Parameters)
+	if err != nil {
+		return provisioner.BindResult{}, provisioner.Invalidf("invalid parameters: %v", err)
+	}
+	in := &proto.BindRequest{
+		Instance:   toInstance(req.Instance),
+		BindingId:  req.BindingID,
+		Parameters: params,
+		Context:    toContext(req.BindContext),
+	}
+	if req.BindResource != nil {
+		in.AppGuid = req.BindResource.AppGUID
+		in.Route = req.BindResource.Route
+	}
+	ctx, cancel := p.context()
+	defer cancel()
+	out, err := p.client.Bind(ctx, in)
+	if err != nil {
+		return provisioner.BindResult{}, fromStatus(err)
+	}
+	return provisioner.BindResult{
+		Created:     out.Created,
+		Credentials: &osb.BindingCredential{Values: out.Credentials},
+		Subject:     out.Subject,
+	}, nil
+}
+
+// Unbind calls the plugin to revoke a binding
+func (p *Plugin) Unbind(req provisioner.UnbindRequest) (bool, error) {
+	ctx, cancel := p.context()
+	defer cancel()
+	out, err := p.client.Unbind(ctx, &proto.UnbindRequest{
+		Instance:  toInstance(req.Instance),
+		BindingId: req.BindingID,
+	})
+	if err != nil {
+		return false, fromStatus(err)
+	}
+	return out.Found, nil
+}
+
+// LastOperation polls the plugin for the state of an asynchronous operation
+func (p *Plugin) LastOperation(req provisioner.LastOperationRequest) (osb.LastOperation, error) {
+	ctx, cancel := p.context()
+	defer cancel()
+	out, err := p.client.LastOperation(ctx, &proto.LastOperationRequest{
+		Instance:  toInstance(req.Instance),
+		Operation: req.Operation,
+	})
+	if err != nil {
+		return osb.LastOperation{}, fromStatus(err)
+	}
+	state := osb.OperationInProgress
+	switch out.State {
+	case proto.LastOperationResponse_SUCCEEDED:
+		state = osb.OperationSucceeded
+	case proto.LastOperationResponse_FAILED:
+		state = osb.OperationFailed
+	}
+	return osb.LastOperation{State: state, Description: out.Description}, nil
+}
+
+// Dispatcher delegates the requests of each service class to the plugin at
+// the endpoint of the class. Connections are opened on first use and shared
+// by the classes of an endpoint.
+type Dispatcher struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	plugins map[string]*Plugin
+}
+
+// NewDispatcher creates a dispatcher calling plugins with a timeout
+func NewDispatcher(timeout time.Duration) *Dispatcher {
+	return &Dispatcher{
+		timeout: timeout,
+		plugins: make(map[string]*Plugin),
+	}
+}
+
+// plugin connects to the plugin of a service class
+func (d *Dispatcher) plugin(class *config.Entry) (*Plugin, error) {
+	endpoint := class.Annotations[EndpointAnnotation]
+	if endpoint == "" {
+		return nil, fmt.Errorf("%s: missing annotation %s", class.Key(), EndpointAnnotation)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p, ok := d.plugins[endpoint]; ok {
+		return p, nil
+	}
+	glog.Infof("Connecting to plugin %q of %s", endpoint, class.Key())
+	p, err := Dial(endpoint, d.timeout)
+	if err != nil {
+		return nil, err
+	}
+	d.plugins[endpoint] = p
+	return p, nil
+}
+
+// Close closes the connections to the plugins
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs error
+	for endpoint, p := range d.plugins {
+		if err := p.Close(); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", endpoint, err))
+		}
+		delete(d.plugins, endpoint)
+	}
+	return errs
+}
+
+// Provision delegates to the plugin of the service class
+func (d *Dispatcher) Provision(req provisioner.ProvisionRequest) (provisioner.Result, error) {
+	p, err := d.plugin(req.Class)
+	if err != nil {
+		return provisioner.Result{}, err
+	}
+	return p.Provision(req)
+}
+
+// Update delegates to the plugin of the service class
+func (d *Dispatcher) Update(req provisioner.UpdateRequest) (provisioner.Result, error) {
+	p, err := d.plugin(req.Class)
+	if err != nil {
+		return provisioner.Result{}, err
+	}
+	return p.Update(req)
+}
+
+// Deprovision delegates to the plugin of the service class
+func (d *Dispatcher) Deprovision(req provisioner.DeprovisionRequest) (provisioner.Result, error) {
+	p, err := d.plugin(req.Class)
+	if err != nil {
+		return provisioner.Result{}, err
+	}
+	return p.Deprovision(req)
+}
+
+// Bind delegates to the plugin of the service class
+func (d *Dispatcher) Bind(req provisioner.BindRequest) (provisioner.BindResult, error) {
+	p, err := d.plugin(req.Class)
+	if err != nil {
+		return provisioner.BindResult{}, err
+	}
+	return p.Bind(req)
+}
+
+// Unbind delegates to the plugin of the service class
+func (d *Dispatcher) Unbind(req provisioner.UnbindRequest) (bool, error) {
+	p, err := d.plugin(req.Class)
+	if err != nil {
+		return false, err
+	}
+	return p.Unbind(req)
+}
+
+// LastOperation delegates to the plugin of the service class
+func (d *Dispatcher) LastOperation(req provisioner.LastOperationRequest) (osb.LastOperation, error) {
+	p, err := d.plugin(req.Class)
+	if err != nil {
+		return osb.LastOperation{}, err
+	}
+	return p.LastOperation(req)
+}
+
+// fromStatus converts the status codes of the contract to the errors of provisioners
+func fromStatus(err error) error {
+	switch grpc.Code(err) {
+	case codes.InvalidArgument:
+		return provisioner.InvalidRequestError(grpc.ErrorDesc(err))
+	case codes.AlreadyExists:
+		return provisioner.ErrConflict
+	case codes.FailedPrecondition:
+		return provisioner.ErrAsyncRequired
+	}
+	return err
+}
+
+// toInstance converts an instance to its message
+func toInstance(in provisioner.Instance) *proto.Instance {
+	out := &proto.Instance{
+		Id:           in.ID,
+		ServiceClass: in.Class.Key(),
+		Namespace:    in.Class.Namespace,
+		Context:      toContext(in.Context),
+	}
+	if class, ok := in.Class.Spec.(*brokerconfig.ServiceClass); ok {
+		out.ServiceId = class.GetEntry().GetId()
+	}
+	if in.Plan != nil {
+		out.PlanId = planID(in.Plan)
+		out.ServicePlan = in.Plan.Key()
+	}
+	return out
+}
+
+// toContext converts a platform context to its message
+func toContext(in *osb.Context) *proto.Context {
+	if in == nil {
+		return nil
+	}
+	return &proto.Context{
+		Platform:         in.Platform,
+		InstanceName:     in.InstanceName,
+		Namespace:        in.Namespace,
+		ClusterId:        in.ClusterID,
+		OrganizationGuid: in.OrganizationGUID,
+		SpaceGuid:        in.SpaceGUID,
+	}
+}
+
+// planID is the catalog id of a service plan
+func planID(plan *config.Entry) string {
+	if spec, ok := plan.Spec.(*brokerconfig.ServicePlan); ok {
+		return spec.GetPlan().GetId()
+	}
+	return ""
+}
+
+// toStruct converts request parameters to a struct message
+func toStruct(in map[string]interface{}) (*structpb.Struct, error) {
+	if in == nil {
+		return nil, nil
+	}
+	js, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	out := &structpb.Struct{}
+	if err = jsonpb.UnmarshalString(string(js), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	brokerconfig "istio.io/api/broker/v1/config"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+	"istio.io/broker/pkg/provisioner"
+	"istio.io/broker/pkg/provisioner/plugin/harness"
+	"istio.io/broker/pkg/provisioner/plugin/reference"
+)
+
+func makeInstance(endpoint string) provisioner.Instance {
+	annotations := map[string]string{provisioner.Annotation: ProvisionerName}
+	if endpoint != "" {
+		annotations[EndpointAnnotation] = endpoint
+	}
+	return provisioner.Instance{
+		ID: "instance-1",
+		Class: &config.Entry{
+			Meta: config.Meta{Type: config.ServiceClass.Type, Name: "database", Namespace: "default",
+				Annotations: annotations},
+			Spec: &brokerconfig.ServiceClass{
+				Entry: &brokerconfig.CatalogEntry{Name: "database", Id: "database-id"},
+			},
+		},
+		Plan: &config.Entry{
+			Meta: config.Meta{Type: config.ServicePlan.Type, Name: "small", Namespace: "default"},
+			Spec: &brokerconfig.ServicePlan{Plan: &brokerconfig.CatalogPlan{Name: "small", Id: "small-id"}},
+		},
+	}
+}
+
+func TestReferencePlugin(t *testing.T) {
+	endpoint, stop, err := harness.Start(reference.NewServer(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	d := NewDispatcher(time.Second)
+	defer func() {
+		if errClose := d.Close(); errClose != nil {
+			t.Error(errClose)
+		}
+	}()
+	instance := makeInstance(endpoint)
+
+	if _, err = d.Provision(provisioner.ProvisionRequest{Instance: instance}); err != provisioner.ErrAsyncRequired {
+		t.Errorf("Provision synchronously => got %v, want %v", err, provisioner.ErrAsyncRequired)
+	}
+	harness.Lifecycle(t, d, instance, 5*time.Second)
+
+	if _, err = d.Bind(provisioner.BindRequest{Instance: instance, BindingID: "binding"}); err == nil {
+		t.Error("Bind to deprovisioned instance => got no error")
+	} else if _, ok := err.(provisioner.InvalidRequestError); !ok {
+		t.Errorf("Bind to deprovisioned instance => got %v, want invalid request", err)
+	}
+}
+
+func TestDispatcherEndpoint(t *testing.T) {
+	d := NewDispatcher(time.Second)
+	if _, err := d.Provision(provisioner.ProvisionRequest{Instance: makeInstance("")}); err == nil {
+		t.Error("Provision without endpoint => got no error")
+	}
+	first, err := d.plugin(makeInstance("localhost:9000").Class)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.plugin(makeInstance("localhost:9000").Class)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("got separate connections to the same endpoint")
+	}
+	if err = d.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFromStatus(t *testing.T) {
+	other := errors.New("other")
+	cases := []struct {
+		in   error
+		want error
+	}{
+		{grpc.Errorf(codes.InvalidArgument, "bad plan"), provisioner.InvalidRequestError("bad plan")},
+		{grpc.Errorf(codes.AlreadyExists, "exists"), provisioner.ErrConflict},
+		{grpc.Errorf(codes.FailedPrecondition, "async"), provisioner.ErrAsyncRequired},
+		{other, other},
+	}
+	for _, c := range cases {
+		if got := fromStatus(c.in); got != c.want {
+			t.Errorf("fromStatus(%v) => got %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestToInstance(t *testing.T) {
+	instance := makeInstance("")
+	got := toInstance(instance)
+	if got.Id != "instance-1" || got.ServiceId != "database-id" || got.PlanId != "small-id" ||
+		got.Namespace != "default" || got.Context != nil {
+		t.Errorf("toInstance() => got %v", got)
+	}
+
+	instance.Context = &osb.Context{Platform: osb.PlatformKubernetes, Namespace: "team-a", ClusterID: "c1"}
+	if ctx := toInstance(instance).GetContext(); ctx.GetPlatform() != osb.PlatformKubernetes ||
+		ctx.GetNamespace() != "team-a" || ctx.GetClusterId() != "c1" {
+		t.Errorf("toInstance() => got context %v", ctx)
+	}
+}
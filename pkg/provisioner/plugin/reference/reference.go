@@ -0,0 +1,219 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reference is a reference provisioner plugin offering in-memory
+// databases. Instances are provisioned and deprovisioned asynchronously after
+// a delay, and each binding gets its own user of the database.
+package reference
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"istio.io/broker/pkg/provisioner/plugin/proto"
+)
+
+// instance is an in-memory database
+type instance struct {
+	planID string
+
+	// pending asynchronous operation and the time it completes
+	operation string
+	deleting  bool
+	readyAt   time.Time
+
+	// bindings by id
+	bindings map[string]*binding
+}
+
+// binding is a user of a database
+type binding struct {
+	app      string
+	password string
+}
+
+// Server implements the provisioner contract
+type Server struct {
+	delay time.Duration
+	now   func() time.Time
+
+	mu         sync.Mutex
+	instances  map[string]*instance
+	operations int
+}
+
+// NewServer creates a plugin completing asynchronous operations after a delay
+func NewServer(delay time.Duration) *Server {
+	return &Server{
+		delay:     delay,
+		now:       time.Now,
+		instances: make(map[string]*instance),
+	}
+}
+
+// Register adds the plugin to a gRPC server
+func (s *Server) Register(server *grpc.Server) {
+	proto.RegisterProvisionerServer(server, s)
+}
+
+// nextOperation identifies a new operation. Callers must hold the lock.
+func (s *Server) nextOperation(kind, id string) string {
+	s.operations++
+	return fmt.Sprintf("%s-%s-%d", kind, id, s.operations)
+}
+
+// ready reports whether an instance completed its operations and removes it
+// if it has been deprovisioned. Callers must hold the lock.
+func (s *Server) ready(id string) (*instance, bool) {
+	in, ok := s.instances[id]
+	if !ok {
+		return nil, false
+	}
+	if in.operation != "" && !s.now().Before(in.readyAt) {
+		glog.V(2).Infof("operation %q completed", in.operation)
+		in.operation = ""
+		if in.deleting {
+			delete(s.instances, id)
+			return nil, false
+		}
+	}
+	return in, in.operation == ""
+}
+
+// Provision creates a database in the background
+func (s *Server) Provision(ctx context.Context, req *proto.ProvisionRequest) (*proto.OperationResponse, error) {
+	if !req.AcceptsIncomplete {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "databases are provisioned asynchronously")
+	}
+	id := req.GetInstance().GetId()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.instances[id]; exists {
+		return nil, grpc.Errorf(codes.AlreadyExists, "instance %q exists", id)
+	}
+	op := s.nextOperation("provision", id)
+	s.instances[id] = &instance{
+		planID:    req.GetInstance().GetPlanId(),
+		operation: op,
+		readyAt:   s.now().Add(s.delay),
+		bindings:  make(map[string]*binding),
+	}
+	glog.Infof("Provisioning database %q", id)
+	return &proto.OperationResponse{Async: true, Operation: op}, nil
+}
+
+// Update changes the plan of a database
+func (s *Server) Update(ctx context.Context, req *proto.UpdateRequest) (*proto.OperationResponse, error) {
+	id := req.GetInstance().GetId()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ready := s.ready(id)
+	if !ready {
+		return nil, grpc.Errorf(codes.InvalidArgument, "instance %q is not ready", id)
+	}
+	in.planID = req.GetInstance().GetPlanId()
+	return &proto.OperationResponse{}, nil
+}
+
+// Deprovision removes a database in the background
+func (s *Server) Deprovision(ctx context.Context, req *proto.DeprovisionRequest) (*proto.OperationResponse, error) {
+	if !req.AcceptsIncomplete {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "databases are deprovisioned asynchronously")
+	}
+	id := req.GetInstance().GetId()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ready := s.ready(id)
+	if !ready {
+		return nil, grpc.Errorf(codes.InvalidArgument, "instance %q is not ready", id)
+	}
+	in.operation = s.nextOperation("deprovision", id)
+	in.deleting = true
+	in.readyAt = s.now().Add(s.delay)
+	glog.Infof("Deprovisioning database %q", id)
+	return &proto.OperationResponse{Async: true, Operation: in.operation}, nil
+}
+
+// Bind creates a user of the database for the application
+func (s *Server) Bind(ctx context.Context, req *proto.BindRequest) (*proto.BindResponse, error) {
+	id := req.GetInstance().GetId()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ready := s.ready(id)
+	if !ready {
+		return nil, grpc.Errorf(codes.InvalidArgument, "instance %q is not ready", id)
+	}
+	b, exists := in.bindings[req.BindingId]
+	switch {
+	case exists && b.app != req.AppGuid:
+		return nil, grpc.Errorf(codes.AlreadyExists, "binding %q exists for another application", req.BindingId)
+	case !exists:
+		password := make([]byte, 16)
+		if _, err := rand.Read(password); err != nil {
+			return nil, err
+		}
+		b = &binding{app: req.AppGuid, password: hex.EncodeToString(password)}
+		in.bindings[req.BindingId] = b
+	}
+	return &proto.BindResponse{
+		Created: !exists,
+		Credentials: map[string]string{
+			"uri":      "memory://" + id,
+			"username": req.BindingId,
+			"password": b.password,
+		},
+		Subject: req.AppGuid,
+	}, nil
+}
+
+// Unbind removes the user of a binding
+func (s *Server) Unbind(ctx context.Context, req *proto.UnbindRequest) (*proto.UnbindResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ok := s.instances[req.GetInstance().GetId()]
+	if !ok {
+		return &proto.UnbindResponse{}, nil
+	}
+	_, found := in.bindings[req.BindingId]
+	delete(in.bindings, req.BindingId)
+	return &proto.UnbindResponse{Found: found}, nil
+}
+
+// LastOperation reports whether an operation completed
+func (s *Server) LastOperation(ctx context.Context,
+	req *proto.LastOperationRequest) (*proto.LastOperationResponse, error) {
+	id := req.GetInstance().GetId()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ok := s.instances[id]
+	if !ok || in.operation != req.Operation {
+		// completed operations are forgotten
+		return &proto.LastOperationResponse{State: proto.LastOperationResponse_SUCCEEDED}, nil
+	}
+	if _, ready := s.ready(id); ready || s.instances[id] == nil {
+		return &proto.LastOperationResponse{State: proto.LastOperationResponse_SUCCEEDED}, nil
+	}
+	return &proto.LastOperationResponse{
+		State:       proto.LastOperationResponse_IN_PROGRESS,
+		Description: fmt.Sprintf("ready in %v", in.readyAt.Sub(s.now())),
+	}, nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package provisioner defines the extension point of the broker: the
+// provisioner of a service class creates the backend resources of its
+// instances and bindings, while the controller handles the open service
+// broker protocol, the persistence of instances and the binding credentials.
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/model/osb"
+)
+
+const (
+	// Annotation on a service class names its provisioner, since the class
+	// message is defined by the Istio API
+	Annotation = "broker.istio.io/provisioner"
+
+	// DefaultProvisioner provisions the service classes without annotation
+	DefaultProvisioner = MeshProvisioner
+)
+
+var (
+	// ErrConflict is returned when a resource already exists with different parameters
+	ErrConflict = errors.New("resource already exists with different parameters")
+
+	// ErrAsyncRequired is returned when an operation can only complete
+	// asynchronously but the platform does not accept incomplete operations
+	ErrAsyncRequired = errors.New("this service plan requires client support for asynchronous operations")
+)
+
+// InvalidRequestError is returned for requests a provisioner cannot serve as given
+type InvalidRequestError string
+
+// Error returns the description of the invalid request
+func (e InvalidRequestError) Error() string {
+	return string(e)
+}
+
+// Invalidf formats an invalid request error
+func Invalidf(format string, args ...interface{}) error {
+	return InvalidRequestError(fmt.Sprintf(format, args...))
+}
+
+// Instance identifies a service instance and the catalog entries it is provisioned from
+type Instance struct {
+	// ID of the service instance
+	ID string
+
+	// Class is the service class of the instance
+	Class *config.Entry
+
+	// Plan is the service plan of the instance, if known
+	Plan *config.Entry
+
+	// Context is the platform context the instance was provisioned in, if provided
+	Context *osb.Context
+}
+
+// ProvisionRequest creates the resources of a new service instance
+type ProvisionRequest struct {
+	Instance
+	Parameters        map[string]interface{}
+	AcceptsIncomplete bool
+}
+
+// UpdateRequest changes the plan or the parameters of a service instance
+type UpdateRequest struct {
+	Instance
+	PreviousPlan      *config.Entry
+	Parameters        map[string]interface{}
+	AcceptsIncomplete bool
+
+	// MaintenanceVersion is the maintenance version of the plan the instance
+	// is updated to. The update upgrades the instance when it differs from
+	// the previous version.
+	MaintenanceVersion         string
+	PreviousMaintenanceVersion string
+}
+
+// DeprovisionRequest removes the resources of a service instance
+type DeprovisionRequest struct {
+	Instance
+	AcceptsIncomplete bool
+}
+
+// BindRequest grants an application access to a service instance
+type BindRequest struct {
+	Instance
+	BindingID    string
+	Parameters   map[string]interface{}
+	BindResource *osb.BindResource
+
+	// BindContext is the platform context of the bind request, if provided
+	BindContext *osb.Context
+}
+
+// UnbindRequest revokes the access of a binding
+type UnbindRequest struct {
+	Instance
+	BindingID string
+}
+
+// LastOperationRequest polls the state of an asynchronous operation
+type LastOperationRequest struct {
+	Instance
+	Operation string
+}
+
+// Result of an instance operation
+type Result struct {
+	// Async reports that the operation continues in the background
+	Async bool
+
+	// Operation identifies an asynchronous operation when polling its state
+	Operation string
+}
+
+// BindResult is the outcome of a bind request
+type BindResult struct {
+	// Created reports whether the binding is new, as opposed to a repeated request
+	Created bool
+
+	// Credentials returned to the platform
+	Credentials *osb.BindingCredential
+
+	// Subject is the identity of the client certificate issued for the
+	// binding. No certificate is issued if empty.
+	Subject string
+}
+
+// Provisioner creates the backend resources of the instances and bindings of service classes.
+// Requests are only passed on for service instances known to the controller, except for
+// bind and unbind requests, which must be idempotent.
+type Provisioner interface {
+	// Provision creates the resources of a new instance
+	Provision(req ProvisionRequest) (Result, error)
+
+	// Update applies a change of plan or parameters to an instance
+	Update(req UpdateRequest) (Result, error)
+
+	// Deprovision removes the resources of an instance
+	Deprovision(req DeprovisionRequest) (Result, error)
+
+	// Bind grants an application access to an instance
+	Bind(req BindRequest) (BindResult, error)
+
+	// Unbind revokes a binding and reports whether it existed
+	Unbind(req UnbindRequest) (bool, error)
+
+	// LastOperation reports the state of an asynchronous operation
+	LastOperation(req LastOperationRequest) (osb.LastOperation, error)
+}
+
+// Reconciler is implemented by provisioners able to converge the resources of
+// the instances and bindings known to the controller, e.g. after the broker
+// crashed part way through an operation or the resources were changed.
+type Reconciler interface {
+	// ReconcileInstance applies the resources of a provisioned instance again
+	ReconcileInstance(instance Instance) error
+
+	// ReconcileBinding applies the resources of a binding again
+	ReconcileBinding(req BindRequest) error
+
+	// Owners lists the ids of the instances and bindings having resources
+	Owners() (instances, bindings []string, err error)
+
+	// RemoveInstance removes the resources of an instance unknown to the controller
+	RemoveInstance(id string) error
+
+	// RemoveBinding removes the resources of a binding unknown to the controller
+	RemoveBinding(id string) error
+}
+
+// Registry holds the provisioners by name
+type Registry struct {
+	mu           sync.RWMutex
+	provisioners map[string]Provisioner
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{provisioners: make(map[string]Provisioner)}
+}
+
+// Register adds a named provisioner
+func (r *Registry) Register(name string, p Provisioner) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.provisioners[name]; exists {
+		return fmt.Errorf("provisioner %q is already registered", name)
+	}
+	r.provisioners[name] = p
+	return nil
+}
+
+// Reconcilers lists the registered provisioners supporting reconciliation by name
+func (r *Registry) Reconcilers() map[string]Reconciler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(map[string]Reconciler)
+	for name, p := range r.provisioners {
+		if reconciler, ok := p.(Reconciler); ok {
+			out[name] = reconciler
+		}
+	}
+	return out
+}
+
+// Lookup finds the provisioner of a service class
+func (r *Registry) Lookup(class *config.Entry) (Provisioner, error) {
+	name := class.Annotations[Annotation]
+	if name == "" {
+		name = DefaultProvisioner
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.provisioners[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown provisioner %q", class.Key(), name)
+	}
+	return p, nil
+}
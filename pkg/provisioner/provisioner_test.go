@@ -0,0 +1,65 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisioner
+
+import (
+	"testing"
+
+	"istio.io/broker/pkg/model/config"
+)
+
+func TestRegistry(t *testing.T) {
+	mesh := NewMesh(nil)
+	other := NewMesh(nil)
+	registry := NewRegistry()
+	if err := registry.Register(MeshProvisioner, mesh); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register("database", other); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register("database", mesh); err == nil {
+		t.Error("registering a name twice should fail")
+	}
+
+	class := func(provisioner string) *config.Entry {
+		entry := &config.Entry{Meta: config.Meta{Type: config.ServiceClass.Type, Name: "class", Namespace: "default"}}
+		if provisioner != "" {
+			entry.Annotations = map[string]string{Annotation: provisioner}
+		}
+		return entry
+	}
+	cases := []struct {
+		annotation string
+		want       Provisioner
+	}{
+		{"", mesh},
+		{MeshProvisioner, mesh},
+		{"database", other},
+		{"missing", nil},
+	}
+	for _, c := range cases {
+		got, err := registry.Lookup(class(c.annotation))
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("Lookup(%q) should fail", c.annotation)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("Lookup(%q) => got %v, %v", c.annotation, got, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	proxyconfig "istio.io/api/proxy/v1/config"
+	"istio.io/broker/pkg/model/config"
+)
+
+// Service classes backed by endpoints outside the mesh are declared by
+// annotations on the service class, since the deployment message of the class
+// only names mesh services.
+const (
+	// ExternalHostAnnotation is the host of the external endpoint, e.g. "api.example.com".
+	// A leading "*." matches the subdomains of a domain.
+	ExternalHostAnnotation = "external.broker.istio.io/host"
+
+	// ExternalPortsAnnotation lists the ports of the external endpoint with
+	// their protocols, e.g. "443/https,80/http". Workloads send plain HTTP to
+	// the https ports and their sidecars originate TLS to the endpoint.
+	ExternalPortsAnnotation = "external.broker.istio.io/ports"
+)
+
+// externalProtocols are the protocols supported by egress rules
+var externalProtocols = map[string]bool{"http": true, "https": true, "http2": true, "grpc": true}
+
+// externalHost matches DNS names with an optional wildcard prefix
+var externalHost = regexp.MustCompile(`^(\*\.)?[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// External is an endpoint outside the mesh backing a service class
+type External struct {
+	// Host of the endpoint
+	Host string
+
+	// Ports of the endpoint
+	Ports []ExternalPort
+}
+
+// ExternalPort is a port of an external endpoint
+type ExternalPort struct {
+	Port     int32
+	Protocol string
+}
+
+// ParseExternal reads the external endpoint of a service class from its
+// annotations. Classes without an external host return nil.
+func ParseExternal(class config.Entry) (*External, error) {
+	host, ok := class.Annotations[ExternalHostAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	if !externalHost.MatchString(host) {
+		return nil, fmt.Errorf("%s: invalid %s %q", class.Key(), ExternalHostAnnotation, host)
+	}
+	ports := class.Annotations[ExternalPortsAnnotation]
+	if ports == "" {
+		return nil, fmt.Errorf("%s: missing annotation %s", class.Key(), ExternalPortsAnnotation)
+	}
+
+	out := &External{Host: host}
+	for _, spec := range strings.Split(ports, ",") {
+		parts := strings.SplitN(strings.TrimSpace(spec), "/", 2)
+		port, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil || port == 0 || len(parts) != 2 || !externalProtocols[strings.ToLower(parts[1])] {
+			return nil, fmt.Errorf("%s: invalid port %q in %s", class.Key(), spec, ExternalPortsAnnotation)
+		}
+		out.Ports = append(out.Ports, ExternalPort{Port: int32(port), Protocol: strings.ToLower(parts[1])})
+	}
+	return out, nil
+}
+
+// URI is the address used by workloads to reach the first HTTP port of the
+// endpoint, or empty if the endpoint has no HTTP port
+func (e *External) URI() string {
+	for _, port := range e.Ports {
+		if port.Protocol == "http" || port.Protocol == "https" {
+			return fmt.Sprintf("http://%s:%d", e.Host, port.Port)
+		}
+	}
+	return ""
+}
+
+// GenerateEgress creates the egress rule opening the mesh to the external
+// endpoint of an instance. Instances of mesh services need no configuration.
+func GenerateEgress(instance Instance) []config.Entry {
+	if instance.External == nil {
+		return nil
+	}
+	rule := &proxyconfig.EgressRule{
+		Destination: &proxyconfig.IstioService{Service: instance.External.Host},
+	}
+	for _, port := range instance.External.Ports {
+		rule.Ports = append(rule.Ports, &proxyconfig.EgressRule_Port{Port: port.Port, Protocol: port.Protocol})
+	}
+	return []config.Entry{{
+		Meta: ownerMeta(config.Meta{
+			Type:      config.EgressRule.Type,
+			Name:      config.ObjectName("instance-", instance.ID),
+			Namespace: instance.Namespace,
+		}, instance.ID, ""),
+		Spec: rule,
+	}}
+}
+
+// ApplyEgress converges the egress configuration of an instance
+func (r *Router) ApplyEgress(instance Instance) error {
+	return r.converge(config.InstanceLabel, instance.ID, egressTypes, GenerateEgress(instance))
+}
+
+// RemoveEgress deletes the egress configuration of an instance
+func (r *Router) RemoveEgress(id string) error {
+	return r.converge(config.InstanceLabel, id, egressTypes, nil)
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"reflect"
+	"testing"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+
+	proxyconfig "istio.io/api/proxy/v1/config"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/platform/memory"
+)
+
+func makeExternal() *External {
+	return &External{
+		Host:  "api.example.com",
+		Ports: []ExternalPort{{Port: 443, Protocol: "https"}, {Port: 80, Protocol: "http"}},
+	}
+}
+
+func TestParseExternal(t *testing.T) {
+	cases := []struct {
+		annotations map[string]string
+		want        *External
+		err         bool
+	}{
+		{nil, nil, false},
+		{map[string]string{ExternalHostAnnotation: "api.example.com", ExternalPortsAnnotation: "443/HTTPS, 80/http"},
+			makeExternal(), false},
+		{map[string]string{ExternalHostAnnotation: "*.example.com", ExternalPortsAnnotation: "8443/grpc"},
+			&External{Host: "*.example.com", Ports: []ExternalPort{{Port: 8443, Protocol: "grpc"}}}, false},
+		{map[string]string{ExternalHostAnnotation: "api.example.com"}, nil, true},
+		{map[string]string{ExternalHostAnnotation: "http://api.example.com", ExternalPortsAnnotation: "80/http"}, nil, true},
+		{map[string]string{ExternalHostAnnotation: "api.example.com", ExternalPortsAnnotation: "443"}, nil, true},
+		{map[string]string{ExternalHostAnnotation: "api.example.com", ExternalPortsAnnotation: "70000/http"}, nil, true},
+		{map[string]string{ExternalHostAnnotation: "api.example.com", ExternalPortsAnnotation: "5432/tcp"}, nil, true},
+	}
+	for _, c := range cases {
+		class := config.Entry{Meta: config.Meta{Type: config.ServiceClass.Type, Name: "api", Annotations: c.annotations}}
+		got, err := ParseExternal(class)
+		if (err != nil) != c.err || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseExternal(%v) => got %+v, %v, want %+v", c.annotations, got, err, c.want)
+		}
+	}
+}
+
+func TestExternalURI(t *testing.T) {
+	if got := makeExternal().URI(); got != "http://api.example.com:443" {
+		t.Errorf("URI() => got %q", got)
+	}
+	grpc := &External{Host: "api.example.com", Ports: []ExternalPort{{Port: 8443, Protocol: "grpc"}}}
+	if got := grpc.URI(); got != "" {
+		t.Errorf("URI() without HTTP port => got %q", got)
+	}
+}
+
+func TestGenerateExternal(t *testing.T) {
+	b := makeBinding()
+	b.Service = ""
+	b.External = makeExternal()
+	entries := Generate(b)
+	if len(entries) != 1 || entries[0].Type != config.RouteRule.Type {
+		t.Fatalf("Generate() => got %v, want a route rule", entries)
+	}
+	if dest := entries[0].Spec.(*proxyconfig.RouteRule).GetDestination(); dest.GetService() != "api.example.com" {
+		t.Errorf("Generate() => got route destination %v", dest)
+	}
+
+	instance := Instance{ID: "F6C1AD1C", External: makeExternal(), Namespace: "default"}
+	entries = GenerateEgress(instance)
+	if len(entries) != 1 || entries[0].Key() != "egress-rule/default/instance-f6c1ad1c" {
+		t.Fatalf("GenerateEgress() => got %v", entries)
+	}
+	rule := entries[0].Spec.(*proxyconfig.EgressRule)
+	if rule.GetDestination().GetService() != "api.example.com" || len(rule.Ports) != 2 ||
+		rule.Ports[0].Port != 443 || rule.Ports[0].Protocol != "https" {
+		t.Errorf("GenerateEgress() => got %v", rule)
+	}
+	if err := config.EgressRule.Validate(rule); err != nil {
+		t.Errorf("GenerateEgress() => invalid egress rule: %v", err)
+	}
+	if entries = GenerateEgress(Instance{ID: "F6C1AD1C", Service: "productpage"}); len(entries) != 0 {
+		t.Errorf("GenerateEgress() for a mesh service => got %v", entries)
+	}
+
+	quota, err := GenerateQuota(instance, Quota{RequestsPerSecond: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range quota {
+		if entry.Type != config.MixerRule.Type {
+			continue
+		}
+		if match := entry.Spec.(*structpb.Struct).Fields["match"].GetStringValue(); match !=
+			`destination.service == "api.example.com"` {
+			t.Errorf("GenerateQuota() => got rule match %q", match)
+		}
+	}
+}
+
+func TestApplyEgress(t *testing.T) {
+	store := memory.Make(config.IstioConfigTypes)
+	r := NewRouter(store)
+	instance := Instance{ID: "f6c1ad1c", External: makeExternal(), Namespace: "default"}
+
+	if err := r.ApplyEgress(instance); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ApplyQuota(instance, Quota{RequestsPerSecond: 10}); err != nil {
+		t.Fatal(err)
+	}
+	instance.External.Ports = instance.External.Ports[:1]
+	if err := r.ApplyEgress(instance); err != nil {
+		t.Fatal(err)
+	}
+	rule, exists := store.Get(config.EgressRule.Type, "instance-f6c1ad1c", "default")
+	if !exists || len(rule.Spec.(*proxyconfig.EgressRule).Ports) != 1 {
+		t.Errorf("ApplyEgress() => got %v, want an updated egress rule", rule)
+	}
+
+	// removing the egress rule leaves the quota in place
+	if err := r.RemoveEgress(instance.ID); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := store.List(config.EgressRule.Type, ""); len(l) != 0 {
+		t.Errorf("RemoveEgress() => got %d egress rule(s) left", len(l))
+	}
+	if l, _ := store.List(config.MixerRule.Type, ""); len(l) != 1 {
+		t.Errorf("RemoveEgress() => got %d mixer rule(s), want 1", len(l))
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	multierror "github.com/hashicorp/go-multierror"
+
+	proxyconfig "istio.io/api/proxy/v1/config"
+	"istio.io/broker/pkg/model/config"
+)
+
+// The quota of a plan is declared by annotations on the service plan, since
+// the plan message is defined by the Istio API. The catalog rejects the plans
+// with invalid quota annotations.
+const (
+	// RequestsPerSecondAnnotation limits the requests per second of each consumer of an instance
+	RequestsPerSecondAnnotation = "quota.broker.istio.io/requests-per-second"
+
+	// RequestsPerDayAnnotation limits the requests per day of each consumer of an instance
+	RequestsPerDayAnnotation = "quota.broker.istio.io/requests-per-day"
+
+	// serviceDomain is the DNS suffix of the mesh services
+	serviceDomain = "svc.cluster.local"
+)
+
+var (
+	// quotaTypes lists the mixer types generated for quotas
+	quotaTypes = config.Descriptor{config.MemQuota, config.Quota, config.MixerRule}
+
+	// egressTypes lists the types generated for external endpoints
+	egressTypes = config.Descriptor{config.EgressRule}
+
+	// bindingTypes lists the types generated for bindings
+	bindingTypes = config.Descriptor{config.RouteRule, config.DestinationPolicy}
+)
+
+// Quota limits the requests to the service of an instance. Zero means unlimited.
+type Quota struct {
+	RequestsPerSecond int64
+	RequestsPerDay    int64
+}
+
+// PlanQuota reads the quota of a service plan from its annotations
+func PlanQuota(plan config.Entry) (Quota, error) {
+	var out Quota
+	var errs error
+	for annotation, limit := range map[string]*int64{
+		RequestsPerSecondAnnotation: &out.RequestsPerSecond,
+		RequestsPerDayAnnotation:    &out.RequestsPerDay,
+	} {
+		value, ok := plan.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			errs = multierror.Append(errs, fmt.Errorf("%s: invalid %s %q", plan.Key(), annotation, value))
+			continue
+		}
+		*limit = n
+	}
+	return out, errs
+}
+
+// Instance identifies the mesh service or the external endpoint of a provisioned service instance
+type Instance struct {
+	// ID of the service instance
+	ID string
+
+	// Service is the mesh service of the service class deployment
+	Service string
+
+	// External is the endpoint outside the mesh of the service class, if any
+	External *External
+
+	// Namespace where the configuration is created, the namespace of the
+	// service class or of the platform the instance is provisioned in
+	Namespace string
+
+	// ServiceNamespace is the namespace of the mesh service if it differs from Namespace
+	ServiceNamespace string
+
+	// Consumers are the mesh services bound to the instance, e.g.
+	// "reviews.bookinfo.svc.cluster.local". The router reads them from the
+	// configuration of the bindings when applying the quota.
+	Consumers []string
+}
+
+// destination is the value of the destination.service attribute of the
+// requests to an instance, or empty if the instance has no destination
+func (i Instance) destination() string {
+	switch {
+	case i.External != nil:
+		return i.External.Host
+	case i.Service != "":
+		return i.Service + "." + serviceNamespace(i.Namespace, i.ServiceNamespace) + "." + serviceDomain
+	}
+	return ""
+}
+
+// GenerateQuota creates the mixer configuration enforcing a quota on the
+// requests of each consumer to the service of an instance: a memquota handler,
+// a quota instance per limit and a rule applying them to the requests of the
+// bound consumers. The counters are keyed by instance, so that instances of
+// the same service do not share their quota. No configuration is generated
+// until a consumer is bound.
+func GenerateQuota(instance Instance, q Quota) ([]config.Entry, error) {
+	base := config.ObjectName("instance-", instance.ID)
+	meta := func(schema config.Schema, name string) config.Meta {
+		return ownerMeta(config.Meta{Type: schema.Type, Name: name, Namespace: instance.Namespace}, instance.ID, "")
+	}
+	qualified := func(schema config.Schema, name string) string {
+		return name + "." + schema.Type + "." + instance.Namespace
+	}
+
+	var out []config.Entry
+	var quotas, instances []interface{}
+	for _, limit := range []struct {
+		suffix   string
+		amount   int64
+		duration string
+	}{
+		{"rps", q.RequestsPerSecond, "1s"},
+		{"daily", q.RequestsPerDay, "24h"},
+	} {
+		if limit.amount == 0 {
+			continue
+		}
+		name := base + "-" + limit.suffix
+		spec, err := toStruct(map[string]interface{}{
+			"dimensions": map[string]interface{}{
+				"instance": strconv.Quote(instance.ID),
+				"source":   `source.service | "unknown"`,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, config.Entry{Meta: meta(config.Quota, name), Spec: spec})
+		quotas = append(quotas, map[string]interface{}{
+			"name":          qualified(config.Quota, name),
+			"maxAmount":     limit.amount,
+			"validDuration": limit.duration,
+		})
+		instances = append(instances, qualified(config.Quota, name))
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	destination := instance.destination()
+	if destination == "" {
+		return nil, fmt.Errorf("instance %q has no service to enforce a quota on", instance.ID)
+	}
+	if len(instance.Consumers) == 0 {
+		return nil, nil
+	}
+	sources := make([]string, 0, len(instance.Consumers))
+	for _, consumer := range instance.Consumers {
+		sources = append(sources, fmt.Sprintf("source.service == %q", consumer))
+	}
+
+	handler, err := toStruct(map[string]interface{}{"quotas": quotas})
+	if err != nil {
+		return nil, err
+	}
+	rule, err := toStruct(map[string]interface{}{
+		"match": fmt.Sprintf("destination.service == %q && (%s)", destination, strings.Join(sources, " || ")),
+		"actions": []interface{}{
+			map[string]interface{}{
+				"handler":   qualified(config.MemQuota, base),
+				"instances": instances,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	out = append(out,
+		config.Entry{Meta: meta(config.MemQuota, base), Spec: handler},
+		config.Entry{Meta: meta(config.MixerRule, base), Spec: rule})
+	return out, nil
+}
+
+// toStruct converts a JSON object to a struct message
+func toStruct(in map[string]interface{}) (*structpb.Struct, error) {
+	js, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	out := &structpb.Struct{}
+	if err = jsonpb.UnmarshalString(string(js), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ApplyQuota converges the mixer configuration of an instance to a quota and
+// to the consumers bound to it, e.g. after the instance changes plan or is
+// bound. A zero quota removes the configuration.
+func (r *Router) ApplyQuota(instance Instance, q Quota) error {
+	consumers, err := r.consumers(instance.ID)
+	if err != nil {
+		return err
+	}
+	instance.Consumers = consumers
+	desired, err := GenerateQuota(instance, q)
+	if err != nil {
+		return err
+	}
+	return r.converge(config.InstanceLabel, instance.ID, quotaTypes, desired)
+}
+
+// consumers lists the mesh services routed to an instance by the route rules of its bindings
+func (r *Router) consumers(id string) ([]string, error) {
+	entries, err := r.store.ListWithOptions(config.RouteRule.Type,
+		config.ListOptions{LabelSelector: config.InstanceLabel + "=" + config.LabelValue(id) + "," + config.BindingLabel})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var out []string
+	for _, entry := range entries {
+		rule, ok := entry.Spec.(*proxyconfig.RouteRule)
+		source := rule.GetMatch().GetSource()
+		if !ok || source.GetName() == "" {
+			continue
+		}
+		service := source.GetName() + "." + serviceNamespace(entry.Namespace, source.GetNamespace()) + "." + serviceDomain
+		if !seen[service] {
+			seen[service] = true
+			out = append(out, service)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// RemoveQuota deletes the mixer configuration of an instance
+func (r *Router) RemoveQuota(id string) error {
+	return r.converge(config.InstanceLabel, id, quotaTypes, nil)
+}
+
+// converge creates, updates and deletes the configuration of an instance or
+// binding, labeled with its id, among the given types to match the desired objects
+func (r *Router) converge(label, id string, types config.Descriptor, desired []config.Entry) error {
+	existing, err := r.ownedConfig(label, id, types)
+	if err != nil {
+		return err
+	}
+	owner := label + "=" + id
+
+	var errs error
+	for _, entry := range desired {
+		old, exists := existing[entry.Key()]
+		delete(existing, entry.Key())
+		switch {
+		case !exists:
+			glog.V(2).Infof("creating %s for %s", entry.Key(), owner)
+			_, err = r.store.Create(entry)
+		case !proto.Equal(old.Spec, entry.Spec):
+			glog.V(2).Infof("updating %s for %s", entry.Key(), owner)
+			entry.ResourceVersion = old.ResourceVersion
+			_, err = r.store.Update(entry)
+		default:
+			continue
+		}
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", entry.Key(), err))
+		}
+	}
+	for _, entry := range existing {
+		glog.V(2).Infof("deleting %s of %s", entry.Key(), owner)
+		if err = r.store.Delete(entry.Type, entry.Name, entry.Namespace); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", entry.Key(), err))
+		}
+	}
+	return errs
+}
+
+// ownedConfig lists the configuration labeled with the id of an instance or binding among the given types by key
+func (r *Router) ownedConfig(label, id string, types config.Descriptor) (map[string]config.Entry, error) {
+	opts := config.ListOptions{LabelSelector: label + "=" + config.LabelValue(id)}
+	out := make(map[string]config.Entry)
+	for _, schema := range types {
+		entries, err := r.store.ListWithOptions(schema.Type, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			out[entry.Key()] = entry
+		}
+	}
+	return out, nil
+}
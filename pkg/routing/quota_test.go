@@ -0,0 +1,167 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"strings"
+	"testing"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/platform/memory"
+)
+
+func TestPlanQuota(t *testing.T) {
+	cases := []struct {
+		annotations map[string]string
+		want        Quota
+		err         bool
+	}{
+		{nil, Quota{}, false},
+		{map[string]string{RequestsPerSecondAnnotation: "10"}, Quota{RequestsPerSecond: 10}, false},
+		{map[string]string{RequestsPerSecondAnnotation: "10", RequestsPerDayAnnotation: "5000"},
+			Quota{RequestsPerSecond: 10, RequestsPerDay: 5000}, false},
+		{map[string]string{RequestsPerDayAnnotation: "lots"}, Quota{}, true},
+		{map[string]string{RequestsPerDayAnnotation: "-1"}, Quota{}, true},
+	}
+	for _, c := range cases {
+		plan := config.Entry{Meta: config.Meta{Type: config.ServicePlan.Type, Name: "istio-monthly", Annotations: c.annotations}}
+		got, err := PlanQuota(plan)
+		if (err != nil) != c.err || (!c.err && got != c.want) {
+			t.Errorf("PlanQuota(%v) => got %+v, %v, want %+v", c.annotations, got, err, c.want)
+		}
+	}
+}
+
+func TestGenerateQuota(t *testing.T) {
+	instance := Instance{
+		ID:        "F6C1AD1C",
+		Service:   "productpage",
+		Namespace: "default",
+		Consumers: []string{"ratings.default.svc.cluster.local", "reviews.bookinfo.svc.cluster.local"},
+	}
+	entries, err := GenerateQuota(instance, Quota{RequestsPerSecond: 10, RequestsPerDay: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{
+		"quota/default/instance-f6c1ad1c-rps":   true,
+		"quota/default/instance-f6c1ad1c-daily": true,
+		"memquota/default/instance-f6c1ad1c":    true,
+		"rule/default/instance-f6c1ad1c":        true,
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("GenerateQuota() => got %d object(s), want %d", len(entries), len(want))
+	}
+	for _, entry := range entries {
+		if !want[entry.Key()] {
+			t.Errorf("GenerateQuota() => unexpected %s", entry.Key())
+		}
+		if entry.Labels[config.InstanceLabel] != instance.ID {
+			t.Errorf("GenerateQuota() => got labels %v", entry.Labels)
+		}
+		switch entry.Type {
+		case config.MixerRule.Type:
+			match := entry.Spec.(*structpb.Struct).Fields["match"].GetStringValue()
+			if match != `destination.service == "productpage.default.svc.cluster.local" && `+
+				`(source.service == "ratings.default.svc.cluster.local" || `+
+				`source.service == "reviews.bookinfo.svc.cluster.local")` {
+				t.Errorf("GenerateQuota() => got rule match %q", match)
+			}
+		case config.Quota.Type:
+			dimensions := entry.Spec.(*structpb.Struct).Fields["dimensions"].GetStructValue()
+			if dimensions.Fields["instance"].GetStringValue() != `"F6C1AD1C"` {
+				t.Errorf("GenerateQuota() => got dimensions %v", dimensions)
+			}
+		}
+	}
+
+	if entries, err = GenerateQuota(instance, Quota{}); err != nil || len(entries) != 0 {
+		t.Errorf("GenerateQuota() without limits => got %d object(s), %v", len(entries), err)
+	}
+	instance.Consumers = nil
+	if entries, err = GenerateQuota(instance, Quota{RequestsPerSecond: 10}); err != nil || len(entries) != 0 {
+		t.Errorf("GenerateQuota() without consumers => got %d object(s), %v", len(entries), err)
+	}
+}
+
+func TestApplyQuota(t *testing.T) {
+	store := memory.Make(config.IstioConfigTypes)
+	r := NewRouter(store)
+	instance := Instance{ID: "f6c1ad1c", Service: "productpage", Namespace: "default"}
+	b := Binding{ID: "8e0d2a4f", InstanceID: instance.ID, Service: "productpage", Consumer: "reviews", Namespace: "default"}
+	if _, err := r.Bind(b); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func() int {
+		n := 0
+		for _, schema := range quotaTypes {
+			l, _ := store.List(schema.Type, "")
+			n += len(l)
+		}
+		return n
+	}
+
+	steps := []struct {
+		quota Quota
+		want  int
+	}{
+		{Quota{RequestsPerSecond: 10, RequestsPerDay: 5000}, 4},
+		{Quota{RequestsPerSecond: 10, RequestsPerDay: 5000}, 4},
+		{Quota{RequestsPerSecond: 100}, 3},
+		{Quota{}, 0},
+	}
+	for _, step := range steps {
+		if err := r.ApplyQuota(instance, step.quota); err != nil {
+			t.Fatalf("ApplyQuota(%+v) => got %v", step.quota, err)
+		}
+		if got := count(); got != step.want {
+			t.Errorf("ApplyQuota(%+v) => got %d object(s), want %d", step.quota, got, step.want)
+		}
+	}
+
+	// a plan change updates the limits in place
+	if err := r.ApplyQuota(instance, Quota{RequestsPerSecond: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ApplyQuota(instance, Quota{RequestsPerSecond: 20}); err != nil {
+		t.Fatal(err)
+	}
+	handler, _ := store.Get(config.MemQuota.Type, "instance-f6c1ad1c", "default")
+	quotas := handler.Spec.(*structpb.Struct).Fields["quotas"].GetListValue().GetValues()
+	if len(quotas) != 1 || quotas[0].GetStructValue().Fields["maxAmount"].GetNumberValue() != 20 {
+		t.Errorf("ApplyQuota() => got quotas %v", quotas)
+	}
+	rule, _ := store.Get(config.MixerRule.Type, "instance-f6c1ad1c", "default")
+	match := rule.Spec.(*structpb.Struct).Fields["match"].GetStringValue()
+	if !strings.HasSuffix(match, `(source.service == "reviews.default.svc.cluster.local")`) {
+		t.Errorf("ApplyQuota() => got rule match %q", match)
+	}
+
+	// the quota is removed with the last consumer
+	if _, err := r.Unbind(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ApplyQuota(instance, Quota{RequestsPerSecond: 20}); err != nil || count() != 0 {
+		t.Errorf("ApplyQuota() without consumers => got %v, %d object(s)", err, count())
+	}
+
+	if err := r.RemoveQuota(instance.ID); err != nil || count() != 0 {
+		t.Errorf("RemoveQuota() => got %v, %d object(s) left", err, count())
+	}
+}
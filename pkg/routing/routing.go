@@ -0,0 +1,249 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package routing generates the Istio traffic configuration that grants the
+// consumer of a service binding access to the mesh service or the external
+// endpoint of a service class, and the mixer configuration that enforces the
+// quota of a service plan.
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	multierror "github.com/hashicorp/go-multierror"
+
+	proxyconfig "istio.io/api/proxy/v1/config"
+	"istio.io/broker/pkg/model/config"
+)
+
+const (
+	// bindingPrecedence orders the binding routes ahead of the default routes of a service
+	bindingPrecedence = 10
+)
+
+// ErrConflict is returned when a binding already exists with different parameters
+var ErrConflict = errors.New("binding already exists with different parameters")
+
+// ownerMeta labels and annotates the configuration generated for an instance or binding
+func ownerMeta(meta config.Meta, instance, binding string) config.Meta {
+	meta.Labels = map[string]string{config.InstanceLabel: config.LabelValue(instance)}
+	meta.Annotations = map[string]string{config.InstanceIDAnnotation: instance}
+	if binding != "" {
+		meta.Labels[config.BindingLabel] = config.LabelValue(binding)
+		meta.Annotations[config.BindingIDAnnotation] = binding
+	}
+	return meta
+}
+
+// Binding grants a consumer access to the mesh service backing a service class
+type Binding struct {
+	// ID of the binding
+	ID string
+
+	// InstanceID of the service instance bound to
+	InstanceID string
+
+	// Service is the mesh service of the service class deployment
+	Service string
+
+	// External is the endpoint outside the mesh of the service class, if any.
+	// It takes the place of the mesh service.
+	External *External
+
+	// Consumer is the mesh service of the application using the binding,
+	// optionally qualified by its namespace, e.g. "reviews.bookinfo"
+	Consumer string
+
+	// Namespace where the configuration is created, the namespace of the
+	// service class or of the platform the instance is provisioned in
+	Namespace string
+
+	// ServiceNamespace is the namespace of the mesh service if it differs from Namespace
+	ServiceNamespace string
+}
+
+// Generate creates the Istio traffic configuration of a binding: a route rule
+// and a destination policy for the traffic from the consumer to the service.
+// The traffic to an external endpoint leaves the mesh through the egress rule
+// of the instance, so only the route rule is generated.
+func Generate(b Binding) []config.Entry {
+	meta := func(schema config.Schema) config.Meta {
+		return ownerMeta(config.Meta{
+			Type:      schema.Type,
+			Name:      config.ObjectName("binding-", b.ID),
+			Namespace: b.Namespace,
+		}, b.InstanceID, b.ID)
+	}
+	destination := &proxyconfig.IstioService{Name: b.Service, Namespace: b.ServiceNamespace}
+	if b.External != nil {
+		destination = &proxyconfig.IstioService{Service: b.External.Host}
+	}
+
+	route := config.Entry{
+		Meta: meta(config.RouteRule),
+		Spec: &proxyconfig.RouteRule{
+			Destination: destination,
+			Precedence:  bindingPrecedence,
+			Match: &proxyconfig.MatchCondition{
+				Source: consumer(b.Consumer),
+			},
+			Route: []*proxyconfig.DestinationWeight{{Weight: 100}},
+		},
+	}
+	if b.External != nil {
+		return []config.Entry{route}
+	}
+	return []config.Entry{
+		route,
+		{
+			Meta: meta(config.DestinationPolicy),
+			Spec: &proxyconfig.DestinationPolicy{
+				Destination: destination,
+				Source:      consumer(b.Consumer),
+				LoadBalancing: &proxyconfig.LoadBalancing{
+					LbPolicy: &proxyconfig.LoadBalancing_Name{Name: proxyconfig.LoadBalancing_ROUND_ROBIN},
+				},
+			},
+		},
+	}
+}
+
+// serviceNamespace is the namespace of a mesh service, defaulting to the namespace of the configuration
+func serviceNamespace(namespace, service string) string {
+	if service != "" {
+		return service
+	}
+	return namespace
+}
+
+// consumer parses a service name optionally qualified by a namespace
+func consumer(service string) *proxyconfig.IstioService {
+	parts := strings.SplitN(service, ".", 2)
+	out := &proxyconfig.IstioService{Name: parts[0]}
+	if len(parts) > 1 {
+		out.Namespace = parts[1]
+	}
+	return out
+}
+
+// Router applies the generated configuration of bindings and instances to a config store
+type Router struct {
+	store config.Store
+}
+
+// NewRouter creates a router writing to a store of the Istio config types
+func NewRouter(store config.Store) *Router {
+	return &Router{store: store}
+}
+
+// Bind creates the configuration of a binding and reports whether it was
+// created. Binding again with the same parameters has no effect. If any
+// object fails to be created, the objects created so far are removed.
+func (r *Router) Bind(b Binding) (bool, error) {
+	var created []config.Entry
+	for _, entry := range Generate(b) {
+		if existing, exists := r.store.Get(entry.Type, entry.Name, entry.Namespace); exists {
+			if !proto.Equal(existing.Spec, entry.Spec) || !reflect.DeepEqual(existing.Labels, entry.Labels) {
+				return false, r.rollback(created, ErrConflict)
+			}
+			continue
+		}
+		glog.V(2).Infof("creating %s for binding %q", entry.Key(), b.ID)
+		if _, err := r.store.Create(entry); err != nil {
+			return false, r.rollback(created, fmt.Errorf("%s: %v", entry.Key(), err))
+		}
+		created = append(created, entry)
+	}
+	return len(created) > 0, nil
+}
+
+// rollback removes the objects created by a failed bind
+func (r *Router) rollback(created []config.Entry, err error) error {
+	for _, entry := range created {
+		if errDelete := r.store.Delete(entry.Type, entry.Name, entry.Namespace); errDelete != nil {
+			err = multierror.Append(err, fmt.Errorf("rollback %s: %v", entry.Key(), errDelete))
+		}
+	}
+	return err
+}
+
+// ApplyBinding converges the configuration of a binding, replacing the objects
+// changed since the binding was created
+func (r *Router) ApplyBinding(b Binding) error {
+	return r.converge(config.BindingLabel, b.ID, bindingTypes, Generate(b))
+}
+
+// Owners lists the ids of the instances and bindings having configuration.
+// The configuration of bindings is not attributed to their instances.
+func (r *Router) Owners() (instances, bindings []string, err error) {
+	seenInstances := make(map[string]bool)
+	seenBindings := make(map[string]bool)
+	for _, schema := range config.IstioConfigTypes {
+		entries, errList := r.store.ListWithOptions(schema.Type, config.ListOptions{LabelSelector: config.InstanceLabel})
+		if errList != nil {
+			return nil, nil, errList
+		}
+		for _, entry := range entries {
+			if id := ownerID(entry, config.BindingLabel, config.BindingIDAnnotation); id != "" {
+				if !seenBindings[id] {
+					seenBindings[id] = true
+					bindings = append(bindings, id)
+				}
+			} else if id = ownerID(entry, config.InstanceLabel, config.InstanceIDAnnotation); !seenInstances[id] {
+				seenInstances[id] = true
+				instances = append(instances, id)
+			}
+		}
+	}
+	sort.Strings(instances)
+	sort.Strings(bindings)
+	return instances, bindings, nil
+}
+
+// ownerID returns the id of the instance or binding owning generated
+// configuration, read from the label for configuration without annotation
+func ownerID(entry config.Entry, label, annotation string) string {
+	if id := entry.Annotations[annotation]; id != "" {
+		return id
+	}
+	return entry.Labels[label]
+}
+
+// Unbind removes the configuration of a binding and reports whether any was found
+func (r *Router) Unbind(id string) (bool, error) {
+	opts := config.ListOptions{LabelSelector: config.BindingLabel + "=" + config.LabelValue(id)}
+	found := false
+	var errs error
+	for _, schema := range config.IstioConfigTypes {
+		entries, err := r.store.ListWithOptions(schema.Type, opts)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		for _, entry := range entries {
+			glog.V(2).Infof("deleting %s of binding %q", entry.Key(), id)
+			if err := r.store.Delete(entry.Type, entry.Name, entry.Namespace); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("%s: %v", entry.Key(), err))
+			}
+			found = true
+		}
+	}
+	return found, errs
+}
@@ -0,0 +1,200 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"strings"
+	"testing"
+
+	proxyconfig "istio.io/api/proxy/v1/config"
+	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/platform/memory"
+)
+
+func makeBinding() Binding {
+	return Binding{
+		ID:         "8E0D2A4F-77B5-4B4A-9E5C-1F0C8A2C1B3D",
+		InstanceID: "f6c1ad1c-b6ba-4a38-8c43-0d1c5a7b9e21",
+		Service:    "productpage",
+		Consumer:   "reviews.bookinfo",
+		Namespace:  "default",
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	b := makeBinding()
+	entries := Generate(b)
+	if len(entries) != len(bindingTypes) {
+		t.Fatalf("Generate() => got %d object(s), want %d", len(entries), len(bindingTypes))
+	}
+	for _, entry := range entries {
+		if entry.Name != "binding-8e0d2a4f-77b5-4b4a-9e5c-1f0c8a2c1b3d" || entry.Namespace != b.Namespace {
+			t.Errorf("Generate() => got %s", entry.Key())
+		}
+		if entry.Labels[config.BindingLabel] != b.ID || entry.Labels[config.InstanceLabel] != b.InstanceID {
+			t.Errorf("Generate() => got labels %v", entry.Labels)
+		}
+		schema, _ := config.IstioConfigTypes.GetByType(entry.Type)
+		if err := schema.Validate(entry.Spec); err != nil {
+			t.Errorf("Generate() => invalid %s: %v", entry.Type, err)
+		}
+	}
+
+	rule := entries[0].Spec.(*proxyconfig.RouteRule)
+	if source := rule.GetMatch().GetSource(); source.GetName() != "reviews" || source.GetNamespace() != "bookinfo" {
+		t.Errorf("Generate() => got route source %v", source)
+	}
+	if rule.GetDestination().GetName() != "productpage" {
+		t.Errorf("Generate() => got route destination %v", rule.GetDestination())
+	}
+}
+
+func TestBindUnbind(t *testing.T) {
+	store := memory.Make(config.IstioConfigTypes)
+	r := NewRouter(store)
+	b := makeBinding()
+
+	if created, err := r.Bind(b); err != nil || !created {
+		t.Fatalf("Bind() => got %t, %v, want created", created, err)
+	}
+	for _, schema := range bindingTypes {
+		if l, _ := store.List(schema.Type, b.Namespace); len(l) != 1 {
+			t.Errorf("Bind() => got %d %s, want 1", len(l), schema.Plural)
+		}
+	}
+
+	// binding again is idempotent
+	if created, err := r.Bind(b); err != nil || created {
+		t.Errorf("Bind() again => got %t, %v, want unchanged", created, err)
+	}
+
+	changed := b
+	changed.Consumer = "ratings"
+	if _, err := r.Bind(changed); err != ErrConflict {
+		t.Errorf("Bind() with another consumer => got %v, want %v", err, ErrConflict)
+	}
+
+	if found, err := r.Unbind(b.ID); err != nil || !found {
+		t.Errorf("Unbind() => got %t, %v, want found", found, err)
+	}
+	for _, schema := range config.IstioConfigTypes {
+		if l, _ := store.List(schema.Type, ""); len(l) != 0 {
+			t.Errorf("Unbind() => got %d %s left", len(l), schema.Plural)
+		}
+	}
+	if found, err := r.Unbind(b.ID); err != nil || found {
+		t.Errorf("Unbind() again => got %t, %v, want not found", found, err)
+	}
+}
+
+func TestBindRollback(t *testing.T) {
+	store := memory.Make(config.IstioConfigTypes)
+	b := makeBinding()
+
+	// a conflicting destination policy fails the bind after the route rule is created
+	policy := Generate(b)[1]
+	policy.Labels = nil
+	if _, err := store.Create(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewRouter(store).Bind(b); err != ErrConflict {
+		t.Errorf("Bind() => got %v, want %v", err, ErrConflict)
+	}
+	if l, _ := store.List(config.RouteRule.Type, ""); len(l) != 0 {
+		t.Errorf("Bind() => got %d route rule(s) left after rollback", len(l))
+	}
+}
+
+func TestApplyBinding(t *testing.T) {
+	store := memory.Make(config.IstioConfigTypes)
+	r := NewRouter(store)
+	b := makeBinding()
+	if _, err := r.Bind(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// a removed destination policy and a changed route rule are restored
+	policy := Generate(b)[1]
+	if err := store.Delete(policy.Type, policy.Name, policy.Namespace); err != nil {
+		t.Fatal(err)
+	}
+	route, _ := store.Get(config.RouteRule.Type, policy.Name, policy.Namespace)
+	route.Spec.(*proxyconfig.RouteRule).Precedence = 1
+	if _, err := store.Update(*route); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.ApplyBinding(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := store.Get(policy.Type, policy.Name, policy.Namespace); !exists {
+		t.Error("ApplyBinding() => destination policy not restored")
+	}
+	route, _ = store.Get(config.RouteRule.Type, policy.Name, policy.Namespace)
+	if route.Spec.(*proxyconfig.RouteRule).Precedence != bindingPrecedence {
+		t.Errorf("ApplyBinding() => got route rule %v", route.Spec)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	store := memory.Make(config.IstioConfigTypes)
+	r := NewRouter(store)
+	b := makeBinding()
+	if _, err := r.Bind(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ApplyEgress(Instance{ID: b.InstanceID, Namespace: b.Namespace, External: makeExternal()}); err != nil {
+		t.Fatal(err)
+	}
+
+	instances, bindings, err := r.Owners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0] != b.InstanceID {
+		t.Errorf("Owners() => got instances %v, want [%s]", instances, b.InstanceID)
+	}
+	if len(bindings) != 1 || bindings[0] != b.ID {
+		t.Errorf("Owners() => got bindings %v, want [%s]", bindings, b.ID)
+	}
+}
+
+func TestBindInvalidNames(t *testing.T) {
+	store := memory.Make(config.IstioConfigTypes)
+	r := NewRouter(store)
+	b := makeBinding()
+	b.ID = "binding/" + strings.Repeat("a", 80)
+	b.InstanceID = "instance_" + strings.Repeat("b", 80)
+
+	for _, entry := range Generate(b) {
+		if len(entry.Name) > 63 || len(entry.Labels[config.BindingLabel]) > 63 || len(entry.Labels[config.InstanceLabel]) > 63 {
+			t.Errorf("Generate() => got %s with labels %v", entry.Key(), entry.Labels)
+		}
+		if entry.Annotations[config.BindingIDAnnotation] != b.ID || entry.Annotations[config.InstanceIDAnnotation] != b.InstanceID {
+			t.Errorf("Generate() => got annotations %v", entry.Annotations)
+		}
+	}
+
+	if _, err := r.Bind(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, bindings, err := r.Owners(); err != nil || len(bindings) != 1 || bindings[0] != b.ID {
+		t.Errorf("Owners() => got %v, %v, want [%s]", bindings, err, b.ID)
+	}
+	if found, err := r.Unbind(b.ID); err != nil || !found {
+		t.Errorf("Unbind() => got %t, %v, want found", found, err)
+	}
+}
@@ -16,47 +16,488 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/context"
+	"k8s.io/client-go/tools/cache"
 
+	"istio.io/broker/pkg/accesslog"
+	"istio.io/broker/pkg/audit"
+	"istio.io/broker/pkg/catalog"
 	"istio.io/broker/pkg/controller"
+	"istio.io/broker/pkg/credentials"
+	"istio.io/broker/pkg/discovery"
+	"istio.io/broker/pkg/election"
+	"istio.io/broker/pkg/metering"
 	"istio.io/broker/pkg/model/config"
+	"istio.io/broker/pkg/platform/aggregate"
 	"istio.io/broker/pkg/platform/kube/crd"
+	"istio.io/broker/pkg/platform/memory"
+	"istio.io/broker/pkg/provisioner"
+	"istio.io/broker/pkg/provisioner/plugin"
+	"istio.io/broker/pkg/routing"
+	"istio.io/broker/pkg/tracing"
 )
 
+const (
+	// statusPeriod is the interval between catalog status reconciliations
+	statusPeriod = 30 * time.Second
+
+	// operationPeriod is the interval between the completions of the pending operations by the leader
+	operationPeriod = 10 * time.Second
+
+	// rotationPeriod is the interval between the rotations of the client certificates due by the leader
+	rotationPeriod = time.Minute
+
+	// reconcilePeriod is the longest interval between reconciliations of the instances and bindings
+	reconcilePeriod = time.Minute
+)
+
+// reconciledTypes are the config types whose changes trigger a reconciliation
+// of the instances and bindings
+var reconciledTypes = config.Descriptor{
+	config.ServiceClass,
+	config.ServicePlan,
+	config.ServiceInstance,
+	config.ServiceBinding,
+}
+
+// Args contains the startup arguments of the broker server
+type Args struct {
+	// KubeConfig is the Kubernetes configuration file.
+	// Use an empty value for the in-cluster configuration.
+	KubeConfig string
+
+	// CRDVersions are the API versions served for the broker CRDs, the first
+	// one being used by the broker. The Istio API version if unset.
+	CRDVersions []string
+
+	// CRDStorageVersion is the API version persisted for the broker CRDs,
+	// the first served version if unset
+	CRDStorageVersion string
+
+	// ConversionWebhook is the HTTPS URL at which the API server reaches the
+	// conversion webhook of the broker, served at crd.ConversionPath on the
+	// conversion webhook port. The
+	// API server converts the versions of the CRDs itself if unset.
+	ConversionWebhook string
+
+	// ConversionWebhookCA is the PEM file of the CA bundle verifying the
+	// certificate of the conversion webhook
+	ConversionWebhookCA string
+
+	// ConversionWebhookPort is the TCP port of the HTTPS listener of the
+	// conversion webhook, since the API server only calls webhooks over TLS
+	ConversionWebhookPort uint16
+
+	// ConversionWebhookCertFile and ConversionWebhookKeyFile are the PEM
+	// files of the serving certificate of the conversion webhook, required
+	// with the webhook
+	ConversionWebhookCertFile string
+	ConversionWebhookKeyFile  string
+
+	// CatalogSelector restricts the published catalog to the matching
+	// service classes and plans
+	CatalogSelector config.ListOptions
+
+	// CACertFile and CAKeyFile are the PEM files of the CA signing the client
+	// certificates of bindings. No certificates are issued if unset.
+	CACertFile string
+	CAKeyFile  string
+
+	// CredentialTTL is the lifetime of the client certificates of bindings
+	CredentialTTL time.Duration
+
+	// CredentialSecrets stores the credentials of bindings in secrets in the
+	// namespace of the instance and only returns a reference to the secrets
+	CredentialSecrets bool
+
+	// PluginTimeout bounds the calls to out-of-process provisioner plugins
+	PluginTimeout time.Duration
+
+	// Discovery publishes the Kubernetes services annotated for the catalog.
+	// The generated objects are kept in memory or written as CRDs depending
+	// on the mode. Use an empty value to disable the discovery.
+	Discovery string
+
+	// MeteringLog is the file recording the lifecycle events of instances and
+	// bindings for usage reports. With leader election, the file must be on a
+	// volume shared by the replicas. The events are stored as metering-event
+	// objects in the state namespace if unset.
+	MeteringLog string
+
+	// StateNamespace stores the certificates issued for bindings and the
+	// metering events, shared by the replicas
+	StateNamespace string
+
+	// AuditLog records the mutating requests with their originating identity
+	// and outcome, as JSON lines on the standard output ("stdout") or in a
+	// file. No audit log is written if unset.
+	AuditLog string
+
+	// Tracing selects the exporter of the request traces, stdout or otlp.
+	// Use an empty value to disable tracing.
+	Tracing string
+
+	// TracingEndpoint is the OpenTelemetry collector receiving the traces over OTLP/HTTP
+	TracingEndpoint string
+
+	// AccessLog records the requests as JSON lines on the standard output
+	// ("stdout") or in a file. No access log is written if unset.
+	AccessLog string
+
+	// AccessLogOptions configure the sampling of the access log and the
+	// redaction of the credentials in the logged bodies
+	AccessLogOptions accesslog.Options
+
+	// LeaderElection elects a leader among the replicas of the broker with a
+	// Lease. Only the leader executes the operations and the reconciliations,
+	// and the followers forward the mutating requests to it.
+	LeaderElection bool
+
+	// Election configures the leader election
+	Election election.Config
+
+	// TLSCertFile and TLSKeyFile are the PEM files of the serving certificate
+	// of the broker API, served over plain HTTP if unset. With leader
+	// election, the followers forward the mutating requests to the leader
+	// over HTTPS, so the certificate must be valid for the identity of each
+	// replica.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ForwardCAFile is the PEM file of the CA bundle verifying the serving
+	// certificate of the leader, the system roots if unset
+	ForwardCAFile string
+}
+
 // Server data
 type Server struct {
-	ctr *controller.Controller
+	store      config.StoreCache
+	instances  config.StoreCache
+	ctr        *controller.Controller
+	catalog    *catalog.Reconciler
+	reconciler *controller.Reconciler
+	discoverer func() *discovery.Discoverer
+	elector    *election.Elector
+	audit      audit.Sink
+	tracer     *sdktrace.TracerProvider
+	accessLog  *accesslog.Logger
+	conversion *conversionServer
+
+	// certFile and keyFile serve the broker API over HTTPS if set
+	certFile, keyFile string
+
+	// leaderDiscovery restricts the discovery to the leader, since it writes CRDs
+	leaderDiscovery bool
 }
 
 // CreateServer creates a broker server.
-func CreateServer(kubeconfig string) (*Server, error) {
-	cc, err := crd.NewClient(kubeconfig, config.BrokerConfigTypes)
+func CreateServer(args Args) (*Server, error) {
+	if _, err := args.CatalogSelector.Matcher(); err != nil {
+		return nil, err
+	}
+	if args.ConversionWebhook != "" && (args.ConversionWebhookCertFile == "" || args.ConversionWebhookKeyFile == "") {
+		return nil, errors.New("the conversion webhook requires a serving certificate and key")
+	}
+	if (args.TLSCertFile == "") != (args.TLSKeyFile == "") {
+		return nil, errors.New("the broker API requires both a serving certificate and key to serve TLS")
+	}
+	var caBundle []byte
+	if args.ConversionWebhookCA != "" {
+		var errCA error
+		if caBundle, errCA = ioutil.ReadFile(args.ConversionWebhookCA); errCA != nil {
+			return nil, errCA
+		}
+	}
+	versions := crd.NewVersionSet(args.CRDVersions, args.CRDStorageVersion, args.ConversionWebhook, caBundle)
+	cc, err := crd.NewVersionedClient(args.KubeConfig, config.BrokerConfigTypes, versions)
+	if err != nil {
+		return nil, err
+	}
+	var conversion *conversionServer
+	if versions.Conversions != nil {
+		conversion = &conversionServer{
+			handler:  crd.NewConversionHandler(config.BrokerConfigTypes, versions.Conversions),
+			port:     args.ConversionWebhookPort,
+			certFile: args.ConversionWebhookCertFile,
+			keyFile:  args.ConversionWebhookKeyFile,
+		}
+	}
+	// the Istio CRDs are registered by the control plane
+	ic, err := crd.NewClient(args.KubeConfig, config.IstioConfigTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets *credentials.SecretStore
+	if args.CredentialSecrets {
+		kube, errKube := crd.CreateInterface(args.KubeConfig)
+		if errKube != nil {
+			return nil, errKube
+		}
+		secrets = credentials.NewSecretStore(kube)
+	}
+
+	provisioners := provisioner.NewRegistry()
+	if err = provisioners.Register(provisioner.MeshProvisioner, provisioner.NewMesh(routing.NewRouter(ic))); err != nil {
+		return nil, err
+	}
+	if err = provisioners.Register(plugin.ProvisionerName, plugin.NewDispatcher(args.PluginTimeout)); err != nil {
+		return nil, err
+	}
+
+	// the catalog is served from a cache of the catalog namespace warmed up by
+	// paging through the CRDs, and the instances and bindings, stored in the
+	// namespaces of their service classes, from a cache across namespaces,
+	// along with the certificates and metering events shared by the replicas
+	store := crd.NewCache(cc, crd.CacheOptions{
+		Namespace: args.CatalogSelector.Namespace,
+		Types:     config.Descriptor{config.ServiceClass, config.ServicePlan},
+	})
+	instances := crd.NewCache(cc, crd.CacheOptions{
+		Types: config.Descriptor{config.ServiceInstance, config.ServiceBinding, config.BindingCertificate,
+			config.MeteringEvent},
+	})
+
+	var creds *credentials.Provider
+	if args.CACertFile != "" {
+		ca, errCA := credentials.LoadCA(args.CACertFile, args.CAKeyFile)
+		if errCA != nil {
+			return nil, errCA
+		}
+		creds = credentials.NewProvider(ca, args.CredentialTTL, instances, args.StateNamespace)
+	}
+
+	catalogStore := config.Store(store)
+	var discoverer func() *discovery.Discoverer
+	if args.Discovery != "" {
+		var target config.Store
+		switch args.Discovery {
+		case discovery.MemoryMode:
+			target = memory.Make(config.BrokerConfigTypes)
+			catalogStore = aggregate.Make(store, target)
+		case discovery.CRDMode:
+			target = cc
+		default:
+			return nil, fmt.Errorf("unknown discovery mode %q", args.Discovery)
+		}
+		kube, errKube := crd.CreateInterface(args.KubeConfig)
+		if errKube != nil {
+			return nil, errKube
+		}
+		// the informer of a discoverer is only started once, so each leadership term needs its own
+		discoverer = func() *discovery.Discoverer {
+			return discovery.NewDiscoverer(kube, target, args.CatalogSelector.Namespace, statusPeriod)
+		}
+	}
+
+	var elector *election.Elector
+	if args.LeaderElection {
+		kube, errKube := crd.CreateInterface(args.KubeConfig)
+		if errKube != nil {
+			return nil, errKube
+		}
+		// the followers forward the requests to the leader over HTTPS when the API serves TLS
+		if args.TLSCertFile != "" && args.Election.TLS == nil {
+			if args.Election.TLS, err = forwardTLSConfig(args.ForwardCAFile); err != nil {
+				return nil, err
+			}
+		}
+		if elector, err = election.NewElector(kube, args.Election); err != nil {
+			return nil, err
+		}
+	}
+
+	var tracer *sdktrace.TracerProvider
+	if args.Tracing != "" {
+		if tracer, err = tracing.NewProvider(args.Tracing, args.TracingEndpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	var sink audit.Sink
+	if args.AuditLog != "" {
+		if sink, err = audit.Open(args.AuditLog); err != nil {
+			return nil, err
+		}
+	}
+
+	var accessLog *accesslog.Logger
+	if args.AccessLog != "" {
+		if accessLog, err = accesslog.Open(args.AccessLog, args.AccessLogOptions); err != nil {
+			return nil, err
+		}
+	}
+
+	recorder := metering.NewStoreRecorder(instances, args.StateNamespace)
+	if args.MeteringLog != "" {
+		recorder = metering.NewFileRecorder(args.MeteringLog)
+	}
+
+	// the OAuth client secrets of the dashboards are read from Kubernetes secrets
+	// referenced by the service classes rather than kept in their annotations
+	dashboardKube, err := crd.CreateInterface(args.KubeConfig)
 	if err != nil {
 		return nil, err
 	}
-	c, err := controller.CreateController(config.MakeBrokerConfigStore(cc))
+	c, err := controller.CreateController(config.MakeSelectedBrokerConfigStore(catalogStore, args.CatalogSelector),
+		instances, provisioners, creds, secrets, recorder, elector, catalog.KubeSecretReader(dashboardKube))
 	if err != nil {
 		return nil, err
 	}
+	r, err := catalog.NewReconciler(catalogStore, instances)
+	if err != nil {
+		return nil, err
+	}
+	// the instances and bindings are reconciled on each change of the broker config
+	reconciler := controller.NewReconciler(c)
+	for _, schema := range reconciledTypes {
+		store.RegisterEventHandler(schema.Type, reconciler.OnChange())
+		instances.RegisterEventHandler(schema.Type, reconciler.OnChange())
+	}
 
 	return &Server{
-		c,
+		store:      store,
+		instances:  instances,
+		ctr:        c,
+		catalog:    r,
+		reconciler: reconciler,
+		discoverer: discoverer,
+		elector:    elector,
+		audit:      sink,
+		tracer:     tracer,
+		accessLog:  accessLog,
+		conversion: conversion,
+		certFile:   args.TLSCertFile,
+		keyFile:    args.TLSKeyFile,
+
+		leaderDiscovery: args.Discovery == discovery.CRDMode,
 	}, nil
 }
 
 // Start runs the server and listen on port.
 func (s *Server) Start(port uint16) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.store.Run(stop)
+	go s.instances.Run(stop)
+	if !cache.WaitForCacheSync(stop, s.store.HasSynced, s.instances.HasSynced) {
+		glog.Error("Unable to sync the config cache")
+		return
+	}
+	// the replicas keep their own catalog of discovered services in memory
+	if s.discoverer != nil && (s.elector == nil || !s.leaderDiscovery) {
+		go s.discoverer().Run(stop)
+	}
+	if s.elector == nil {
+		go s.lead(stop)
+	} else {
+		s.elector.OnLeading(s.lead)
+		go s.elector.Run(stop)
+	}
+	if s.tracer != nil {
+		tracing.Install(s.tracer)
+		// export the spans still batched when the server exits
+		defer func() {
+			if err := s.tracer.Shutdown(context.Background()); err != nil {
+				glog.Warningf("Unable to export the traces: %v", err)
+			}
+		}()
+	}
+
 	router := mux.NewRouter()
 
 	router.HandleFunc("/v2/catalog", s.ctr.Catalog).Methods("GET")
+	instance := "/v2/service_instances/{instance_id}"
+	binding := instance + "/service_bindings/{binding_id}"
+	// the mutating requests are served by the leader and audited there
+	mutating := func(operation string, handler http.HandlerFunc) http.HandlerFunc {
+		return election.Forward(s.elector, audit.Handler(s.audit, operation, handler))
+	}
+	router.HandleFunc(instance, mutating(audit.Provision, s.ctr.Provision)).Methods("PUT")
+	router.HandleFunc(instance, mutating(audit.Update, s.ctr.UpdateInstance)).Methods("PATCH")
+	router.HandleFunc(instance, mutating(audit.Deprovision, s.ctr.Deprovision)).Methods("DELETE")
+	router.HandleFunc(instance, s.ctr.GetInstance).Methods("GET")
+	router.HandleFunc(instance+"/last_operation", s.ctr.LastOperation).Methods("GET")
+	router.HandleFunc(binding, mutating(audit.Bind, s.ctr.Bind)).Methods("PUT")
+	router.HandleFunc(binding, mutating(audit.Unbind, s.ctr.Unbind)).Methods("DELETE")
+	router.HandleFunc("/credentials/crl", s.ctr.RevocationList).Methods("GET")
+	router.HandleFunc("/metering/usage", s.ctr.Usage).Methods("GET")
+	if s.conversion != nil {
+		go s.conversion.serve()
+	}
 
-	http.Handle("/", router)
+	handler := tracing.Middleware(router)
+	if s.accessLog != nil {
+		handler = s.accessLog.Handler(router, handler)
+	}
+	http.Handle("/", handler)
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
+	addr := fmt.Sprintf(":%d", port)
+	var err error
+	if s.certFile != "" {
+		err = http.ListenAndServeTLS(addr, s.certFile, s.keyFile, nil)
+	} else {
+		err = http.ListenAndServe(addr, nil)
+	}
+	if err != nil {
 		glog.Errorf("Unable to start server: %v", err)
 	}
 }
+
+// forwardTLSConfig verifies the serving certificate of the leader with the
+// CA bundle in caFile, or with the system roots if empty
+func forwardTLSConfig(caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		return &tls.Config{}, nil
+	}
+	bundle, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return &tls.Config{RootCAs: roots}, nil
+}
+
+// conversionServer serves the conversion webhook of the CRDs over HTTPS
+type conversionServer struct {
+	handler           http.Handler
+	port              uint16
+	certFile, keyFile string
+}
+
+// serve listens for the conversion reviews of the API server
+func (c *conversionServer) serve() {
+	router := mux.NewRouter()
+	router.Handle(crd.ConversionPath, c.handler).Methods("POST")
+	server := &http.Server{Addr: fmt.Sprintf(":%d", c.port), Handler: router}
+	if err := server.ListenAndServeTLS(c.certFile, c.keyFile); err != nil {
+		glog.Errorf("Unable to start the conversion webhook: %v", err)
+	}
+}
+
+// lead runs the reconciliations, rotates the client certificates and
+// completes the operations until stop is closed. With leader election, it
+// runs on the leader only.
+func (s *Server) lead(stop <-chan struct{}) {
+	if s.discoverer != nil && s.elector != nil && s.leaderDiscovery {
+		go s.discoverer().Run(stop)
+	}
+	go s.catalog.Run(statusPeriod, stop)
+	go s.reconciler.Run(reconcilePeriod, stop)
+	go s.ctr.RunRotations(rotationPeriod, stop)
+	s.ctr.RunOperations(operationPeriod, stop)
+}
@@ -277,3 +277,93 @@ func CheckBrokerConfigTypes(store config.Store, namespace string, t *testing.T)
 		}
 	}
 }
+
+// CheckListOptions validates label and field selectors of an empty config store
+func CheckListOptions(r config.Store, t *testing.T, namespace string, n int) {
+	for i := 0; i < n; i++ {
+		if _, err := r.Create(Make(namespace, i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	cases := []struct {
+		opts config.ListOptions
+		want int
+	}{
+		{config.ListOptions{Namespace: namespace}, n},
+		{config.ListOptions{Namespace: namespace, LabelSelector: "key=fake-config1"}, 1},
+		{config.ListOptions{Namespace: namespace, LabelSelector: "key in (fake-config0,fake-config1)"}, 2},
+		{config.ListOptions{Namespace: namespace, LabelSelector: "missing"}, 0},
+		{config.ListOptions{Namespace: namespace, FieldSelector: "metadata.name=fake-config0"}, 1},
+		{config.ListOptions{Namespace: namespace, FieldSelector: "metadata.name!=fake-config0"}, n - 1},
+	}
+	for _, c := range cases {
+		l, err := r.ListWithOptions(FakeConfig.Type, c.opts)
+		if err != nil {
+			t.Errorf("ListWithOptions(%+v) => got %v", c.opts, err)
+		}
+		if len(l) != c.want {
+			t.Errorf("ListWithOptions(%+v) => got %d element(s), want %d", c.opts, len(l), c.want)
+		}
+	}
+
+	if _, err := r.ListWithOptions(FakeConfig.Type, config.ListOptions{LabelSelector: "key in"}); err == nil {
+		t.Error("expected error for a malformed label selector")
+	}
+
+	for i := 0; i < n; i++ {
+		elt := Make(namespace, i)
+		if err := r.Delete(FakeConfig.Type, elt.Name, elt.Namespace); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// CheckListPage validates that paging through an empty config store returns every object once
+func CheckListPage(r config.Store, t *testing.T, namespace string, n int, limit int64) {
+	for i := 0; i < n; i++ {
+		if _, err := r.Create(Make(namespace, i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	opts := config.ListOptions{Namespace: namespace, Limit: limit}
+	for pages := 0; ; pages++ {
+		if int64(pages) > int64(n)/limit+1 {
+			t.Fatalf("ListPage(%+v) => too many pages", opts)
+		}
+		l, next, err := r.ListPage(FakeConfig.Type, opts)
+		if err != nil {
+			t.Fatalf("ListPage(%+v) => got %v", opts, err)
+		}
+		if int64(len(l)) > limit {
+			t.Errorf("ListPage(%+v) => got %d element(s), want at most %d", opts, len(l), limit)
+		}
+		for _, elt := range l {
+			if seen[elt.Key()] {
+				t.Errorf("ListPage(%+v) => got %s twice", opts, elt.Key())
+			}
+			seen[elt.Key()] = true
+		}
+		if next == "" {
+			break
+		}
+		opts.Continue = next
+	}
+	if len(seen) != n {
+		t.Errorf("ListPage() => got %d element(s) in all pages, want %d", len(seen), n)
+	}
+
+	// ListWithOptions returns all pages
+	if l, err := r.ListWithOptions(FakeConfig.Type, config.ListOptions{Namespace: namespace, Limit: limit}); err != nil || len(l) != n {
+		t.Errorf("ListWithOptions() => got %d element(s) (%v), want %d", len(l), err, n)
+	}
+
+	for i := 0; i < n; i++ {
+		elt := Make(namespace, i)
+		if err := r.Delete(FakeConfig.Type, elt.Name, elt.Namespace); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "crd.Get", trace.WithSpanKind(trace.SpanKindClient))
+		End(span, errors.New("unavailable"))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}).Methods("PUT")
+
+	// without provider the requests are served as usual
+	w := httptest.NewRecorder()
+	Middleware(router).ServeHTTP(w, httptest.NewRequest("PUT", "/v2/service_instances/instance-1", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d without provider, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	recorder, restore := record()
+	defer restore()
+	req := httptest.NewRequest("PUT", "/v2/service_instances/instance-1", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	req.Header.Set(RequestIdentityHeader, "e26cea36-9b57-4f6e-b3ab-2b1f1b9e2e53")
+	Middleware(router).ServeHTTP(httptest.NewRecorder(), req)
+
+	// unsampled traces are not recorded
+	req = httptest.NewRequest("PUT", "/v2/service_instances/instance-2", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	Middleware(router).ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d span(s), want 2", len(spans))
+	}
+	get, server := spans[0], spans[1]
+	if server.Name() != "PUT /v2/service_instances/{instance_id}" || server.SpanKind() != trace.SpanKindServer ||
+		server.SpanContext().TraceID().String() != "0af7651916cd43dd8448eb211c80319c" ||
+		server.Parent().SpanID().String() != "b7ad6b7169203331" {
+		t.Errorf("got server span %q %+v", server.Name(), server.SpanContext())
+	}
+	attributes := make(map[string]interface{})
+	for _, kv := range server.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	if attributes["osb.request_identity"] != "e26cea36-9b57-4f6e-b3ab-2b1f1b9e2e53" ||
+		attributes["http.status_code"] != int64(http.StatusServiceUnavailable) || server.Status().Code != codes.Error {
+		t.Errorf("got server span attributes %v, status %+v", attributes, server.Status())
+	}
+	if get.Name() != "crd.Get" || get.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("got client span %q with parent %v", get.Name(), get.Parent().SpanID())
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records the spans of the broker requests with the
+// OpenTelemetry SDK. The trace context follows the W3C trace context format,
+// so that the spans join the traces of the platform, and the spans are
+// exported in the OpenTelemetry protocol or to the standard output. The CRD
+// client records its calls to the Kubernetes API as child spans.
+package tracing
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// Exporters selectable by name
+const (
+	// StdoutExporter writes the spans as JSON to the standard output
+	StdoutExporter = "stdout"
+
+	// OTLPExporter sends the spans to an OpenTelemetry collector over OTLP/HTTP
+	OTLPExporter = "otlp"
+)
+
+const (
+	// ServiceName identifies the broker in the exported traces
+	ServiceName = "istio-broker"
+
+	// instrumentationName names the tracer of the broker spans
+	instrumentationName = "istio.io/broker"
+)
+
+// NewProvider creates a tracer provider batching the spans for an exporter
+// selected by name. The OTLP exporter sends the spans to the collector at
+// endpoint, e.g. "http://otel-collector.istio-system:4318". Shutting the
+// provider down exports the remaining spans.
+func NewProvider(exporter, endpoint string) (*sdktrace.TracerProvider, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case StdoutExporter:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case OTLPExporter:
+		exp, err = newOTLPExporter(endpoint)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+	), nil
+}
+
+// newOTLPExporter creates an exporter posting the spans to the traces path of a collector
+func newOTLPExporter(endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid tracing endpoint %q", endpoint)
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + "/v1/traces"),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	return otlptracehttp.New(context.Background(), opts...)
+}
+
+// Install makes a tracer provider record the spans of the broker and
+// propagates the trace context in the W3C format
+func Install(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// Start creates a span, as a child of the current span of a context if any,
+// and returns a context holding it. The span records nothing until a tracer
+// provider is installed.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End records the failure of the operation of a span, ignoring nil errors, and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/net/context"
+)
+
+// record installs a tracer provider keeping the ended spans in memory, and
+// returns them with a function restoring the no-op provider
+func record() (*tracetest.SpanRecorder, func()) {
+	recorder := tracetest.NewSpanRecorder()
+	Install(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder, func() { Install(noop.NewTracerProvider()) }
+}
+
+func TestNewProvider(t *testing.T) {
+	cases := []struct {
+		exporter, endpoint string
+		valid              bool
+	}{
+		{StdoutExporter, "", true},
+		{OTLPExporter, "http://otel-collector.istio-system:4318", true},
+		{OTLPExporter, "https://collector.example.com/otlp/", true},
+		{OTLPExporter, "otel-collector", false},
+		{"zipkin", "", false},
+	}
+	for _, c := range cases {
+		provider, err := NewProvider(c.exporter, c.endpoint)
+		if (err == nil) != c.valid {
+			t.Errorf("NewProvider(%q, %q) => got %v, want valid %t", c.exporter, c.endpoint, err, c.valid)
+		}
+		if provider != nil {
+			if err = provider.Shutdown(context.Background()); err != nil {
+				t.Errorf("Shutdown() => got %v", err)
+			}
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	// spans record nothing without a provider
+	if _, span := Start(context.Background(), "disabled"); span.IsRecording() {
+		t.Error("Start() without provider => got a recording span")
+	}
+
+	recorder, restore := record()
+	defer restore()
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("not found"))
+	End(parent, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d span(s), want 2", len(spans))
+	}
+	if spans[0].Name() != "child" || spans[0].Parent().SpanID() != spans[1].SpanContext().SpanID() ||
+		spans[0].SpanContext().TraceID() != spans[1].SpanContext().TraceID() {
+		t.Errorf("got child span %+v of %+v", spans[0].SpanContext(), spans[1].SpanContext())
+	}
+	if status := spans[0].Status(); status.Code != codes.Error || status.Description != "not found" {
+		t.Errorf("got child status %+v", status)
+	}
+	if status := spans[1].Status(); status.Code != codes.Unset {
+		t.Errorf("got parent status %+v", status)
+	}
+}